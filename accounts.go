@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// account is a profile of the -config file processed by -all-profiles
+// or -profiles, each in a run of its own.
+type account struct {
+	profile string
+	// summary is the summary of its run, nil if the run ended before
+	// processing mailboxes, e.g. as it could not log in.
+	summary *Summary
+	code    int
+}
+
+// namespace makes the files a run writes those of the account, so that
+// accounts sharing the values of the top level of the -config file do
+// not write to the same ones: the profile name is added to the name of
+// the -log-file and -summary-json-file, e.g. run-alice.json, and
+// -backup-dir gets a directory per profile.
+func (a *account) namespace(logFile, summaryFile, backupDir *string) {
+	for _, path := range []*string{logFile, summaryFile} {
+		if *path != "" {
+			ext := filepath.Ext(*path)
+			*path = strings.TrimSuffix(*path, ext) + "-" + a.profile + ext
+		}
+	}
+	if *backupDir != "" {
+		*backupDir = filepath.Join(*backupDir, a.profile)
+	}
+}
+
+// codeSeverity orders exit codes from the best outcome to the worst.
+// Codes not listed are worse than all listed.
+var codeSeverity = []int{0, exitDuplicates, exitPartial, 1, exitConnect, exitLogin, exitUsage}
+
+// worseCode returns whichever of the exit codes a and b reports the
+// worse outcome.
+func worseCode(a, b int) int {
+	rank := func(code int) int {
+		for i, c := range codeSeverity {
+			if c == code {
+				return i
+			}
+		}
+		return len(codeSeverity)
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
+
+// runAccounts runs the command of args once for each of the named
+// profiles of the -config file at configPath, or for all of them if
+// names is empty, one after another with a connection each. A failing
+// account does not stop the others, but an interrupt does. A section
+// headed by the profile precedes the output of each account, and a
+// table of all accounts with their total ends the combined report. It
+// returns the worst exit code of the accounts.
+func runAccounts(command string, args []string, configPath string, names []string) int {
+	defined, err := configProfiles(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -config: %s\n", err)
+		return 1
+	}
+	if len(names) == 0 {
+		names = defined
+	}
+	var p problems
+	p.check(len(names) > 0, "%s defines no profiles", configPath)
+	for _, name := range names {
+		p.check(contains(defined, name), "unknown profile %q, defined are %s", name, strings.Join(defined, ", "))
+	}
+	if len(p) > 0 {
+		p.print(os.Stderr, command)
+		return exitUsage
+	}
+
+	// a signal stops the account being processed, see run, and the
+	// accounts after it
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var accounts []*account
+	code := 0
+	for i, name := range names {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("== profile %s ==\n", name)
+		a := &account{profile: name}
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		a.code = run(args, a)
+		accounts = append(accounts, a)
+		code = worseCode(code, a.code)
+		select {
+		case <-sigs:
+			fmt.Fprintf(os.Stderr, "stopped, %d profiles not processed: %s\n", len(names)-i-1, strings.Join(names[i+1:], ", "))
+			printAccounts(os.Stdout, accounts)
+			return worseCode(code, 1)
+		default:
+		}
+	}
+	fmt.Println()
+	printAccounts(os.Stdout, accounts)
+	return code
+}
+
+// printAccounts writes a table of the outcome of each account and their
+// total to w.
+func printAccounts(w io.Writer, accounts []*account) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "profile\tmailboxes\tfound\tremoved\tfailed\texit")
+	var mailboxes, found, removed, failed int
+	for _, a := range accounts {
+		var m, f, r, e int
+		if a.summary != nil {
+			m, f, e = len(a.summary.Results), a.summary.Found(), a.summary.Failed()
+			for _, res := range a.summary.Results {
+				r += res.Removed
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", a.profile, m, f, r, e, a.code)
+		mailboxes, found, removed, failed = mailboxes+m, found+f, removed+r, failed+e
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\t%d\t%d\t\n", mailboxes, found, removed, failed)
+	tw.Flush()
+}
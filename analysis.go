@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// analysisReport is the JSON layout of a dedup.Analysis.
+type analysisReport struct {
+	Mailbox    string            `json:"mailbox"`
+	Messages   int               `json:"messages"`
+	Bytes      int64             `json:"bytes"`
+	Oldest     *time.Time        `json:"oldest,omitempty"`
+	Newest     *time.Time        `json:"newest,omitempty"`
+	Duplicates []duplicateReport `json:"duplicates"`
+	TopSenders []senderReport    `json:"top_senders"`
+	Sizes      []sizeReport      `json:"sizes"`
+}
+
+type duplicateReport struct {
+	Strategy string `json:"strategy"`
+	Count    int    `json:"count"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type senderReport struct {
+	From     string `json:"from"`
+	Messages int    `json:"messages"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type sizeReport struct {
+	// Below is 0 for the last, unbounded bucket.
+	Below    int64 `json:"below"`
+	Messages int   `json:"messages"`
+}
+
+// printAnalysis writes a to w in the given format, text or json.
+func printAnalysis(w io.Writer, a dedup.Analysis, format string) error {
+	if format == "json" {
+		r := analysisReport{Mailbox: a.Mailbox, Messages: a.Messages, Bytes: a.Bytes}
+		if !a.Oldest.IsZero() {
+			r.Oldest, r.Newest = &a.Oldest, &a.Newest
+		}
+		for _, d := range a.Duplicates {
+			r.Duplicates = append(r.Duplicates, duplicateReport{d.Strategy, d.Count, d.Bytes})
+		}
+		r.TopSenders = []senderReport{}
+		for _, s := range a.TopSenders {
+			r.TopSenders = append(r.TopSenders, senderReport{s.From, s.Messages, s.Bytes})
+		}
+		for _, b := range a.Sizes {
+			r.Sizes = append(r.Sizes, sizeReport{b.Below, b.Messages})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	fmt.Fprintf(w, "mailbox %s\n  messages: %d, %s\n", a.Mailbox, a.Messages, byteSize(a.Bytes))
+	if !a.Oldest.IsZero() {
+		fmt.Fprintf(w, "  dates: %s to %s\n", a.Oldest.Format("2006-01-02"), a.Newest.Format("2006-01-02"))
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  duplicates by\tmessages\tsize")
+	for _, d := range a.Duplicates {
+		fmt.Fprintf(tw, "  %s\t%d\t%s\n", d.Strategy, d.Count, byteSize(d.Bytes))
+	}
+	fmt.Fprintln(tw, "  top senders\tmessages\tsize")
+	for _, s := range a.TopSenders {
+		fmt.Fprintf(tw, "  %s\t%d\t%s\n", s.From, s.Messages, byteSize(s.Bytes))
+	}
+	fmt.Fprintln(tw, "  sizes\tmessages")
+	from := int64(0)
+	for _, b := range a.Sizes {
+		if b.Below == 0 {
+			fmt.Fprintf(tw, "  %s and more\t%d\n", byteSize(from), b.Messages)
+		} else {
+			fmt.Fprintf(tw, "  below %s\t%d\n", byteSize(b.Below), b.Messages)
+		}
+		from = b.Below
+	}
+	return tw.Flush()
+}
+
+// byteSize formats n bytes with a binary unit, e.g. 1.5 MiB.
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	imapcmd "github.com/emersion/go-imap/commands"
+)
+
+// appendResult is the outcome of appending a directory.
+type appendResult struct {
+	Appended int
+	// Failed maps the files which could not be appended to the error.
+	Failed map[string]error
+	// UIDs maps the appended files to the UID of their message, for
+	// those which could be located.
+	UIDs map[string]uint32
+	// Searched is set if the messages were located by Message-ID as
+	// the server lacks UIDPLUS. SearchErr is the error if that failed.
+	Searched  bool
+	SearchErr error
+}
+
+// appendDir appends the .eml files in dir to mbox in name order with
+// flags, continuing past files which fail, and locates the appended
+// messages: by the APPENDUID response with UIDPLUS, otherwise by
+// searching mbox for their Message-ID afterwards.
+func appendDir(c *client.Client, uidPlus bool, mbox, dir string, flags []string) (appendResult, error) {
+	res := appendResult{Failed: map[string]error{}, UIDs: map[string]uint32{}}
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return res, err
+	}
+	sort.Strings(files)
+	ids := make(map[string]string)
+	for _, path := range files {
+		uid, id, err := appendFile(c, uidPlus, mbox, path, flags)
+		if err != nil {
+			res.Failed[path] = err
+			continue
+		}
+		res.Appended++
+		if uid != 0 {
+			res.UIDs[path] = uid
+		} else if id != "" {
+			ids[path] = id
+		}
+	}
+	if len(ids) > 0 {
+		res.Searched = true
+		res.SearchErr = locate(c, mbox, ids, res.UIDs)
+	}
+	return res, nil
+}
+
+// appendFile appends the message in the file at path to mbox with
+// flags. Its internal date is taken from the Date header, or from the
+// modification time of the file if it has none. It returns the UID of
+// the message if uidPlus is set and the server told it, and its
+// Message-ID.
+func appendFile(c *client.Client, uidPlus bool, mbox, path string, flags []string) (uint32, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+
+	date, id := fi.ModTime(), ""
+	if msg, err := mail.ReadMessage(f); err == nil {
+		if d, err := msg.Header.Date(); err == nil {
+			date = d
+		}
+		id = strings.TrimSpace(msg.Header.Get("Message-Id"))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, "", err
+	}
+	msg := &sizedReader{f, int(fi.Size())}
+	if !uidPlus {
+		return 0, id, c.Append(mbox, flags, date, msg)
+	}
+	status, err := c.Execute(&imapcmd.Append{Mailbox: mbox, Flags: flags, Date: date, Message: msg}, nil)
+	if err != nil {
+		return 0, id, err
+	}
+	if err := status.Err(); err != nil {
+		return 0, id, err
+	}
+	// [APPENDUID uidvalidity uid], RFC 4315
+	if status.Code == "APPENDUID" && len(status.Arguments) == 2 {
+		if uid, err := imap.ParseNumber(status.Arguments[1]); err == nil {
+			return uid, id, nil
+		}
+	}
+	return 0, id, nil
+}
+
+// locate finds the messages appended to mbox by their Message-ID, given
+// by file in ids, and adds their UIDs to uids. A Message-ID found more
+// than once is taken to be the copy with the highest UID, the one
+// appended last.
+func locate(c *client.Client, mbox string, ids map[string]string, uids map[string]uint32) error {
+	if _, err := c.Select(mbox, true); err != nil {
+		return err
+	}
+	for path, id := range ids {
+		criteria := imap.NewSearchCriteria()
+		criteria.Header.Add("Message-Id", id)
+		found, err := c.UidSearch(criteria)
+		if err != nil {
+			return err
+		}
+		for _, uid := range found {
+			if uid > uids[path] {
+				uids[path] = uid
+			}
+		}
+	}
+	return nil
+}
+
+// printAppended prints the UIDs the appended messages of res were
+// located at in mbox, and how.
+func printAppended(logger *slog.Logger, mbox string, res appendResult) {
+	uids := make([]uint32, 0, len(res.UIDs))
+	for _, uid := range res.UIDs {
+		uids = append(uids, uid)
+	}
+	how := "by APPENDUID"
+	if res.Searched {
+		how = "by Message-ID as the server lacks UIDPLUS"
+		fmt.Printf("%s: the server lacks UIDPLUS, looking the appended messages up by Message-ID\n", mbox)
+	}
+	if res.SearchErr != nil {
+		logger.Warn("cannot locate appended messages", "mailbox", mbox, "err", res.SearchErr)
+		fmt.Fprintf(os.Stderr, "%s: warning: cannot locate the appended messages: %s\n", mbox, res.SearchErr)
+	}
+	if len(uids) > 0 {
+		logger.Info("located appended messages", "mailbox", mbox, "uids", uidList(uids), "how", how)
+		fmt.Printf("%s: appended messages are UIDs %s\n", mbox, uidList(uids))
+	}
+	if n := res.Appended - len(uids); n > 0 && res.SearchErr == nil {
+		fmt.Printf("%s: %d appended messages not located, having no Message-ID\n", mbox, n)
+	}
+}
+
+// parseFlags splits a comma or space separated list of flags such as
+// "\Seen,\Flagged".
+func parseFlags(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// sizedReader is an imap.Literal of a file of known size.
+type sizedReader struct {
+	io.Reader
+	size int
+}
+
+func (r *sizedReader) Len() int {
+	return r.size
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// TestRunRestoreWithoutUIDPLUS restores a backup to a server without
+// UIDPLUS, which tells no APPENDUID, and checks that the appended
+// messages are looked up by Message-ID, taking the last copy of one
+// already in the mailbox, and that this is said.
+func TestRunRestoreWithoutUIDPLUS(t *testing.T) {
+	s := imaptest.NewServer(t)
+	s.AppendMessages(t, "INBOX", imaptest.Message{MessageID: "<a@example.org>", Subject: "A"})
+	dir := t.TempDir()
+	for name, m := range map[string]imaptest.Message{
+		"1.eml": {MessageID: "<a@example.org>", Subject: "A"},
+		"2.eml": {MessageID: "<b@example.org>", Subject: "B"},
+		"3.eml": {Subject: "C"},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), m.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	code, stdout, stderr := runMain(t, nil, args(s, "restore", "-mbox", "INBOX", dir)...)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	for _, want := range []string{
+		"appended 3 of 3 messages to INBOX",
+		"INBOX: the server lacks UIDPLUS, looking the appended messages up by Message-ID",
+		"INBOX: appended messages are UIDs 2:3",
+		"INBOX: 1 appended messages not located, having no Message-ID",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("missing %q in stdout:\n%s", want, stdout)
+		}
+	}
+	if uids := s.UIDs(t, "INBOX"); len(uids) != 4 {
+		t.Errorf("got UIDs %v", uids)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// backupSection fetches a whole message without setting \Seen.
+var backupSection = &imap.BodySectionName{Peek: true}
+
+// backupDirName returns the directory below dir holding the backup of
+// mbox taken at t, e.g. "INBOX-20240102-150405".
+func backupDirName(dir, mbox string, t time.Time) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, mbox)
+	return filepath.Join(dir, name+"-"+t.Format("20060102-150405"))
+}
+
+// backup writes the duplicates of groups in the selected mailbox mbox
+// as .eml files named by their zero padded UID into a new directory
+// below dir, together with a restore.sh appending them to mbox again.
+// It returns the directory.
+func backup(c dedup.Client, mbox string, groups []dedup.Group, dir string) (string, error) {
+	seqset := &imap.SeqSet{}
+	n := 0
+	for _, g := range groups {
+		seqset.AddNum(g.Duplicates...)
+		n += len(g.Duplicates)
+	}
+	out := backupDirName(dir, mbox, time.Now())
+	if err := os.MkdirAll(out, 0700); err != nil {
+		return "", err
+	}
+
+	msgChan := make(chan *imap.Message, 10)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, backupSection.FetchItem()}, msgChan)
+	}()
+
+	var files []string
+	var writeErr error
+	for msg := range msgChan {
+		if writeErr != nil {
+			continue
+		}
+		body := msg.GetBody(backupSection)
+		if body == nil {
+			writeErr = fmt.Errorf("no body returned for UID %d", msg.Uid)
+			continue
+		}
+		name := fmt.Sprintf("%010d.eml", msg.Uid)
+		if writeErr = writeFile(filepath.Join(out, name), body); writeErr == nil {
+			files = append(files, name)
+		}
+	}
+	if err := <-errChan; err != nil {
+		return out, &dedup.Error{Op: "fetch", Mailbox: mbox, Set: seqset, Err: err}
+	}
+	if writeErr != nil {
+		return out, writeErr
+	}
+	if len(files) != n {
+		return out, fmt.Errorf("backed up %d of %d duplicates", len(files), n)
+	}
+	sort.Strings(files)
+	return out, writeRestoreScript(out, mbox, files)
+}
+
+// writeFile writes r to a new file at path readable by the user only.
+func writeFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeRestoreScript writes restore.sh to dir, appending the backed up
+// files to mbox with -append. Connection flags are passed on, so it is
+// run as e.g. ./restore.sh -server imap.example.com -username me.
+func writeRestoreScript(dir, mbox string, files []string) error {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Restores the %d duplicates removed from %s on %s:\n", len(files), mbox, time.Now().Format("2006-01-02 15:04:05"))
+	for _, f := range files {
+		fmt.Fprintf(&b, "#   %s\n", f)
+	}
+	b.WriteString("# Pass the connection flags as arguments. Set IMAP_CLEAN_DUP to the\n# binary if it is not on the PATH.\n")
+	fmt.Fprintf(&b, "exec \"${IMAP_CLEAN_DUP:-imap-clean-dup}\" -append \"$(dirname \"$0\")\" -mbox %s \"$@\"\n", shellQuote(mbox))
+	return os.WriteFile(filepath.Join(dir, "restore.sh"), []byte(b.String()), 0700)
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
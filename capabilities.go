@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// capabilityUses are the optional capabilities list-capabilities checks
+// for, with what they change for this tool.
+var capabilityUses = []struct {
+	name, use string
+}{
+	{"UIDPLUS", "UID EXPUNGE removes only the duplicates; without it EXPUNGE is used, where other messages are flagged \\Deleted only with -allow-full-expunge, and -append finds the appended messages by Message-ID"},
+	{"IDLE", "-watch is told of new messages instead of polling every minute"},
+	{"SPECIAL-USE", "-keep-role finds mailboxes by role, without it only the inbox role works"},
+	{"QUOTA", "runs removing duplicates report the quota used before and after"},
+	{"X-GM-EXT-1", "Gmail: removing a message may only remove a label, use -verify-after"},
+	{"MOVE", "not used, duplicates are removed rather than moved"},
+	{"CONDSTORE", "not used"},
+	{"COMPRESS=DEFLATE", "-compress auto deflates the traffic after login, -timing shows the saving"},
+}
+
+// printCapabilities prints the capabilities server advertised before
+// login, greeting, and after it, caps, followed by a checklist of the
+// optional ones this tool uses and of the ways to log in.
+func printCapabilities(w io.Writer, server string, greeting, caps dedup.Capabilities) {
+	fmt.Fprintf(w, "capabilities of %s before login:\n  %s\n", server, strings.Join(greeting.Names(), " "))
+	fmt.Fprintf(w, "capabilities after login:\n  %s\n", strings.Join(caps.Names(), " "))
+
+	check := func(ok bool) string {
+		if ok {
+			return "[x]"
+		}
+		return "[ ]"
+	}
+	fmt.Fprintln(w, "features:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range capabilityUses {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", check(caps.Has(c.name)), c.name, c.use)
+	}
+	tw.Flush()
+
+	// AUTH= is only advertised before login
+	fmt.Fprintln(w, "login:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "  %s LOGIN\t-password\n", check(!greeting.Has("LOGINDISABLED")))
+	fmt.Fprintf(tw, "  %s AUTH=XOAUTH2\t-oauth2-credentials\n", check(greeting.Has("AUTH=XOAUTH2")))
+	for _, name := range greeting.Names() {
+		if strings.HasPrefix(name, "AUTH=") && name != "AUTH=XOAUTH2" {
+			fmt.Fprintf(tw, "  [x] %s\tnot used, -password logs in with LOGIN\n", name)
+		}
+	}
+	tw.Flush()
+}
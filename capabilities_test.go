@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+func TestPrintCapabilities(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		greeting, caps map[string]bool
+		want, missing  []string
+	}{
+		{
+			"Gmail",
+			map[string]bool{"IMAP4rev1": true, "AUTH=XOAUTH2": true, "AUTH=PLAIN": true},
+			map[string]bool{"IMAP4rev1": true, "UIDPLUS": true, "MOVE": true, "X-GM-EXT-1": true, "IDLE": true},
+			[]string{"  [x] UIDPLUS", "  [x] IDLE", "  [x] X-GM-EXT-1", "  [ ] QUOTA", "  [x] LOGIN", "  [x] AUTH=XOAUTH2", "  [x] AUTH=PLAIN "},
+			[]string{"[x] SPECIAL-USE"},
+		},
+		{
+			"IMAP4rev1 only, no login",
+			map[string]bool{"IMAP4rev1": true, "LOGINDISABLED": true},
+			map[string]bool{"IMAP4rev1": true},
+			[]string{"capabilities after login:\n  IMAP4REV1\n", "  [ ] UIDPLUS", "  [ ] IDLE", "  [ ] LOGIN", "  [ ] AUTH=XOAUTH2"},
+			[]string{"[x]"},
+		},
+	} {
+		var b bytes.Buffer
+		printCapabilities(&b, "imap.example.org", dedup.NewCapabilities(test.greeting), dedup.NewCapabilities(test.caps))
+		out := b.String()
+		for _, s := range test.want {
+			if !strings.Contains(out, s) {
+				t.Errorf("%s: %q missing from:\n%s", test.name, s, out)
+			}
+		}
+		for _, s := range test.missing {
+			if strings.Contains(out, s) {
+				t.Errorf("%s: %q in:\n%s", test.name, s, out)
+			}
+		}
+	}
+}
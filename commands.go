@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is a subcommand, accepting the connection flags and its own.
+type command struct {
+	name    string
+	summary string
+	// args describes the positional arguments, if any.
+	args  string
+	flags []string
+	// set are flag values implied by the command.
+	set map[string]string
+}
+
+// connectionFlags are accepted by every command.
+var connectionFlags = []string{
+	"username", "password", "oauth2-credentials", "server", "port", "tls", "starttls", "tls-min-version", "tls-max-version", "compress", "server-url", "scan-server", "delete-server",
+	"config", "profile", "profiles", "all-profiles", "log-file", "debug-imap", "timing", "always-report", "summary-json-file", "notify-url", "notify-on", "email-report", "email-on", "email-from", "email-html", "smtp-server", "smtp-user", "smtp-password", "max-duration", "version",
+}
+
+// scanFlags select and configure the detection of duplicates.
+var scanFlags = []string{
+	"mbox", "all-mailboxes", "strict", "list-only-dups", "report", "dedup-report-duplicates-only-summary", "dedup-group-report-limit", "dedup-group-report-spill", "snippet", "sort", "sort-order", "ignore-message-id",
+	"ignore-from", "ignore-sender", "ignore-reply-to", "ignore-to", "ignore-cc", "ignore-bcc",
+	"normalize-subject", "date-window", "list-id", "dedup-attachment-name-only", "key-include-size", "scope-by-sender", "dedup-hash-header-raw", "volatile-headers", "dedup-ignore-resent-headers", "key-template", "preset",
+	"scope", "min-group-size", "report-threshold-bytes", "dedup-preserve-largest", "dedup-preserve-smallest", "compare-strategies", "strategy", "dedup-key", "body-bytes", "fetch-buffer", "hash-workers", "fetch-chunk",
+	"max-dups", "preserve-newest-per-sender", "op-retries", "uid-from", "uid-to", "limit", "noop-keepalive", "stats", "format",
+	"count-only", "fail-on-duplicates", "dedup-sent-reconcile", "sent-mbox", "prefer", "keep-role", "drafts-mode",
+}
+
+// commands lists the subcommands in the order they are listed in the
+// usage.
+var commands = []command{
+	{
+		name:    "scan",
+		summary: "find and report duplicates without removing them",
+		flags:   append([]string{"plan", "tui"}, scanFlags...),
+		set:     map[string]string{"dry-run": "true"},
+	},
+	{
+		name:    "clean",
+		summary: "find and remove duplicates",
+		flags:   append([]string{"dry-run", "plan", "backup-dir", "merge-flags", "per-message-delay", "allow-full-expunge", "verify-before-delete", "verify-after", "watch", "interval", "max-consecutive-failures", "force-lock"}, scanFlags...),
+	},
+	{
+		name:    "apply",
+		summary: "remove the duplicates of a plan file written by scan -plan",
+		args:    "<plan>",
+		flags:   []string{"dry-run", "tui", "backup-dir", "merge-flags", "per-message-delay", "allow-full-expunge", "force-lock", "op-retries", "snippet", "dedup-report-duplicates-only-summary", "dedup-group-report-limit", "dedup-group-report-spill"},
+	},
+	{
+		name:    "list-mailboxes",
+		summary: "list the selectable mailboxes",
+		flags:   []string{"overview", "format"},
+	},
+	{
+		name:    "list-capabilities",
+		summary: "print the capabilities of the server and which of them are used",
+		set:     map[string]string{"list-capabilities": "true"},
+	},
+	{
+		name:    "restore",
+		summary: "append the .eml files of a backup directory to -mbox",
+		args:    "<dir>",
+		flags:   []string{"mbox", "append-flags", "force-lock"},
+	},
+	{
+		name:    "stats",
+		summary: "print the status of mailboxes, or analyze them read-only",
+		flags: []string{"mbox", "all-mailboxes", "strict", "overview", "format", "analyze",
+			"ignore-from", "ignore-sender", "ignore-reply-to", "ignore-to", "ignore-cc", "ignore-bcc",
+			"normalize-subject", "date-window", "list-id", "dedup-attachment-name-only", "key-include-size", "min-group-size",
+			"uid-from", "uid-to", "limit", "fetch-buffer", "hash-workers", "fetch-chunk", "op-retries"},
+		set: map[string]string{"stats": "true"},
+	},
+	{
+		name:    "cross-server",
+		summary: "compare -mbox with its migrated copy on -new-server-url",
+		flags: []string{"new-server-url", "new-password", "delete-migrated", "backup-dir", "per-message-delay", "allow-full-expunge", "force-lock",
+			"mbox", "ignore-message-id", "ignore-from", "ignore-sender", "ignore-reply-to", "ignore-to", "ignore-cc", "ignore-bcc",
+			"normalize-subject", "date-window", "list-id", "dedup-attachment-name-only", "key-include-size", "dedup-hash-header-raw", "volatile-headers", "dedup-ignore-resent-headers",
+			"key-template", "uid-from", "uid-to", "limit", "fetch-buffer", "hash-workers", "fetch-chunk", "op-retries"},
+	},
+	{
+		name:    "completion",
+		summary: "print the completion script of a shell",
+		args:    "<bash|zsh|fish>",
+	},
+}
+
+// findCommand returns the command named name.
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// parseArgs parses args into the flags of flag.CommandLine and returns
+// the name of the command, empty if none was given, and its positional
+// arguments. Without a command all flags are accepted as before
+// subcommands existed. A command only accepts its own flags, which are
+// then set on flag.CommandLine as if given there, and flag.Usage is
+// replaced by its usage. Errors have been printed with the usage,
+// flag.ErrHelp is returned if help was asked for.
+func parseArgs(args []string) (string, []string, error) {
+	name, rest, err := parseCommand(args)
+	if err != nil && err != flag.ErrHelp {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\n", err)
+		flag.Usage()
+	}
+	return name, rest, err
+}
+
+// parseCommand is parseArgs without printing errors.
+func parseCommand(args []string) (string, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", nil, flag.CommandLine.Parse(args)
+	}
+	if args[0] == "help" {
+		flag.Usage()
+		return "", nil, flag.ErrHelp
+	}
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		return "", nil, fmt.Errorf("unknown command %q", args[0])
+	}
+
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	for _, name := range append(append([]string{}, connectionFlags...), cmd.flags...) {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Usage = func() {
+		w := fs.Output()
+		fmt.Fprintf(w, "Usage: %s %s [flags]", os.Args[0], cmd.name)
+		if cmd.args != "" {
+			fmt.Fprintf(w, " %s", cmd.args)
+		}
+		fmt.Fprintf(w, "\n\n%s.\n\nFlags:\n", strings.ToUpper(cmd.summary[:1])+cmd.summary[1:])
+		fs.PrintDefaults()
+	}
+	flag.Usage = fs.Usage
+	fs.SetOutput(io.Discard)
+	err := fs.Parse(args[1:])
+	fs.SetOutput(nil)
+	if err == flag.ErrHelp {
+		fs.Usage()
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = flag.Set(f.Name, f.Value.String())
+		}
+	})
+	for name, value := range cmd.set {
+		if err == nil {
+			err = flag.Set(name, value)
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	if cmd.args == "" && fs.NArg() > 0 {
+		return "", nil, fmt.Errorf("%s takes no arguments", cmd.name)
+	}
+	switch cmd.name {
+	case "restore":
+		if fs.NArg() != 1 {
+			return "", nil, fmt.Errorf("restore needs exactly one directory")
+		}
+		if err := flag.Set("append", fs.Arg(0)); err != nil {
+			return "", nil, err
+		}
+	case "apply":
+		if fs.NArg() != 1 {
+			return "", nil, fmt.Errorf("apply needs exactly one plan file")
+		}
+		if err := flag.Set("apply-plan", fs.Arg(0)); err != nil {
+			return "", nil, err
+		}
+	case "completion":
+		if fs.NArg() != 1 || completionScripts[fs.Arg(0)] == nil {
+			return "", nil, fmt.Errorf("completion needs one of bash, zsh or fish")
+		}
+	}
+	return cmd.name, fs.Args(), nil
+}
+
+// printCommands lists the commands for the usage.
+func printCommands() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-16s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun %s <command> -h for the flags of a command. Without a command all\nflags below are accepted, which is deprecated.\n\n", os.Args[0])
+}
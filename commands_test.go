@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// defineFlags defines the flags of run on a new flag.CommandLine, which
+// is restored once t ends.
+func defineFlags(t *testing.T) {
+	t.Helper()
+	oldOut, oldFlags := os.Stdout, flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = oldFlags })
+	os.Stdout = tempFile(t)
+	defer func() { os.Stdout = oldOut }()
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	// -version defines all flags and returns before using them
+	if code := run([]string{"-version"}, nil); code != 0 {
+		t.Fatalf("-version: exit code %d", code)
+	}
+}
+
+// parse calls parseCommand with args on the flags of run, defined
+// afresh, and returns the values of the flags named in names.
+func parse(t *testing.T, args []string, names []string) (string, []string, map[string]string, error) {
+	t.Helper()
+	defineFlags(t)
+	oldErr, oldUsage := os.Stderr, flag.Usage
+	os.Stderr = tempFile(t)
+	flag.Usage = func() {}
+	defer func() { os.Stderr, flag.Usage = oldErr, oldUsage }()
+	name, rest, err := parseCommand(args)
+	values := make(map[string]string)
+	for _, n := range names {
+		values[n] = flag.Lookup(n).Value.String()
+	}
+	return name, rest, values, err
+}
+
+func TestParseCommand(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		name string
+		rest []string
+		// set are the values of flags afterwards.
+		set map[string]string
+		// err is part of the error, none if empty.
+		err string
+	}{
+		{args: nil, name: ""},
+		{args: []string{"-mbox", "Archive", "-dry-run"}, name: "", set: map[string]string{"mbox": "Archive", "dry-run": "true"}},
+		{args: []string{"scan"}, name: "scan", set: map[string]string{"dry-run": "true"}},
+		{args: []string{"scan", "-mbox", "Archive", "-plan", "plan.json"}, name: "scan", set: map[string]string{"mbox": "Archive", "plan": "plan.json", "dry-run": "true"}},
+		{args: []string{"scan", "-watch"}, err: "flag provided but not defined: -watch"},
+		{args: []string{"scan", "INBOX"}, err: "scan takes no arguments"},
+		{args: []string{"clean"}, name: "clean", set: map[string]string{"dry-run": "false"}},
+		{args: []string{"clean", "-dry-run", "-watch", "-server", "imap.example.org"}, name: "clean", set: map[string]string{"dry-run": "true", "watch": "true", "server": "imap.example.org"}},
+		{args: []string{"apply", "plan.json"}, name: "apply", rest: []string{"plan.json"}, set: map[string]string{"apply-plan": "plan.json", "dry-run": "false"}},
+		{args: []string{"apply", "-dry-run", "-backup-dir", "bak", "plan.json"}, name: "apply", rest: []string{"plan.json"}, set: map[string]string{"apply-plan": "plan.json", "dry-run": "true", "backup-dir": "bak"}},
+		{args: []string{"apply"}, err: "apply needs exactly one plan file"},
+		{args: []string{"apply", "a.json", "b.json"}, err: "apply needs exactly one plan file"},
+		{args: []string{"apply", "-mbox", "INBOX", "plan.json"}, err: "flag provided but not defined: -mbox"},
+		{args: []string{"list-mailboxes", "-overview"}, name: "list-mailboxes", set: map[string]string{"overview": "true"}},
+		{args: []string{"list-mailboxes", "-dry-run"}, err: "flag provided but not defined: -dry-run"},
+		{args: []string{"list-capabilities"}, name: "list-capabilities", set: map[string]string{"list-capabilities": "true"}},
+		{args: []string{"list-capabilities", "now"}, err: "list-capabilities takes no arguments"},
+		{args: []string{"restore", "-mbox", "Archive", "backup/INBOX"}, name: "restore", rest: []string{"backup/INBOX"}, set: map[string]string{"append": "backup/INBOX", "mbox": "Archive"}},
+		{args: []string{"restore"}, err: "restore needs exactly one directory"},
+		{args: []string{"stats", "-analyze"}, name: "stats", set: map[string]string{"stats": "true", "analyze": "true"}},
+		{args: []string{"cross-server", "-new-server-url", "imaps://new.example.org/INBOX"}, name: "cross-server", set: map[string]string{"new-server-url": "imaps://new.example.org/INBOX"}},
+		{args: []string{"completion", "zsh"}, name: "completion", rest: []string{"zsh"}},
+		{args: []string{"completion", "tcsh"}, err: "completion needs one of bash, zsh or fish"},
+		{args: []string{"completion"}, err: "completion needs one of bash, zsh or fish"},
+		{args: []string{"help"}, err: flag.ErrHelp.Error()},
+		{args: []string{"clean", "-h"}, err: flag.ErrHelp.Error()},
+		{args: []string{"frobnicate"}, err: `unknown command "frobnicate"`},
+		{args: []string{"Scan"}, err: `unknown command "Scan"`},
+	} {
+		var names []string
+		for name := range test.set {
+			names = append(names, name)
+		}
+		name, rest, values, err := parse(t, test.args, names)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+			continue
+		}
+		if name != test.name || len(rest) != len(test.rest) || (len(rest) > 0 && !reflect.DeepEqual(rest, test.rest)) {
+			t.Errorf("%q: got command %q with %q", test.args, name, rest)
+		}
+		for n, want := range test.set {
+			if values[n] != want {
+				t.Errorf("%q: got -%s %q, want %q", test.args, n, values[n], want)
+			}
+		}
+	}
+}
+
+// TestCommandFlags checks that every flag of a command is defined, as
+// parseCommand would otherwise fail on the command.
+func TestCommandFlags(t *testing.T) {
+	defineFlags(t)
+	for _, cmd := range commands {
+		for _, name := range append(append([]string{}, connectionFlags...), cmd.flags...) {
+			if flag.Lookup(name) == nil {
+				t.Errorf("%s: flag -%s is not defined", cmd.name, name)
+			}
+		}
+		for name := range cmd.set {
+			if flag.Lookup(name) == nil {
+				t.Errorf("%s: implied flag -%s is not defined", cmd.name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// completionName is the name of the binary the completion scripts are
+// registered for.
+const completionName = "imap-clean-dup"
+
+// completionScripts maps each supported shell to the function printing
+// its completion script.
+var completionScripts = map[string]func(io.Writer){
+	"bash": printBashCompletion,
+	"zsh":  printZshCompletion,
+	"fish": printFishCompletion,
+}
+
+// Flags whose values are completed as files, directories or mailbox
+// names. Mailbox names are listed by running list-mailboxes, which
+// only works if the credentials are set in the environment or a
+// configuration file.
+var (
+	fileFlags    = []string{"config", "log-file", "summary-json-file", "plan", "apply-plan"}
+	dirFlags     = []string{"backup-dir", "append"}
+	mailboxFlags = []string{"mbox", "sent-mbox"}
+)
+
+// flagValues returns the values accepted by the flag name if it only
+// accepts a fixed set, nil otherwise.
+func flagValues(name string) []string {
+	switch name {
+	case "strategy":
+		return []string{string(dedup.StrategyEnvelope), string(dedup.StrategyTiered)}
+	case "scope":
+		return []string{string(dedup.ScopeMailbox), string(dedup.ScopeConversation)}
+	case "tls-min-version", "tls-max-version":
+		var names []string
+		for v := range tlsVersions {
+			names = append(names, v)
+		}
+		sort.Strings(names)
+		return names
+	case "compress":
+		return []string{"auto", "off"}
+	case "dedup-key":
+		return []string{"body", "body-first-n-bytes"}
+	case "format":
+		return []string{"text", "json"}
+	case "prefer":
+		return []string{string(dedup.PreferInbox), string(dedup.PreferSent)}
+	case "keep-role":
+		return roleNames()
+	case "dedup-group-report-spill":
+		return []string{"file", "stream"}
+	case "drafts-mode":
+		return []string{"skip", "safe", "normal"}
+	case "report":
+		return []string{"summary", "messages"}
+	case "sort-order":
+		return []string{"asc", "desc"}
+	case "notify-on", "email-on":
+		return []string{"always", "changes", "errors"}
+	case "preset":
+		var names []string
+		for n := range presets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return names
+	case "sort":
+		var names []string
+		for n := range sortKeys {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return names
+	}
+	return nil
+}
+
+// valueFlags returns the names of the flags taking fixed values.
+func valueFlags() []string {
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if flagValues(f.Name) != nil {
+			names = append(names, f.Name)
+		}
+	})
+	return names
+}
+
+// commandFlags returns the flags accepted by cmd.
+func commandFlags(cmd command) []string {
+	return append(append([]string{}, connectionFlags...), cmd.flags...)
+}
+
+// commandNames returns the names of all commands.
+func commandNames() []string {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	return names
+}
+
+// dashed returns names with a leading dash each, separated by spaces.
+func dashed(names []string) string {
+	return "-" + strings.Join(names, " -")
+}
+
+// patterns returns names with a leading dash each as alternatives of a
+// shell case pattern.
+func patterns(names []string) string {
+	return "-" + strings.Join(names, "|-")
+}
+
+// printBashCompletion prints a bash completion script, to be sourced
+// e.g. from ~/.bashrc.
+func printBashCompletion(w io.Writer) {
+	fmt.Fprintf(w, `# bash completion for %[1]s, e.g. source <(%[1]s completion bash)
+_imap_clean_dup() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W %[2]q -- "$cur"))
+		return
+	fi
+	case $prev in
+`, completionName, strings.Join(commandNames(), " "))
+	for _, name := range valueFlags() {
+		fmt.Fprintf(w, "\t-%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", name, strings.Join(flagValues(name), " "))
+	}
+	fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", patterns(fileFlags))
+	fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -d -- \"$cur\")); return ;;\n", patterns(dirFlags))
+	fmt.Fprintf(w, "\t%s)\n\t\tlocal IFS=$'\\n'\n\t\tCOMPREPLY=($(compgen -W \"$(\"${COMP_WORDS[0]}\" list-mailboxes 2>/dev/null)\" -- \"$cur\"))\n\t\treturn ;;\n", patterns(mailboxFlags))
+	fmt.Fprint(w, "\tesac\n\tlocal flags\n\tcase ${COMP_WORDS[1]} in\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\t%s) flags=%q ;;\n", cmd.name, dashed(commandFlags(cmd)))
+	}
+	fmt.Fprintf(w, `	esac
+	case ${COMP_WORDS[1]},$cur in
+	restore,-*|apply,-*|completion,-*) ;;
+	restore,*) COMPREPLY=($(compgen -d -- "$cur")); return ;;
+	apply,*) COMPREPLY=($(compgen -f -- "$cur")); return ;;
+	completion,*) COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")); return ;;
+	esac
+	COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+}
+complete -F _imap_clean_dup %s
+`, completionName)
+}
+
+// printZshCompletion prints a zsh completion script, to be saved as
+// _imap-clean-dup in a directory of $fpath.
+func printZshCompletion(w io.Writer) {
+	fmt.Fprintf(w, `#compdef %s
+_imap_clean_dup() {
+	if (( CURRENT == 2 )); then
+		compadd -- %s
+		return
+	fi
+	case ${words[CURRENT-1]} in
+`, completionName, strings.Join(commandNames(), " "))
+	for _, name := range valueFlags() {
+		fmt.Fprintf(w, "\t-%s) compadd -- %s; return ;;\n", name, strings.Join(flagValues(name), " "))
+	}
+	fmt.Fprintf(w, "\t%s) _files; return ;;\n", patterns(fileFlags))
+	fmt.Fprintf(w, "\t%s) _files -/; return ;;\n", patterns(dirFlags))
+	fmt.Fprintf(w, "\t%s) compadd -- ${(f)\"$(${words[1]} list-mailboxes 2>/dev/null)\"}; return ;;\n", patterns(mailboxFlags))
+	fmt.Fprint(w, "\tesac\n\tif [[ $PREFIX != -* ]]; then\n\t\tcase ${words[2]} in\n\t\trestore) _files -/; return ;;\n\t\tapply) _files; return ;;\n\t\tcompletion) compadd -- bash zsh fish; return ;;\n\t\tesac\n\tfi\n\tcase ${words[2]} in\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\t%s) compadd -- %s ;;\n", cmd.name, dashed(commandFlags(cmd)))
+	}
+	fmt.Fprintf(w, "\tesac\n}\ncompdef _imap_clean_dup %s\n", completionName)
+}
+
+// printFishCompletion prints a fish completion script, to be saved as
+// imap-clean-dup.fish in ~/.config/fish/completions.
+func printFishCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# fish completion for %s\ncomplete -c %[1]s -f\n", completionName)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a %s -d %s\n", completionName, cmd.name, fishQuote(cmd.summary))
+	}
+	fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from restore' -x -a '(__fish_complete_directories)'\n", completionName)
+	fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from apply' -F\n", completionName)
+	fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from completion' -x -a 'bash zsh fish'\n", completionName)
+
+	// each flag is completed after the commands accepting it
+	var names []string
+	accepted := map[string][]string{}
+	for _, cmd := range commands {
+		for _, name := range commandFlags(cmd) {
+			if accepted[name] == nil {
+				names = append(names, name)
+			}
+			accepted[name] = append(accepted[name], cmd.name)
+		}
+	}
+	for _, name := range names {
+		f := flag.Lookup(name)
+		fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from %s' -o %s -d %s", completionName, strings.Join(accepted[name], " "), name, fishQuote(f.Usage))
+		switch {
+		case flagValues(name) != nil:
+			fmt.Fprintf(w, " -x -a %s", fishQuote(strings.Join(flagValues(name), " ")))
+		case contains(fileFlags, name):
+			fmt.Fprint(w, " -r -F")
+		case contains(dirFlags, name):
+			fmt.Fprint(w, " -x -a '(__fish_complete_directories)'")
+		case contains(mailboxFlags, name):
+			fmt.Fprintf(w, " -x -a '(%s list-mailboxes 2>/dev/null)'", completionName)
+		case !isBoolFlag(f):
+			fmt.Fprint(w, " -x")
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// fishQuote quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// contains reports whether names contains name.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
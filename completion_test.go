@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// TestCompletionGolden compares the completion script of each shell to
+// testdata/completion.<shell>, rewritten by go test -run
+// TestCompletionGolden -update after a deliberate change.
+func TestCompletionGolden(t *testing.T) {
+	for shell := range completionScripts {
+		code, stdout, stderr := runMain(t, nil, "completion", shell)
+		if code != 0 {
+			t.Fatalf("%s: exit code %d, stderr:\n%s", shell, code, stderr)
+		}
+		golden := filepath.Join("testdata", "completion."+shell)
+		if *updateGolden {
+			if err := os.WriteFile(golden, []byte(stdout), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stdout != string(want) {
+			t.Errorf("%s: the script differs from %s, run go test -run TestCompletionGolden -update if that is intended, got:\n%s", shell, golden, stdout)
+		}
+	}
+}
+
+// TestCompletionSyntax has each shell installed check the syntax of its
+// script.
+func TestCompletionSyntax(t *testing.T) {
+	for shell := range completionScripts {
+		path, err := exec.LookPath(shell)
+		if err != nil {
+			t.Logf("%s not installed, not checked", shell)
+			continue
+		}
+		script := filepath.Join("testdata", "completion."+shell)
+		if out, err := exec.Command(path, "-n", script).CombinedOutput(); err != nil {
+			t.Errorf("%s -n %s: %v\n%s", shell, script, err, out)
+		}
+	}
+}
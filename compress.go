@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	imapcmd "github.com/emersion/go-imap/commands"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// sessionConn is the connection of a session which may be compressed
+// with COMPRESS=DEFLATE (RFC 4978). go-imap cannot swap the connection
+// of a client safely once its reader is running, so sessionConn is
+// handed to it when dialing and switches itself, to TLS for STARTTLS
+// and to deflate for COMPRESS: it is armed before the command is sent
+// and switches right after the line of its tagged OK, where the server
+// does.
+type sessionConn struct {
+	// Conn is the connection as dialed, used for addresses, deadlines
+	// and closing.
+	net.Conn
+	metrics *dedup.Metrics
+
+	mu sync.Mutex
+	// r and w are the topmost layer, the dialed connection, TLS or
+	// deflate.
+	r io.Reader
+	w io.Writer
+	// armed is the command whose OK switches, "STARTTLS" or
+	// "COMPRESS", empty if none.
+	armed     string
+	tlsConfig *tls.Config
+	// tag is the tag of the armed command, taken from its line as it is
+	// written.
+	tag string
+	// line is the start of the line being read while armed.
+	line []byte
+	// switched is set once the armed command succeeded.
+	switched bool
+	tlsConn  *tls.Conn
+	zw       *flate.Writer
+}
+
+func newSessionConn(conn net.Conn, metrics *dedup.Metrics) *sessionConn {
+	return &sessionConn{Conn: conn, metrics: metrics, r: conn, w: conn}
+}
+
+// sessionDialer dials a sessionConn, with TLS if tlsConfig is set.
+type sessionDialer struct {
+	dialer    client.Dialer
+	metrics   *dedup.Metrics
+	tlsConfig *tls.Config
+	// conn is the last connection dialed.
+	conn *sessionConn
+}
+
+func (d *sessionDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.tlsConfig != nil {
+		conn = tls.Client(conn, d.tlsConfig)
+	}
+	d.conn = newSessionConn(conn, d.metrics)
+	return d.conn, nil
+}
+
+func (s *sessionConn) Read(b []byte) (int, error) {
+	// the layers only switch in Read, but s may be armed while it
+	// waits for the tagged OK
+	s.mu.Lock()
+	r, compressed := s.r, s.zw != nil
+	s.mu.Unlock()
+	n, err := r.Read(b)
+	if n > 0 {
+		n = s.scan(b[:n])
+	}
+	if compressed {
+		s.metrics.AddCompression(0, int64(n))
+	}
+	return n, err
+}
+
+func (s *sessionConn) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	if s.armed != "" && s.tag == "" {
+		if i := bytes.IndexByte(b, ' '); i > 0 {
+			s.tag = string(b[:i])
+		}
+	}
+	w, zw := s.w, s.zw
+	s.mu.Unlock()
+	if zw == nil {
+		return w.Write(b)
+	}
+	n, err := zw.Write(b)
+	if err == nil {
+		// every write is a whole command or a part of a literal the
+		// server is waiting for
+		err = zw.Flush()
+	}
+	s.metrics.AddCompression(0, int64(n))
+	return n, err
+}
+
+// scan scans p, if s is armed, for the tagged response of the armed
+// command. If it is OK, the layers are switched and the bytes of p
+// following its line, which belong to the new layer, are left to be
+// read from it. It returns the number of bytes of p which are still to
+// be read.
+func (s *sessionConn) scan(p []byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.armed == "" {
+		return len(p)
+	}
+	for i, ch := range p {
+		if ch != '\n' {
+			if len(s.line) < len(s.tag)+4 {
+				s.line = append(s.line, ch)
+			}
+			continue
+		}
+		line := string(s.line)
+		s.line = s.line[:0]
+		if s.tag == "" || len(line) <= len(s.tag) || line[:len(s.tag)+1] != s.tag+" " {
+			continue
+		}
+		if line[len(s.tag)+1:] == "OK " || line[len(s.tag)+1:] == "OK\r" {
+			s.upgrade(p[i+1:])
+		}
+		s.armed, s.tag = "", ""
+		return i + 1
+	}
+	return len(p)
+}
+
+// upgrade switches to the layer of the armed command, which reads rest
+// before what is left on the current layer.
+func (s *sessionConn) upgrade(rest []byte) {
+	r := io.MultiReader(bytes.NewReader(append([]byte(nil), rest...)), s.r)
+	switch s.armed {
+	case "STARTTLS":
+		s.tlsConn = tls.Client(&prefixedConn{Conn: s.Conn, r: r}, s.tlsConfig)
+		s.r, s.w = s.tlsConn, s.tlsConn
+	case "COMPRESS":
+		s.zw, _ = flate.NewWriter(meteredWriter{s.w, s.metrics}, flate.DefaultCompression)
+		s.r = flate.NewReader(meteredReader{r, s.metrics})
+	}
+	s.switched = true
+}
+
+// arm arms s for cmd, returning whether the previous armed command
+// succeeded.
+func (s *sessionConn) arm(cmd string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switched := s.switched
+	s.armed, s.tag, s.line, s.switched = cmd, "", s.line[:0], false
+	return switched
+}
+
+// run arms s for the command called name, runs cmd on c and reports
+// whether the server switched.
+func (s *sessionConn) run(c *client.Client, name string, cmd imap.Commander) (bool, *imap.StatusResp, error) {
+	s.arm(name)
+	status, err := c.Execute(cmd, nil)
+	return s.arm(""), status, err
+}
+
+// startTLS upgrades the session on c with STARTTLS, as
+// client.Client.StartTLS does with a connection it can swap.
+func (s *sessionConn) startTLS(c *client.Client, tlsConfig *tls.Config) error {
+	s.tlsConfig = tlsConfig
+	switched, status, err := s.run(c, "STARTTLS", &imapcmd.StartTLS{})
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+	if !switched {
+		return errors.New("the server did not start TLS")
+	}
+	if err := s.tlsConn.Handshake(); err != nil {
+		return err
+	}
+	// capabilities change with TLS
+	_, err = c.Capability()
+	return err
+}
+
+// compress compresses the session on c with COMPRESS=DEFLATE if the
+// server advertises it, reporting whether it does so. A server
+// refusing it leaves the session as it is.
+func (s *sessionConn) compress(c *client.Client) (bool, error) {
+	if ok, err := c.Support("COMPRESS=DEFLATE"); err != nil || !ok {
+		return false, err
+	}
+	switched, _, err := s.run(c, "COMPRESS", &compressCommand{})
+	return switched, err
+}
+
+// compressCommand is COMPRESS DEFLATE, which go-imap has no command
+// for.
+type compressCommand struct{}
+
+func (*compressCommand) Command() *imap.Command {
+	return &imap.Command{Name: "COMPRESS", Arguments: []interface{}{imap.RawString("DEFLATE")}}
+}
+
+// prefixedConn reads from r instead of its Conn.
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// meteredReader and meteredWriter count the compressed traffic of a
+// session into the metrics.
+type meteredReader struct {
+	r io.Reader
+	m *dedup.Metrics
+}
+
+func (r meteredReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.m.AddCompression(int64(n), 0)
+	return n, err
+}
+
+type meteredWriter struct {
+	w io.Writer
+	m *dedup.Metrics
+}
+
+func (w meteredWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.m.AddCompression(int64(n), 0)
+	return n, err
+}
+
+// compressSession compresses the session on c, whose connection is
+// sess, if sess is set and server advertises COMPRESS=DEFLATE. If that
+// fails, c is logged out.
+func compressSession(c *client.Client, sess *sessionConn, server string) error {
+	if sess == nil {
+		return nil
+	}
+	if _, err := sess.compress(c); err != nil {
+		c.Logout()
+		return &connectError{
+			msg:  fmt.Sprintf("COMPRESS=DEFLATE failed on %s", server),
+			hint: "use -compress off",
+			err:  err,
+		}
+	}
+	return nil
+}
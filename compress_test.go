@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// TestRunCompress cleans a mailbox on servers with and without
+// COMPRESS=DEFLATE and checks that -compress auto compresses the
+// session where it is advertised, falls back silently where not, and
+// that -timing reports the compressed and the logical bytes.
+func TestRunCompress(t *testing.T) {
+	saving := regexp.MustCompile(`COMPRESS=DEFLATE: (\d+) bytes of IMAP traffic took (\d+) bytes compressed \(\d+%\)`)
+	for _, test := range []struct {
+		advertised bool
+		compress   string
+		compressed bool
+	}{
+		{true, "auto", true},
+		{true, "off", false},
+		{false, "auto", false},
+	} {
+		s := dupServer(t)
+		if test.advertised {
+			s = dupServer(t, imaptest.Compress)
+		}
+		code, stdout, stderr := runMain(t, nil, args(s, "clean", "-compress", test.compress, "-timing", "-debug-imap")...)
+		if code != 0 {
+			t.Errorf("advertised %t, -compress %s: exit code %d, stderr:\n%s", test.advertised, test.compress, code, stderr)
+			continue
+		}
+		if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1, 2, 4}) {
+			t.Errorf("advertised %t, -compress %s: got UIDs %v left", test.advertised, test.compress, uids)
+		}
+		if sent := strings.Contains(stderr, " COMPRESS DEFLATE"); sent != test.compressed {
+			t.Errorf("advertised %t, -compress %s: COMPRESS sent %t", test.advertised, test.compress, sent)
+		}
+		m := saving.FindStringSubmatch(stdout + stderr)
+		if (m != nil) != test.compressed {
+			t.Errorf("advertised %t, -compress %s: got stdout:\n%s", test.advertised, test.compress, stdout)
+			continue
+		}
+		if m != nil {
+			logical, _ := strconv.Atoi(m[1])
+			compressed, _ := strconv.Atoi(m[2])
+			if logical == 0 || compressed == 0 || compressed >= logical {
+				t.Errorf("advertised %t, -compress %s: %d logical bytes took %d compressed", test.advertised, test.compress, logical, compressed)
+			}
+		}
+	}
+}
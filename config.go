@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configValue is a value of a configuration file together with the
+// line it was set on.
+type configValue struct {
+	value string
+	line  int
+}
+
+// configFile is a parsed configuration file. Keys are flag names, the
+// profiles hold the values of the [profiles.<name>] tables.
+type configFile struct {
+	path     string
+	values   map[string]configValue
+	profiles map[string]map[string]configValue
+	// names are the names of the profiles in the order of the file.
+	names []string
+}
+
+// configOnlyFlags are flags which cannot be set from a configuration
+// file.
+var configOnlyFlags = map[string]bool{"config": true, "profile": true, "profiles": true, "all-profiles": true}
+
+// parseConfig reads the TOML configuration file at path. Only the
+// subset needed for flags is supported: top level keys, tables named
+// profiles.<name>, and string, boolean and number values. Keys must be
+// flag names.
+func parseConfig(path string) (*configFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cf := &configFile{path: path, values: map[string]configValue{}, profiles: map[string]map[string]configValue{}}
+	table := cf.values
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || !isComment(line[end+1:]) {
+				return nil, fmt.Errorf("%s:%d: invalid table header", path, n)
+			}
+			name := strings.TrimSpace(line[1:end])
+			profile := strings.TrimPrefix(name, "profiles.")
+			if profile == name || profile == "" {
+				return nil, fmt.Errorf("%s:%d: unknown table %q, only [profiles.<name>] is supported", path, n, name)
+			}
+			if _, ok := cf.profiles[profile]; ok {
+				return nil, fmt.Errorf("%s:%d: profile %q defined twice", path, n, profile)
+			}
+			table = map[string]configValue{}
+			cf.profiles[profile] = table
+			cf.names = append(cf.names, profile)
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if unquoted, err := strconv.Unquote(key); err == nil {
+			key = unquoted
+		}
+		if f := flag.Lookup(key); f == nil || configOnlyFlags[key] {
+			return nil, fmt.Errorf("%s:%d: unknown key %q", path, n, key)
+		}
+		if _, ok := table[key]; ok {
+			return nil, fmt.Errorf("%s:%d: key %q set twice", path, n, key)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %s", path, n, key, err)
+		}
+		table[key] = configValue{value, n}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+// parseConfigValue returns the flag value of a TOML value, dropping a
+// trailing comment.
+func parseConfigValue(s string) (string, error) {
+	if s == "" {
+		return "", fmt.Errorf("missing value")
+	}
+	switch s[0] {
+	case '"':
+		end := closingQuote(s)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if !isComment(s[end+1:]) {
+			return "", fmt.Errorf("unexpected text after string")
+		}
+		return strconv.Unquote(s[:end+1])
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if !isComment(s[end+2:]) {
+			return "", fmt.Errorf("unexpected text after string")
+		}
+		return s[1 : end+1], nil
+	}
+
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if s == "true" || s == "false" {
+		return s, nil
+	}
+	if _, err := strconv.ParseFloat(strings.Replace(s, "_", "", -1), 64); err != nil {
+		return "", fmt.Errorf("invalid value %q, strings need quotes", s)
+	}
+	return strings.Replace(s, "_", "", -1), nil
+}
+
+// closingQuote returns the index of the quote ending the basic string
+// starting s, or -1.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// isComment reports whether s is empty or a comment.
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// apply sets the flags from the file which were not given explicitly,
+// the values of the named profile taking precedence over the top level
+// ones. An empty profile only applies the top level values.
+func (cf *configFile) apply(profile string) error {
+	values := map[string]configValue{}
+	for k, v := range cf.values {
+		values[k] = v
+	}
+	if profile != "" {
+		p, ok := cf.profiles[profile]
+		if !ok {
+			var names []string
+			for n := range cf.profiles {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("%s: unknown profile %q, defined are %s", cf.path, profile, strings.Join(names, ", "))
+		}
+		for k, v := range p {
+			values[k] = v
+		}
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for k, v := range values {
+		if set[k] {
+			continue
+		}
+		if err := flag.Set(k, v.value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %s", cf.path, v.line, k, err)
+		}
+	}
+	return nil
+}
+
+// secretFlags are the flags holding passwords.
+var secretFlags = []string{"password", "new-password", "smtp-password"}
+
+// hasSecrets reports whether the file or any of its profiles sets a
+// password.
+func (cf *configFile) hasSecrets() bool {
+	for _, name := range secretFlags {
+		if _, ok := cf.values[name]; ok {
+			return true
+		}
+		for _, p := range cf.profiles {
+			if _, ok := p[name]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandHome replaces a leading ~/ of path by the home directory.
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[2:]), nil
+}
+
+// configProfiles returns the names of the profiles of the configuration
+// file at path in the order they are defined.
+func configProfiles(path string) ([]string, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, err
+	}
+	cf, err := parseConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return cf.names, nil
+}
+
+// loadConfig parses the configuration file at path, warning on stderr
+// if it holds a password but is readable by group or others, and
+// applies it with the named profile.
+func loadConfig(path, profile string) error {
+	path, err := expandHome(path)
+	if err != nil {
+		return err
+	}
+	cf, err := parseConfig(path)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && cf.hasSecrets() {
+		if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0077 != 0 {
+			fmt.Fprintf(os.Stderr, "warning: %s contains a password but is readable by others (mode %s), run chmod 600 %s\n", path, fi.Mode().Perm(), path)
+		}
+	}
+	return cf.apply(profile)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes content to a configuration file with mode perm
+// and returns its path.
+func writeConfig(t *testing.T, content string, perm os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile leaves the mode to the umask
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfig(t *testing.T) {
+	defineFlags(t)
+	path := writeConfig(t, `# comment
+server = "imap.example.org" # trailing comment
+port = 993
+tls = true
+mbox = 'Archive "old"'
+dedup-group-report-limit = 10_000
+"dry-run" = false
+
+[profiles.work]
+username = "work@example.org"
+password = "s\"cret#"
+
+[profiles.home]
+username = "home@example.org"
+`, 0600)
+	cf, err := parseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string)
+	for k, v := range cf.values {
+		values[k] = v.value
+	}
+	want := map[string]string{"server": "imap.example.org", "port": "993", "tls": "true", "mbox": `Archive "old"`, "dedup-group-report-limit": "10000", "dry-run": "false"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got values %v", values)
+	}
+	if line := cf.values["tls"].line; line != 4 {
+		t.Errorf("tls set on line %d", line)
+	}
+	if !reflect.DeepEqual(cf.names, []string{"work", "home"}) {
+		t.Errorf("got profiles %v", cf.names)
+	}
+	if got := cf.profiles["work"]["password"].value; got != `s"cret#` {
+		t.Errorf("got password %q", got)
+	}
+	if !cf.hasSecrets() {
+		t.Error("the password of a profile is no secret")
+	}
+
+	for _, test := range []struct {
+		content string
+		err     string
+	}{
+		{"server = \"a\"\nfrobnicate = true\n", `:2: unknown key "frobnicate"`},
+		{"profile = \"work\"\n", `:1: unknown key "profile"`},
+		{"port = 1\nport = 2\n", `:2: key "port" set twice`},
+		{"\n[servers.a]\n", `:2: unknown table "servers.a", only [profiles.<name>] is supported`},
+		{"[profiles.a]\n[profiles.a]\n", `:2: profile "a" defined twice`},
+		{"[profiles.a\n", `:1: invalid table header`},
+		{"server\n", `:1: expected key = value`},
+		{"server = imap.example.org\n", `:1: server: invalid value "imap.example.org", strings need quotes`},
+		{"server = \"imap\n", `:1: server: unterminated string`},
+		{"server = \"a\" b\n", `:1: server: unexpected text after string`},
+		{"server =\n", `:1: server: missing value`},
+	} {
+		_, err := parseConfig(writeConfig(t, test.content, 0600))
+		if err == nil || !strings.HasSuffix(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %q", test.content, err, test.err)
+		}
+	}
+}
+
+// TestConfigApply checks that explicit flags take precedence over the
+// profile, the profile over the top level values and those over the
+// defaults.
+func TestConfigApply(t *testing.T) {
+	path := writeConfig(t, `server = "top.example.org"
+username = "top"
+mbox = "Top"
+port = "not a port"
+
+[profiles.work]
+username = "work"
+mbox = "Work"
+port = 10993
+`, 0600)
+	for _, test := range []struct {
+		profile string
+		args    []string
+		want    map[string]string
+		err     string
+	}{
+		{"work", nil, map[string]string{"server": "top.example.org", "username": "work", "mbox": "Work", "port": "10993", "fetch-chunk": "0"}, ""},
+		{"work", []string{"-mbox", "Flag"}, map[string]string{"server": "top.example.org", "username": "work", "mbox": "Flag"}, ""},
+		{"", []string{"-port", "143"}, map[string]string{"server": "top.example.org", "username": "top", "mbox": "Top", "port": "143"}, ""},
+		{"", nil, nil, `:4: port: parse error`},
+		{"home", nil, nil, `unknown profile "home", defined are work`},
+	} {
+		defineFlags(t)
+		if err := flag.CommandLine.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		err := loadConfig(path, test.profile)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s %v: got error %v, want %q", test.profile, test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %v: %v", test.profile, test.args, err)
+			continue
+		}
+		for name, want := range test.want {
+			if got := flag.Lookup(name).Value.String(); got != want {
+				t.Errorf("%s %v: -%s is %q, want %q", test.profile, test.args, name, got, want)
+			}
+		}
+	}
+}
+
+func TestLoadConfigPermissions(t *testing.T) {
+	for _, test := range []struct {
+		content string
+		perm    os.FileMode
+		warn    bool
+	}{
+		{"password = \"secret\"\n", 0600, false},
+		{"password = \"secret\"\n", 0640, true},
+		{"[profiles.a]\nsmtp-password = \"secret\"\n", 0604, true},
+		{"server = \"imap.example.org\"\n", 0644, false},
+	} {
+		defineFlags(t)
+		path := writeConfig(t, test.content, test.perm)
+		oldErr := os.Stderr
+		errFile := tempFile(t)
+		os.Stderr = errFile
+		err := loadConfig(path, "")
+		os.Stderr = oldErr
+		if err != nil {
+			t.Fatal(err)
+		}
+		stderr := readFile(t, errFile)
+		want := "warning: " + path + " contains a password but is readable by others (mode " + test.perm.String() + "), run chmod 600 " + path
+		if warned := strings.Contains(stderr, want); warned != test.warn {
+			t.Errorf("%q with mode %s: got stderr:\n%s", test.content, test.perm, stderr)
+		}
+	}
+}
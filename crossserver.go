@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// crossServer compares mbox on the server of cl, the old one of a
+// migration, with newMbox on nc and prints the messages on both, only
+// on the old and only on the new server. If remove is set the messages
+// on both are removed from the old server; nc is only ever examined.
+func (cl *cleaner) crossServer(ctx context.Context, mbox string, nc *client.Client, newMbox string, remove bool) MailboxResult {
+	cfg := cl.cfg
+	cfg.Progress = nil
+	old, err := dedup.TakeInventory(ctx, cl.retrying(ctx, cl.scan), mbox, cfg)
+	if err != nil {
+		cl.logger.Error("cannot take inventory", "server", "old", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot take inventory of the old server: %s\n", err)
+		return MailboxResult{Mailbox: mbox, Err: err}
+	}
+	cfg.ReadOnly = true
+	inv, err := dedup.TakeInventory(ctx, cl.retrying(ctx, nc), newMbox, cfg)
+	if err != nil {
+		cl.logger.Error("cannot take inventory", "server", "new", "mailbox", newMbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot take inventory of the new server: %s\n", err)
+		return MailboxResult{Mailbox: mbox, Err: err}
+	}
+
+	diff := dedup.DiffInventories(old, inv)
+	both := dedup.Count(diff.Both)
+	cl.logger.Info("compared servers", "mailbox", mbox, "new_mailbox", newMbox, "old", old.Len(), "new", inv.Len(),
+		"both", both, "only_old", len(diff.OnlyOld), "only_new", len(diff.OnlyNew))
+	fmt.Printf("%s: %d messages on the old server, %d in %s on the new one\n", mbox, old.Len(), inv.Len(), newMbox)
+	fmt.Printf("on both: %d messages\n", both)
+	fmt.Printf("only on the old server, never removed: %d messages\n", len(diff.OnlyOld))
+	for _, uid := range diff.OnlyOld {
+		fmt.Printf("  %s %d %q\n", mbox, uid, old.Subjects[uid])
+	}
+	fmt.Printf("only on the new server: %d messages\n", len(diff.OnlyNew))
+	for _, uid := range diff.OnlyNew {
+		fmt.Printf("  %s %d %q\n", newMbox, uid, inv.Subjects[uid])
+	}
+	if !remove {
+		return MailboxResult{Mailbox: mbox}
+	}
+
+	release, err := cl.locks.hold(mbox)
+	if err != nil {
+		cl.logger.Error("cannot lock mailbox", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot remove migrated messages: %s\n", err)
+		return MailboxResult{Mailbox: mbox, Err: err}
+	}
+	defer release()
+	return cl.apply(ctx, mbox, diff.Both)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sync"
+
+	"github.com/emersion/go-imap"
+)
+
+// loginCommand matches a LOGIN command, with the tag and the command
+// name as group.
+var loginCommand = regexp.MustCompile(`(?i)^([^ ]+ LOGIN) `)
+
+// authenticateCommand matches an AUTHENTICATE command, with the tag,
+// the command name and the mechanism as first group and the initial
+// response, if any, as second.
+var authenticateCommand = regexp.MustCompile(`(?i)^([^ ]+ AUTHENTICATE [^ \r\n]+)( [^\r\n]*)?\r?\n$`)
+
+// literalEnd matches a line continued by a literal, such as a user name
+// or password sent as {8}.
+var literalEnd = regexp.MustCompile(`\{\d+\+?\}\r?\n$`)
+
+// lockedWriter serializes the writes of the two directions of a trace.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// traceWriter writes the lines of one direction of an IMAP session
+// with a prefix, such as "C: " for the commands of the client. If
+// redact is set, the credentials of LOGIN and AUTHENTICATE commands are
+// left out.
+type traceWriter struct {
+	w      io.Writer
+	prefix string
+	redact bool
+	buf    []byte
+	// literal is set while the continuation lines of a LOGIN sending
+	// a literal or the response of an AUTHENTICATE are written.
+	literal bool
+}
+
+func (t *traceWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	for {
+		i := bytes.IndexByte(t.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := t.line(t.buf[:i+1])
+		t.buf = t.buf[i+1:]
+		if _, err := io.WriteString(t.w, t.prefix+line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// line returns the line as written to the trace.
+func (t *traceWriter) line(line []byte) string {
+	if !t.redact {
+		return string(line)
+	}
+	redacted := "<redacted>\r\n"
+	if !t.literal {
+		if m := authenticateCommand.FindSubmatch(line); m != nil {
+			// without SASL-IR the response follows on the next line
+			t.literal = len(m[2]) == 0
+			if t.literal {
+				return string(line)
+			}
+			return string(m[1]) + " " + redacted
+		}
+		m := loginCommand.FindSubmatch(line)
+		if m == nil {
+			return string(line)
+		}
+		redacted = string(m[1]) + " " + redacted
+	}
+	t.literal = literalEnd.Match(line)
+	return redacted
+}
+
+// debugTrace returns the writer go-imap traces a session to when
+// -debug-imap is set, writing the commands sent and the responses
+// received to w line by line, or nil if debugging is off.
+func debugTrace(enabled bool, w io.Writer) io.Writer {
+	if !enabled {
+		return nil
+	}
+	lw := &lockedWriter{w: w}
+	return imap.NewDebugWriter(
+		&traceWriter{w: lw, prefix: "C: ", redact: true},
+		&traceWriter{w: lw, prefix: "S: "},
+	)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTraceRedaction(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// writes are the chunks written to the trace, as sent.
+		writes []string
+		want   string
+	}{
+		{
+			"quoted login",
+			[]string{"a1 LOGIN \"alice\" \"s3cr\\\"et\"\r\n", "a2 SELECT INBOX\r\n"},
+			"C: a1 LOGIN <redacted>\r\nC: a2 SELECT INBOX\r\n",
+		},
+		{
+			"login literal",
+			// the password follows as a literal once the server sent
+			// its continuation request
+			[]string{"a1 LOGIN alice {6}\r\n", "s3cret\r\n", "a2 SELECT INBOX\r\n"},
+			"C: a1 LOGIN <redacted>\r\nC: <redacted>\r\nC: a2 SELECT INBOX\r\n",
+		},
+		{
+			"login literals",
+			[]string{"a1 LOGIN {5}\r\n", "alice {6}\r\n", "s3cret\r\n", "a2 SELECT INBOX\r\n"},
+			"C: a1 LOGIN <redacted>\r\nC: <redacted>\r\nC: <redacted>\r\nC: a2 SELECT INBOX\r\n",
+		},
+		{
+			"login literal split across writes",
+			[]string{"a1 LOGIN alice {6}\r", "\ns3c", "ret\r\na2 SELECT INBOX\r\n"},
+			"C: a1 LOGIN <redacted>\r\nC: <redacted>\r\nC: a2 SELECT INBOX\r\n",
+		},
+		{
+			"authenticate plain with initial response",
+			[]string{"a1 AUTHENTICATE PLAIN AGFsaWNlAHMzY3JldA==\r\n", "a2 SELECT INBOX\r\n"},
+			"C: a1 AUTHENTICATE PLAIN <redacted>\r\nC: a2 SELECT INBOX\r\n",
+		},
+		{
+			"authenticate plain on the next line",
+			[]string{"a1 AUTHENTICATE PLAIN\r\n", "AGFsaWNlAHMzY3JldA==\r\n", "a2 SELECT INBOX\r\n"},
+			"C: a1 AUTHENTICATE PLAIN\r\nC: <redacted>\r\nC: a2 SELECT INBOX\r\n",
+		},
+		{
+			"other commands",
+			[]string{"a1 CAPABILITY\r\n", "a2 UID FETCH 1:* (UID ENVELOPE)\r\n"},
+			"C: a1 CAPABILITY\r\nC: a2 UID FETCH 1:* (UID ENVELOPE)\r\n",
+		},
+	} {
+		var b bytes.Buffer
+		tw := &traceWriter{w: &b, prefix: "C: ", redact: true}
+		for _, w := range test.writes {
+			if _, err := tw.Write([]byte(w)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if b.String() != test.want {
+			t.Errorf("%s: got trace\n%s\nwant\n%s", test.name, b.String(), test.want)
+		}
+		if strings.Contains(b.String(), "s3cr") || strings.Contains(b.String(), "AGFsaWNl") {
+			t.Errorf("%s: password traced", test.name)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package dedup
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Analysis describes the messages of a mailbox and its duplicates.
+type Analysis struct {
+	Mailbox string
+	// Messages and Bytes are the number and total RFC822.SIZE of the
+	// messages scanned.
+	Messages int
+	Bytes    int64
+	// Oldest and Newest are the earliest and latest envelope dates,
+	// zero without any.
+	Oldest, Newest time.Time
+	// Duplicates are the duplicates found keying by message-id and by
+	// envelope-hash, as with Compare.
+	Duplicates []DuplicateStats
+	// TopSenders are the senders with the most messages, most first,
+	// at most MaxTopSenders of them.
+	TopSenders []SenderStats
+	// Sizes counts the messages by size, in the buckets of
+	// SizeBuckets.
+	Sizes []SizeBucket
+}
+
+// DuplicateStats are the duplicates one way of keying finds.
+type DuplicateStats struct {
+	Strategy string
+	// Count is the number of messages which would be removed, Bytes
+	// their total size.
+	Count int
+	Bytes int64
+}
+
+// SenderStats are the messages of one sender, by first From address.
+type SenderStats struct {
+	From     string
+	Messages int
+	Bytes    int64
+}
+
+// SizeBucket is the number of messages below a size and at least as
+// large as the bound of the bucket before.
+type SizeBucket struct {
+	// Below is the exclusive upper bound in bytes, 0 for the last
+	// bucket, which is unbounded.
+	Below    int64
+	Messages int
+}
+
+// MaxTopSenders is the number of senders an Analysis lists.
+const MaxTopSenders = 10
+
+// SizeBuckets are the upper bounds of the buckets of Analysis.Sizes.
+var SizeBuckets = []int64{10 << 10, 100 << 10, 1 << 20, 10 << 20, 0}
+
+// Analyze examines mbox read-only and describes its messages and the
+// duplicates keying by message-id and by envelope-hash would find,
+// fetching envelopes and sizes only. The envelope hash, MinGroupSize,
+// Limit and the UID range follow cfg; KeyTemplate, RawHeader, Strategy
+// and Scope are left out. Bodies are not fetched, Compare counts the
+// duplicates comparing them finds.
+func Analyze(ctx context.Context, c Client, mbox string, cfg Config) (a Analysis, err error) {
+	cfg = cfg.withDefaults()
+	cfg.IgnoreMessageID = false
+	cfg.KeyTemplate = nil
+	cfg.RawHeader = false
+	cfg.Scope = ScopeMailbox
+	a.Mailbox = mbox
+	metrics := cfg.Metrics
+	if ctx.Err() != nil {
+		return a, canceled(ctx, mbox, PhaseSelect)
+	}
+	done := metrics.Track(mbox, PhaseSelect)
+	st, err := c.Select(mbox, true)
+	done(1, 0)
+	if err != nil {
+		return a, selectError(mbox, err)
+	}
+	deleted, err := deletedUIDs(c, st, cfg)
+	if err != nil {
+		return a, err
+	}
+	windows, _, err := scanWindows(c, st, cfg)
+	if err != nil {
+		return a, err
+	}
+
+	envCfg := cfg
+	envCfg.IgnoreMessageID = true
+	byEnvelope := newEnvelopeHasher(envCfg)
+	type copies struct {
+		n     int
+		bytes int64
+	}
+	keys := []map[digest]*copies{make(map[digest]*copies), make(map[digest]*copies)}
+	senders := make(map[string]*SenderStats)
+	a.Sizes = make([]SizeBucket, len(SizeBuckets))
+	for i, below := range SizeBuckets {
+		a.Sizes[i].Below = below
+	}
+	seen := make(map[uint32]bool)
+	for _, w := range windows {
+		if ctx.Err() != nil {
+			return a, canceledIn(ctx, mbox, PhaseFetch, w)
+		}
+		_, err := fetchWindow(ctx, c, mbox, w, cfg, func(k keyed) {
+			msg := k.msg
+			if seen[msg.Uid] || k.err != nil {
+				return
+			}
+			seen[msg.Uid] = true
+			if _, ok := deleted[msg.Uid]; ok {
+				return
+			}
+			if st.UidNext != 0 && msg.Uid >= st.UidNext {
+				return
+			}
+			size := int64(msg.Size)
+			a.Messages++
+			a.Bytes += size
+			if date := msg.Envelope.Date; !date.IsZero() {
+				if a.Oldest.IsZero() || date.Before(a.Oldest) {
+					a.Oldest = date
+				}
+				if date.After(a.Newest) {
+					a.Newest = date
+				}
+			}
+			for i := range a.Sizes {
+				if a.Sizes[i].Below == 0 || size < a.Sizes[i].Below {
+					a.Sizes[i].Messages++
+					break
+				}
+			}
+			if addrs := msg.Envelope.From; len(addrs) > 0 {
+				from := strings.ToLower(addrs[0].MailboxName + "@" + addrs[0].HostName)
+				s := senders[from]
+				if s == nil {
+					s = &SenderStats{From: from}
+					senders[from] = s
+				}
+				s.Messages++
+				s.Bytes += size
+			}
+			env, _, _ := byEnvelope.Digest(msg)
+			for i, key := range []digest{k.key, env} {
+				cp := keys[i][key]
+				if cp == nil {
+					keys[i][key] = &copies{n: 1}
+					continue
+				}
+				cp.n++
+				cp.bytes += size
+			}
+		})
+		if err != nil {
+			return a, err
+		}
+	}
+
+	for i, name := range []string{"message-id", "envelope-hash"} {
+		d := DuplicateStats{Strategy: name}
+		for _, cp := range keys[i] {
+			if cp.n >= cfg.MinGroupSize {
+				d.Count += cp.n - 1
+				d.Bytes += cp.bytes
+			}
+		}
+		a.Duplicates = append(a.Duplicates, d)
+	}
+	for _, s := range senders {
+		a.TopSenders = append(a.TopSenders, *s)
+	}
+	sort.Slice(a.TopSenders, func(i, j int) bool {
+		si, sj := a.TopSenders[i], a.TopSenders[j]
+		if si.Messages != sj.Messages {
+			return si.Messages > sj.Messages
+		}
+		return si.From < sj.From
+	})
+	if len(a.TopSenders) > MaxTopSenders {
+		a.TopSenders = a.TopSenders[:MaxTopSenders]
+	}
+	return a, nil
+}
@@ -0,0 +1,242 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/emersion/go-imap"
+)
+
+// Action is what Apply does with the duplicates of a group.
+type Action int
+
+const (
+	// ActionDelete marks duplicates \Deleted and expunges them. On
+	// servers without UIDPLUS, which can only expunge every message
+	// flagged \Deleted, a mailbox where other messages are flagged
+	// \Deleted already is left alone with an error wrapping
+	// ErrFullExpunge.
+	ActionDelete Action = iota
+	// ActionDeleteExpungeAll is ActionDelete, but on servers without
+	// UIDPLUS it expunges mailboxes where other messages are flagged
+	// \Deleted too, removing them as well.
+	ActionDeleteExpungeAll
+)
+
+// Result is the outcome of Apply.
+type Result struct {
+	// Removed is the number of duplicates acted upon.
+	Removed int
+	// Expunged are the UIDs flagged \Deleted and expunged, by mailbox.
+	Expunged map[string][]uint32
+	// Flagged are the UIDs flagged \Deleted whose expunge failed, by
+	// mailbox.
+	Flagged map[string][]uint32
+	// Purged is the number of messages the server reported expunged,
+	// by mailbox. It differs from the number of Expunged UIDs if
+	// another client marked messages \Deleted too, or if some of those
+	// flagged by Apply were not removed.
+	Purged map[string]int
+	// Mismatched are the messages whose envelope was not the one
+	// recorded by the scan, by mailbox. Their duplicates, or they
+	// themselves, were not removed.
+	Mismatched map[string][]Mismatch
+	// FullExpunged are the mailboxes expunged with EXPUNGE as the
+	// server lacks UIDPLUS, with the number of messages other clients
+	// had flagged \Deleted, which were expunged too.
+	FullExpunged map[string]int
+}
+
+// Apply performs action on the duplicates of groups, one mailbox after
+// another in the order the groups are given, within a mailbox from the
+// highest UID down. Keepers are never touched.
+//
+// A mailbox whose UIDVALIDITY differs from the one the groups were
+// scanned with is not touched, Apply returns an error wrapping
+// ErrUIDValidityChanged then. For groups scanned with
+// Config.RecordEnvelopes the envelopes of keepers and duplicates are
+// fetched again first. A duplicate which is gone or whose Message-ID or
+// subject changed is left alone, as are all duplicates of a keeper
+// which did, and reported in Result.Mismatched. Without UIDPLUS the
+// mailboxes are expunged as action allows and listed in
+// Result.FullExpunged.
+//
+// Once ctx is done no further duplicates are flagged, but those already
+// flagged in the current mailbox are still expunged so that none is
+// left behind marked \Deleted. Apply then returns ctx.Err() wrapped with
+// the phase it stopped in.
+func Apply(ctx context.Context, c Client, groups []Group, action Action, metrics *Metrics) (res Result, err error) {
+	var mailboxes []string
+	uids := make(map[string][]uint32)
+	uidValidity := make(map[string]uint32)
+	for _, g := range groups {
+		if _, ok := uids[g.Mailbox]; !ok {
+			mailboxes = append(mailboxes, g.Mailbox)
+		}
+		uids[g.Mailbox] = append(uids[g.Mailbox], g.Duplicates...)
+		if g.UIDValidity != 0 {
+			uidValidity[g.Mailbox] = g.UIDValidity
+		}
+	}
+
+	res.Expunged = make(map[string][]uint32)
+	res.Flagged = make(map[string][]uint32)
+	res.Purged = make(map[string]int)
+	res.Mismatched = make(map[string][]Mismatch)
+	res.FullExpunged = make(map[string]int)
+	for _, mbox := range mailboxes {
+		if ctx.Err() != nil {
+			return res, canceled(ctx, mbox, PhaseSelect)
+		}
+		r, err := remove(ctx, c, mbox, uidValidity[mbox], groups, uids[mbox], action, metrics)
+		if len(r.mismatches) > 0 {
+			res.Mismatched[mbox] = r.mismatches
+		}
+		if r.purged > 0 {
+			res.Purged[mbox] = r.purged
+		}
+		if r.expunged {
+			res.Expunged[mbox] = r.flagged
+			res.Removed += len(r.flagged)
+		} else if len(r.flagged) > 0 {
+			res.Flagged[mbox] = r.flagged
+		}
+		if r.fullExpunge {
+			res.FullExpunged[mbox] = r.others
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// removal is the outcome of remove in a mailbox.
+type removal struct {
+	// flagged are the UIDs flagged \Deleted, expunged if expunged is
+	// set.
+	flagged  []uint32
+	expunged bool
+	// purged is the number of messages the server reported expunged.
+	purged     int
+	mismatches []Mismatch
+	// fullExpunge is set if EXPUNGE was issued for lack of UIDPLUS,
+	// others is then the number of messages other clients had flagged
+	// \Deleted.
+	fullExpunge bool
+	others      int
+}
+
+// remove marks uids of mbox \Deleted and expunges them, unless its
+// UIDVALIDITY is no longer uidValidity, leaving out those whose
+// envelope or whose keeper's envelope in groups changed. With UIDPLUS
+// only those are expunged. Without it EXPUNGE also removes messages
+// another client flagged \Deleted, so it first searches for them and,
+// unless action is ActionDeleteExpungeAll, leaves mbox alone if there
+// are any. Once ctx is done it stops flagging and expunges those
+// flagged so far.
+//
+// Messages are flagged from the highest UID down. Commands only address
+// them by UID, but expunges by other clients, or by an interrupted run
+// of this one, renumber the messages above the removed one. Working
+// down means such a shift never moves a message not yet handled, so
+// the order stays safe should a server or proxy fall back to sequence
+// numbers, and it costs nothing otherwise.
+func remove(ctx context.Context, c Client, mbox string, uidValidity uint32, groups []Group, uids []uint32, action Action, metrics *Metrics) (r removal, err error) {
+	done := metrics.Track(mbox, PhaseSelect)
+	st, err := c.Select(mbox, false)
+	done(1, 0)
+	if err != nil {
+		return r, selectError(mbox, err)
+	}
+	if uidValidity != 0 && st.UidValidity != uidValidity {
+		return r, &Error{Op: "select", Mailbox: mbox, Err: fmt.Errorf("%w: was %d, is %d", ErrUIDValidityChanged, uidValidity, st.UidValidity)}
+	}
+	uids, r.mismatches, err = checkEnvelopes(ctx, c, mbox, groups, uids, metrics)
+	if err != nil {
+		return removal{}, err
+	}
+	uids = append([]uint32(nil), uids...)
+	sort.Slice(uids, func(i, j int) bool { return uids[i] > uids[j] })
+	uidPlus := capabilitiesOf(c).UIDPlus
+	if !uidPlus && len(uids) > 0 {
+		if r.others, err = deletedByOthers(c, mbox, uids, metrics); err != nil {
+			return r, err
+		}
+		if r.others > 0 && action != ActionDeleteExpungeAll {
+			return r, &Error{Op: "expunge", Mailbox: mbox, Err: fmt.Errorf("%w: %d messages", ErrFullExpunge, r.others)}
+		}
+	}
+
+	store := metrics.Track(mbox, PhaseStore)
+	for _, uid := range uids {
+		if ctx.Err() != nil {
+			err = canceled(ctx, mbox, PhaseStore)
+			break
+		}
+		seqSet := &imap.SeqSet{}
+		seqSet.AddNum(uid)
+		if err := c.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+			store(len(r.flagged)+1, len(r.flagged))
+			return r, &Error{Op: "store", Mailbox: mbox, Set: seqSet, Err: err}
+		}
+		r.flagged = append(r.flagged, uid)
+	}
+	store(len(r.flagged), len(r.flagged))
+	if len(r.flagged) == 0 {
+		return r, err
+	}
+
+	expunge := metrics.Track(mbox, PhaseExpunge)
+	seqNums := make(chan uint32)
+	counted := make(chan int)
+	go func() {
+		n := 0
+		for range seqNums {
+			n++
+		}
+		counted <- n
+	}()
+	var expungeErr error
+	if uidPlus {
+		set := &imap.SeqSet{}
+		set.AddNum(r.flagged...)
+		expungeErr = uidExpunge(c, set, seqNums)
+	} else {
+		r.fullExpunge = true
+		expungeErr = c.Expunge(seqNums)
+	}
+	r.purged = <-counted
+	expunge(1, r.purged)
+	if expungeErr != nil {
+		return r, &Error{Op: "expunge", Mailbox: mbox, Err: expungeErr}
+	}
+	r.expunged = true
+	return r, err
+}
+
+// deletedByOthers returns the number of messages of the selected
+// mailbox mbox flagged \Deleted which are not among uids, all of which
+// EXPUNGE would remove.
+func deletedByOthers(c Client, mbox string, uids []uint32, metrics *Metrics) (int, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.DeletedFlag}
+	done := metrics.Track(mbox, PhaseExpunge)
+	found, err := c.UidSearch(criteria)
+	done(1, len(found))
+	if err != nil {
+		return 0, &Error{Op: "search", Mailbox: mbox, Err: err}
+	}
+	ours := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		ours[uid] = true
+	}
+	n := 0
+	for _, uid := range found {
+		if !ours[uid] {
+			n++
+		}
+	}
+	return n, nil
+}
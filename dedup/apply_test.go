@@ -0,0 +1,191 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/tomasvitek/imap-clean-dup/internal/fakeimap"
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// fiveMessages returns a scripted client with five messages in INBOX
+// and the groups keeping UIDs 1 and 3 of them.
+func fiveMessages() (*fakeimap.Client, []Group) {
+	c := newFake(
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "A"},
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "A"},
+		imaptest.Message{MessageID: "<b@example.org>", Subject: "B"},
+		imaptest.Message{MessageID: "<b@example.org>", Subject: "B"},
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "A"},
+	)
+	return c, []Group{
+		{Mailbox: "INBOX", Keeper: 1, Duplicates: []uint32{2, 5}, UIDValidity: 1},
+		{Mailbox: "INBOX", Keeper: 3, Duplicates: []uint32{4}, UIDValidity: 1},
+	}
+}
+
+const storeDeleted = " +FLAGS.SILENT (\\Deleted)"
+
+func TestApplyCommands(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		uidPlus  bool
+		commands []string
+	}{
+		{"EXPUNGE", false, []string{
+			"SELECT INBOX",
+			// EXPUNGE is only safe if no other message is flagged
+			"UID SEARCH DELETED",
+			"UID STORE 5" + storeDeleted,
+			"UID STORE 4" + storeDeleted,
+			"UID STORE 2" + storeDeleted,
+			"EXPUNGE",
+		}},
+		{"UID EXPUNGE", true, []string{
+			"SELECT INBOX",
+			"UID STORE 5" + storeDeleted,
+			"UID STORE 4" + storeDeleted,
+			"UID STORE 2" + storeDeleted,
+			"UID EXPUNGE 2,4:5",
+		}},
+	} {
+		fake, groups := fiveMessages()
+		var c Client = fake
+		if test.uidPlus {
+			c = WithCapabilities(c, NewCapabilities(map[string]bool{"UIDPLUS": true}))
+		}
+		res, err := Apply(context.Background(), c, groups, ActionDelete, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := fake.Commands(); !reflect.DeepEqual(got, test.commands) {
+			t.Errorf("%s: got commands %q, want %q", test.name, got, test.commands)
+		}
+		if uids := fake.UIDs("INBOX"); !reflect.DeepEqual(uids, []uint32{1, 3}) {
+			t.Errorf("%s: got UIDs %v left", test.name, uids)
+		}
+		if res.Removed != 3 || !reflect.DeepEqual(res.Expunged["INBOX"], []uint32{5, 4, 2}) {
+			t.Errorf("%s: got result %+v", test.name, res)
+		}
+	}
+}
+
+func TestApplyGuards(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// prepare changes the mailbox or the groups after the scan
+		prepare  func(c *fakeimap.Client, groups []Group)
+		err      error
+		commands []string
+	}{
+		{
+			"UIDVALIDITY changed",
+			func(c *fakeimap.Client, groups []Group) { c.Mailboxes["INBOX"].UIDValidity = 2 },
+			ErrUIDValidityChanged,
+			[]string{"SELECT INBOX"},
+		},
+		{
+			"flagged by another client",
+			func(c *fakeimap.Client, groups []Group) {
+				c.Mailboxes["INBOX"].Messages[2].Flags = []string{imap.DeletedFlag}
+			},
+			ErrFullExpunge,
+			[]string{"SELECT INBOX", "UID SEARCH DELETED"},
+		},
+		{
+			"flagged by this run",
+			func(c *fakeimap.Client, groups []Group) {
+				c.Mailboxes["INBOX"].Messages[1].Flags = []string{imap.DeletedFlag}
+			},
+			nil,
+			[]string{
+				"SELECT INBOX",
+				"UID SEARCH DELETED",
+				"UID STORE 5" + storeDeleted,
+				"UID STORE 4" + storeDeleted,
+				"UID STORE 2" + storeDeleted,
+				"EXPUNGE",
+			},
+		},
+	} {
+		c, groups := fiveMessages()
+		test.prepare(c, groups)
+		_, err := Apply(context.Background(), c, groups, ActionDelete, nil)
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+		if got := c.Commands(); !reflect.DeepEqual(got, test.commands) {
+			t.Errorf("%s: got commands %q, want %q", test.name, got, test.commands)
+		}
+	}
+}
+
+func TestApplyMismatch(t *testing.T) {
+	c, groups := fiveMessages()
+	envA := Envelope{MessageID: "<a@example.org>", Subject: "A"}
+	envB := Envelope{MessageID: "<b@example.org>", Subject: "B"}
+	groups[0].Envelopes = map[uint32]Envelope{1: envA, 2: envA, 5: envA}
+	// the keeper of the second group is no longer the message scanned
+	groups[1].Envelopes = map[uint32]Envelope{3: {MessageID: "<c@example.org>", Subject: "C"}, 4: envB}
+	res, err := Apply(context.Background(), c, groups, ActionDelete, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uids := c.UIDs("INBOX"); !reflect.DeepEqual(uids, []uint32{1, 3, 4}) {
+		t.Errorf("got UIDs %v left", uids)
+	}
+	want := []Mismatch{{UID: 3, Keeper: true, Scanned: Envelope{MessageID: "<c@example.org>", Subject: "C"}, Found: envB}}
+	if !reflect.DeepEqual(res.Mismatched["INBOX"], want) || res.Removed != 2 {
+		t.Errorf("got result %+v", res)
+	}
+}
+
+func TestApplyStoreError(t *testing.T) {
+	c, groups := fiveMessages()
+	failure := errors.New("connection reset")
+	// SELECT, UID SEARCH, UID STORE 5, UID STORE 4
+	c.Errors = map[int]error{4: failure}
+	res, err := Apply(context.Background(), c, groups, ActionDelete, nil)
+	var e *Error
+	if !errors.As(err, &e) || e.Op != "store" || e.Set.String() != "4" || !errors.Is(err, failure) {
+		t.Errorf("got error %v", err)
+	}
+	// the message flagged is reported, nothing is expunged
+	if res.Removed != 0 || !reflect.DeepEqual(res.Flagged["INBOX"], []uint32{5}) {
+		t.Errorf("got result %+v", res)
+	}
+	if uids := c.UIDs("INBOX"); len(uids) != 5 {
+		t.Errorf("got UIDs %v left", uids)
+	}
+}
+
+// TestApplyOrder checks that duplicates are flagged from the highest UID
+// down whatever order the groups list them in, without reordering the
+// groups themselves.
+func TestApplyOrder(t *testing.T) {
+	c, _ := fiveMessages()
+	groups := []Group{
+		{Mailbox: "INBOX", Keeper: 3, Duplicates: []uint32{4}, UIDValidity: 1},
+		{Mailbox: "INBOX", Keeper: 1, Duplicates: []uint32{5, 2}, UIDValidity: 1},
+	}
+	if _, err := Apply(context.Background(), c, groups, ActionDelete, nil); err != nil {
+		t.Fatal(err)
+	}
+	var stored []string
+	for _, cmd := range c.Commands() {
+		if strings.HasPrefix(cmd, "UID STORE ") {
+			stored = append(stored, cmd)
+		}
+	}
+	want := []string{"UID STORE 5" + storeDeleted, "UID STORE 4" + storeDeleted, "UID STORE 2" + storeDeleted}
+	if !reflect.DeepEqual(stored, want) {
+		t.Errorf("got %q, want %q", stored, want)
+	}
+	if !reflect.DeepEqual(groups[0].Duplicates, []uint32{4}) || !reflect.DeepEqual(groups[1].Duplicates, []uint32{5, 2}) {
+		t.Errorf("got groups %+v after Apply", groups)
+	}
+}
@@ -0,0 +1,154 @@
+package dedup
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+	"github.com/tomasvitek/imap-clean-dup/seed"
+)
+
+// benchMailbox describes a mailbox scanned by the benchmarks.
+type benchMailbox struct {
+	messages int
+	ratio    float64
+	// size is the size of the bodies in bytes.
+	size int
+}
+
+func (m benchMailbox) String() string {
+	return fmt.Sprintf("%dk-dup%.0f%%-%dKiB", m.messages/1000, 100*m.ratio, m.size/1024)
+}
+
+var benchMailboxes = []benchMailbox{
+	{10000, 0.2, 1024},
+	{10000, 0.5, 1024},
+	{10000, 0.2, 16 * 1024},
+	{100000, 0.2, 1024},
+}
+
+// benchServer returns a server with the messages of m in INBOX, which
+// are generated by the seed package.
+func benchServer(b *testing.B, m benchMailbox) *imaptest.Server {
+	b.Helper()
+	if m.messages > 10000 && testing.Short() {
+		b.Skip("large mailbox in short mode")
+	}
+	s := imaptest.NewServer(b, imaptest.UIDPlus)
+	s.AppendSeed(b, "INBOX", seed.Generate(seed.Config{
+		Messages:       m.messages,
+		DuplicateRatio: m.ratio,
+		MinSize:        m.size,
+		MaxSize:        m.size,
+		Seed:           1,
+	}))
+	return s
+}
+
+// reportThroughput reports the messages processed per second, as the
+// msg/s of -timing.
+func reportThroughput(b *testing.B, messages int) {
+	b.ReportMetric(float64(messages)*float64(b.N)/b.Elapsed().Seconds(), "msg/s")
+}
+
+// BenchmarkScan scans each of benchMailboxes with each strategy. The
+// allocations reported include those of the server, which runs in the
+// same process.
+func BenchmarkScan(b *testing.B) {
+	for _, m := range benchMailboxes {
+		for _, strategy := range []Strategy{StrategyEnvelope, StrategyTiered} {
+			b.Run(fmt.Sprintf("%s/%s", m, strategy), func(b *testing.B) {
+				s := benchServer(b, m)
+				c := s.Dial(b)
+				cfg := Config{Strategy: strategy, ReadOnly: true}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := Scan(context.Background(), c, "INBOX", cfg); err != nil {
+						b.Fatal(err)
+					}
+				}
+				reportThroughput(b, m.messages)
+			})
+		}
+	}
+}
+
+func BenchmarkApply(b *testing.B) {
+	for _, m := range benchMailboxes[:2] {
+		b.Run(m.String(), func(b *testing.B) {
+			b.ReportAllocs()
+			removed := 0
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				s := benchServer(b, m)
+				c := WithCapabilities(s.Dial(b), NewCapabilities(map[string]bool{"UIDPLUS": true}))
+				groups, err := Scan(context.Background(), c, "INBOX", Config{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				res, err := Apply(context.Background(), c, groups, ActionDelete, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				removed += res.Removed
+			}
+			b.ReportMetric(float64(removed)/b.Elapsed().Seconds(), "msg/s")
+		})
+	}
+}
+
+// BenchmarkCandidates measures the memory the candidates of a scan take
+// per message, keyed by digests as Scan does and by the hex encoded
+// keys they replaced.
+func BenchmarkCandidates(b *testing.B) {
+	const messages = 100000
+	keys := make([][]byte, messages)
+	for i := range keys {
+		keys[i] = []byte("<" + strconv.Itoa(i) + ".1577836800@mail.example.org>")
+	}
+	b.Run("digest", func(b *testing.B) {
+		benchmarkRetained(b, messages, func() interface{} {
+			candidates := make(map[digest]candidate)
+			for i, key := range keys {
+				candidates[keyDigest(key)] = candidate{first: uint32(i + 1), size: 1}
+			}
+			return candidates
+		})
+	})
+	b.Run("hex", func(b *testing.B) {
+		benchmarkRetained(b, messages, func() interface{} {
+			candidates := make(map[string]candidate)
+			for i, key := range keys {
+				d := keyDigest(key)
+				candidates[hex.EncodeToString(d[:])] = candidate{first: uint32(i + 1), size: 1}
+			}
+			return candidates
+		})
+	})
+}
+
+// benchmarkRetained reports the heap build retains per message, for a
+// structure of the given number of messages.
+func benchmarkRetained(b *testing.B, messages int, build func() interface{}) {
+	b.ReportAllocs()
+	var retained uint64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		v := build()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(v)
+		if after.HeapAlloc > before.HeapAlloc {
+			retained += after.HeapAlloc - before.HeapAlloc
+		}
+	}
+	b.ReportMetric(float64(retained)/float64(b.N)/float64(messages), "B/msg")
+}
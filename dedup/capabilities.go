@@ -0,0 +1,111 @@
+package dedup
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// Capabilities are the optional extensions a server supports, as
+// advertised in its CAPABILITY response after login. The zero value
+// supports none, so features fall back to plain IMAP4rev1.
+type Capabilities struct {
+	// UIDPlus is UIDPLUS, RFC 4315: UID EXPUNGE removes only the given
+	// messages.
+	UIDPlus bool
+	// Move is MOVE, RFC 6851.
+	Move bool
+	// CondStore is CONDSTORE, RFC 7162.
+	CondStore bool
+	// GmailExt is X-GM-EXT-1, Gmail's labels and thread IDs.
+	GmailExt bool
+	// SpecialUse is SPECIAL-USE, RFC 6154: mailboxes flagged \Sent,
+	// \Trash and the like.
+	SpecialUse bool
+	// ID is ID, RFC 2971.
+	ID bool
+	// Quota is QUOTA, RFC 2087: GETQUOTAROOT reports the usage of the
+	// quota of a mailbox.
+	Quota bool
+
+	names []string
+}
+
+// NewCapabilities returns the capabilities of a server from the set
+// returned by (*client.Client).Capability.
+func NewCapabilities(caps map[string]bool) Capabilities {
+	var c Capabilities
+	for name, ok := range caps {
+		if ok {
+			c.names = append(c.names, strings.ToUpper(name))
+		}
+	}
+	sort.Strings(c.names)
+	c.UIDPlus = c.Has("UIDPLUS")
+	c.Move = c.Has("MOVE")
+	c.CondStore = c.Has("CONDSTORE")
+	c.GmailExt = c.Has("X-GM-EXT-1")
+	c.SpecialUse = c.Has("SPECIAL-USE")
+	c.ID = c.Has("ID")
+	c.Quota = c.Has("QUOTA")
+	return c
+}
+
+// Has reports whether the server advertised the capability name,
+// compared case-insensitively.
+func (c Capabilities) Has(name string) bool {
+	name = strings.ToUpper(name)
+	i := sort.SearchStrings(c.names, name)
+	return i < len(c.names) && c.names[i] == name
+}
+
+// Names returns all capabilities advertised, sorted.
+func (c Capabilities) Names() []string {
+	return append([]string(nil), c.names...)
+}
+
+// capable is a Client knowing the capabilities of its server.
+type capable interface {
+	Capabilities() Capabilities
+}
+
+// capableClient is a Client with the capabilities of its server.
+type capableClient struct {
+	Client
+	caps Capabilities
+}
+
+func (c *capableClient) Capabilities() Capabilities {
+	return c.caps
+}
+
+// WithCapabilities returns c with the capabilities of its server, which
+// Scan and Apply consult to use extensions where they are supported.
+// Without it a Client is assumed to support none.
+func WithCapabilities(c Client, caps Capabilities) Client {
+	return &capableClient{Client: c, caps: caps}
+}
+
+// capabilitiesOf returns the capabilities of the server of c, none if
+// they are unknown.
+func capabilitiesOf(c Client) Capabilities {
+	if cc, ok := c.(capable); ok {
+		return cc.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// uidExpunge issues UID EXPUNGE of UIDPLUS for seqset, sending the
+// sequence numbers expunged to ch and closing it, as Expunge does.
+func uidExpunge(c Client, seqset *imap.SeqSet, ch chan uint32) error {
+	defer close(ch)
+	cmd := &commands.Uid{Cmd: &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{seqset}}}
+	status, err := c.Execute(cmd, &responses.Expunge{SeqNums: ch})
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
@@ -0,0 +1,89 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// capabilitySets are the capabilities of a few representative servers
+// after login.
+var capabilitySets = []struct {
+	name string
+	caps map[string]bool
+	want Capabilities
+}{
+	{"IMAP4rev1 only", map[string]bool{"IMAP4rev1": true}, Capabilities{}},
+	{"Dovecot", map[string]bool{"IMAP4rev1": true, "UIDPLUS": true, "MOVE": true, "CONDSTORE": true, "SPECIAL-USE": true, "ID": true, "QUOTA": true, "IDLE": true},
+		Capabilities{UIDPlus: true, Move: true, CondStore: true, SpecialUse: true, ID: true, Quota: true}},
+	{"Gmail", map[string]bool{"IMAP4rev1": true, "UIDPLUS": true, "MOVE": true, "X-GM-EXT-1": true, "ID": true, "IDLE": true},
+		Capabilities{UIDPlus: true, Move: true, GmailExt: true, ID: true}},
+	{"lower case, withdrawn", map[string]bool{"imap4rev1": true, "uidplus": true, "quota": false}, Capabilities{UIDPlus: true}},
+}
+
+func TestNewCapabilities(t *testing.T) {
+	for _, set := range capabilitySets {
+		caps := NewCapabilities(set.caps)
+		names := caps.Names()
+		caps.names = nil
+		if !reflect.DeepEqual(caps, set.want) {
+			t.Errorf("%s: got %+v, want %+v", set.name, caps, set.want)
+		}
+		for i, name := range names {
+			if i > 0 && names[i-1] >= name {
+				t.Errorf("%s: names %v not sorted", set.name, names)
+			}
+			if !NewCapabilities(set.caps).Has(name) {
+				t.Errorf("%s: lacks %s", set.name, name)
+			}
+		}
+		if NewCapabilities(set.caps).Has("quota") != set.want.Quota {
+			t.Errorf("%s: Has(\"quota\") is not %v", set.name, set.want.Quota)
+		}
+	}
+}
+
+// TestCapabilitiesGating removes the duplicates of a mailbox where
+// another client flagged a message \Deleted, through each set, and
+// checks that UID EXPUNGE is used where the server has UIDPLUS and that
+// Apply otherwise refuses to expunge, unless told to remove the others
+// too.
+func TestCapabilitiesGating(t *testing.T) {
+	for _, set := range capabilitySets {
+		for _, action := range []Action{ActionDelete, ActionDeleteExpungeAll} {
+			fake, groups := fiveMessages()
+			fake.Mailboxes["INBOX"].Messages[2].Flags = []string{imap.DeletedFlag}
+			// the capabilities reach Apply through the retries
+			c := &RetryClient{Client: WithCapabilities(fake, NewCapabilities(set.caps))}
+			if got := capabilitiesOf(c).UIDPlus; got != set.want.UIDPlus {
+				t.Errorf("%s: UIDPLUS is %v through the retries", set.name, got)
+			}
+			res, err := Apply(context.Background(), c, groups, action, nil)
+			commands := fake.Commands()
+			last := commands[len(commands)-1]
+			switch {
+			case set.want.UIDPlus:
+				if err != nil || last != "UID EXPUNGE 2,4:5" {
+					t.Errorf("%s, action %v: got error %v, commands %q", set.name, action, err, commands)
+				}
+			case action == ActionDelete:
+				if !errors.Is(err, ErrFullExpunge) || res.Removed != 0 {
+					t.Errorf("%s, action %v: got error %v, %d removed", set.name, action, err, res.Removed)
+				}
+			default:
+				if err != nil || last != "EXPUNGE" || res.FullExpunged["INBOX"] != 1 {
+					t.Errorf("%s, action %v: got error %v, commands %q, result %+v", set.name, action, err, commands, res)
+				}
+			}
+		}
+	}
+
+	// a Client without capabilities supports none
+	fake, _ := fiveMessages()
+	if caps := capabilitiesOf(fake); !reflect.DeepEqual(caps, Capabilities{}) {
+		t.Errorf("got capabilities %+v", caps)
+	}
+}
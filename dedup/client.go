@@ -0,0 +1,27 @@
+package dedup
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+)
+
+// Client is the part of an IMAP client used by this package. It is
+// satisfied by *client.Client and allows scans and removals to run
+// against other implementations, such as scripted ones in tests.
+//
+// As with *client.Client, Fetch and UidFetch must close ch when they
+// return, whether they failed or not. Execute issues commands go-imap
+// has no method for, such as UID EXPUNGE.
+type Client interface {
+	Select(name string, readOnly bool) (*imap.MailboxStatus, error)
+	Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error
+	UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error
+	UidSearch(criteria *imap.SearchCriteria) ([]uint32, error)
+	UidStore(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error
+	Expunge(ch chan uint32) error
+	Noop() error
+	Execute(cmd imap.Commander, h responses.Handler) (*imap.StatusResp, error)
+}
+
+var _ Client = (*client.Client)(nil)
@@ -0,0 +1,152 @@
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Comparison is the number of duplicates one way of keying messages
+// finds in a mailbox.
+type Comparison struct {
+	// Strategy names the way of keying: message-id, envelope-hash,
+	// body-hash or tiered.
+	Strategy string
+	// Duplicates is the number of messages which would be removed.
+	Duplicates int
+	// Groups is the number of messages with duplicates.
+	Groups int
+}
+
+// comparedStrategies are the ways of keying Compare reports, in order.
+var comparedStrategies = []string{"message-id", "envelope-hash", "body-hash", "tiered"}
+
+// Compare fetches the envelopes and bodies of mbox once and reports
+// how many duplicates each way of keying would find in them:
+// message-id keys by Message-ID and by envelope hash without one, as
+// StrategyEnvelope does, envelope-hash always by envelope hash, as with
+// IgnoreMessageID, body-hash by the body alone and tiered by the
+// message-id key confirmed by the body, as StrategyTiered does. The
+// envelope hash, BodyBytes, MinGroupSize and the UID range follow
+// cfg, while IgnoreMessageID, KeyTemplate, RawHeader, Strategy, Scope, MaxDups and
+// PerSenderCap are left out. The mailbox is examined read-only and
+// nothing is removed. Messages without a body are only counted by the
+// keys not using it.
+func Compare(ctx context.Context, c Client, mbox string, cfg Config) ([]Comparison, error) {
+	cfg = cfg.withDefaults()
+	cfg.IgnoreMessageID = false
+	cfg.KeyTemplate = nil
+	cfg.RawHeader = false
+	cfg.Scope = ScopeMailbox
+	metrics := cfg.Metrics
+	if ctx.Err() != nil {
+		return nil, canceled(ctx, mbox, PhaseSelect)
+	}
+	done := metrics.Track(mbox, PhaseSelect)
+	st, err := c.Select(mbox, true)
+	done(1, 0)
+	if err != nil {
+		return nil, selectError(mbox, err)
+	}
+	deleted, err := deletedUIDs(c, st, cfg)
+	if err != nil {
+		return nil, err
+	}
+	windows, _, err := scanWindows(c, st, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.TextSpecifier}, Peek: true}
+	if cfg.BodyBytes > 0 {
+		section.Partial = []int{0, cfg.BodyBytes}
+	}
+	items := append(keyFetchItems(cfg), section.FetchItem())
+	byID := newEnvelopeHasher(cfg)
+	envCfg := cfg
+	envCfg.IgnoreMessageID = true
+	byEnvelope := newEnvelopeHasher(envCfg)
+
+	counts := make([]map[digest]int, len(comparedStrategies))
+	for i := range counts {
+		counts[i] = make(map[digest]int)
+	}
+	seen := make(map[uint32]bool)
+	for _, w := range windows {
+		if ctx.Err() != nil {
+			return nil, canceled(ctx, mbox, PhaseFetch)
+		}
+		msgChan := make(chan *imap.Message, cfg.FetchBuffer)
+		errChan := make(chan error, 1)
+		fetchStart, fetchBytes := time.Now(), metrics.Bytes()
+		go func(w window) {
+			if w.uid {
+				errChan <- c.UidFetch(w.seqset, items, msgChan)
+			} else {
+				errChan <- c.Fetch(w.seqset, items, msgChan)
+			}
+		}(w)
+		n := 0
+		for msg := range msgChan {
+			if ctx.Err() != nil || seen[msg.Uid] || msg.Envelope == nil {
+				continue
+			}
+			seen[msg.Uid] = true
+			if _, ok := deleted[msg.Uid]; ok {
+				continue
+			}
+			if st.UidNext != 0 && msg.Uid >= st.UidNext {
+				continue
+			}
+			n++
+			id, _, _ := byID.Digest(msg)
+			env, _, _ := byEnvelope.Digest(msg)
+			counts[0][id]++
+			counts[1][env]++
+			body := msg.GetBody(section)
+			if body == nil {
+				continue
+			}
+			hash := sha256.New()
+			if cfg.BodyBytes > 0 {
+				fmt.Fprintf(hash, "size:%d\n", msg.Size)
+			}
+			if _, err := io.Copy(hash, body); err != nil {
+				continue
+			}
+			var sum digest
+			copy(sum[:], hash.Sum(nil))
+			counts[2][sum]++
+			counts[3][keyDigest(append(id[:], sum[:]...))]++
+		}
+		err := <-errChan
+		metrics.Add(mbox, PhaseFetch, PhaseStats{
+			Duration: time.Since(fetchStart),
+			Bytes:    metrics.Bytes() - fetchBytes,
+			Commands: 1,
+			Messages: n,
+		})
+		if err != nil {
+			return nil, &Error{Op: "fetch", Mailbox: mbox, Set: w.seqset, SeqNums: !w.uid, Err: err}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, canceled(ctx, mbox, PhaseFetch)
+	}
+
+	results := make([]Comparison, len(comparedStrategies))
+	for i, name := range comparedStrategies {
+		results[i].Strategy = name
+		for _, n := range counts[i] {
+			if n >= cfg.MinGroupSize {
+				results[i].Duplicates += n - 1
+				results[i].Groups++
+			}
+		}
+	}
+	return results, nil
+}
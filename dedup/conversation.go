@@ -0,0 +1,135 @@
+package dedup
+
+import (
+	"bufio"
+	"fmt"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// Scope is the set of messages copies are looked for in.
+type Scope string
+
+const (
+	// ScopeMailbox groups copies anywhere in the mailbox.
+	ScopeMailbox Scope = "mailbox"
+	// ScopeConversation only groups copies within the same
+	// conversation, the messages connected by their Message-ID,
+	// In-Reply-To and References headers. Copies with the same
+	// Message-ID are always in the same conversation, so the scope
+	// only makes a difference for envelope hash or KeyTemplate keys.
+	ScopeConversation Scope = "conversation"
+)
+
+// referencesSection fetches the References header of a message.
+var referencesSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"References"}},
+	Peek:         true,
+}
+
+// threadMessage is a keyed message of a ScopeConversation scan.
+type threadMessage struct {
+	uid uint32
+	key digest
+	id  string
+}
+
+// conversations is the reference graph of the messages of a mailbox,
+// a union-find of message IDs. Messages without a Message-ID get an ID
+// of their own from their UID.
+type conversations struct {
+	parent map[string]string
+	msgs   []threadMessage
+}
+
+func newConversations() *conversations {
+	return &conversations{parent: make(map[string]string)}
+}
+
+// add records msg with its key, joining it with the messages it
+// refers to. It must be called in fetch order.
+func (cs *conversations) add(msg *imap.Message, key digest) {
+	id := msg.Envelope.MessageId
+	if id == "" {
+		id = fmt.Sprintf("uid:%d", msg.Uid)
+	}
+	cs.msgs = append(cs.msgs, threadMessage{msg.Uid, key, id})
+	cs.root(id)
+	for _, ref := range messageIDs(msg.Envelope.InReplyTo + " " + references(msg)) {
+		cs.union(id, ref)
+	}
+}
+
+// root returns the representative ID of the conversation of id.
+func (cs *conversations) root(id string) string {
+	p, ok := cs.parent[id]
+	if !ok {
+		cs.parent[id] = id
+		return id
+	}
+	if p == id {
+		return id
+	}
+	r := cs.root(p)
+	cs.parent[id] = r
+	return r
+}
+
+func (cs *conversations) union(a, b string) {
+	ra, rb := cs.root(a), cs.root(b)
+	if ra != rb {
+		cs.parent[rb] = ra
+	}
+}
+
+// split regroups the recorded messages by key within each
+// conversation, returning the candidates and duplicates Scan would
+// have found had the key included the conversation.
+func (cs *conversations) split() (map[digest]candidate, []uint32, []digest) {
+	candidates := make(map[digest]candidate)
+	var dups []uint32
+	var dupKeys []digest
+	var buf []byte
+	for _, m := range cs.msgs {
+		buf = append(append(buf[:0], m.key[:]...), cs.root(m.id)...)
+		key := keyDigest(buf)
+		g, found := candidates[key]
+		if !found {
+			g.first = m.uid
+		}
+		g.size++
+		candidates[key] = g
+		if found {
+			dups = append(dups, m.uid)
+			dupKeys = append(dupKeys, key)
+		}
+	}
+	return candidates, dups, dupKeys
+}
+
+// messageIDs returns the message IDs, such as <a@example.org>, of a
+// References or In-Reply-To header.
+func messageIDs(s string) []string {
+	var ids []string
+	for _, f := range strings.Fields(s) {
+		if strings.HasPrefix(f, "<") && strings.HasSuffix(f, ">") {
+			ids = append(ids, f)
+		}
+	}
+	return ids
+}
+
+// references returns the References header of msg if it was fetched.
+func references(msg *imap.Message) string {
+	body := msg.GetBody(referencesSection)
+	if body == nil {
+		return ""
+	}
+	header, err := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ""
+	}
+	return header.Get("References")
+}
@@ -0,0 +1,825 @@
+// Package dedup finds and removes duplicate messages in IMAP
+// mailboxes.
+//
+// Scan fetches the envelopes of a mailbox and groups messages sharing
+// a Message-ID, or an envelope hash for messages without one. Apply
+// acts on the duplicates of such groups. The package never prints
+// anything itself, progress is reported through Config.Progress.
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Config controls how Scan detects duplicates. The zero value compares
+// Message-IDs with a single hash worker.
+type Config struct {
+	// IgnoreMessageID makes every message keyed by its envelope hash.
+	IgnoreMessageID bool
+	// IgnoreFields are the address fields left out of the envelope hash.
+	IgnoreFields AddressField
+	// NormalizeSubject makes the envelope hash ignore case, whitespace
+	// and reply or forward markers of the subject.
+	NormalizeSubject bool
+	// DateWindow makes the envelope hash treat dates within the same
+	// window as equal.
+	DateWindow time.Duration
+	// ListID adds the List-Id header to the envelope hash.
+	ListID bool
+	// AttachmentNames adds the file names and sizes of the attachments
+	// to every key, taken from the BODYSTRUCTURE without fetching any
+	// attachment. Copies with a different version of an attachment
+	// are then kept apart, far cheaper than comparing bodies.
+	AttachmentNames bool
+	// KeySize adds the RFC822.SIZE of the message to every key, so
+	// that copies with the same envelope but a different size, such
+	// as one with an attachment stripped, are kept apart without
+	// fetching bodies. Servers may count sizes differently, so it is
+	// of little use across servers.
+	KeySize bool
+	// ScopeBySender adds the first From address of a message to keys
+	// not derived from its Message-ID, so that identical messages
+	// without a Message-ID from different senders, such as automated
+	// notifications, are never taken as duplicates of each other. It
+	// also holds with FieldFrom in IgnoreFields, a KeyTemplate or
+	// RawHeader. Messages keyed by Message-ID are not affected.
+	ScopeBySender bool
+	// MinGroupSize is the number of copies a message needs before
+	// its duplicates are returned for removal.
+	MinGroupSize int
+	// MinWastedBytes leaves out the groups whose duplicates take less
+	// than this many bytes together, by RFC822.SIZE, so that only the
+	// cleanups freeing noticeable space are returned. 0 returns all.
+	MinWastedBytes int64
+	// Strategy selects how duplicates are confirmed.
+	Strategy Strategy
+	// FetchBuffer is the number of fetched messages buffered ahead
+	// of the key calculation.
+	FetchBuffer int
+	// BodyBytes limits the body comparison of StrategyTiered to the
+	// first BodyBytes bytes of the body together with the message
+	// size, 0 compares whole bodies. This is far faster on messages
+	// with large attachments, but copies differing only after the
+	// first BodyBytes bytes while having the same size are taken as
+	// duplicates.
+	BodyBytes int
+	// HashWorkers is the number of goroutines calculating keys.
+	HashWorkers int
+	// FetchChunk is the number of messages fetched per command, 0
+	// fetches the whole mailbox at once.
+	FetchChunk int
+	// MaxDups stops the scan between chunks once this many
+	// duplicates were found, 0 scans the whole mailbox.
+	MaxDups int
+	// UIDFrom and UIDTo bound the UIDs of the scanned messages,
+	// inclusively. 0 leaves the range open on that side.
+	UIDFrom, UIDTo uint32
+	// Limit scans only the first Limit messages in UID order, of the
+	// UID range if one is set, 0 scans all. Keepers and duplicates
+	// are then only found among them.
+	Limit int
+	// NoopInterval issues a NOOP between chunks once this long passed
+	// since the scan started or the last NOOP, so that servers and
+	// proxies with idle timers keep the connection during long scans.
+	// As the NOOP can only be sent between chunks, FetchChunk defaults
+	// to KeepAliveChunk if it is set.
+	NoopInterval time.Duration
+	// RawHeader replaces the Message-ID and envelope hash keys by the
+	// hash of the whole header as fetched, without the fields matching
+	// VolatileHeaders. Copies differing only in transport headers then
+	// share a key, without fetching any body.
+	RawHeader bool
+	// VolatileHeaders are the header names left out with RawHeader,
+	// compared case-insensitively, with a trailing * matching any
+	// rest. DefaultVolatileHeaders is used if it is nil.
+	VolatileHeaders []string
+	// IgnoreResentHeaders leaves the Resent-* headers out with
+	// RawHeader as well, so that a message redistributed by a list or
+	// a forwarding rule is a copy of the original. The other keys never
+	// include them.
+	IgnoreResentHeaders bool
+	// KeyTemplate replaces the Message-ID and envelope hash keys by
+	// the output of the template executed on the KeyData of each
+	// message. Messages it fails for are kept.
+	KeyTemplate *template.Template
+	// PerSenderCap keeps at most this many messages of each sender,
+	// by the first From address, removing the older ones, 0 keeps
+	// all. It is applied last: messages removed as duplicates, which
+	// are subject to MinGroupSize and MaxDups, do not count towards
+	// it, while every other message does, including duplicates kept
+	// below MinGroupSize or beyond MaxDups. The messages it removes
+	// are returned as one group per sender with Sender set.
+	PerSenderCap int
+	// Keep selects the copy of each group which is kept, KeepFirst by
+	// default.
+	Keep Keep
+	// Scope limits where copies are looked for, ScopeMailbox by
+	// default. With ScopeConversation the References header is
+	// fetched too and the grouping is only known once the whole
+	// mailbox was fetched, so events report copies of other
+	// conversations as Duplicate and MaxDups counts them while
+	// fetching.
+	Scope Scope
+	// ReadOnly makes Scan select the mailbox with EXAMINE, which
+	// leaves \Recent alone and works on mailboxes shared read-only.
+	// Set it if the duplicates are not removed afterwards; Apply
+	// selects the mailbox read-write itself.
+	ReadOnly bool
+	// RecordEnvelopes records the Message-ID and subject of the
+	// keeper and duplicates of each group in Group.Envelopes, which
+	// Apply checks before removing anything. This guards against
+	// removing the wrong messages when some time passes between scan
+	// and removal, at the cost of fetching the envelopes of the groups
+	// once more after the scan and a FETCH ENVELOPE before removal.
+	RecordEnvelopes bool
+	// RecordSizes records the RFC822.SIZE of the keeper and duplicates
+	// of each group in Group.Sizes, e.g. to report the space freed.
+	RecordSizes bool
+
+	// Metrics records timing, traffic and command counts if set.
+	Metrics *Metrics
+	// Progress is called for every event of a scan if set.
+	Progress func(Event)
+}
+
+// withDefaults replaces unset values of cfg by their defaults.
+func (cfg Config) withDefaults() Config {
+	if cfg.MinGroupSize < 2 {
+		cfg.MinGroupSize = 2
+	}
+	if cfg.HashWorkers < 1 {
+		cfg.HashWorkers = 1
+	}
+	if cfg.Strategy == "" {
+		cfg.Strategy = StrategyEnvelope
+	}
+	if cfg.Keep == "" {
+		cfg.Keep = KeepFirst
+	}
+	if cfg.Scope == "" {
+		cfg.Scope = ScopeMailbox
+	}
+	if cfg.NoopInterval > 0 && cfg.FetchChunk <= 0 {
+		cfg.FetchChunk = KeepAliveChunk
+	}
+	if cfg.IgnoreResentHeaders {
+		volatile := cfg.VolatileHeaders
+		if volatile == nil {
+			volatile = DefaultVolatileHeaders
+		}
+		cfg.VolatileHeaders = append(volatile[:len(volatile):len(volatile)], "Resent-*")
+	}
+	return cfg
+}
+
+// KeepAliveChunk is the FetchChunk used with a NoopInterval if none is
+// set.
+const KeepAliveChunk = 1000
+
+func (cfg Config) progress(e Event) {
+	if cfg.Progress != nil {
+		cfg.Progress(e)
+	}
+}
+
+// Strategy is a way of detecting duplicates.
+type Strategy string
+
+const (
+	// StrategyEnvelope compares Message-IDs, or envelope hashes for
+	// messages without one.
+	StrategyEnvelope Strategy = "envelope"
+	// StrategyTiered confirms envelope duplicates by their body.
+	StrategyTiered Strategy = "tiered"
+)
+
+// EventKind tells what an Event reports.
+type EventKind int
+
+const (
+	// EventSelected reports the selected mailbox in Status.
+	EventSelected EventKind = iota
+	// EventMessage reports a scanned message. Duplicate is set if its
+	// key was seen before, under StrategyTiered it is only a candidate
+	// until confirmed.
+	EventMessage
+	// EventConfirmed reports a candidate whose body matches.
+	EventConfirmed
+	// EventBodyMismatch reports a candidate kept as its body differs.
+	EventBodyMismatch
+	// EventBodyMissing reports a candidate kept as its body could not
+	// be fetched.
+	EventBodyMissing
+	// EventBelowThreshold reports Count duplicates kept as their
+	// groups have less than MinGroupSize copies.
+	EventBelowThreshold
+	// EventTruncated reports that the scan stopped after Count of
+	// Total messages as MaxDups duplicates were found.
+	EventTruncated
+	// EventKeyError reports a message kept as the KeyTemplate failed
+	// for it with Err.
+	EventKeyError
+	// EventRepeatedUID reports a UID the server returned again in the
+	// same scan, which is skipped.
+	EventRepeatedUID
+	// EventNoEnvelope reports a message the server returned without an
+	// envelope, which is skipped and never removed.
+	EventNoEnvelope
+	// EventKeeper reports that UID of Size bytes is kept instead of
+	// the first copy, the UID given as Count, as Keep asks.
+	EventKeeper
+	// EventSenderCapped reports that Count of the Total messages kept
+	// of sender From exceed PerSenderCap and are removed.
+	EventSenderCapped
+	// EventEmpty reports that the mailbox has no messages, or only
+	// Count flagged \Deleted, so nothing is fetched.
+	EventEmpty
+	// EventNewer reports Count messages at or above the UIDNEXT the
+	// mailbox was selected with, which arrived during the scan and
+	// were ignored.
+	EventNewer
+	// EventLimited reports that only the first Count of Total messages
+	// are scanned, as Limit asks.
+	EventLimited
+	// EventBelowBytes reports Count duplicates in Total groups kept as
+	// they take less than MinWastedBytes per group.
+	EventBelowBytes
+)
+
+// Event reports the progress of a scan.
+type Event struct {
+	Kind    EventKind
+	Mailbox string
+	Status  *imap.MailboxStatus
+	UID     uint32
+	Subject string
+	// Date, From and Size describe the message of an EventMessage.
+	// From is the first sender as mailbox@host.
+	Date time.Time
+	From string
+	Size uint32
+	// Key is the Message-ID of the message, or its hex encoded key
+	// digest if the envelope hash was used.
+	Key       string
+	Duplicate bool
+	Count     int
+	Total     int
+	Err       error
+}
+
+// Group is a message and its duplicates in one mailbox.
+type Group struct {
+	Mailbox string
+	// Key is the hex encoded key digest shared by the messages.
+	Key string
+	// HashVersion is the scheme of envelope hash keys which produced
+	// Key.
+	HashVersion int
+	// Keeper is the UID of the copy which is kept, the first one
+	// unless Config.Keep selects another.
+	Keeper uint32
+	// KeeperMailbox is the mailbox of Keeper if it is not Mailbox, as
+	// for groups returned by Reconcile, or the mailbox on the other
+	// server for those of DiffInventories.
+	KeeperMailbox string
+	// Duplicates are the UIDs of the other copies in UID order.
+	Duplicates []uint32
+	// UIDValidity is the UIDVALIDITY of Mailbox when it was scanned.
+	// Apply refuses to act on the UIDs if it changed, 0 skips the
+	// check.
+	UIDValidity uint32
+	// Strategy is how the copies were matched. It is empty for groups
+	// of Config.PerSenderCap, whose messages are not copies.
+	Strategy Strategy
+	// Sender is set for groups removing the messages of a sender
+	// beyond Config.PerSenderCap. Duplicates are then the older
+	// messages of the sender rather than copies, and Keeper is its
+	// newest one. A message removed so may be the Keeper of another
+	// group.
+	Sender string
+	// Envelopes are the envelopes of Keeper and Duplicates as scanned,
+	// by UID, if Config.RecordEnvelopes was set. Apply then leaves
+	// duplicates alone whose envelope or whose keeper's changed, nil
+	// skips the check.
+	Envelopes map[uint32]Envelope
+	// Sizes are the sizes of Keeper and Duplicates by UID, if
+	// Config.RecordSizes was set.
+	Sizes map[uint32]uint32
+}
+
+// DuplicateUIDs returns the UIDs of the duplicates of groups in mbox,
+// sorted and each once, as removed by Apply.
+func DuplicateUIDs(groups []Group, mbox string) []uint32 {
+	seen := make(map[uint32]bool)
+	var uids []uint32
+	for _, g := range groups {
+		if g.Mailbox != mbox {
+			continue
+		}
+		for _, uid := range g.Duplicates {
+			if !seen[uid] {
+				seen[uid] = true
+				uids = append(uids, uid)
+			}
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+// Count returns the number of duplicates in groups.
+func Count(groups []Group) int {
+	n := 0
+	for _, g := range groups {
+		n += len(g.Duplicates)
+	}
+	return n
+}
+
+// digest is a truncated SHA-256 of a message key.
+type digest [16]byte
+
+// candidate is a group of messages sharing a key.
+type candidate struct {
+	first uint32
+	size  uint32
+}
+
+func keyDigest(key []byte) (d digest) {
+	sum := sha256.Sum256(key)
+	copy(d[:], sum[:])
+	return d
+}
+
+// Scan selects mbox and returns its groups of duplicates. Groups with
+// less than cfg.MinGroupSize copies are left out. With
+// cfg.PerSenderCap the groups of messages beyond the cap follow.
+//
+// Messages flagged \Deleted are about to be expunged and ignored, they
+// are neither kept nor removed as duplicates. A mailbox without any
+// other messages is not fetched at all. So are messages arriving during
+// the scan, with UIDs from the UIDNEXT of the SELECT response on, so
+// that the scan covers the mailbox as it was selected.
+//
+// Once ctx is done no further commands are issued, a fetch in flight is
+// drained and Scan returns ctx.Err() wrapped with the phase it stopped
+// in and, while fetching, the window of messages not fetched in full.
+func Scan(ctx context.Context, c Client, mbox string, cfg Config) (groups []Group, err error) {
+	cfg = cfg.withDefaults()
+	metrics := cfg.Metrics
+	if ctx.Err() != nil {
+		return nil, canceled(ctx, mbox, PhaseSelect)
+	}
+	done := metrics.Track(mbox, PhaseSelect)
+	st, err := c.Select(mbox, cfg.ReadOnly)
+	done(1, 0)
+	if err != nil {
+		return nil, selectError(mbox, err)
+	}
+	cfg.progress(Event{Kind: EventSelected, Mailbox: mbox, Status: st})
+	deleted, err := deletedUIDs(c, st, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if int(st.Messages) == len(deleted) {
+		cfg.progress(Event{Kind: EventEmpty, Mailbox: mbox, Count: len(deleted)})
+		return nil, nil
+	}
+
+	// candidates tracks the copies of each message, dupKeys holds the
+	// key of each entry in dups. Keys are fixed size digests so that
+	// memory stays bounded on mailboxes with millions of messages.
+	candidates := make(map[digest]candidate)
+	// seen guards against servers returning a UID more than once,
+	// which would otherwise make it a duplicate of itself
+	seen := make(map[uint32]struct{})
+	var senders senderMessages
+	if cfg.PerSenderCap > 0 {
+		senders = make(senderMessages)
+	}
+	var threads *conversations
+	if cfg.Scope == ScopeConversation {
+		threads = newConversations()
+	}
+	var dups []uint32
+	var dupKeys []digest
+
+	windows, total, err := scanWindows(c, st, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, canceled(ctx, mbox, PhaseSelect)
+	}
+
+	fetched, truncated, newer := 0, false, 0
+	lastNoop := time.Now()
+	for _, w := range windows {
+		if ctx.Err() != nil {
+			return nil, canceledIn(ctx, mbox, PhaseFetch, w)
+		}
+		if cfg.MaxDups > 0 && len(dups) >= cfg.MaxDups {
+			truncated = true
+			break
+		}
+		if cfg.NoopInterval > 0 && time.Since(lastNoop) >= cfg.NoopInterval {
+			done := metrics.Track(mbox, PhaseFetch)
+			err = c.Noop()
+			done(1, 0)
+			if err != nil {
+				return nil, &Error{Op: "noop", Mailbox: mbox, Err: err}
+			}
+			lastNoop = time.Now()
+		}
+
+		var n int
+		n, err = fetchWindow(ctx, c, mbox, w, cfg, func(k keyed) {
+			msg, key := k.msg, k.key
+			if _, ok := seen[msg.Uid]; ok {
+				cfg.progress(Event{Kind: EventRepeatedUID, Mailbox: mbox, UID: msg.Uid})
+				return
+			}
+			seen[msg.Uid] = struct{}{}
+			if _, ok := deleted[msg.Uid]; ok {
+				return
+			}
+			if st.UidNext != 0 && msg.Uid >= st.UidNext {
+				newer++
+				return
+			}
+			if k.err == errNoEnvelope {
+				cfg.progress(Event{Kind: EventNoEnvelope, Mailbox: mbox, UID: msg.Uid, Size: msg.Size})
+				return
+			}
+			if k.err != nil {
+				cfg.progress(Event{Kind: EventKeyError, Mailbox: mbox, UID: msg.Uid, Subject: msg.Envelope.Subject, Err: k.err})
+				return
+			}
+
+			senders.add(msg)
+			if threads != nil {
+				threads.add(msg, key)
+			}
+			g, found := candidates[key]
+			if !found {
+				g.first = msg.Uid
+			}
+			g.size++
+			candidates[key] = g
+			if found {
+				dups = append(dups, msg.Uid)
+				dupKeys = append(dupKeys, key)
+			}
+
+			// without a callback skip building the event, this is the
+			// hot path on large mailboxes
+			if cfg.Progress == nil {
+				return
+			}
+			messageID := msg.Envelope.MessageId
+			if k.hashed {
+				messageID = fmt.Sprintf("%x", key)
+			}
+			var from string
+			if addrs := msg.Envelope.From; len(addrs) > 0 {
+				from = addrs[0].MailboxName + "@" + addrs[0].HostName
+			}
+			cfg.progress(Event{
+				Kind:      EventMessage,
+				Mailbox:   mbox,
+				UID:       msg.Uid,
+				Subject:   msg.Envelope.Subject,
+				Date:      msg.Envelope.Date,
+				From:      from,
+				Size:      msg.Size,
+				Key:       messageID,
+				Duplicate: found,
+			})
+		})
+		fetched += n
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if newer > 0 {
+		cfg.progress(Event{Kind: EventNewer, Mailbox: mbox, Count: newer})
+	}
+	if threads != nil {
+		candidates, dups, dupKeys = threads.split()
+	}
+
+	if cfg.Strategy == StrategyTiered {
+		dups, dupKeys, candidates, err = confirmByBody(ctx, c, mbox, candidates, dups, dupKeys, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// keep the duplicates of groups below the threshold
+	kept := 0
+	uids, keys := dups[:0], dupKeys[:0]
+	for i, uid := range dups {
+		if int(candidates[dupKeys[i]].size) < cfg.MinGroupSize {
+			kept++
+			continue
+		}
+		uids, keys = append(uids, uid), append(keys, dupKeys[i])
+	}
+	if kept > 0 {
+		cfg.progress(Event{Kind: EventBelowThreshold, Mailbox: mbox, Count: kept})
+	}
+	if cfg.MaxDups > 0 && len(uids) > cfg.MaxDups {
+		uids, keys = uids[:cfg.MaxDups], keys[:cfg.MaxDups]
+	}
+	if truncated {
+		cfg.progress(Event{Kind: EventTruncated, Mailbox: mbox, Count: fetched, Total: total})
+	}
+
+	index := make(map[digest]int)
+	for i, uid := range uids {
+		j, ok := index[keys[i]]
+		if !ok {
+			j = len(groups)
+			index[keys[i]] = j
+			groups = append(groups, Group{
+				Mailbox:     mbox,
+				Key:         fmt.Sprintf("%x", keys[i]),
+				HashVersion: HashVersion,
+				Keeper:      candidates[keys[i]].first,
+				Strategy:    cfg.Strategy,
+			})
+		}
+		groups[j].Duplicates = append(groups[j].Duplicates, uid)
+	}
+	// sizes and envelopes are only fetched for the messages of groups
+	// rather than kept for every message scanned
+	d := details{sizes: make(map[uint32]uint32), envelopes: make(map[uint32]Envelope)}
+	if cfg.Keep != KeepFirst || cfg.MinWastedBytes > 0 || cfg.RecordSizes || cfg.RecordEnvelopes {
+		if err := d.fetch(ctx, c, mbox, groups, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Keep != KeepFirst {
+		keepBySize(groups, d.sizes, cfg)
+	}
+	if cfg.MinWastedBytes > 0 {
+		groups = dropSmall(mbox, groups, d.sizes, cfg)
+	}
+	if cfg.PerSenderCap > 0 {
+		capped := capPerSender(mbox, senders, groups, cfg)
+		if cfg.RecordSizes || cfg.RecordEnvelopes {
+			if err := d.fetch(ctx, c, mbox, capped, cfg); err != nil {
+				return nil, err
+			}
+		}
+		groups = append(groups, capped...)
+	}
+	for i := range groups {
+		g := &groups[i]
+		g.UIDValidity = st.UidValidity
+		if cfg.RecordSizes {
+			g.Sizes = make(map[uint32]uint32)
+		}
+		if cfg.RecordEnvelopes {
+			g.Envelopes = make(map[uint32]Envelope)
+		}
+		for _, uid := range append([]uint32{g.Keeper}, g.Duplicates...) {
+			if size, ok := d.sizes[uid]; ok && g.Sizes != nil {
+				g.Sizes[uid] = size
+			}
+			if env, ok := d.envelopes[uid]; ok && g.Envelopes != nil {
+				g.Envelopes[uid] = env
+			}
+		}
+	}
+	return groups, nil
+}
+
+// details are the sizes and envelopes of the messages of groups.
+type details struct {
+	sizes     map[uint32]uint32
+	envelopes map[uint32]Envelope
+}
+
+// fetch fetches the sizes and, with cfg.RecordEnvelopes, the envelopes
+// of the keepers and duplicates of groups not fetched before. Messages
+// gone since the scan are left out.
+func (d details) fetch(ctx context.Context, c Client, mbox string, groups []Group, cfg Config) error {
+	set := &imap.SeqSet{}
+	for _, g := range groups {
+		for _, uid := range append([]uint32{g.Keeper}, g.Duplicates...) {
+			if _, ok := d.sizes[uid]; !ok {
+				set.AddNum(uid)
+			}
+		}
+	}
+	if set.Empty() {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return canceled(ctx, mbox, PhaseFetch)
+	}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}
+	if cfg.RecordEnvelopes {
+		items = append(items, imap.FetchEnvelope)
+	}
+	return fetchMessages(c, mbox, set, items, cfg.Metrics, func(msg *imap.Message) {
+		d.sizes[msg.Uid] = msg.Size
+		if cfg.RecordEnvelopes && msg.Envelope != nil {
+			d.envelopes[msg.Uid] = Envelope{MessageID: msg.Envelope.MessageId, Subject: msg.Envelope.Subject}
+		}
+	})
+}
+
+// deletedUIDs returns the UIDs of the messages of the selected mailbox
+// flagged \Deleted. An empty mailbox is not searched.
+func deletedUIDs(c Client, st *imap.MailboxStatus, cfg Config) (map[uint32]struct{}, error) {
+	if st.Messages == 0 {
+		return nil, nil
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.DeletedFlag}
+	done := cfg.Metrics.Track(st.Name, PhaseSelect)
+	uids, err := c.UidSearch(criteria)
+	done(1, len(uids))
+	if err != nil {
+		return nil, &Error{Op: "search", Mailbox: st.Name, Err: err}
+	}
+	deleted := make(map[uint32]struct{}, len(uids))
+	for _, uid := range uids {
+		deleted[uid] = struct{}{}
+	}
+	return deleted, nil
+}
+
+// window is a set of messages fetched with a single command.
+type window struct {
+	seqset *imap.SeqSet
+	// uid is set if seqset holds UIDs rather than sequence numbers.
+	uid bool
+}
+
+// uidRange returns the UIDs between from and to, where 0 leaves either
+// side open.
+func uidRange(from, to uint32) *imap.SeqSet {
+	if from == 0 {
+		from = 1
+	}
+	if to == 0 {
+		to = math.MaxUint32
+	}
+	seqset := &imap.SeqSet{}
+	seqset.AddRange(from, to)
+	return seqset
+}
+
+// scanWindows returns the windows to fetch from the selected mailbox
+// and the number of messages they cover. Without a UID range the
+// mailbox is split by sequence number, with one the UIDs in the range
+// are searched first so that sparse UIDs do not cause empty windows.
+// Windows beyond cfg.Limit messages are left out, which is reported
+// as EventLimited.
+func scanWindows(c Client, st *imap.MailboxStatus, cfg Config) ([]window, int, error) {
+	bounded := cfg.UIDFrom > 1 || cfg.UIDTo != 0
+	limited := cfg.Limit > 0 && (bounded || int(st.Messages) > cfg.Limit)
+	switch {
+	case !limited && cfg.FetchChunk <= 0:
+		return []window{{uidRange(cfg.UIDFrom, cfg.UIDTo), true}}, int(st.Messages), nil
+	case !limited && !bounded:
+		return fetchWindows(st.Messages, cfg.FetchChunk), int(st.Messages), nil
+	case !bounded:
+		// sequence numbers are in UID order, so the first messages
+		// are those numbered up to the limit
+		cfg.progress(Event{Kind: EventLimited, Mailbox: st.Name, Count: cfg.Limit, Total: int(st.Messages)})
+		chunk := cfg.FetchChunk
+		if chunk <= 0 {
+			chunk = cfg.Limit
+		}
+		return fetchWindows(uint32(cfg.Limit), chunk), cfg.Limit, nil
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = uidRange(cfg.UIDFrom, cfg.UIDTo)
+	done := cfg.Metrics.Track(st.Name, PhaseSelect)
+	uids, err := c.UidSearch(criteria)
+	done(1, len(uids))
+	if err != nil {
+		return nil, 0, &Error{Op: "search", Mailbox: st.Name, Set: criteria.Uid, Err: err}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	if limited && len(uids) > cfg.Limit {
+		cfg.progress(Event{Kind: EventLimited, Mailbox: st.Name, Count: cfg.Limit, Total: len(uids)})
+		uids = uids[:cfg.Limit]
+	}
+
+	chunk := cfg.FetchChunk
+	if chunk <= 0 {
+		chunk = len(uids)
+	}
+	var windows []window
+	for from := 0; from < len(uids); from += chunk {
+		to := from + chunk
+		if to > len(uids) {
+			to = len(uids)
+		}
+		seqset := &imap.SeqSet{}
+		seqset.AddNum(uids[from:to]...)
+		windows = append(windows, window{seqset, true})
+	}
+	return windows, len(uids), nil
+}
+
+// fetchWindows splits a mailbox of the given number of messages into
+// sequence number windows of chunk messages.
+func fetchWindows(messages uint32, chunk int) []window {
+	var windows []window
+	for from := uint32(1); from <= messages; from += uint32(chunk) {
+		to := from + uint32(chunk) - 1
+		if to > messages {
+			to = messages
+		}
+		seqset := &imap.SeqSet{}
+		seqset.AddRange(from, to)
+		windows = append(windows, window{seqset, false})
+	}
+	return windows
+}
+
+// fetchWindow fetches the envelopes of the messages in w and calls
+// process for each of them in sequence order. It returns the number of
+// fetched messages. Once ctx is done the rest of the fetch is drained
+// without calling process.
+func fetchWindow(ctx context.Context, c Client, mbox string, w window, cfg Config, process func(keyed)) (n int, err error) {
+	metrics := cfg.Metrics
+	items := keyFetchItems(cfg)
+	msgChan := make(chan *imap.Message, cfg.FetchBuffer)
+	errChan := make(chan error, 1)
+	fetchStart, fetchBytes := time.Now(), metrics.Bytes()
+	// the fetch error is only handed over through errChan, the fetch
+	// closes msgChan on failure as well so the loop below ends
+	go func() {
+		if w.uid {
+			errChan <- c.UidFetch(w.seqset, items, msgChan)
+		} else {
+			errChan <- c.Fetch(w.seqset, items, msgChan)
+		}
+	}()
+
+	var hashTime time.Duration
+	for k := range keyMessages(msgChan, cfg) {
+		if ctx.Err() != nil {
+			continue
+		}
+		n++
+		hashTime += k.took
+		process(k)
+	}
+	err = <-errChan
+	// hashing is summed over the workers and overlaps the fetch
+	metrics.Add(mbox, PhaseFetch, PhaseStats{
+		Duration: time.Since(fetchStart) - hashTime/time.Duration(cfg.HashWorkers),
+		Bytes:    metrics.Bytes() - fetchBytes,
+		Commands: 1,
+		Messages: n,
+	})
+	metrics.Add(mbox, PhaseHash, PhaseStats{Duration: hashTime, Messages: n})
+	if err != nil {
+		return n, &Error{Op: "fetch", Mailbox: mbox, Set: w.seqset, SeqNums: !w.uid, Err: err}
+	}
+	if ctx.Err() != nil {
+		return n, canceledIn(ctx, mbox, PhaseFetch, w)
+	}
+	return n, nil
+}
+
+// dropSmall returns groups without those whose duplicates take less
+// than cfg.MinWastedBytes together, reporting how many were dropped.
+func dropSmall(mbox string, groups []Group, sizes map[uint32]uint32, cfg Config) []Group {
+	kept := groups[:0]
+	small, dups := 0, 0
+	for _, g := range groups {
+		var wasted int64
+		for _, uid := range g.Duplicates {
+			wasted += int64(sizes[uid])
+		}
+		if wasted < cfg.MinWastedBytes {
+			small++
+			dups += len(g.Duplicates)
+			continue
+		}
+		kept = append(kept, g)
+	}
+	if small > 0 {
+		cfg.progress(Event{Kind: EventBelowBytes, Mailbox: mbox, Count: dups, Total: small})
+	}
+	return kept
+}
@@ -0,0 +1,711 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"github.com/tomasvitek/imap-clean-dup/internal/fakeimap"
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+var _ Client = (*fakeimap.Client)(nil)
+
+// newServer returns a server with msgs in INBOX and a session on it.
+func newServer(t *testing.T, msgs ...imaptest.Message) (*imaptest.Server, Client) {
+	t.Helper()
+	s := imaptest.NewServer(t)
+	s.AppendMessages(t, "INBOX", msgs...)
+	return s, s.Dial(t)
+}
+
+// newFake returns a scripted client with msgs in INBOX.
+func newFake(msgs ...imaptest.Message) *fakeimap.Client {
+	c := fakeimap.New()
+	for _, m := range msgs {
+		c.Append("INBOX", m.Bytes())
+	}
+	return c
+}
+
+// scan scans INBOX of c with cfg, failing t on errors.
+func scan(t *testing.T, c Client, cfg Config) []Group {
+	t.Helper()
+	groups, err := Scan(context.Background(), c, "INBOX", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return groups
+}
+
+// copies returns the keeper and duplicates of each group.
+func copies(groups []Group) [][]uint32 {
+	var all [][]uint32
+	for _, g := range groups {
+		all = append(all, append([]uint32{g.Keeper}, g.Duplicates...))
+	}
+	return all
+}
+
+func TestScanMessageID(t *testing.T) {
+	_, c := newServer(t,
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "A", Body: "one"},
+		imaptest.Message{MessageID: "<b@example.org>", Subject: "B"},
+		// the Message-ID decides, whatever the envelope or body
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "A again", Body: "two"},
+		imaptest.Message{MessageID: "<a@example.org>", From: "x@example.org", Subject: "A"},
+	)
+	groups := scan(t, c, Config{})
+	if want := [][]uint32{{1, 3, 4}}; !reflect.DeepEqual(copies(groups), want) {
+		t.Errorf("got copies %v, want %v", copies(groups), want)
+	}
+	if g := groups[0]; g.Mailbox != "INBOX" || g.Strategy != StrategyEnvelope || g.UIDValidity == 0 {
+		t.Errorf("got group %+v", g)
+	}
+}
+
+func TestScanEnvelopeHash(t *testing.T) {
+	_, c := newServer(t,
+		imaptest.Message{Subject: "Report"},
+		imaptest.Message{Subject: "Report"},
+		imaptest.Message{Subject: "Other"},
+		imaptest.Message{Subject: "Report", To: "b@example.org"},
+		imaptest.Message{Subject: "Report", Body: "a body does not count"},
+	)
+	var keys []string
+	groups := scan(t, c, Config{Progress: func(e Event) {
+		if e.Kind == EventMessage {
+			keys = append(keys, e.Key)
+		}
+	}})
+	if want := [][]uint32{{1, 2, 5}}; !reflect.DeepEqual(copies(groups), want) {
+		t.Errorf("got copies %v, want %v", copies(groups), want)
+	}
+	// messages without Message-ID are reported by their hash
+	if len(keys) != 5 || keys[0] != groups[0].Key || keys[2] == keys[0] {
+		t.Errorf("got keys %q, group key %s", keys, groups[0].Key)
+	}
+}
+
+// TestScanKeySize checks that with KeySize messages of the same
+// envelope, or Message-ID, are only copies if their sizes are the same
+// too, as when one of them has an attachment.
+func TestScanKeySize(t *testing.T) {
+	for _, id := range []string{"", "<a@example.org>"} {
+		_, c := newServer(t,
+			imaptest.Message{MessageID: id, Subject: "Report", Body: "see attached"},
+			imaptest.Message{MessageID: id, Subject: "Report", Body: "see attached\r\n" + strings.Repeat("UEsDBBQ", 200)},
+			imaptest.Message{MessageID: id, Subject: "Report", Body: "see attached"},
+			imaptest.Message{MessageID: id, Subject: "Report", Body: "see attached, too"},
+		)
+		for _, test := range []struct {
+			cfg  Config
+			want [][]uint32
+		}{
+			{Config{}, [][]uint32{{1, 2, 3, 4}}},
+			{Config{KeySize: true}, [][]uint32{{1, 3}}},
+			{Config{KeySize: true, IgnoreMessageID: true}, [][]uint32{{1, 3}}},
+		} {
+			if got := copies(scan(t, c, test.cfg)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Message-ID %q, %+v: got copies %v, want %v", id, test.cfg, got, test.want)
+			}
+		}
+	}
+}
+
+func TestScanIgnoreMessageID(t *testing.T) {
+	_, c := newServer(t,
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "A"},
+		imaptest.Message{MessageID: "<b@example.org>", Subject: "A"},
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "B"},
+	)
+	groups := scan(t, c, Config{IgnoreMessageID: true})
+	if want := [][]uint32{{1, 2}}; !reflect.DeepEqual(copies(groups), want) {
+		t.Errorf("got copies %v, want %v", copies(groups), want)
+	}
+}
+
+// TestScanResent checks that a message redistributed with Resent-*
+// headers is a copy of the original, which only the raw header tells
+// apart unless the headers are volatile or ignored.
+func TestScanResent(t *testing.T) {
+	resent := func(m imaptest.Message) []byte {
+		return append([]byte("Resent-From: list@example.org\r\nResent-Date: Mon, 4 Mar 2024 09:00:00 +0000\r\nResent-Message-ID: <resent@example.org>\r\n"), m.Bytes()...)
+	}
+	for _, test := range []struct {
+		name string
+		msg  imaptest.Message
+		cfg  Config
+		want [][]uint32
+	}{
+		{"message-id", imaptest.Message{MessageID: "<a@example.org>", Subject: "A"}, Config{}, [][]uint32{{1, 2}}},
+		{"envelope", imaptest.Message{Subject: "A"}, Config{}, [][]uint32{{1, 2}}},
+		{"ignore message-id", imaptest.Message{MessageID: "<a@example.org>", Subject: "A"}, Config{IgnoreMessageID: true}, [][]uint32{{1, 2}}},
+		{"raw header", imaptest.Message{Subject: "A"}, Config{RawHeader: true}, nil},
+		{"raw header, volatile", imaptest.Message{Subject: "A"}, Config{RawHeader: true, VolatileHeaders: append([]string{"Resent-*"}, DefaultVolatileHeaders...)}, [][]uint32{{1, 2}}},
+		{"raw header, ignore resent", imaptest.Message{Subject: "A"}, Config{RawHeader: true, IgnoreResentHeaders: true}, [][]uint32{{1, 2}}},
+		{"raw header, ignore resent, no volatile", imaptest.Message{Subject: "A"}, Config{RawHeader: true, VolatileHeaders: []string{}, IgnoreResentHeaders: true}, [][]uint32{{1, 2}}},
+	} {
+		c := fakeimap.New()
+		c.Append("INBOX", test.msg.Bytes(), resent(test.msg))
+		if got := copies(scan(t, c, test.cfg)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got copies %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestScanRawHeader delivers copies of a message on different paths,
+// with other Received lines, some folded, and other transport headers,
+// and checks that the raw header key collapses them once those are
+// volatile, whatever their bodies, but not a message whose other
+// headers differ.
+func TestScanRawHeader(t *testing.T) {
+	header := "From: a@example.org\r\nTo: b@example.org\r\nSubject: A\r\nMessage-ID: <a@example.org>\r\n"
+	raw := func(transport, header, body string) []byte {
+		return []byte(transport + header + "\r\n" + body)
+	}
+	c := fakeimap.New()
+	c.Append("INBOX",
+		raw("Received: from mx1.example.org by mail.example.org; Mon, 4 Mar 2024 09:00:00 +0000\r\n", header, "Hello\r\n"),
+		raw("Received: from mx2.example.org\r\n\tby mail.example.org with ESMTPS id 1;\r\n\tMon, 4 Mar 2024 09:00:01 +0000\r\n"+
+			"received: from relay.example.net by mx2.example.org; Mon, 4 Mar 2024 09:00:00 +0000\r\n"+
+			"DKIM-Signature: v=1; a=rsa-sha256; d=example.org;\r\n b=c2lnbmF0dXJl\r\n", header, "Hello\r\n"),
+		raw("X-Spam-Score: 0.1\r\nReceived: from mx3.example.org by mail.example.org; Mon, 4 Mar 2024 09:00:02 +0000\r\n", header, "Hello again\r\n"),
+		// another header under the same Message-ID
+		raw("Received: from mx1.example.org by mail.example.org; Mon, 4 Mar 2024 10:00:00 +0000\r\n", strings.Replace(header, "Subject: A", "Subject: Re: A", 1), "Hello\r\n"),
+	)
+	for _, test := range []struct {
+		name     string
+		volatile []string
+		want     [][]uint32
+	}{
+		{"default", nil, [][]uint32{{1, 2, 3}}},
+		{"case-insensitive, no X-*", []string{"received", "dkim-signature"}, [][]uint32{{1, 2}}},
+		{"nothing volatile", []string{}, nil},
+	} {
+		got := copies(scan(t, c, Config{RawHeader: true, VolatileHeaders: test.volatile}))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got copies %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestScanEmpty(t *testing.T) {
+	s, c := newServer(t)
+	var events []Event
+	groups := scan(t, c, Config{Progress: func(e Event) { events = append(events, e) }})
+	if len(groups) != 0 {
+		t.Errorf("got groups %+v", groups)
+	}
+	if len(events) != 2 || events[1].Kind != EventEmpty || events[1].Count != 0 {
+		t.Errorf("got events %+v", events)
+	}
+
+	// messages flagged \Deleted are as good as gone
+	s.AppendMessages(t, "INBOX",
+		imaptest.Message{MessageID: "<a@example.org>", Flags: []string{imap.DeletedFlag}},
+		imaptest.Message{MessageID: "<a@example.org>", Flags: []string{imap.DeletedFlag}},
+	)
+	events = nil
+	groups = scan(t, c, Config{Progress: func(e Event) { events = append(events, e) }})
+	if len(groups) != 0 {
+		t.Errorf("got groups %+v", groups)
+	}
+	if len(events) != 2 || events[1].Kind != EventEmpty || events[1].Count != 2 {
+		t.Errorf("got events %+v", events)
+	}
+}
+
+func TestScanSkipsDeleted(t *testing.T) {
+	_, c := newServer(t,
+		imaptest.Message{MessageID: "<a@example.org>", Flags: []string{imap.DeletedFlag}},
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+	)
+	groups := scan(t, c, Config{})
+	if want := [][]uint32{{2, 3}}; !reflect.DeepEqual(copies(groups), want) {
+		t.Errorf("got copies %v, want %v", copies(groups), want)
+	}
+}
+
+func TestScanReadOnly(t *testing.T) {
+	s, c := newServer(t,
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+	)
+	groups := scan(t, c, Config{ReadOnly: true})
+	if len(groups) != 1 {
+		t.Fatalf("got groups %+v", groups)
+	}
+	if !c.(interface{ Mailbox() *imap.MailboxStatus }).Mailbox().ReadOnly {
+		t.Error("INBOX not examined read-only")
+	}
+	if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1, 2}) {
+		t.Errorf("got UIDs %v after scan", uids)
+	}
+}
+
+func TestScanWindows(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		cfg     Config
+		fetches []string
+	}{
+		{"whole mailbox", Config{}, []string{"UID FETCH 1:4294967295"}},
+		{"chunks", Config{FetchChunk: 2}, []string{"FETCH 1:2", "FETCH 3:4", "FETCH 5"}},
+		{"limit", Config{Limit: 3}, []string{"FETCH 1:3"}},
+		{"limit in chunks", Config{Limit: 3, FetchChunk: 2}, []string{"FETCH 1:2", "FETCH 3"}},
+		{"UID range", Config{UIDFrom: 2, UIDTo: 4}, []string{"UID FETCH 2:4"}},
+		{"UID range in chunks", Config{UIDFrom: 2, FetchChunk: 2}, []string{"UID SEARCH UID 2:4294967295", "UID FETCH 2:3", "UID FETCH 4:5"}},
+	} {
+		c := newFake(
+			imaptest.Message{MessageID: "<a@example.org>"},
+			imaptest.Message{MessageID: "<a@example.org>"},
+			imaptest.Message{MessageID: "<b@example.org>"},
+			imaptest.Message{MessageID: "<a@example.org>"},
+			imaptest.Message{MessageID: "<b@example.org>"},
+		)
+		scan(t, c, test.cfg)
+		want := append([]string{"SELECT INBOX", "UID SEARCH DELETED"}, test.fetches...)
+		if got := c.Commands(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got commands %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+// arriving appends msgs to INBOX of Client once after fetches were
+// issued, as mail delivered while a scan is in progress.
+type arriving struct {
+	*fakeimap.Client
+	after   int
+	msgs    []imaptest.Message
+	fetches int
+}
+
+func (c *arriving) Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	c.arrive()
+	return c.Client.Fetch(seqset, items, ch)
+}
+
+func (c *arriving) UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	c.arrive()
+	return c.Client.UidFetch(seqset, items, ch)
+}
+
+func (c *arriving) arrive() {
+	if c.fetches == c.after {
+		for _, m := range c.msgs {
+			c.Client.Append("INBOX", m.Bytes())
+		}
+	}
+	c.fetches++
+}
+
+// TestScanArriving delivers copies of scanned messages before and
+// between the fetch windows and checks that the scan leaves them out,
+// covering the mailbox as it was selected.
+func TestScanArriving(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		cfg   Config
+		after int
+		// newer is the Count of EventNewer, the arrivals fetched and
+		// left out
+		newer int
+	}{
+		{"whole mailbox", Config{}, 0, 2},
+		{"chunks", Config{FetchChunk: 2}, 1, 0},
+		{"UID range in chunks", Config{UIDFrom: 1, FetchChunk: 2}, 1, 0},
+		{"UID range to the end", Config{UIDFrom: 3}, 0, 2},
+	} {
+		c := &arriving{
+			Client: newFake(
+				imaptest.Message{MessageID: "<a@example.org>"},
+				imaptest.Message{MessageID: "<a@example.org>"},
+				imaptest.Message{MessageID: "<b@example.org>"},
+				imaptest.Message{MessageID: "<a@example.org>"},
+				imaptest.Message{MessageID: "<b@example.org>"},
+			),
+			after: test.after,
+			msgs:  []imaptest.Message{{MessageID: "<a@example.org>"}, {MessageID: "<b@example.org>"}},
+		}
+		newer := 0
+		groups := scan(t, c, Config{FetchChunk: test.cfg.FetchChunk, UIDFrom: test.cfg.UIDFrom, Progress: func(e Event) {
+			if e.Kind == EventNewer {
+				newer += e.Count
+			}
+		}})
+		want := [][]uint32{{1, 2, 4}, {3, 5}}
+		if test.cfg.UIDFrom == 3 {
+			want = [][]uint32{{3, 5}}
+		}
+		if !reflect.DeepEqual(copies(groups), want) {
+			t.Errorf("%s: got copies %v, want %v", test.name, copies(groups), want)
+		}
+		if newer != test.newer {
+			t.Errorf("%s: %d newer messages reported, want %d", test.name, newer, test.newer)
+		}
+		if uids := c.UIDs("INBOX"); len(uids) != 7 {
+			t.Errorf("%s: nothing arrived, got UIDs %v", test.name, uids)
+		}
+	}
+}
+
+// TestDuplicateUIDs checks that the flat list of UIDs to remove, as
+// once returned by FindDups, is still derived from the groups: every
+// message but the first with a key, messages without a Message-ID keyed
+// by their envelope.
+func TestDuplicateUIDs(t *testing.T) {
+	var msgs []imaptest.Message
+	for i := 0; i < 60; i++ {
+		switch {
+		case i%5 == 4:
+			msgs = append(msgs, imaptest.Message{Subject: fmt.Sprintf("no id %d", i%3)})
+		default:
+			msgs = append(msgs, imaptest.Message{MessageID: fmt.Sprintf("<%d@example.org>", i*i%17)})
+		}
+	}
+	seen := make(map[string]bool)
+	var want []uint32
+	for i, m := range msgs {
+		key := m.MessageID
+		if key == "" {
+			key = "subject:" + m.Subject
+		}
+		if seen[key] {
+			want = append(want, uint32(i+1))
+		}
+		seen[key] = true
+	}
+
+	for _, cfg := range []Config{{}, {FetchChunk: 7}, {HashWorkers: 4}} {
+		groups := scan(t, newFake(msgs...), cfg)
+		if got := DuplicateUIDs(groups, "INBOX"); !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v: got UIDs %v, want %v", cfg, got, want)
+		}
+		if Count(groups) != len(want) {
+			t.Errorf("%+v: counted %d duplicates, want %d", cfg, Count(groups), len(want))
+		}
+		if got := DuplicateUIDs(groups, "Archive"); len(got) != 0 {
+			t.Errorf("%+v: got UIDs %v of another mailbox", cfg, got)
+		}
+	}
+
+	// groups of several mailboxes, with a UID in two groups
+	groups := []Group{
+		{Mailbox: "INBOX", Keeper: 1, Duplicates: []uint32{9, 4}},
+		{Mailbox: "Archive", Keeper: 1, Duplicates: []uint32{2, 3}},
+		{Mailbox: "INBOX", Keeper: 2, Duplicates: []uint32{4, 7}},
+	}
+	if got := DuplicateUIDs(groups, "INBOX"); !reflect.DeepEqual(got, []uint32{4, 7, 9}) {
+		t.Errorf("got INBOX UIDs %v", got)
+	}
+	if got := DuplicateUIDs(groups, "Archive"); !reflect.DeepEqual(got, []uint32{2, 3}) {
+		t.Errorf("got Archive UIDs %v", got)
+	}
+	if got := DuplicateUIDs(nil, "INBOX"); got != nil {
+		t.Errorf("got UIDs %v without groups", got)
+	}
+}
+
+func TestScanMaxDups(t *testing.T) {
+	c := newFake(
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<b@example.org>"},
+		imaptest.Message{MessageID: "<b@example.org>"},
+	)
+	var truncated []Event
+	groups := scan(t, c, Config{MaxDups: 1, FetchChunk: 2, Progress: func(e Event) {
+		if e.Kind == EventTruncated {
+			truncated = append(truncated, e)
+		}
+	}})
+	if want := [][]uint32{{1, 2}}; !reflect.DeepEqual(copies(groups), want) {
+		t.Errorf("got copies %v, want %v", copies(groups), want)
+	}
+	// no further window is fetched once enough duplicates are found
+	if got := c.Commands(); len(got) != 3 || got[2] != "FETCH 1:2" {
+		t.Errorf("got commands %q", got)
+	}
+	if len(truncated) != 1 || truncated[0].Count != 2 || truncated[0].Total != 5 {
+		t.Errorf("got events %+v", truncated)
+	}
+}
+
+func TestScanMinGroupSize(t *testing.T) {
+	var msgs []imaptest.Message
+	for _, id := range []string{"a", "a", "b", "b", "b", "c", "c", "c", "c"} {
+		msgs = append(msgs, imaptest.Message{MessageID: "<" + id + "@example.org>"})
+	}
+	for _, test := range []struct {
+		min    int
+		copies [][]uint32
+		// kept is the Count of EventBelowThreshold, 0 if none is sent.
+		kept int
+	}{
+		{0, [][]uint32{{1, 2}, {3, 4, 5}, {6, 7, 8, 9}}, 0},
+		{2, [][]uint32{{1, 2}, {3, 4, 5}, {6, 7, 8, 9}}, 0},
+		{3, [][]uint32{{3, 4, 5}, {6, 7, 8, 9}}, 1},
+		{4, [][]uint32{{6, 7, 8, 9}}, 3},
+		{5, nil, 6},
+	} {
+		kept := 0
+		groups := scan(t, newFake(msgs...), Config{MinGroupSize: test.min, Progress: func(e Event) {
+			if e.Kind == EventBelowThreshold {
+				kept += e.Count
+			}
+		}})
+		if !reflect.DeepEqual(copies(groups), test.copies) || kept != test.kept {
+			t.Errorf("MinGroupSize %d: got copies %v, %d kept", test.min, copies(groups), kept)
+		}
+	}
+}
+
+func TestScanRepeatedUID(t *testing.T) {
+	c := newFake(
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<b@example.org>"},
+	)
+	// the server returns UID 1 twice, which must not make it a
+	// duplicate of itself
+	msgs := c.Mailboxes["INBOX"].Messages
+	c.Mailboxes["INBOX"].Messages = append(msgs, msgs[0])
+	var repeated []uint32
+	groups := scan(t, c, Config{Progress: func(e Event) {
+		if e.Kind == EventRepeatedUID {
+			repeated = append(repeated, e.UID)
+		}
+	}})
+	if len(groups) != 0 {
+		t.Errorf("got groups %+v", groups)
+	}
+	if !reflect.DeepEqual(repeated, []uint32{1}) {
+		t.Errorf("got repeated UIDs %v", repeated)
+	}
+}
+
+func TestScanFetchError(t *testing.T) {
+	c := newFake(
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+	)
+	failure := errors.New("connection reset")
+	// SELECT, UID SEARCH, FETCH 1:2, FETCH 3
+	c.Errors = map[int]error{4: failure}
+	_, err := Scan(context.Background(), c, "INBOX", Config{FetchChunk: 2})
+	var e *Error
+	if !errors.As(err, &e) || e.Op != "fetch" || e.Set.String() != "3" || !e.SeqNums || !errors.Is(err, failure) {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	for _, uidPlus := range []bool{false, true} {
+		var extensions []server.Extension
+		if uidPlus {
+			extensions = append(extensions, imaptest.UIDPlus)
+		}
+		s := imaptest.NewServer(t, extensions...)
+		s.AppendMessages(t, "INBOX",
+			imaptest.Message{MessageID: "<a@example.org>"},
+			imaptest.Message{MessageID: "<b@example.org>"},
+			imaptest.Message{MessageID: "<a@example.org>"},
+			imaptest.Message{Subject: "no id"},
+			imaptest.Message{MessageID: "<b@example.org>"},
+			imaptest.Message{Subject: "no id"},
+		)
+		c := s.Dial(t)
+		var client Client = c
+		if uidPlus {
+			caps, err := c.Capability()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client = WithCapabilities(c, NewCapabilities(caps))
+		}
+		groups := scan(t, client, Config{})
+		if want := [][]uint32{{1, 3}, {2, 5}, {4, 6}}; !reflect.DeepEqual(copies(groups), want) {
+			t.Fatalf("UIDPLUS %t: got copies %v, want %v", uidPlus, copies(groups), want)
+		}
+		res, err := Apply(context.Background(), client, groups, ActionDelete, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1, 2, 4}) {
+			t.Errorf("UIDPLUS %t: got UIDs %v left", uidPlus, uids)
+		}
+		if res.Removed != 3 || res.Purged["INBOX"] != 3 || !reflect.DeepEqual(res.Expunged["INBOX"], []uint32{6, 5, 3}) {
+			t.Errorf("UIDPLUS %t: got result %+v", uidPlus, res)
+		}
+		if _, ok := res.FullExpunged["INBOX"]; ok == uidPlus {
+			t.Errorf("UIDPLUS %t: got full expunges %v", uidPlus, res.FullExpunged)
+		}
+	}
+}
+
+func TestApplyFullExpunge(t *testing.T) {
+	s, c := newServer(t,
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<other@example.org>"},
+	)
+	groups := scan(t, c, Config{})
+	// another client flags a message \Deleted, which EXPUNGE would
+	// remove too
+	s.SetFlags(t, "INBOX", 3, imap.DeletedFlag)
+	_, err := Apply(context.Background(), c, groups, ActionDelete, nil)
+	if !errors.Is(err, ErrFullExpunge) {
+		t.Fatalf("got error %v, want ErrFullExpunge", err)
+	}
+	if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1, 2, 3}) {
+		t.Errorf("got UIDs %v left", uids)
+	}
+	if flags := s.Flags(t, "INBOX", 2); len(flags) != 0 {
+		t.Errorf("got flags %v on the duplicate left alone", flags)
+	}
+
+	res, err := Apply(context.Background(), c, groups, ActionDeleteExpungeAll, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1}) {
+		t.Errorf("got UIDs %v left", uids)
+	}
+	if res.Removed != 1 || res.Purged["INBOX"] != 2 || res.FullExpunged["INBOX"] != 1 {
+		t.Errorf("got result %+v", res)
+	}
+}
+
+func TestApplyUIDValidity(t *testing.T) {
+	s, c := newServer(t,
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+	)
+	groups := scan(t, c, Config{})
+	groups[0].UIDValidity++
+	_, err := Apply(context.Background(), c, groups, ActionDelete, nil)
+	if !errors.Is(err, ErrUIDValidityChanged) {
+		t.Fatalf("got error %v, want ErrUIDValidityChanged", err)
+	}
+	if uids := s.UIDs(t, "INBOX"); len(uids) != 2 {
+		t.Errorf("got UIDs %v left", uids)
+	}
+}
+
+// TestScanLimit pins which copies are duplicates when the scan stops
+// at exactly Limit messages, also within a UID range and in chunks.
+func TestScanLimit(t *testing.T) {
+	for _, test := range []struct {
+		cfg     Config
+		copies  [][]uint32
+		limited bool
+	}{
+		{Config{Limit: 1}, nil, true},
+		{Config{Limit: 2}, [][]uint32{{1, 2}}, true},
+		{Config{Limit: 3}, [][]uint32{{1, 2}}, true},
+		{Config{Limit: 4}, [][]uint32{{1, 2, 4}}, true},
+		{Config{Limit: 5}, [][]uint32{{1, 2, 4}, {3, 5}}, false},
+		{Config{Limit: 6}, [][]uint32{{1, 2, 4}, {3, 5}}, false},
+		{Config{Limit: 3, FetchChunk: 2}, [][]uint32{{1, 2}}, true},
+		{Config{Limit: 4, FetchChunk: 3}, [][]uint32{{1, 2, 4}}, true},
+		{Config{Limit: 2, UIDFrom: 2}, nil, true},
+		{Config{Limit: 3, UIDFrom: 2}, [][]uint32{{2, 4}}, true},
+		{Config{Limit: 3, UIDFrom: 2, FetchChunk: 2}, [][]uint32{{2, 4}}, true},
+	} {
+		c := newFake(
+			imaptest.Message{MessageID: "<a@example.org>"},
+			imaptest.Message{MessageID: "<a@example.org>"},
+			imaptest.Message{MessageID: "<b@example.org>"},
+			imaptest.Message{MessageID: "<a@example.org>"},
+			imaptest.Message{MessageID: "<b@example.org>"},
+		)
+		var limited []Event
+		cfg := test.cfg
+		cfg.Progress = func(e Event) {
+			if e.Kind == EventLimited {
+				limited = append(limited, e)
+			}
+		}
+		if got := copies(scan(t, c, cfg)); !reflect.DeepEqual(got, test.copies) {
+			t.Errorf("%+v: got copies %v, want %v", test.cfg, got, test.copies)
+		}
+		if (len(limited) == 1) != test.limited || len(limited) > 1 || (test.limited && limited[0].Count != test.cfg.Limit) {
+			t.Errorf("%+v: got events %+v", test.cfg, limited)
+		}
+	}
+}
+
+// TestScanAllocsPerMessage checks that recording sizes and envelopes
+// costs no memory for every message scanned, only for the messages of
+// groups.
+func TestScanAllocsPerMessage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("large mailbox in short mode")
+	}
+	const messages = 20000
+	c := fakeimap.New()
+	for i := 0; i < messages; i++ {
+		// the first and the last message are copies
+		c.Append("INBOX", imaptest.Message{MessageID: fmt.Sprintf("<%d@example.org>", i%(messages-1))}.Bytes())
+	}
+	allocated := func(cfg Config) ([]Group, uint64) {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		groups := scan(t, c, cfg)
+		runtime.ReadMemStats(&after)
+		return groups, after.TotalAlloc - before.TotalAlloc
+	}
+	_, plain := allocated(Config{})
+	groups, recording := allocated(Config{Keep: KeepLargest, RecordSizes: true, RecordEnvelopes: true})
+	if extra := (int64(recording) - int64(plain)) / messages; extra > 8 {
+		t.Errorf("got %d more bytes allocated per message recording sizes and envelopes", extra)
+	}
+	if len(groups) != 1 || len(groups[0].Sizes) != 2 || len(groups[0].Envelopes) != 2 ||
+		groups[0].Sizes[1] == 0 || groups[0].Envelopes[messages].MessageID != "<0@example.org>" {
+		t.Errorf("got groups %+v", groups)
+	}
+}
+
+func TestScanScopeBySender(t *testing.T) {
+	c := newFake(
+		imaptest.Message{From: "a@example.org", Subject: "Build failed"},
+		imaptest.Message{From: "b@example.org", Subject: "Build failed"},
+		imaptest.Message{From: "A@Example.org", Subject: "Build failed"},
+		imaptest.Message{From: "b@example.org", Subject: "Build failed"},
+		// messages keyed by Message-ID are not scoped
+		imaptest.Message{From: "a@example.org", MessageID: "<m@example.org>", Subject: "M"},
+		imaptest.Message{From: "b@example.org", MessageID: "<m@example.org>", Subject: "M"},
+	)
+	// the envelope gives From as Sender and Reply-To when missing
+	from := FieldFrom | FieldSender | FieldReplyTo
+	subject := template.Must(template.New("key").Parse("{{.Subject}}"))
+	for _, test := range []struct {
+		name string
+		cfg  Config
+		want [][]uint32
+	}{
+		{"ignore from", Config{IgnoreFields: from}, [][]uint32{{1, 2, 3, 4}, {5, 6}}},
+		{"ignore from, scoped", Config{IgnoreFields: from, ScopeBySender: true}, [][]uint32{{1, 3}, {2, 4}, {5, 6}}},
+		{"key template", Config{KeyTemplate: subject}, [][]uint32{{1, 2, 3, 4}, {5, 6}}},
+		// a template replaces the Message-ID, so it is scoped as well
+		{"key template, scoped", Config{KeyTemplate: subject, ScopeBySender: true}, [][]uint32{{1, 3}, {2, 4}}},
+		// without IgnoreFields the sender is hashed as given
+		{"scoped", Config{ScopeBySender: true}, [][]uint32{{2, 4}, {5, 6}}},
+	} {
+		groups := scan(t, c, test.cfg)
+		if got := copies(groups); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got copies %v, want %v", test.name, got, test.want)
+		}
+	}
+}
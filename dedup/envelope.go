@@ -0,0 +1,111 @@
+package dedup
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap"
+)
+
+// Envelope is what Apply checks a message against before removing its
+// copies when Config.RecordEnvelopes was set for the scan.
+type Envelope struct {
+	MessageID string
+	Subject   string
+}
+
+// Mismatch is a message whose envelope no longer is the one recorded
+// by the scan, so that Apply left it and its group alone.
+type Mismatch struct {
+	UID uint32
+	// Keeper is set if the message is the keeper of its group, whose
+	// duplicates were then all kept.
+	Keeper bool
+	// Scanned is the envelope recorded by the scan.
+	Scanned Envelope
+	// Found is the envelope found by Apply, empty if Gone.
+	Found Envelope
+	// Gone is set if the message no longer exists.
+	Gone bool
+}
+
+// checkEnvelopes fetches the envelopes of the keepers and duplicates of
+// the groups of the selected mailbox mbox which recorded any, and
+// returns those of uids which may be removed: duplicates whose envelope
+// and whose keeper's envelope are still the ones recorded, or for which
+// none were recorded. Keepers in other mailboxes are not checked.
+func checkEnvelopes(ctx context.Context, c Client, mbox string, groups []Group, uids []uint32, metrics *Metrics) ([]uint32, []Mismatch, error) {
+	recorded := make(map[uint32]Envelope)
+	for _, g := range groups {
+		if g.Mailbox != mbox {
+			continue
+		}
+		for uid, env := range g.Envelopes {
+			if uid == g.Keeper && g.KeeperMailbox != "" {
+				continue
+			}
+			recorded[uid] = env
+		}
+	}
+	if len(recorded) == 0 {
+		return uids, nil, nil
+	}
+	if ctx.Err() != nil {
+		return nil, nil, canceled(ctx, mbox, PhaseFetch)
+	}
+
+	set := &imap.SeqSet{}
+	for uid := range recorded {
+		set.AddNum(uid)
+	}
+	found := make(map[uint32]Envelope)
+	err := fetchMessages(c, mbox, set, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, metrics, func(msg *imap.Message) {
+		if msg.Envelope != nil {
+			found[msg.Uid] = Envelope{MessageID: msg.Envelope.MessageId, Subject: msg.Envelope.Subject}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var mismatches []Mismatch
+	refused := make(map[uint32]bool)
+	// a message may be in more than one group, e.g. in one of
+	// Config.PerSenderCap too, it is reported once
+	matches := make(map[uint32]bool)
+	check := func(uid uint32, keeper bool) bool {
+		if ok, checked := matches[uid]; checked {
+			return ok
+		}
+		want, ok := recorded[uid]
+		if !ok {
+			return true
+		}
+		got, exists := found[uid]
+		matches[uid] = exists && got == want
+		if !matches[uid] {
+			mismatches = append(mismatches, Mismatch{UID: uid, Keeper: keeper, Scanned: want, Found: got, Gone: !exists})
+		}
+		return matches[uid]
+	}
+	for _, g := range groups {
+		if g.Mailbox != mbox {
+			continue
+		}
+		keeperOK := g.KeeperMailbox != "" || check(g.Keeper, true)
+		for _, uid := range g.Duplicates {
+			if !keeperOK || !check(uid, false) {
+				refused[uid] = true
+			}
+		}
+	}
+	if len(refused) == 0 {
+		return uids, mismatches, nil
+	}
+	var kept []uint32
+	for _, uid := range uids {
+		if !refused[uid] {
+			kept = append(kept, uid)
+		}
+	}
+	return kept, mismatches, nil
+}
@@ -0,0 +1,86 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+var (
+	// ErrMailboxNotFound is wrapped by errors selecting a mailbox the
+	// server reports as not existing.
+	ErrMailboxNotFound = errors.New("mailbox not found")
+	// ErrUIDValidityChanged is wrapped by errors of Apply if the
+	// UIDVALIDITY of a mailbox changed since it was scanned, so that
+	// the UIDs of the groups may name other messages now.
+	ErrUIDValidityChanged = errors.New("UIDVALIDITY changed since the scan")
+	// ErrFullExpunge is wrapped by errors of Apply if the server lacks
+	// UIDPLUS and EXPUNGE would also remove messages other clients
+	// flagged \Deleted, see ActionDeleteExpungeAll.
+	ErrFullExpunge = errors.New("server lacks UIDPLUS, EXPUNGE would also remove the messages other clients flagged \\Deleted")
+)
+
+// Error is the error of an operation on a mailbox. All errors returned
+// by Scan, Apply and Reconcile are of this type.
+type Error struct {
+	// Op is the operation which failed, an IMAP command such as
+	// "select", "search", "fetch", "store" or "expunge", or the Phase
+	// a canceled run stopped in.
+	Op      string
+	Mailbox string
+	// Set are the messages the command was issued for, if any. They
+	// are UIDs unless SeqNums is set.
+	Set     *imap.SeqSet
+	SeqNums bool
+	Err     error
+}
+
+func (e *Error) Error() string {
+	s := e.Op + " " + e.Mailbox
+	if e.Set != nil {
+		if e.SeqNums {
+			s += " messages " + e.Set.String()
+		} else {
+			s += " UIDs " + e.Set.String()
+		}
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// canceled returns the error of a run on mbox stopped in phase p as
+// ctx is done.
+func canceled(ctx context.Context, mbox string, p Phase) error {
+	return &Error{Op: string(p), Mailbox: mbox, Err: fmt.Errorf("canceled: %w", ctx.Err())}
+}
+
+// canceledIn is canceled for a scan stopped before or while fetching
+// the window w, which is named in the error so that it tells where
+// the scan stopped.
+func canceledIn(ctx context.Context, mbox string, p Phase, w window) error {
+	return &Error{Op: string(p), Mailbox: mbox, Set: w.seqset, SeqNums: !w.uid, Err: fmt.Errorf("canceled: %w", ctx.Err())}
+}
+
+// notFoundTexts are parts of the texts servers reject selecting a
+// missing mailbox with. go-imap drops the NONEXISTENT response code,
+// so the text is all there is to go by.
+var notFoundTexts = []string{"nonexistent", "no such mailbox", "unknown mailbox", "doesn't exist", "does not exist", "not found"}
+
+// selectError returns the error of selecting mbox, wrapping
+// ErrMailboxNotFound if err says that it does not exist.
+func selectError(mbox string, err error) error {
+	text := strings.ToLower(err.Error())
+	for _, t := range notFoundTexts {
+		if strings.Contains(text, t) {
+			err = fmt.Errorf("%w: %s", ErrMailboxNotFound, err)
+			break
+		}
+	}
+	return &Error{Op: "select", Mailbox: mbox, Err: err}
+}
@@ -0,0 +1,91 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+func TestErrorString(t *testing.T) {
+	set := new(imap.SeqSet)
+	set.AddRange(5, 10)
+	failure := errors.New("Mailbox is locked")
+	for _, test := range []struct {
+		err  *Error
+		want string
+	}{
+		{&Error{Op: "select", Mailbox: "INBOX", Err: failure}, "select INBOX: Mailbox is locked"},
+		{&Error{Op: "store", Mailbox: "Archive/2020", Set: set, Err: failure}, "store Archive/2020 UIDs 5:10: Mailbox is locked"},
+		{&Error{Op: "fetch", Mailbox: "INBOX", Set: set, SeqNums: true, Err: failure}, "fetch INBOX messages 5:10: Mailbox is locked"},
+	} {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+		if !errors.Is(test.err, failure) {
+			t.Errorf("%q does not wrap its cause", test.err)
+		}
+	}
+}
+
+// TestErrorChain checks the errors returned on a real session: their
+// rendering, that they are *Error and what they wrap.
+func TestErrorChain(t *testing.T) {
+	s, c := newServer(t,
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+	)
+	groups := scan(t, c, Config{})
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failure := errors.New("connection reset")
+
+	for _, test := range []struct {
+		name string
+		run  func() error
+		op   string
+		want string
+		is   error
+	}{
+		{"missing mailbox", func() error {
+			_, err := Scan(context.Background(), c, "Missing", Config{})
+			return err
+		}, "select", "select Missing: mailbox not found: No such mailbox", ErrMailboxNotFound},
+		{"canceled", func() error {
+			_, err := Scan(canceledCtx, c, "INBOX", Config{})
+			return err
+		}, "select", "select INBOX: canceled: context canceled", context.Canceled},
+		{"fetch", func() error {
+			_, err := Scan(context.Background(), &failingFetch{Client: c, err: failure}, "INBOX", Config{})
+			return err
+		}, "fetch", "fetch INBOX UIDs 1:4294967295: connection reset", failure},
+		{"fetch chunk", func() error {
+			_, err := Scan(context.Background(), &failingFetch{Client: c, err: failure}, "INBOX", Config{FetchChunk: 1})
+			return err
+		}, "fetch", "fetch INBOX messages 1: connection reset", failure},
+		{"UIDVALIDITY", func() error {
+			g := groups[0]
+			g.UIDValidity++
+			_, err := Apply(context.Background(), c, []Group{g}, ActionDelete, nil)
+			return err
+		}, "select", "select INBOX: UIDVALIDITY changed since the scan: was 2, is 1", ErrUIDValidityChanged},
+	} {
+		err := test.run()
+		var e *Error
+		if !errors.As(err, &e) || e.Op != test.op {
+			t.Errorf("%s: got error %#v", test.name, err)
+			continue
+		}
+		if err.Error() != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, err, test.want)
+		}
+		if !errors.Is(err, test.is) {
+			t.Errorf("%s: %q does not wrap %q", test.name, err, test.is)
+		}
+	}
+	if uids := s.UIDs(t, "INBOX"); len(uids) != 2 {
+		t.Errorf("got UIDs %v", uids)
+	}
+}
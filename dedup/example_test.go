@@ -0,0 +1,91 @@
+package dedup_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+	"github.com/tomasvitek/imap-clean-dup/internal/fakeimap"
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// This example removes the duplicates of INBOX, reporting the messages
+// scanned as they are keyed.
+func Example() {
+	c, err := client.DialTLS("imap.example.org:993", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	groups, err := dedup.Scan(ctx, c, "INBOX", dedup.Config{
+		Progress: func(e dedup.Event) {
+			if e.Kind == dedup.EventMessage && e.Duplicate {
+				log.Printf("%d is a duplicate: %q", e.UID, e.Subject)
+			}
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	res, err := dedup.Apply(ctx, c, groups, dedup.ActionDelete, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("removed %d duplicates\n", res.Removed)
+}
+
+// This example scans a mailbox read-only, on a fake client standing in
+// for a *client.Client, and lists the copies of each message found more
+// than once.
+func ExampleScan() {
+	c := fakeimap.New()
+	c.Append("INBOX",
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "Hello"}.Bytes(),
+		imaptest.Message{MessageID: "<b@example.org>", Subject: "Other"}.Bytes(),
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "Hello"}.Bytes(),
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "Hello"}.Bytes(),
+	)
+	groups, err := dedup.Scan(context.Background(), c, "INBOX", dedup.Config{ReadOnly: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, g := range groups {
+		fmt.Printf("keeping %d, removing %v\n", g.Keeper, g.Duplicates)
+	}
+	fmt.Println(dedup.Count(groups), "duplicates")
+	// Output:
+	// keeping 1, removing [3 4]
+	// 2 duplicates
+}
+
+// This example removes the duplicates found by Scan, marking them
+// \Deleted and expunging them.
+func ExampleApply() {
+	c := fakeimap.New()
+	c.Append("INBOX",
+		imaptest.Message{MessageID: "<a@example.org>"}.Bytes(),
+		imaptest.Message{MessageID: "<a@example.org>"}.Bytes(),
+		imaptest.Message{MessageID: "<b@example.org>"}.Bytes(),
+	)
+	ctx := context.Background()
+	groups, err := dedup.Scan(ctx, c, "INBOX", dedup.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	res, err := dedup.Apply(ctx, c, groups, dedup.ActionDelete, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("removed", res.Removed, "left", c.UIDs("INBOX"))
+	// Output:
+	// removed 1 left [1 3]
+}
@@ -0,0 +1,237 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+	"github.com/tomasvitek/imap-clean-dup/seed"
+)
+
+// failingFetch fails every FETCH and UID FETCH of Client with err after
+// passing on at most after of its messages, as a server dropping the
+// connection part way. It closes ch as Client does.
+type failingFetch struct {
+	Client
+	after int
+	err   error
+	// fetches counts the fetches issued.
+	fetches int32
+}
+
+func (c *failingFetch) Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.fetch(false, seqset, items, ch)
+}
+
+func (c *failingFetch) UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.fetch(true, seqset, items, ch)
+}
+
+func (c *failingFetch) fetch(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	atomic.AddInt32(&c.fetches, 1)
+	defer close(ch)
+	in := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		if uid {
+			done <- c.Client.UidFetch(seqset, items, in)
+		} else {
+			done <- c.Client.Fetch(seqset, items, in)
+		}
+	}()
+	n := 0
+	for msg := range in {
+		if n < c.after {
+			ch <- msg
+			n++
+		}
+	}
+	<-done
+	return c.err
+}
+
+// noEnvelope drops the envelope of the messages fetched by Client whose
+// UIDs are in uids, as servers failing to parse them do.
+type noEnvelope struct {
+	Client
+	uids map[uint32]bool
+}
+
+func (c *noEnvelope) Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.fetch(false, seqset, items, ch)
+}
+
+func (c *noEnvelope) UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.fetch(true, seqset, items, ch)
+}
+
+func (c *noEnvelope) fetch(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	defer close(ch)
+	in := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		if uid {
+			done <- c.Client.UidFetch(seqset, items, in)
+		} else {
+			done <- c.Client.Fetch(seqset, items, in)
+		}
+	}()
+	for msg := range in {
+		if c.uids[msg.Uid] {
+			msg.Envelope = nil
+		}
+		ch <- msg
+	}
+	return <-done
+}
+
+// fetchPaths are the functions of the package which fetch messages in
+// a goroutine, on INBOX of fetchServer.
+var fetchPaths = []struct {
+	name string
+	run  func(ctx context.Context, c Client) error
+}{
+	{"Scan", func(ctx context.Context, c Client) error {
+		_, err := Scan(ctx, c, "INBOX", Config{HashWorkers: 4, FetchChunk: 2})
+		return err
+	}},
+	{"Scan tiered", func(ctx context.Context, c Client) error {
+		_, err := Scan(ctx, c, "INBOX", Config{Strategy: StrategyTiered, HashWorkers: 4})
+		return err
+	}},
+	{"Scan conversation", func(ctx context.Context, c Client) error {
+		_, err := Scan(ctx, c, "INBOX", Config{Scope: ScopeConversation, HashWorkers: 4})
+		return err
+	}},
+	{"Compare", func(ctx context.Context, c Client) error {
+		_, err := Compare(ctx, c, "INBOX", Config{HashWorkers: 4})
+		return err
+	}},
+	{"Analyze", func(ctx context.Context, c Client) error {
+		_, err := Analyze(ctx, c, "INBOX", Config{HashWorkers: 4})
+		return err
+	}},
+	{"Verify", func(ctx context.Context, c Client) error {
+		_, err := Verify(ctx, c, "INBOX", []Group{{Mailbox: "INBOX", Keeper: 1, Duplicates: []uint32{2}}}, Config{})
+		return err
+	}},
+	{"MergeFlags", func(ctx context.Context, c Client) error {
+		_, err := MergeFlags(ctx, c, []Group{{Mailbox: "INBOX", Keeper: 1, Duplicates: []uint32{2, 5}}}, nil)
+		return err
+	}},
+	{"Snippets", func(ctx context.Context, c Client) error {
+		_, err := Snippets(ctx, c, "INBOX", []uint32{1, 2, 3}, 40, nil)
+		return err
+	}},
+	{"TakeInventory", func(ctx context.Context, c Client) error {
+		_, err := TakeInventory(ctx, c, "INBOX", Config{})
+		return err
+	}},
+	{"Reconcile", func(ctx context.Context, c Client) error {
+		_, err := Reconcile(ctx, c, "INBOX", "Sent", PreferInbox, Config{})
+		return err
+	}},
+}
+
+// fetchServer returns a server with duplicates in INBOX and Sent.
+func fetchServer(t *testing.T) *imaptest.Server {
+	s := imaptest.NewServer(t)
+	for _, mbox := range []string{"INBOX", "Sent"} {
+		s.AppendMessages(t, mbox,
+			imaptest.Message{MessageID: "<a@example.org>", Subject: "A", Body: "one"},
+			imaptest.Message{MessageID: "<a@example.org>", Subject: "A", Body: "one"},
+			imaptest.Message{MessageID: "<b@example.org>", Subject: "B"},
+			imaptest.Message{Subject: "C"},
+			imaptest.Message{MessageID: "<a@example.org>", Subject: "A", Body: "one"},
+		)
+	}
+	return s
+}
+
+// TestFetchErrorFirst fails the first fetch of each path before it
+// delivers any message, on a real session, and checks that the error
+// is returned at once, without fetching anything else. Run it with
+// -race: the fetch goroutines only hand their error over on a channel.
+func TestFetchErrorFirst(t *testing.T) {
+	s := fetchServer(t)
+	failure := errors.New("Mailbox is inaccessible")
+	for _, path := range fetchPaths {
+		c := &failingFetch{Client: s.Dial(t), err: failure}
+		err := path.run(context.Background(), c)
+		var e *Error
+		if !errors.As(err, &e) || e.Op != "fetch" || e.Mailbox == "" || !errors.Is(err, failure) {
+			t.Errorf("%s: got error %v", path.name, err)
+		}
+		if c.fetches != 1 {
+			t.Errorf("%s: %d fetches issued", path.name, c.fetches)
+		}
+	}
+}
+
+// TestFetchErrorMidway is the regression test of the fetch goroutine
+// assigning its error to the named result of the function ranging over
+// the messages: the fetch fails after delivering some messages, while
+// they are still being keyed, which -race reports should the two
+// goroutines share the variable again.
+func TestFetchErrorMidway(t *testing.T) {
+	s := fetchServer(t)
+	failure := errors.New("connection reset")
+	for _, path := range fetchPaths {
+		c := &failingFetch{Client: s.Dial(t), after: 2, err: failure}
+		if err := path.run(context.Background(), c); !errors.Is(err, failure) {
+			t.Errorf("%s: got error %v", path.name, err)
+		}
+	}
+
+	// many messages keyed by several workers while the fetch fails
+	s = imaptest.NewServer(t)
+	s.AppendSeed(t, "INBOX", seed.Generate(seed.Config{Messages: 500, DuplicateRatio: 0.3, MinSize: 64, MaxSize: 256}))
+	for _, after := range []int{0, 1, 250, 499} {
+		c := &failingFetch{Client: s.Dial(t), after: after, err: failure}
+		groups, err := Scan(context.Background(), c, "INBOX", Config{HashWorkers: 8})
+		if !errors.Is(err, failure) || groups != nil {
+			t.Errorf("after %d messages: got %d groups, error %v", after, len(groups), err)
+		}
+	}
+}
+
+// TestFetchNoEnvelope interleaves messages without an envelope with
+// those having one on every fetch path, which must neither fail nor
+// treat them as copies.
+func TestFetchNoEnvelope(t *testing.T) {
+	s := fetchServer(t)
+	// 1, 2 and 5 of INBOX are copies, as are those of Sent
+	for _, path := range fetchPaths {
+		c := &noEnvelope{Client: s.Dial(t), uids: map[uint32]bool{2: true, 4: true}}
+		if err := path.run(context.Background(), c); err != nil {
+			t.Errorf("%s: %v", path.name, err)
+		}
+	}
+
+	var skipped []uint32
+	c := &noEnvelope{Client: s.Dial(t), uids: map[uint32]bool{2: true, 4: true}}
+	groups, err := Scan(context.Background(), c, "INBOX", Config{Progress: func(e Event) {
+		if e.Kind == EventNoEnvelope {
+			skipped = append(skipped, e.UID)
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]uint32{{1, 5}}; !reflect.DeepEqual(copies(groups), want) {
+		t.Errorf("got copies %v, want %v", copies(groups), want)
+	}
+	if want := []uint32{2, 4}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("skipped %v, want %v", skipped, want)
+	}
+
+	// nor is a message without one ever the keeper
+	c = &noEnvelope{Client: s.Dial(t), uids: map[uint32]bool{1: true, 2: true, 5: true}}
+	if groups, err := Scan(context.Background(), c, "INBOX", Config{}); err != nil || len(groups) != 0 {
+		t.Errorf("got groups %+v, error %v", groups, err)
+	}
+}
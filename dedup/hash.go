@@ -0,0 +1,330 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// AddressField is a set of envelope address fields.
+type AddressField int
+
+const (
+	FieldFrom AddressField = 1 << iota
+	FieldSender
+	FieldReplyTo
+	FieldTo
+	FieldCc
+	FieldBcc
+)
+
+// AddressFields lists the address fields with their names in the order
+// they are hashed.
+var AddressFields = []struct {
+	Field AddressField
+	Name  string
+	get   func(*imap.Envelope) []*imap.Address
+}{
+	{FieldFrom, "from", func(e *imap.Envelope) []*imap.Address { return e.From }},
+	{FieldSender, "sender", func(e *imap.Envelope) []*imap.Address { return e.Sender }},
+	{FieldReplyTo, "reply-to", func(e *imap.Envelope) []*imap.Address { return e.ReplyTo }},
+	{FieldTo, "to", func(e *imap.Envelope) []*imap.Address { return e.To }},
+	{FieldCc, "cc", func(e *imap.Envelope) []*imap.Address { return e.Cc }},
+	{FieldBcc, "bcc", func(e *imap.Envelope) []*imap.Address { return e.Bcc }},
+}
+
+// timeFormat is the layout of time.Time.String.
+const timeFormat = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// listIDSection fetches the List-Id header of a message.
+var listIDSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"List-Id"}},
+	Peek:         true,
+}
+
+// errNoEnvelope is the key error of messages returned without an
+// envelope, as some Exchange servers do for calendar items.
+var errNoEnvelope = errors.New("no envelope returned")
+
+// HashVersion identifies the scheme of envelope hash keys. Version 1
+// appended the SHA-1 of nothing to the envelope instead of hashing it;
+// version 2 is the hex encoded SHA-1 of the envelope.
+const HashVersion = 2
+
+// envelopeHasher calculates the key of messages without a usable
+// Message-ID from their envelope as configured. Its
+// buffers and hash are reused between messages.
+type envelopeHasher struct {
+	cfg  Config
+	hash hash.Hash
+	buf  []byte
+	sum  []byte
+	key  []byte
+	tmpl bytes.Buffer
+}
+
+// Digest returns the key digest of a message, derived from its
+// Message-ID unless it has none or the configuration ignores it. hashed
+// reports whether the envelope hash was used. With a KeyTemplate the
+// key is the output of the template instead, and err is set if it
+// fails for msg. With RawHeader it is the hash of the header, err is
+// set if the header was not returned. Messages the server returned
+// without an envelope have no key, err is errNoEnvelope for them.
+func (h *envelopeHasher) Digest(msg *imap.Message) (d digest, hashed bool, err error) {
+	if msg.Envelope == nil {
+		return d, false, errNoEnvelope
+	}
+	if h.cfg.KeyTemplate != nil {
+		h.tmpl.Reset()
+		if err := h.cfg.KeyTemplate.Execute(&h.tmpl, NewKeyData(msg)); err != nil {
+			return d, true, err
+		}
+		h.tmpl.Write(h.appendExtras(nil, msg))
+		return keyDigest(h.appendSender(h.tmpl.Bytes(), msg)), true, nil
+	}
+	if h.cfg.RawHeader {
+		patterns := h.cfg.VolatileHeaders
+		if patterns == nil {
+			patterns = DefaultVolatileHeaders
+		}
+		h.buf, err = appendRawHeader(h.buf[:0], msg, patterns)
+		if err != nil {
+			return d, true, err
+		}
+		h.buf = h.appendSender(h.appendExtras(h.buf, msg), msg)
+		return keyDigest(h.buf), true, nil
+	}
+	if msg.Envelope.MessageId != "" && !h.cfg.IgnoreMessageID {
+		h.buf = append(h.buf[:0], msg.Envelope.MessageId...)
+		h.buf = h.appendExtras(h.buf, msg)
+		return keyDigest(h.buf), false, nil
+	}
+	return keyDigest(h.appendSender(h.Key(msg), msg)), true, nil
+}
+
+// appendSender appends the first From address of msg, in lower case,
+// to the key b with ScopeBySender.
+func (h *envelopeHasher) appendSender(b []byte, msg *imap.Message) []byte {
+	if !h.cfg.ScopeBySender {
+		return b
+	}
+	b = append(b, "\nscope-sender:"...)
+	if len(msg.Envelope.From) > 0 {
+		from := msg.Envelope.From[0]
+		b = append(b, strings.ToLower(from.MailboxName+"@"+from.HostName)...)
+	}
+	return b
+}
+
+// appendExtras appends what every kind of key includes as configured,
+// the attachments and the size of msg.
+func (h *envelopeHasher) appendExtras(b []byte, msg *imap.Message) []byte {
+	if h.cfg.AttachmentNames {
+		b = appendAttachments(b, msg)
+	}
+	if h.cfg.KeySize {
+		b = append(b, "\nsize:"...)
+		b = strconv.AppendUint(b, uint64(msg.Size), 10)
+	}
+	return b
+}
+
+// KeyData is what a KeyTemplate is executed on. Addresses are given as
+// mailbox@host.
+type KeyData struct {
+	Date      time.Time
+	Subject   string
+	MessageID string
+	InReplyTo string
+	From      []string
+	Sender    []string
+	ReplyTo   []string
+	To        []string
+	Cc        []string
+	Bcc       []string
+	// ListID is the List-Id header of the message.
+	ListID string
+}
+
+// NewKeyData returns the template data of a fetched message.
+func NewKeyData(msg *imap.Message) KeyData {
+	env := msg.Envelope
+	addrs := func(list []*imap.Address) []string {
+		s := make([]string, len(list))
+		for i, a := range list {
+			s[i] = a.MailboxName + "@" + a.HostName
+		}
+		return s
+	}
+	return KeyData{
+		Date:      env.Date,
+		Subject:   env.Subject,
+		MessageID: env.MessageId,
+		InReplyTo: env.InReplyTo,
+		From:      addrs(env.From),
+		Sender:    addrs(env.Sender),
+		ReplyTo:   addrs(env.ReplyTo),
+		To:        addrs(env.To),
+		Cc:        addrs(env.Cc),
+		Bcc:       addrs(env.Bcc),
+		ListID:    listID(msg),
+	}
+}
+
+func newEnvelopeHasher(cfg Config) *envelopeHasher {
+	return &envelopeHasher{cfg: cfg, hash: sha1.New()}
+}
+
+// Key returns the hex encoded key of msg. The returned slice is only
+// valid until the next call.
+func (h *envelopeHasher) Key(msg *imap.Message) []byte {
+	env := msg.Envelope
+	b := append(h.buf[:0], "date:"...)
+	if h.cfg.DateWindow > 0 {
+		b = env.Date.UTC().Truncate(h.cfg.DateWindow).AppendFormat(b, timeFormat)
+	} else {
+		b = env.Date.AppendFormat(b, timeFormat)
+	}
+	b = append(b, "\nsubject:"...)
+	if h.cfg.NormalizeSubject {
+		b = append(b, normalizeSubject(env.Subject)...)
+	} else {
+		b = append(b, env.Subject...)
+	}
+	if h.cfg.ListID {
+		b = append(b, "\nlist-id:"...)
+		b = append(b, listID(msg)...)
+	}
+	for _, af := range AddressFields {
+		if h.cfg.IgnoreFields&af.Field != 0 {
+			continue
+		}
+		for _, f := range af.get(env) {
+			b = append(b, '\n')
+			b = append(b, af.Name...)
+			b = append(b, ':')
+			b = append(b, f.MailboxName...)
+			b = append(b, '@')
+			b = append(b, f.HostName...)
+		}
+	}
+	b = append(b, "\nin-reply-to:"...)
+	b = append(b, env.InReplyTo...)
+	b = h.appendExtras(b, msg)
+
+	h.buf = b
+	h.hash.Reset()
+	h.hash.Write(b)
+	h.sum = h.hash.Sum(h.sum[:0])
+
+	n := hex.EncodedLen(len(h.sum))
+	if cap(h.key) < n {
+		h.key = make([]byte, n)
+	}
+	h.key = h.key[:n]
+	hex.Encode(h.key, h.sum)
+	return h.key
+}
+
+// subjectPrefixes are the reply and forward markers dropped from
+// normalized subjects.
+var subjectPrefixes = []string{"re:", "fwd:", "fw:", "aw:", "wg:"}
+
+// normalizeSubject lower cases the subject, drops any reply and forward
+// markers and collapses whitespace.
+func normalizeSubject(subject string) string {
+	s := strings.ToLower(strings.Join(strings.Fields(subject), " "))
+	for trimmed := true; trimmed; {
+		trimmed = false
+		for _, p := range subjectPrefixes {
+			if strings.HasPrefix(s, p) {
+				s = strings.TrimSpace(s[len(p):])
+				trimmed = true
+			}
+		}
+	}
+	return s
+}
+
+// listID returns the List-Id header of msg if it was fetched.
+func listID(msg *imap.Message) string {
+	body := msg.GetBody(listIDSection)
+	if body == nil {
+		return ""
+	}
+	header, err := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(header.Get("List-Id"))
+}
+
+// appendAttachments appends a line with the file name and size of each
+// attachment of msg to b, in the order of the parts. Parts with a file
+// name, or a disposition of attachment, count as attachments. Sizes
+// are those of the encoded parts.
+func appendAttachments(b []byte, msg *imap.Message) []byte {
+	if msg.BodyStructure == nil {
+		return b
+	}
+	msg.BodyStructure.Walk(func(path []int, part *imap.BodyStructure) bool {
+		name := attachmentName(part)
+		if name == "" && !strings.EqualFold(part.Disposition, "attachment") {
+			return true
+		}
+		b = append(b, "\nattachment:"...)
+		b = append(b, name...)
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, uint64(part.Size), 10)
+		// the parts of an attached message are not attachments of
+		// their own
+		return false
+	})
+	return b
+}
+
+// attachmentName returns the file name of part, from the filename
+// parameter of its disposition or else the name parameter of its type.
+// Unlike (*imap.BodyStructure).Filename it matches the parameter names
+// case-insensitively, as servers send them in upper case too.
+func attachmentName(part *imap.BodyStructure) string {
+	param := func(params map[string]string, name string) string {
+		for k, v := range params {
+			if strings.EqualFold(k, name) {
+				return v
+			}
+		}
+		return ""
+	}
+	if name := param(part.DispositionParams, "filename"); name != "" {
+		return name
+	}
+	return param(part.Params, "name")
+}
+
+// keyFetchItems returns the items to fetch for calculating keys.
+func keyFetchItems(cfg Config) []imap.FetchItem {
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822Size}
+	if cfg.ListID || cfg.KeyTemplate != nil {
+		items = append(items, listIDSection.FetchItem())
+	}
+	if cfg.Scope == ScopeConversation {
+		items = append(items, referencesSection.FetchItem())
+	}
+	if cfg.AttachmentNames {
+		items = append(items, imap.FetchBodyStructure)
+	}
+	if cfg.RawHeader {
+		items = append(items, headerSection.FetchItem())
+	}
+	return items
+}
@@ -0,0 +1,255 @@
+package dedup
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// fetchedMessage returns a message as fetched for keying, with a
+// Message-ID unless messageID is empty.
+func fetchedMessage(uid uint32, messageID string) *imap.Message {
+	msg := imap.NewMessage(uid, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822Size})
+	msg.Uid, msg.Size = uid, 4096
+	msg.Envelope = &imap.Envelope{
+		Date:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Subject:   "Quarterly report",
+		From:      []*imap.Address{{MailboxName: "alice", HostName: "example.org"}},
+		To:        []*imap.Address{{MailboxName: "bob", HostName: "example.org"}, {MailboxName: "carol", HostName: "example.org"}},
+		MessageId: messageID,
+	}
+	return msg
+}
+
+// digestConfigs are the kinds of keys on the hot path of a scan.
+var digestConfigs = []struct {
+	name string
+	cfg  Config
+}{
+	{"message-id", Config{}},
+	{"envelope", Config{IgnoreMessageID: true}},
+}
+
+func BenchmarkDigest(b *testing.B) {
+	for _, dc := range digestConfigs {
+		b.Run(dc.name, func(b *testing.B) {
+			h := newEnvelopeHasher(dc.cfg.withDefaults())
+			msg := fetchedMessage(1, "<20200102030405.1234@example.org>")
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := h.Digest(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestDigestAllocs guards the memory of scans of large mailboxes: keys
+// are digested into fixed size arrays with the buffers of the hasher,
+// which allocates nothing per message once warmed up.
+func TestDigestAllocs(t *testing.T) {
+	for _, dc := range digestConfigs {
+		h := newEnvelopeHasher(dc.cfg.withDefaults())
+		msg := fetchedMessage(1, "<20200102030405.1234@example.org>")
+		allocs := testing.AllocsPerRun(100, func() {
+			h.Digest(msg)
+		})
+		if allocs > 0 {
+			t.Errorf("%s: %v allocations per message", dc.name, allocs)
+		}
+	}
+}
+
+// TestKeyGolden pins the keys of HashVersion 2, the hex encoded SHA-1
+// of the envelope, and checks that the buffers reused between messages
+// do not change them. A deliberate change of the keys must come with a
+// new HashVersion.
+func TestKeyGolden(t *testing.T) {
+	for _, test := range []struct {
+		cfg      Config
+		envelope string
+		key      string
+	}{
+		{Config{}, "date:2020-01-02 03:04:05 +0000 UTC\nsubject:Quarterly report\nfrom:alice@example.org\nto:bob@example.org\nto:carol@example.org\nin-reply-to:", "54b390bdca71cb98deaae742ec2ba5b20bfdb8d5"},
+		{Config{NormalizeSubject: true, DateWindow: time.Hour}, "date:2020-01-02 03:00:00 +0000 UTC\nsubject:quarterly report\nfrom:alice@example.org\nto:bob@example.org\nto:carol@example.org\nin-reply-to:", "8f0be4fb65cc7c7ec91a4a4821bf04adfacbbb08"},
+		{Config{IgnoreFields: FieldTo}, "date:2020-01-02 03:04:05 +0000 UTC\nsubject:Quarterly report\nfrom:alice@example.org\nin-reply-to:", "26e190e55638938e639d917dde8401c4f14ff11e"},
+		{Config{ListID: true}, "date:2020-01-02 03:04:05 +0000 UTC\nsubject:Quarterly report\nlist-id:\nfrom:alice@example.org\nto:bob@example.org\nto:carol@example.org\nin-reply-to:", "890a7346b1bd05e707dd99017bed035d018bfc1a"},
+	} {
+		sum := sha1.Sum([]byte(test.envelope))
+		if got := hex.EncodeToString(sum[:]); got != test.key {
+			t.Errorf("%+v: SHA-1 of the envelope is %s, not %s", test.cfg, got, test.key)
+		}
+		h := newEnvelopeHasher(test.cfg.withDefaults())
+		if got := string(h.Key(fetchedMessage(1, ""))); got != test.key {
+			t.Errorf("%+v: got key %s, want %s", test.cfg, got, test.key)
+		}
+		other := fetchedMessage(2, "")
+		other.Envelope.Subject = "A much longer subject growing the buffers of the hasher"
+		h.Key(other)
+		if got := string(h.Key(fetchedMessage(1, ""))); got != test.key {
+			t.Errorf("%+v: got key %s after another message, want %s", test.cfg, got, test.key)
+		}
+	}
+
+	h := newEnvelopeHasher(Config{}.withDefaults())
+	d, hashed, err := h.Digest(fetchedMessage(1, "<a@example.org>"))
+	if got := fmt.Sprintf("%x", d); got != "48ca6375ef05266344d0959c6a45610b" || hashed || err != nil {
+		t.Errorf("got digest %s of the Message-ID, hashed %t, error %v", got, hashed, err)
+	}
+}
+
+func TestIgnoreFields(t *testing.T) {
+	for _, af := range AddressFields {
+		original := fetchedMessage(1, "")
+		changed := fetchedMessage(2, "")
+		for _, other := range AddressFields {
+			set := func(env *imap.Envelope, host string) {
+				addrs := []*imap.Address{{MailboxName: other.Name, HostName: host}}
+				switch other.Field {
+				case FieldFrom:
+					env.From = addrs
+				case FieldSender:
+					env.Sender = addrs
+				case FieldReplyTo:
+					env.ReplyTo = addrs
+				case FieldTo:
+					env.To = addrs
+				case FieldCc:
+					env.Cc = addrs
+				case FieldBcc:
+					env.Bcc = addrs
+				}
+			}
+			set(original.Envelope, "example.org")
+			if other.Field == af.Field {
+				set(changed.Envelope, "example.com")
+			} else {
+				set(changed.Envelope, "example.org")
+			}
+		}
+		for _, ignore := range []bool{false, true} {
+			var cfg Config
+			if ignore {
+				cfg.IgnoreFields = af.Field
+			}
+			h := newEnvelopeHasher(cfg.withDefaults())
+			d1, _, _ := h.Digest(original)
+			d2, _, _ := h.Digest(changed)
+			if (d1 == d2) != ignore {
+				t.Errorf("%s ignored %t: got same key %t", af.Name, ignore, d1 == d2)
+			}
+		}
+	}
+}
+
+// bodyStructure parses the BODYSTRUCTURE of a FETCH response, s.
+func bodyStructure(t *testing.T, s string) *imap.BodyStructure {
+	t.Helper()
+	fields, err := imap.NewReader(bufio.NewReader(strings.NewReader(s))).ReadList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := &imap.BodyStructure{}
+	if err := bs.Parse(fields); err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+// Fixtures of BODYSTRUCTURE responses.
+const (
+	plainBody = `("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" 120 4)`
+	pdfBody   = `(("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" 120 4)` +
+		`("APPLICATION" "PDF" ("NAME" "report.pdf") NIL NIL "BASE64" 1000 NIL ("ATTACHMENT" ("FILENAME" "report.pdf")) NIL NIL) "MIXED")`
+)
+
+func TestKeyAttachmentNames(t *testing.T) {
+	for _, test := range []struct {
+		name, body, want string
+	}{
+		{"plain text", plainBody, ""},
+		{"attachment", pdfBody, "\nattachment:report.pdf 1000"},
+		{"new version", strings.Replace(pdfBody, "1000", "1200", 1), "\nattachment:report.pdf 1200"},
+		{"lower case parameters", strings.NewReplacer("NAME", "name", "FILENAME", "filename").Replace(pdfBody), "\nattachment:report.pdf 1000"},
+		{"renamed", strings.ReplaceAll(pdfBody, "report.pdf", "report-v2.pdf"), "\nattachment:report-v2.pdf 1000"},
+		{
+			"name in the content type only",
+			`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 10 1)("IMAGE" "PNG" ("NAME" "logo.png") "<logo@example.org>" NIL "BASE64" 300 NIL ("INLINE" NIL) NIL NIL) "RELATED")`,
+			"\nattachment:logo.png 300",
+		},
+		{
+			"attachment without a name",
+			`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 10 1)("APPLICATION" "OCTET-STREAM" NIL NIL NIL "BASE64" 300 NIL ("ATTACHMENT" NIL) NIL NIL) "MIXED")`,
+			"\nattachment: 300",
+		},
+		{
+			"alternative bodies",
+			`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 10 1)("TEXT" "HTML" NIL NIL NIL "7BIT" 40 2) "ALTERNATIVE")`,
+			"",
+		},
+		{
+			// the attachments of a forwarded message are its own
+			"forwarded message",
+			`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 10 1)` +
+				`("MESSAGE" "RFC822" NIL NIL NIL "7BIT" 2000 ("Wed, 1 Jan 2020 00:00:00 +0000" "Fwd" NIL NIL NIL NIL NIL NIL NIL "<x@example.org>") ` +
+				`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 10 1)("APPLICATION" "PDF" NIL NIL NIL "BASE64" 500 NIL ("ATTACHMENT" ("FILENAME" "inner.pdf")) NIL NIL) "MIXED") ` +
+				`40 NIL ("ATTACHMENT" ("FILENAME" "fwd.eml")) NIL NIL) ` +
+				`("APPLICATION" "PDF" NIL NIL NIL "BASE64" 800 NIL ("ATTACHMENT" ("FILENAME" "outer.pdf")) NIL NIL) "MIXED")`,
+			"\nattachment:fwd.eml 2000\nattachment:outer.pdf 800",
+		},
+	} {
+		msg := fetchedMessage(1, "")
+		msg.BodyStructure = bodyStructure(t, test.body)
+		if got := string(appendAttachments(nil, msg)); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// the names and sizes are part of every kind of key, only if asked
+	for _, cfg := range []Config{{}, {KeySize: true}, {ListID: true}} {
+		for _, names := range []bool{false, true} {
+			cfg.AttachmentNames = names
+			h := newEnvelopeHasher(cfg.withDefaults())
+			key := func(body string) string {
+				msg := fetchedMessage(1, "<a@example.org>")
+				if body != "" {
+					msg.BodyStructure = bodyStructure(t, body)
+				}
+				d, _, err := h.Digest(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return fmt.Sprintf("%x", d)
+			}
+			if key(plainBody) != key("") {
+				t.Errorf("%+v: a body without attachments changed the key", cfg)
+			}
+			if changed := key(pdfBody) != key(strings.Replace(pdfBody, "1000", "1200", 1)); changed != names {
+				t.Errorf("%+v: another attachment size changed the key: %t", cfg, changed)
+			}
+			if changed := key(pdfBody) != key(plainBody); changed != names {
+				t.Errorf("%+v: an attachment changed the key: %t", cfg, changed)
+			}
+		}
+
+		fetched := false
+		for _, item := range keyFetchItems(Config{AttachmentNames: true}) {
+			fetched = fetched || item == imap.FetchBodyStructure
+		}
+		if !fetched {
+			t.Error("BODYSTRUCTURE not fetched")
+		}
+		for _, item := range keyFetchItems(Config{}) {
+			if item == imap.FetchBodyStructure {
+				t.Error("BODYSTRUCTURE fetched without AttachmentNames")
+			}
+		}
+	}
+}
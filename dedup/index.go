@@ -0,0 +1,241 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/emersion/go-imap"
+)
+
+// Index holds the key of every message of a mailbox seen so far, so
+// that messages arriving later can be checked against them without
+// scanning the mailbox again.
+//
+// That is only possible where a Scan compares keys alone and keeps the
+// first copy: with StrategyEnvelope, KeepFirst and ScopeMailbox, a
+// MinGroupSize of at most 2, and without MinWastedBytes, MaxDups,
+// PerSenderCap, Limit or a UID range. With any other Config nothing is
+// indexed, and the mailbox is scanned again whenever messages arrived.
+type Index struct {
+	Mailbox string
+	// UIDValidity is the UIDVALIDITY of the mailbox the keys belong
+	// to.
+	UIDValidity uint32
+	// UIDNext is the UID from which messages were not fetched yet.
+	UIDNext uint32
+
+	cfg  Config
+	keys map[digest]uint32
+	// rescan is set if cfg needs the whole mailbox to be scanned.
+	rescan bool
+}
+
+// incremental reports whether new messages can be checked against the
+// keys of an Index with cfg rather than by scanning the whole mailbox.
+func (cfg Config) incremental() bool {
+	return cfg.Strategy == StrategyEnvelope && cfg.Keep == KeepFirst && cfg.Scope == ScopeMailbox &&
+		cfg.MinGroupSize <= 2 && cfg.MinWastedBytes == 0 && cfg.MaxDups == 0 && cfg.PerSenderCap == 0 &&
+		cfg.Limit == 0 && cfg.UIDFrom <= 1 && cfg.UIDTo == 0
+}
+
+// NewIndex fetches the keys of the messages in mbox. Duplicates already
+// in the mailbox are left to Scan, the first copy of each is indexed.
+// Progress is not reported for them.
+func NewIndex(ctx context.Context, c Client, mbox string, cfg Config) (*Index, error) {
+	x := &Index{Mailbox: mbox, cfg: cfg.withDefaults()}
+	x.rescan = !x.cfg.incremental()
+	progress := x.cfg.Progress
+	x.cfg.Progress = nil
+	_, err := x.Update(ctx, c)
+	x.cfg.Progress = progress
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Update selects the mailbox, fetches the messages which arrived since
+// the last update and returns those with the key of an indexed message
+// as its duplicates; the others are indexed. Keepers which no longer
+// exist are replaced by their first duplicate. If the UIDVALIDITY of the
+// mailbox changed the index is rebuilt, checking every message.
+//
+// An EventMessage is reported for each new message, no EventSelected.
+//
+// Without an index, the mailbox is scanned again if its UIDNEXT grew or
+// its UIDVALIDITY changed, or every time if the server does not report
+// UIDNEXT, and all the groups found are returned. Events are only
+// reported for the new messages then.
+func (x *Index) Update(ctx context.Context, c Client) ([]Group, error) {
+	cfg, mbox, metrics := x.cfg, x.Mailbox, x.cfg.Metrics
+	if ctx.Err() != nil {
+		return nil, canceled(ctx, mbox, PhaseSelect)
+	}
+	done := metrics.Track(mbox, PhaseSelect)
+	st, err := c.Select(mbox, cfg.ReadOnly)
+	done(1, 0)
+	if err != nil {
+		return nil, selectError(mbox, err)
+	}
+	if x.rescan {
+		return x.scan(ctx, c, st)
+	}
+	if x.keys == nil || st.UidValidity != x.UIDValidity {
+		x.keys = make(map[digest]uint32)
+		x.UIDValidity, x.UIDNext = st.UidValidity, 1
+	}
+	if st.Messages == 0 || (st.UidNext != 0 && st.UidNext <= x.UIDNext) {
+		if st.UidNext != 0 {
+			x.UIDNext = st.UidNext
+		}
+		return nil, nil
+	}
+	deleted, err := deletedUIDs(c, st, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.UIDFrom, cfg.UIDTo, cfg.Limit = x.UIDNext, 0, 0
+	windows, _, err := scanWindows(c, st, cfg)
+	if err != nil {
+		return nil, err
+	}
+	var dups []uint32
+	var dupKeys []digest
+	next := x.UIDNext
+	for _, w := range windows {
+		if ctx.Err() != nil {
+			return nil, canceledIn(ctx, mbox, PhaseFetch, w)
+		}
+		_, err := fetchWindow(ctx, c, mbox, w, cfg, func(k keyed) {
+			msg := k.msg
+			if msg.Uid < x.UIDNext || (st.UidNext != 0 && msg.Uid >= st.UidNext) {
+				return
+			}
+			if msg.Uid >= next {
+				next = msg.Uid + 1
+			}
+			if _, ok := deleted[msg.Uid]; ok {
+				return
+			}
+			if k.err == errNoEnvelope {
+				cfg.progress(Event{Kind: EventNoEnvelope, Mailbox: mbox, UID: msg.Uid, Size: msg.Size})
+				return
+			}
+			if k.err != nil {
+				cfg.progress(Event{Kind: EventKeyError, Mailbox: mbox, UID: msg.Uid, Subject: msg.Envelope.Subject, Err: k.err})
+				return
+			}
+			first, found := x.keys[k.key]
+			if found && first == msg.Uid {
+				return
+			}
+			if found {
+				dups = append(dups, msg.Uid)
+				dupKeys = append(dupKeys, k.key)
+			} else {
+				x.keys[k.key] = msg.Uid
+			}
+			if cfg.Progress == nil {
+				return
+			}
+			messageID := msg.Envelope.MessageId
+			if k.hashed {
+				messageID = fmt.Sprintf("%x", k.key)
+			}
+			var from string
+			if addrs := msg.Envelope.From; len(addrs) > 0 {
+				from = addrs[0].MailboxName + "@" + addrs[0].HostName
+			}
+			cfg.progress(Event{
+				Kind:      EventMessage,
+				Mailbox:   mbox,
+				UID:       msg.Uid,
+				Subject:   msg.Envelope.Subject,
+				Date:      msg.Envelope.Date,
+				From:      from,
+				Size:      msg.Size,
+				Key:       messageID,
+				Duplicate: found,
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if st.UidNext != 0 {
+		next = st.UidNext
+	}
+	x.UIDNext = next
+	if len(dups) == 0 {
+		return nil, nil
+	}
+
+	// keepers may have been removed since they were indexed
+	keepers := &imap.SeqSet{}
+	for _, key := range dupKeys {
+		keepers.AddNum(x.keys[key])
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = keepers
+	done = metrics.Track(mbox, PhaseSelect)
+	found, err := c.UidSearch(criteria)
+	done(1, len(found))
+	if err != nil {
+		return nil, &Error{Op: "search", Mailbox: mbox, Set: keepers, Err: err}
+	}
+	exists := make(map[uint32]bool, len(found))
+	for _, uid := range found {
+		exists[uid] = true
+	}
+
+	var groups []Group
+	index := make(map[digest]int)
+	for i, uid := range dups {
+		key := dupKeys[i]
+		if !exists[x.keys[key]] {
+			x.keys[key] = uid
+			exists[uid] = true
+			continue
+		}
+		j, ok := index[key]
+		if !ok {
+			j = len(groups)
+			index[key] = j
+			groups = append(groups, Group{
+				Mailbox:     mbox,
+				Key:         fmt.Sprintf("%x", key),
+				HashVersion: HashVersion,
+				Keeper:      x.keys[key],
+				UIDValidity: st.UidValidity,
+				Strategy:    StrategyEnvelope,
+			})
+		}
+		groups[j].Duplicates = append(groups[j].Duplicates, uid)
+	}
+	return groups, nil
+}
+
+// scan scans the mailbox again for an Index without keys, selected with
+// status st, unless it is the first update or no messages arrived.
+func (x *Index) scan(ctx context.Context, c Client, st *imap.MailboxStatus) ([]Group, error) {
+	first := x.UIDValidity == 0
+	unchanged := st.UidValidity == x.UIDValidity && st.UidNext != 0 && st.UidNext <= x.UIDNext
+	from := x.UIDNext
+	if st.UidValidity != x.UIDValidity {
+		from = 0
+	}
+	x.UIDValidity, x.UIDNext = st.UidValidity, st.UidNext
+	if first || unchanged || st.Messages == 0 {
+		return nil, nil
+	}
+	cfg := x.cfg
+	if progress := cfg.Progress; progress != nil {
+		cfg.Progress = func(e Event) {
+			if e.UID >= from && e.UID != 0 {
+				progress(e)
+			}
+		}
+	}
+	return Scan(ctx, c, x.Mailbox, cfg)
+}
@@ -0,0 +1,142 @@
+package dedup
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// appendMessages appends the messages with the given Message-IDs to
+// INBOX of c, from sender.
+func appendMessages(c interface {
+	Append(string, ...[]byte) []uint32
+}, sender string, ids ...string) {
+	for _, id := range ids {
+		c.Append("INBOX", imaptest.Message{MessageID: "<" + id + "@example.org>", From: sender, Subject: id}.Bytes())
+	}
+}
+
+// fetches returns the UID FETCH commands of commands.
+func fetches(commands []string) []string {
+	var fetched []string
+	for _, cmd := range commands {
+		if strings.HasPrefix(cmd, "UID FETCH ") {
+			fetched = append(fetched, cmd)
+		}
+	}
+	return fetched
+}
+
+func TestIndexUpdate(t *testing.T) {
+	c := newFake()
+	appendMessages(c, "a@example.org", "a", "b", "a")
+	ctx := context.Background()
+	x, err := NewIndex(ctx, c, "INBOX", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the duplicate already in the mailbox is left to Scan
+	if x.rescan || x.UIDNext != 4 {
+		t.Fatalf("got index %+v", x)
+	}
+
+	appendMessages(c, "a@example.org", "a", "c", "b", "c")
+	before := len(c.Commands())
+	groups, err := x.Update(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]uint32{{1, 4}, {2, 6}, {5, 7}}; !reflect.DeepEqual(copies(groups), want) {
+		t.Errorf("got copies %v, want %v", copies(groups), want)
+	}
+	// only the new messages are fetched
+	if got := fetches(c.Commands()[before:]); !reflect.DeepEqual(got, []string{"UID FETCH 4:4294967295"}) {
+		t.Errorf("got %q", got)
+	}
+
+	// nothing is fetched if nothing arrived
+	before = len(c.Commands())
+	if groups, err := x.Update(ctx, c); err != nil || len(groups) != 0 {
+		t.Errorf("got groups %+v, error %v", groups, err)
+	}
+	if got := c.Commands()[before:]; !reflect.DeepEqual(got, []string{"SELECT INBOX"}) {
+		t.Errorf("got commands %q without new messages", got)
+	}
+}
+
+// TestIndexRescan checks that the settings an index cannot follow make
+// Update scan the mailbox again, finding what Scan finds.
+func TestIndexRescan(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"strategy", Config{Strategy: StrategyTiered}},
+		{"keep", Config{Keep: KeepLast}},
+		{"scope", Config{Scope: ScopeConversation}},
+		{"min group size", Config{MinGroupSize: 3}},
+		{"min wasted bytes", Config{MinWastedBytes: 1}},
+		{"max dups", Config{MaxDups: 1, FetchChunk: 2}},
+		{"per sender cap", Config{PerSenderCap: 2}},
+		{"uid range", Config{UIDFrom: 2}},
+	} {
+		c := newFake()
+		appendMessages(c, "a@example.org", "a", "b", "c")
+		ctx := context.Background()
+		x, err := NewIndex(ctx, c, "INBOX", test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !x.rescan {
+			t.Errorf("%s: not scanned again", test.name)
+		}
+		if got := fetches(c.Commands()); len(got) != 0 {
+			t.Errorf("%s: got %q before anything arrived", test.name, got)
+		}
+
+		appendMessages(c, "a@example.org", "a", "b", "a", "d")
+		appendMessages(c, "b@example.org", "e")
+		groups, err := x.Update(ctx, c)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		want := scan(t, c, test.cfg)
+		if len(want) == 0 || !reflect.DeepEqual(copies(groups), copies(want)) {
+			t.Errorf("%s: got copies %v, Scan finds %v", test.name, copies(groups), copies(want))
+		}
+
+		before := len(c.Commands())
+		if groups, err := x.Update(ctx, c); err != nil || len(groups) != 0 {
+			t.Errorf("%s: got groups %+v, error %v without new messages", test.name, groups, err)
+		}
+		if got := c.Commands()[before:]; !reflect.DeepEqual(got, []string{"SELECT INBOX"}) {
+			t.Errorf("%s: got commands %q without new messages", test.name, got)
+		}
+	}
+}
+
+func TestIndexRescanEvents(t *testing.T) {
+	c := newFake()
+	appendMessages(c, "a@example.org", "a", "b")
+	var uids []uint32
+	cfg := Config{MinGroupSize: 3, Progress: func(e Event) {
+		if e.Kind == EventMessage {
+			uids = append(uids, e.UID)
+		}
+	}}
+	ctx := context.Background()
+	x, err := NewIndex(ctx, c, "INBOX", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendMessages(c, "a@example.org", "a", "a")
+	if _, err := x.Update(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(uids, []uint32{3, 4}) {
+		t.Errorf("got events of UIDs %v", uids)
+	}
+}
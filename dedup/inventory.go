@@ -0,0 +1,144 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Inventory holds the keys of the messages of a mailbox, such as one
+// migrated to another server, so that two copies of it can be compared.
+type Inventory struct {
+	Mailbox     string
+	UIDValidity uint32
+	// Subjects are the subjects of the messages by UID.
+	Subjects map[uint32]string
+
+	uids map[digest][]uint32
+	// order holds the keys in the order first seen.
+	order []digest
+}
+
+// TakeInventory examines mbox read-only and returns the keys of its
+// messages. Messages flagged \Deleted, without an envelope or whose key
+// fails are left out, so a diff never lists them on either side.
+// Strategy, Scope and the selection of kept copies do not apply, the
+// options of the key, Limit and the UID range do.
+func TakeInventory(ctx context.Context, c Client, mbox string, cfg Config) (*Inventory, error) {
+	cfg = cfg.withDefaults()
+	cfg.Scope = ScopeMailbox
+	metrics := cfg.Metrics
+	if ctx.Err() != nil {
+		return nil, canceled(ctx, mbox, PhaseSelect)
+	}
+	done := metrics.Track(mbox, PhaseSelect)
+	st, err := c.Select(mbox, true)
+	done(1, 0)
+	if err != nil {
+		return nil, selectError(mbox, err)
+	}
+	cfg.progress(Event{Kind: EventSelected, Mailbox: mbox, Status: st})
+	inv := &Inventory{Mailbox: mbox, UIDValidity: st.UidValidity, Subjects: make(map[uint32]string), uids: make(map[digest][]uint32)}
+	deleted, err := deletedUIDs(c, st, cfg)
+	if err != nil {
+		return nil, err
+	}
+	windows, _, err := scanWindows(c, st, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range windows {
+		if ctx.Err() != nil {
+			return nil, canceledIn(ctx, mbox, PhaseFetch, w)
+		}
+		_, err := fetchWindow(ctx, c, mbox, w, cfg, func(k keyed) {
+			msg := k.msg
+			if _, ok := inv.Subjects[msg.Uid]; ok {
+				return
+			}
+			if _, ok := deleted[msg.Uid]; ok {
+				return
+			}
+			if st.UidNext != 0 && msg.Uid >= st.UidNext {
+				return
+			}
+			if k.err == errNoEnvelope {
+				cfg.progress(Event{Kind: EventNoEnvelope, Mailbox: mbox, UID: msg.Uid, Size: msg.Size})
+				return
+			}
+			if k.err != nil {
+				cfg.progress(Event{Kind: EventKeyError, Mailbox: mbox, UID: msg.Uid, Subject: msg.Envelope.Subject, Err: k.err})
+				return
+			}
+			inv.Subjects[msg.Uid] = msg.Envelope.Subject
+			if _, ok := inv.uids[k.key]; !ok {
+				inv.order = append(inv.order, k.key)
+			}
+			inv.uids[k.key] = append(inv.uids[k.key], msg.Uid)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inv, nil
+}
+
+// Len returns the number of messages in the inventory.
+func (inv *Inventory) Len() int {
+	return len(inv.Subjects)
+}
+
+// InventoryDiff compares the inventory of a mailbox with that of its
+// copy, such as the old and the new server of a migration.
+type InventoryDiff struct {
+	// Both are the messages of the old mailbox also in the new one, as
+	// groups whose Duplicates are in the old mailbox and whose Keeper
+	// is the first copy in the new one, named by KeeperMailbox. Passed
+	// to Apply with a client of the old server they remove the
+	// migrated messages from it.
+	Both []Group
+	// OnlyOld are the UIDs of the messages of the old mailbox missing
+	// from the new one, in UID order. They were not migrated and must
+	// be kept.
+	OnlyOld []uint32
+	// OnlyNew are the UIDs of the messages of the new mailbox missing
+	// from the old one, in UID order.
+	OnlyNew []uint32
+}
+
+// DiffInventories compares the inventory of the old mailbox with that
+// of the new one. Every copy of a key in old is matched by the first
+// copy in new, so duplicates within the old mailbox are removed along.
+func DiffInventories(old, new *Inventory) InventoryDiff {
+	var d InventoryDiff
+	for _, key := range old.order {
+		uids := old.uids[key]
+		kept, ok := new.uids[key]
+		if !ok {
+			d.OnlyOld = append(d.OnlyOld, uids...)
+			continue
+		}
+		d.Both = append(d.Both, Group{
+			Mailbox:       old.Mailbox,
+			Key:           fmt.Sprintf("%x", key),
+			HashVersion:   HashVersion,
+			Keeper:        kept[0],
+			KeeperMailbox: new.Mailbox,
+			Duplicates:    append([]uint32(nil), uids...),
+			UIDValidity:   old.UIDValidity,
+			Strategy:      StrategyEnvelope,
+		})
+	}
+	for _, key := range new.order {
+		if _, ok := old.uids[key]; !ok {
+			d.OnlyNew = append(d.OnlyNew, new.uids[key]...)
+		}
+	}
+	sortUIDs(d.OnlyOld)
+	sortUIDs(d.OnlyNew)
+	return d
+}
+
+func sortUIDs(uids []uint32) {
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+}
@@ -0,0 +1,54 @@
+package dedup
+
+import "sort"
+
+// Keep selects which copy of a group of duplicates is kept.
+type Keep string
+
+const (
+	// KeepFirst keeps the copy with the lowest UID, usually the one
+	// delivered first.
+	KeepFirst Keep = "first"
+	// KeepLargest keeps the largest copy, e.g. the one which still has
+	// its attachments.
+	KeepLargest Keep = "largest"
+	// KeepSmallest keeps the smallest copy.
+	KeepSmallest Keep = "smallest"
+	// KeepLast keeps the copy with the highest UID, usually the one
+	// saved last, e.g. the latest version of a draft.
+	KeepLast Keep = "last"
+)
+
+// keepBySize makes the largest or smallest copy of each group its
+// Keeper as cfg.Keep asks, by the sizes of the scanned messages. Among
+// copies of the same size the one with the lowest UID is kept. With
+// KeepLast the sizes are ignored and the highest UID is kept.
+func keepBySize(groups []Group, sizes map[uint32]uint32, cfg Config) {
+	for i := range groups {
+		g := &groups[i]
+		keeper := g.Keeper
+		for _, uid := range g.Duplicates {
+			s, k := sizes[uid], sizes[keeper]
+			if cfg.Keep == KeepLast {
+				if uid > keeper {
+					keeper = uid
+				}
+				continue
+			}
+			if (cfg.Keep == KeepLargest && s > k) || (cfg.Keep == KeepSmallest && s < k) || (s == k && uid < keeper) {
+				keeper = uid
+			}
+		}
+		if keeper == g.Keeper {
+			continue
+		}
+		for j, uid := range g.Duplicates {
+			if uid == keeper {
+				g.Duplicates[j] = g.Keeper
+			}
+		}
+		sort.Slice(g.Duplicates, func(a, b int) bool { return g.Duplicates[a] < g.Duplicates[b] })
+		cfg.progress(Event{Kind: EventKeeper, Mailbox: g.Mailbox, UID: keeper, Size: sizes[keeper], Count: int(g.Keeper)})
+		g.Keeper = keeper
+	}
+}
@@ -0,0 +1,63 @@
+package dedup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+func TestKeep(t *testing.T) {
+	for _, test := range []struct {
+		keep   Keep
+		copies []uint32
+	}{
+		{KeepFirst, []uint32{1, 2, 3, 4}},
+		// UIDs 2 and 4 are as large, the lower is kept
+		{KeepLargest, []uint32{2, 1, 3, 4}},
+		{KeepSmallest, []uint32{3, 1, 2, 4}},
+		{KeepLast, []uint32{4, 1, 2, 3}},
+	} {
+		c := newFake(
+			imaptest.Message{MessageID: "<a@example.org>", Body: "medium"},
+			imaptest.Message{MessageID: "<a@example.org>", Body: strings.Repeat("large", 10)},
+			imaptest.Message{MessageID: "<a@example.org>"},
+			imaptest.Message{MessageID: "<a@example.org>", Body: strings.Repeat("LARGE", 10)},
+		)
+		var kept []Event
+		groups := scan(t, c, Config{Keep: test.keep, Progress: func(e Event) {
+			if e.Kind == EventKeeper {
+				kept = append(kept, e)
+			}
+		}})
+		if got := copies(groups); !reflect.DeepEqual(got, [][]uint32{test.copies}) {
+			t.Errorf("%s: got copies %v, want %v", test.keep, got, [][]uint32{test.copies})
+		}
+		// a keeper other than the first copy is reported
+		if moved := test.copies[0] != 1; moved != (len(kept) == 1) || moved && (kept[0].UID != test.copies[0] || kept[0].Count != 1) {
+			t.Errorf("%s: got events %+v", test.keep, kept)
+		}
+	}
+}
+
+// TestKeepTies checks that of copies as large the one with the lowest
+// UID is kept by the size policies.
+func TestKeepTies(t *testing.T) {
+	for _, test := range []struct {
+		keep   Keep
+		copies []uint32
+	}{
+		{KeepLargest, []uint32{1, 2, 3}},
+		{KeepSmallest, []uint32{2, 1, 3}},
+	} {
+		c := newFake(
+			imaptest.Message{MessageID: "<a@example.org>", Body: "large"},
+			imaptest.Message{MessageID: "<a@example.org>", Body: "tiny"},
+			imaptest.Message{MessageID: "<a@example.org>", Body: "tiny"},
+		)
+		if got := copies(scan(t, c, Config{Keep: test.keep})); !reflect.DeepEqual(got, [][]uint32{test.copies}) {
+			t.Errorf("%s: got copies %v, want %v", test.keep, got, [][]uint32{test.copies})
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// unmergedFlags are never copied by MergeFlags: \Deleted would remove
+// the keeper with its duplicates, \Recent is only set by the server and
+// \Draft describes a copy rather than what the user did with it.
+var unmergedFlags = map[string]bool{
+	strings.ToLower(imap.DeletedFlag): true,
+	strings.ToLower(imap.RecentFlag):  true,
+	strings.ToLower(imap.DraftFlag):   true,
+}
+
+// FlagMerge is a keeper which MergeFlags gave the flags of its
+// duplicates.
+type FlagMerge struct {
+	Mailbox string
+	UID     uint32
+	// Added are the flags the keeper lacked, sorted.
+	Added []string
+}
+
+// MergeFlags sets on the Keeper of each group the flags of its
+// Duplicates it lacks, such as \Seen, \Flagged, \Answered and custom
+// keywords, so that removing the duplicates with Apply afterwards loses
+// none of them. Flags are only ever added, never removed from a keeper.
+//
+// Groups of Config.PerSenderCap, whose messages are not copies, are
+// left out. A mailbox whose UIDVALIDITY differs from the one the groups
+// were scanned with is not touched, MergeFlags returns an error wrapping
+// ErrUIDValidityChanged then. Keepers and duplicates which no longer
+// exist are skipped.
+func MergeFlags(ctx context.Context, c Client, groups []Group, metrics *Metrics) ([]FlagMerge, error) {
+	type keeper struct {
+		mbox string
+		uid  uint32
+	}
+	var dupMailboxes, keeperMailboxes []string
+	dups := make(map[string][]uint32)
+	keepers := make(map[string][]uint32)
+	uidValidity := make(map[string]uint32)
+	for _, g := range groups {
+		if g.Sender != "" || len(g.Duplicates) == 0 {
+			continue
+		}
+		if _, ok := dups[g.Mailbox]; !ok {
+			dupMailboxes = append(dupMailboxes, g.Mailbox)
+		}
+		dups[g.Mailbox] = append(dups[g.Mailbox], g.Duplicates...)
+		if g.UIDValidity != 0 {
+			uidValidity[g.Mailbox] = g.UIDValidity
+		}
+		km := g.keeperMailbox()
+		if _, ok := keepers[km]; !ok {
+			keeperMailboxes = append(keeperMailboxes, km)
+		}
+		keepers[km] = append(keepers[km], g.Keeper)
+	}
+
+	// the flags of the duplicates, by keeper
+	wanted := make(map[keeper]map[string]string)
+	for _, mbox := range dupMailboxes {
+		flags, _, err := fetchFlags(ctx, c, mbox, true, uidValidity[mbox], dups[mbox], metrics)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			if g.Mailbox != mbox || g.Sender != "" {
+				continue
+			}
+			k := keeper{g.keeperMailbox(), g.Keeper}
+			for _, uid := range g.Duplicates {
+				for _, f := range flags[uid] {
+					if unmergedFlags[strings.ToLower(f)] {
+						continue
+					}
+					if wanted[k] == nil {
+						wanted[k] = make(map[string]string)
+					}
+					wanted[k][strings.ToLower(f)] = f
+				}
+			}
+		}
+	}
+
+	var merged []FlagMerge
+	for _, mbox := range keeperMailboxes {
+		var uids []uint32
+		for _, uid := range keepers[mbox] {
+			if len(wanted[keeper{mbox, uid}]) > 0 {
+				uids = append(uids, uid)
+			}
+		}
+		if len(uids) == 0 {
+			continue
+		}
+		has, permanent, err := fetchFlags(ctx, c, mbox, false, uidValidity[mbox], uids, metrics)
+		if err != nil {
+			return merged, err
+		}
+		storable := storableFlags(permanent)
+		// keepers lacking the same flags are given them with one STORE
+		sets := make(map[string]*imap.SeqSet)
+		var order []string
+		added := make(map[string][]string)
+		for _, uid := range uids {
+			current, ok := has[uid]
+			if !ok {
+				continue
+			}
+			missing := make(map[string]string)
+			for lower, f := range wanted[keeper{mbox, uid}] {
+				missing[lower] = f
+			}
+			for _, f := range current {
+				delete(missing, strings.ToLower(f))
+			}
+			for lower := range missing {
+				if !storable(lower) {
+					delete(missing, lower)
+				}
+			}
+			if len(missing) == 0 {
+				continue
+			}
+			var flags []string
+			for _, f := range missing {
+				flags = append(flags, f)
+			}
+			sort.Strings(flags)
+			key := strings.Join(flags, " ")
+			if sets[key] == nil {
+				sets[key] = &imap.SeqSet{}
+				order = append(order, key)
+				added[key] = flags
+			}
+			sets[key].AddNum(uid)
+			merged = append(merged, FlagMerge{Mailbox: mbox, UID: uid, Added: flags})
+		}
+		store := metrics.Track(mbox, PhaseStore)
+		for i, key := range order {
+			if ctx.Err() != nil {
+				store(i, 0)
+				return merged, canceled(ctx, mbox, PhaseStore)
+			}
+			values := make([]interface{}, len(added[key]))
+			for j, f := range added[key] {
+				values[j] = f
+			}
+			if err := c.UidStore(sets[key], imap.FormatFlagsOp(imap.AddFlags, true), values, nil); err != nil {
+				store(i+1, 0)
+				return merged, &Error{Op: "store", Mailbox: mbox, Set: sets[key], Err: err}
+			}
+		}
+		store(len(order), len(order))
+	}
+	return merged, nil
+}
+
+// keeperMailbox returns the mailbox of the Keeper of g.
+func (g Group) keeperMailbox() string {
+	if g.KeeperMailbox != "" {
+		return g.KeeperMailbox
+	}
+	return g.Mailbox
+}
+
+// storableFlags returns whether a flag, in lower case, can be stored
+// in a mailbox with the PERMANENTFLAGS permanent. System flags always
+// can, since some servers only list \*, keywords if they are listed or
+// new ones can be created. Servers not sending PERMANENTFLAGS are
+// assumed to store any.
+func storableFlags(permanent []string) func(flag string) bool {
+	allowed := make(map[string]bool)
+	for _, f := range permanent {
+		allowed[strings.ToLower(f)] = true
+	}
+	return func(flag string) bool {
+		return len(permanent) == 0 || strings.HasPrefix(flag, `\`) || allowed[flag] || allowed[imap.TryCreateFlag]
+	}
+}
+
+// fetchFlags selects mbox, read-only if readOnly is set, and returns the
+// flags of those of uids which exist together with the PERMANENTFLAGS of
+// mbox. If uidValidity is not 0 and the UIDVALIDITY of mbox differs,
+// nothing is fetched.
+func fetchFlags(ctx context.Context, c Client, mbox string, readOnly bool, uidValidity uint32, uids []uint32, metrics *Metrics) (map[uint32][]string, []string, error) {
+	if ctx.Err() != nil {
+		return nil, nil, canceled(ctx, mbox, PhaseSelect)
+	}
+	done := metrics.Track(mbox, PhaseSelect)
+	st, err := c.Select(mbox, readOnly)
+	done(1, 0)
+	if err != nil {
+		return nil, nil, selectError(mbox, err)
+	}
+	if uidValidity != 0 && st.UidValidity != uidValidity {
+		return nil, nil, &Error{Op: "select", Mailbox: mbox, Err: fmt.Errorf("%w: was %d, is %d", ErrUIDValidityChanged, uidValidity, st.UidValidity)}
+	}
+
+	seqset := &imap.SeqSet{}
+	seqset.AddNum(uids...)
+	msgChan := make(chan *imap.Message, 16)
+	errChan := make(chan error, 1)
+	fetch := metrics.Track(mbox, PhaseFetch)
+	go func() {
+		errChan <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, msgChan)
+	}()
+	flags := make(map[uint32][]string)
+	for msg := range msgChan {
+		if msg.Uid != 0 {
+			flags[msg.Uid] = msg.Flags
+		}
+	}
+	err = <-errChan
+	fetch(1, len(flags))
+	if err != nil {
+		return nil, nil, &Error{Op: "fetch", Mailbox: mbox, Set: seqset, Err: err}
+	}
+	return flags, st.PermanentFlags, nil
+}
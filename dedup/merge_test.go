@@ -0,0 +1,70 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+func TestMergeFlags(t *testing.T) {
+	s, c := newServer(t,
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>", Flags: []string{imap.SeenFlag, "$Label1"}},
+		imaptest.Message{MessageID: "<a@example.org>", Flags: []string{imap.FlaggedFlag, imap.SeenFlag}},
+		// \Draft describes the copy, it is not merged
+		imaptest.Message{MessageID: "<a@example.org>", Flags: []string{imap.DraftFlag, imap.AnsweredFlag}},
+		imaptest.Message{MessageID: "<b@example.org>", Flags: []string{imap.SeenFlag}},
+		imaptest.Message{MessageID: "<b@example.org>", Flags: []string{imap.SeenFlag}},
+		imaptest.Message{MessageID: "<c@example.org>"},
+		imaptest.Message{MessageID: "<d@example.org>", Flags: []string{imap.FlaggedFlag}},
+	)
+	groups := scan(t, c, Config{})
+	// older messages of a sender are no copies of the newest
+	groups = append(groups, Group{Mailbox: "INBOX", Keeper: 7, Duplicates: []uint32{8}, UIDValidity: groups[0].UIDValidity, Sender: "a@example.org"})
+
+	merged, err := MergeFlags(context.Background(), c, groups, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server stores keywords in lower case
+	want := []FlagMerge{{Mailbox: "INBOX", UID: 1, Added: []string{"$label1", imap.AnsweredFlag, imap.FlaggedFlag, imap.SeenFlag}}}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("got merged %+v, want %+v", merged, want)
+	}
+	for uid, flags := range map[uint32][]string{
+		1: {"$label1", imap.AnsweredFlag, imap.FlaggedFlag, imap.SeenFlag},
+		// the keeper had all flags of its duplicate already
+		5: {imap.SeenFlag},
+		7: nil,
+	} {
+		got := s.Flags(t, "INBOX", uid)
+		sort.Strings(got)
+		if len(got) != len(flags) || (len(got) > 0 && !reflect.DeepEqual(got, flags)) {
+			t.Errorf("UID %d: got flags %v, want %v", uid, got, flags)
+		}
+	}
+	// the duplicates are left as they were
+	if got := s.Flags(t, "INBOX", 2); len(got) != 2 {
+		t.Errorf("UID 2: got flags %v", got)
+	}
+}
+
+func TestMergeFlagsUIDValidity(t *testing.T) {
+	s, c := newServer(t,
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>", Flags: []string{imap.FlaggedFlag}},
+	)
+	groups := scan(t, c, Config{})
+	groups[0].UIDValidity++
+	if _, err := MergeFlags(context.Background(), c, groups, nil); !errors.Is(err, ErrUIDValidityChanged) {
+		t.Errorf("got error %v", err)
+	}
+	if got := s.Flags(t, "INBOX", 1); len(got) != 0 {
+		t.Errorf("got flags %v on the keeper", got)
+	}
+}
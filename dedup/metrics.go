@@ -0,0 +1,297 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// Phase names a distinct step of a run for the timing report.
+type Phase string
+
+const (
+	PhaseConnect Phase = "connect"
+	PhaseSelect  Phase = "select"
+	PhaseFetch   Phase = "fetch"
+	PhaseHash    Phase = "hash"
+	PhaseStore   Phase = "store"
+	PhaseExpunge Phase = "expunge"
+)
+
+// phases lists all phases in the order they are reported.
+var phases = []Phase{PhaseConnect, PhaseSelect, PhaseFetch, PhaseHash, PhaseStore, PhaseExpunge}
+
+// PhaseStats holds the numbers recorded for a single phase.
+type PhaseStats struct {
+	Duration time.Duration
+	Bytes    int64
+	Commands int
+	// Messages is the number of messages processed, if the phase
+	// works on messages.
+	Messages int
+}
+
+func (s *PhaseStats) add(o PhaseStats) {
+	s.Duration += o.Duration
+	s.Bytes += o.Bytes
+	s.Commands += o.Commands
+	s.Messages += o.Messages
+}
+
+// Rate returns the processed messages per second.
+func (s PhaseStats) Rate() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Messages) / s.Duration.Seconds()
+}
+
+func (s PhaseStats) row() string {
+	return fmt.Sprintf("%s\t%d\t%d\t%d\t%.0f\t", s.Duration.Round(time.Millisecond), s.Bytes, s.Commands, s.Messages, s.Rate())
+}
+
+// Metrics collects wall time, bytes transferred and command counts
+// per mailbox and phase. Bytes are taken from the connection counter
+// and are therefore approximate when phases overlap. A nil *Metrics
+// records nothing. It is safe for concurrent use.
+type Metrics struct {
+	bytes int64
+	// compressed and logical are the traffic of sessions using
+	// COMPRESS=DEFLATE, as compressed and as read and written by IMAP.
+	compressed int64
+	logical    int64
+
+	mu        sync.Mutex
+	mailboxes []string
+	stats     map[string]map[Phase]*PhaseStats
+}
+
+// NewMetrics returns an empty metrics collector.
+func NewMetrics() *Metrics {
+	return &Metrics{stats: make(map[string]map[Phase]*PhaseStats)}
+}
+
+// Bytes returns the number of bytes transferred so far.
+func (m *Metrics) Bytes() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.bytes)
+}
+
+// AddCompression records compressed bytes transferred on a session
+// using COMPRESS=DEFLATE for logical bytes read or written by IMAP.
+func (m *Metrics) AddCompression(compressed, logical int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.compressed, compressed)
+	atomic.AddInt64(&m.logical, logical)
+}
+
+// Compression returns the compressed and the logical bytes recorded by
+// AddCompression.
+func (m *Metrics) Compression() (compressed, logical int64) {
+	if m == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&m.compressed), atomic.LoadInt64(&m.logical)
+}
+
+// Track starts timing phase p of mbox. Calling the returned function
+// stops it and records the given number of issued IMAP commands and
+// processed messages.
+func (m *Metrics) Track(mbox string, p Phase) func(commands, messages int) {
+	start := time.Now()
+	startBytes := m.Bytes()
+	return func(commands, messages int) {
+		m.Add(mbox, p, PhaseStats{
+			Duration: time.Since(start),
+			Bytes:    m.Bytes() - startBytes,
+			Commands: commands,
+			Messages: messages,
+		})
+	}
+}
+
+// Add records s for phase p of mbox.
+func (m *Metrics) Add(mbox string, p Phase, s PhaseStats) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byPhase, ok := m.stats[mbox]
+	if !ok {
+		byPhase = make(map[Phase]*PhaseStats)
+		m.stats[mbox] = byPhase
+		m.mailboxes = append(m.mailboxes, mbox)
+	}
+	if byPhase[p] == nil {
+		byPhase[p] = &PhaseStats{}
+	}
+	byPhase[p].add(s)
+}
+
+// Mailbox returns the recorded numbers of phase p for mbox.
+func (m *Metrics) Mailbox(mbox string, p Phase) PhaseStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.stats[mbox][p]; s != nil {
+		return *s
+	}
+	return PhaseStats{}
+}
+
+// MailboxBytes returns the bytes transferred in all phases of mbox.
+func (m *Metrics) MailboxBytes(mbox string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, s := range m.stats[mbox] {
+		n += s.Bytes
+	}
+	return n
+}
+
+// Total returns the numbers of phase p summed over all mailboxes.
+func (m *Metrics) Total(p Phase) PhaseStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total(p)
+}
+
+func (m *Metrics) total(p Phase) PhaseStats {
+	var total PhaseStats
+	for _, byPhase := range m.stats {
+		if s := byPhase[p]; s != nil {
+			total.add(*s)
+		}
+	}
+	return total
+}
+
+// Phases returns the recorded numbers of each phase of mbox, nil if
+// there are none.
+func (m *Metrics) Phases(mbox string) map[Phase]PhaseStats {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var byPhase map[Phase]PhaseStats
+	for p, s := range m.stats[mbox] {
+		if byPhase == nil {
+			byPhase = make(map[Phase]PhaseStats)
+		}
+		byPhase[p] = *s
+	}
+	return byPhase
+}
+
+// Totals returns the numbers of each phase recorded for any mailbox,
+// summed over all mailboxes, nil if there are none.
+func (m *Metrics) Totals() map[Phase]PhaseStats {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var totals map[Phase]PhaseStats
+	for _, p := range phases {
+		if s := m.total(p); s != (PhaseStats{}) {
+			if totals == nil {
+				totals = make(map[Phase]PhaseStats)
+			}
+			totals[p] = s
+		}
+	}
+	return totals
+}
+
+// Print writes the timing report to w.
+func (m *Metrics) Print(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "mailbox\tphase\ttime\tbytes\tcommands\tmessages\tmsg/s\t")
+	for _, mbox := range m.mailboxes {
+		name := mbox
+		if name == "" {
+			name = "-"
+		}
+		for _, p := range phases {
+			if s := m.stats[mbox][p]; s != nil {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", name, p, s.row())
+			}
+		}
+	}
+	var all PhaseStats
+	for _, p := range phases {
+		s := m.total(p)
+		all.add(s)
+		fmt.Fprintf(tw, "total\t%s\t%s\n", p, s.row())
+	}
+	all.Messages = 0
+	fmt.Fprintf(tw, "total\tall\t%s\n", all.row())
+	tw.Flush()
+	if compressed, logical := m.Compression(); logical > 0 {
+		fmt.Fprintf(w, "COMPRESS=DEFLATE: %d bytes of IMAP traffic took %d bytes compressed (%.0f%%)\n", logical, compressed, 100*float64(compressed)/float64(logical))
+	}
+}
+
+// Dial implements client.Dialer, counting all traffic on the
+// returned connection.
+func (m *Metrics) Dial(network, addr string) (net.Conn, error) {
+	return m.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial but gives up once ctx is done.
+func (m *Metrics) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, n: &m.bytes}, nil
+}
+
+// Dialer returns a client.Dialer counting traffic into m which gives
+// up once ctx is done.
+func (m *Metrics) Dialer(ctx context.Context) client.Dialer {
+	return contextDialer{ctx, m}
+}
+
+type contextDialer struct {
+	ctx context.Context
+	m   *Metrics
+}
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.m.DialContext(d.ctx, network, addr)
+}
+
+// countingConn adds the number of bytes read and written to n.
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
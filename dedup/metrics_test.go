@@ -0,0 +1,104 @@
+package dedup
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsAggregation(t *testing.T) {
+	m := NewMetrics()
+	m.Add("", PhaseConnect, PhaseStats{Duration: time.Second, Bytes: 100, Commands: 2})
+	m.Add("INBOX", PhaseFetch, PhaseStats{Duration: 2 * time.Second, Bytes: 1000, Commands: 1, Messages: 10})
+	m.Add("INBOX", PhaseFetch, PhaseStats{Duration: time.Second, Bytes: 500, Commands: 1, Messages: 5})
+	m.Add("INBOX", PhaseStore, PhaseStats{Bytes: 30, Commands: 3, Messages: 3})
+	m.Add("Archive", PhaseFetch, PhaseStats{Duration: time.Second, Bytes: 200, Commands: 1, Messages: 2})
+
+	if got, want := m.Mailbox("INBOX", PhaseFetch), (PhaseStats{3 * time.Second, 1500, 2, 15}); got != want {
+		t.Errorf("got INBOX fetch %+v, want %+v", got, want)
+	}
+	if got, want := m.Total(PhaseFetch), (PhaseStats{4 * time.Second, 1700, 3, 17}); got != want {
+		t.Errorf("got total fetch %+v, want %+v", got, want)
+	}
+	if got := m.MailboxBytes("INBOX"); got != 1530 {
+		t.Errorf("got %d bytes of INBOX", got)
+	}
+	if got := m.Total(PhaseExpunge); got != (PhaseStats{}) {
+		t.Errorf("got total expunge %+v", got)
+	}
+	if got := m.Mailbox("INBOX", PhaseFetch).Rate(); got != 5 {
+		t.Errorf("got rate %v", got)
+	}
+
+	want := map[Phase]PhaseStats{
+		PhaseFetch: {3 * time.Second, 1500, 2, 15},
+		PhaseStore: {0, 30, 3, 3},
+	}
+	if got := m.Phases("INBOX"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got phases of INBOX %+v, want %+v", got, want)
+	}
+	want = map[Phase]PhaseStats{
+		PhaseConnect: {time.Second, 100, 2, 0},
+		PhaseFetch:   {4 * time.Second, 1700, 3, 17},
+		PhaseStore:   {0, 30, 3, 3},
+	}
+	if got := m.Totals(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got totals %+v, want %+v", got, want)
+	}
+
+	var b bytes.Buffer
+	m.Print(&b)
+	for _, row := range []string{"INBOX  fetch  3s  1500  2  15  5", "total  fetch  4s  1700  3  17  4", "total  all  5s  1830  8  0  0", "-  connect"} {
+		if !strings.Contains(strings.Join(strings.Fields(b.String()), " "), strings.Join(strings.Fields(row), " ")) {
+			t.Errorf("missing row %q in:\n%s", row, b.String())
+		}
+	}
+}
+
+func TestMetricsTrack(t *testing.T) {
+	m := NewMetrics()
+	done := m.Track("INBOX", PhaseSelect)
+	done(1, 0)
+	done = m.Track("INBOX", PhaseSelect)
+	done(2, 7)
+	if s := m.Mailbox("INBOX", PhaseSelect); s.Commands != 3 || s.Messages != 7 || s.Duration < 0 {
+		t.Errorf("got %+v", s)
+	}
+
+	// a nil *Metrics records nothing
+	var nilMetrics *Metrics
+	nilMetrics.Track("INBOX", PhaseFetch)(1, 1)
+	nilMetrics.Add("INBOX", PhaseFetch, PhaseStats{Commands: 1})
+	if nilMetrics.Bytes() != 0 || nilMetrics.Phases("INBOX") != nil || nilMetrics.Totals() != nil {
+		t.Error("nil metrics recorded")
+	}
+}
+
+func TestMetricsCompression(t *testing.T) {
+	m := NewMetrics()
+	var b bytes.Buffer
+	m.Print(&b)
+	if strings.Contains(b.String(), "COMPRESS") {
+		t.Errorf("compression printed without any:\n%s", b.String())
+	}
+
+	m.AddCompression(0, 1000)
+	m.AddCompression(150, 0)
+	m.AddCompression(100, 600)
+	if compressed, logical := m.Compression(); compressed != 250 || logical != 1600 {
+		t.Errorf("got %d bytes compressed of %d", compressed, logical)
+	}
+	b.Reset()
+	m.Print(&b)
+	if want := "COMPRESS=DEFLATE: 1600 bytes of IMAP traffic took 250 bytes compressed (16%)\n"; !strings.HasSuffix(b.String(), want) {
+		t.Errorf("got:\n%s\nwant it to end in %q", b.String(), want)
+	}
+
+	var nilMetrics *Metrics
+	nilMetrics.AddCompression(1, 1)
+	if compressed, logical := nilMetrics.Compression(); compressed != 0 || logical != 0 {
+		t.Error("nil metrics recorded compression")
+	}
+}
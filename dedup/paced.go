@@ -0,0 +1,58 @@
+package dedup
+
+import (
+	"context"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+)
+
+// PacedClient is a Client waiting Delay between the commands modifying
+// a mailbox, STORE, EXPUNGE and those issued with Execute such as UID
+// EXPUNGE, for servers which fail under a quick succession of them.
+// Apply flags one message per STORE, so the delay falls between
+// messages. Other commands are passed on right away.
+type PacedClient struct {
+	Client
+	// Delay is the least time between the start of two modifying
+	// commands.
+	Delay time.Duration
+	// Ctx stops the waiting once done, if set. The command is still
+	// issued then, so that a STORE is followed by its EXPUNGE.
+	Ctx context.Context
+
+	last time.Time
+}
+
+// wait sleeps until Delay passed since the last modifying command.
+func (c *PacedClient) wait() {
+	if !c.last.IsZero() {
+		if d := c.Delay - time.Since(c.last); d > 0 {
+			var done <-chan struct{}
+			if c.Ctx != nil {
+				done = c.Ctx.Done()
+			}
+			select {
+			case <-time.After(d):
+			case <-done:
+			}
+		}
+	}
+	c.last = time.Now()
+}
+
+func (c *PacedClient) UidStore(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error {
+	c.wait()
+	return c.Client.UidStore(seqset, item, value, ch)
+}
+
+func (c *PacedClient) Expunge(ch chan uint32) error {
+	c.wait()
+	return c.Client.Expunge(ch)
+}
+
+func (c *PacedClient) Execute(cmd imap.Commander, h responses.Handler) (*imap.StatusResp, error) {
+	c.wait()
+	return c.Client.Execute(cmd, h)
+}
@@ -0,0 +1,68 @@
+package dedup
+
+import (
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// keyed is a fetched message together with its key digest.
+type keyed struct {
+	msg *imap.Message
+	key digest
+	// hashed is set if the key was derived from the envelope hash
+	// rather than the Message-ID.
+	hashed bool
+	// err is set if the KeyTemplate failed for the message, key is
+	// not set then.
+	err error
+	// took is the time spent calculating the key.
+	took time.Duration
+}
+
+// keyMessages calculates the keys of the messages from msgChan on the
+// configured number of workers and delivers them in the order they were
+// fetched. At most twice as many messages as there are workers are in
+// flight, so a slow consumer holds back the fetch instead of buffering
+// without bound. The returned channel is closed once msgChan is closed
+// and all its messages have been delivered; it must be drained.
+func keyMessages(msgChan <-chan *imap.Message, cfg Config) <-chan keyed {
+	workers := cfg.HashWorkers
+	type job struct {
+		msg  *imap.Message
+		slot chan keyed
+	}
+	jobs := make(chan job, workers)
+	// queue holds the result slots in fetch order
+	queue := make(chan chan keyed, 2*workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			hasher := newEnvelopeHasher(cfg)
+			for j := range jobs {
+				start := time.Now()
+				key, hashed, err := hasher.Digest(j.msg)
+				j.slot <- keyed{msg: j.msg, key: key, hashed: hashed, err: err, took: time.Since(start)}
+			}
+		}()
+	}
+
+	go func() {
+		for msg := range msgChan {
+			slot := make(chan keyed, 1)
+			queue <- slot
+			jobs <- job{msg, slot}
+		}
+		close(jobs)
+		close(queue)
+	}()
+
+	out := make(chan keyed)
+	go func() {
+		for slot := range queue {
+			out <- <-slot
+		}
+		close(out)
+	}()
+	return out
+}
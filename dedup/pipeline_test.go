@@ -0,0 +1,172 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+	"github.com/tomasvitek/imap-clean-dup/seed"
+)
+
+// settle waits for the number of goroutines to drop back to n, failing
+// t if it does not within a second.
+func settle(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left, not %d:\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeyMessagesOrder(t *testing.T) {
+	var msgs []*imap.Message
+	for i := 1; i <= 200; i++ {
+		// every third message shares the Message-ID of another
+		msgs = append(msgs, fetchedMessage(uint32(i), fmt.Sprintf("<%d@example.org>", i%67)))
+	}
+	var want []digest
+	for _, workers := range []int{1, 2, 8} {
+		n := runtime.NumGoroutine()
+		msgChan := make(chan *imap.Message)
+		go func() {
+			for _, msg := range msgs {
+				msgChan <- msg
+			}
+			close(msgChan)
+		}()
+		var uids []uint32
+		var keys []digest
+		for k := range keyMessages(msgChan, Config{HashWorkers: workers}.withDefaults()) {
+			uids = append(uids, k.msg.Uid)
+			keys = append(keys, k.key)
+		}
+		for i, uid := range uids {
+			if uid != uint32(i+1) {
+				t.Fatalf("%d workers: got UIDs %v", workers, uids)
+			}
+		}
+		if want == nil {
+			want = keys
+		} else if !reflect.DeepEqual(keys, want) {
+			t.Errorf("%d workers: got other keys than with one", workers)
+		}
+		settle(t, n)
+	}
+}
+
+// TestFetchBufferDrain fails the fetch part way with the smallest and
+// larger buffers and several workers, and checks that Scan returns the
+// error promptly without leaving any goroutine of the fetch behind.
+func TestFetchBufferDrain(t *testing.T) {
+	s := imaptest.NewServer(t)
+	s.AppendSeed(t, "INBOX", seed.Generate(seed.Config{Messages: 300, DuplicateRatio: 0.3, MinSize: 64, MaxSize: 128}))
+	failure := errors.New("connection reset")
+	for _, buffer := range []int{1, 10, 1000} {
+		for _, workers := range []int{1, 4} {
+			c := &failingFetch{Client: s.Dial(t), after: 150, err: failure}
+			n := runtime.NumGoroutine()
+			done := make(chan error, 1)
+			go func() {
+				_, err := Scan(context.Background(), c, "INBOX", Config{FetchBuffer: buffer, HashWorkers: workers})
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, failure) {
+					t.Errorf("buffer %d, %d workers: got error %v", buffer, workers, err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("buffer %d, %d workers: Scan did not return", buffer, workers)
+			}
+			settle(t, n)
+		}
+	}
+}
+
+// slowFetch passes on the messages of each FETCH and UID FETCH of Client
+// one every delay, as a slow server. It closes ch as Client does.
+type slowFetch struct {
+	Client
+	delay time.Duration
+	// fetches counts the fetches issued.
+	fetches int32
+}
+
+func (c *slowFetch) Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.fetch(false, seqset, items, ch)
+}
+
+func (c *slowFetch) UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.fetch(true, seqset, items, ch)
+}
+
+func (c *slowFetch) fetch(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	atomic.AddInt32(&c.fetches, 1)
+	defer close(ch)
+	in := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		if uid {
+			done <- c.Client.UidFetch(seqset, items, in)
+		} else {
+			done <- c.Client.Fetch(seqset, items, in)
+		}
+	}()
+	for msg := range in {
+		time.Sleep(c.delay)
+		ch <- msg
+	}
+	return <-done
+}
+
+// TestScanCancelMidFetch cancels scans of a slow server part way
+// through a fetch window and checks that Scan drains the window, issues
+// no further fetch and returns the cancellation with the phase and
+// window it stopped in, without leaving any goroutine behind.
+func TestScanCancelMidFetch(t *testing.T) {
+	s := imaptest.NewServer(t)
+	s.AppendSeed(t, "INBOX", seed.Generate(seed.Config{Messages: 200, DuplicateRatio: 0.3, MinSize: 64, MaxSize: 128}))
+	for _, workers := range []int{1, 4} {
+		c := &slowFetch{Client: s.Dial(t), delay: 10 * time.Millisecond}
+		n := runtime.NumGoroutine()
+		ctx, cancel := context.WithCancel(context.Background())
+		var scanned int32
+		cfg := Config{FetchChunk: 20, HashWorkers: workers, Progress: func(e Event) {
+			if e.Kind == EventMessage && atomic.AddInt32(&scanned, 1) == 25 {
+				cancel()
+			}
+		}}
+		start := time.Now()
+		groups, err := Scan(ctx, c, "INBOX", cfg)
+		cancel()
+		// the whole mailbox takes two seconds, the first two windows
+		// a fifth of it
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("%d workers: Scan took %s", workers, took)
+		}
+		var e *Error
+		if !errors.Is(err, context.Canceled) || !errors.As(err, &e) || e.Op != string(PhaseFetch) || e.Set == nil || groups != nil {
+			t.Errorf("%d workers: got %d groups, error %v", workers, len(groups), err)
+		} else if want := "21:40"; e.Set.String() != want {
+			t.Errorf("%d workers: stopped in window %s, want %s", workers, e.Set, want)
+		}
+		if c.fetches != 2 {
+			t.Errorf("%d workers: %d fetches issued", workers, c.fetches)
+		}
+		if got := atomic.LoadInt32(&scanned); got != 25 {
+			t.Errorf("%d workers: %d messages scanned after the cancellation", workers, got-25)
+		}
+		settle(t, n)
+	}
+}
@@ -0,0 +1,109 @@
+package dedup
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Quota is a quota root of the QUOTA extension (RFC 2087) and the
+// usage of its resources.
+type Quota struct {
+	Root      string
+	Resources []QuotaResource
+}
+
+// QuotaResource is the usage and limit of a resource of a quota root,
+// such as STORAGE, counted in units of 1024 octets, or MESSAGE.
+type QuotaResource struct {
+	Name  string
+	Usage int64
+	Limit int64
+}
+
+// getQuotaRoot is the GETQUOTAROOT command of QUOTA.
+type getQuotaRoot struct {
+	mailbox string
+}
+
+func (cmd getQuotaRoot) Command() *imap.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.mailbox)
+	return &imap.Command{Name: "GETQUOTAROOT", Arguments: []interface{}{imap.FormatMailboxName(mailbox)}}
+}
+
+// quotaHandler collects the QUOTA responses to GETQUOTAROOT.
+type quotaHandler struct {
+	quotas []Quota
+}
+
+func (h *quotaHandler) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	switch {
+	case !ok:
+		return responses.ErrUnhandled
+	case name == "QUOTAROOT":
+		return nil
+	case name != "QUOTA":
+		return responses.ErrUnhandled
+	}
+	// Responses which do not parse are skipped rather than failing
+	// the command, some servers send resources of their own making.
+	if len(fields) < 2 {
+		return nil
+	}
+	root, err := imap.ParseString(fields[0])
+	if err != nil {
+		return nil
+	}
+	list, ok := fields[1].([]interface{})
+	if !ok {
+		return nil
+	}
+	q := Quota{Root: root}
+	for i := 0; i+2 < len(list); i += 3 {
+		name, err := imap.ParseString(list[i])
+		if err != nil {
+			break
+		}
+		usage, err := parseQuotaNumber(list[i+1])
+		if err != nil {
+			break
+		}
+		limit, err := parseQuotaNumber(list[i+2])
+		if err != nil {
+			break
+		}
+		q.Resources = append(q.Resources, QuotaResource{Name: strings.ToUpper(name), Usage: usage, Limit: limit})
+	}
+	if len(q.Resources) > 0 {
+		h.quotas = append(h.quotas, q)
+	}
+	return nil
+}
+
+func parseQuotaNumber(f interface{}) (int64, error) {
+	s, err := imap.ParseString(f)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// QuotaRoots returns the quota roots of mbox with the usage of their
+// resources, asking with GETQUOTAROOT. The server must support QUOTA.
+// Malformed QUOTA responses are left out, so a server which misreports
+// its quota may yield none.
+func QuotaRoots(c Client, mbox string) ([]Quota, error) {
+	h := &quotaHandler{}
+	status, err := c.Execute(getQuotaRoot{mailbox: mbox}, h)
+	if err != nil {
+		return nil, &Error{Op: "getquotaroot", Mailbox: mbox, Err: err}
+	}
+	if err := status.Err(); err != nil {
+		return nil, &Error{Op: "getquotaroot", Mailbox: mbox, Err: err}
+	}
+	return h.quotas, nil
+}
@@ -0,0 +1,73 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// DefaultVolatileHeaders are the headers left out of RawHeader keys if
+// Config.VolatileHeaders is nil. They are added or rewritten on the way
+// to the mailbox, so copies delivered on different paths differ in
+// them.
+var DefaultVolatileHeaders = []string{"Received", "X-*", "DKIM-Signature"}
+
+// headerSection fetches the whole header of a message.
+var headerSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+	Peek:         true,
+}
+
+// errNoHeader is the key error of messages returned without their
+// header with RawHeader.
+var errNoHeader = errors.New("no header returned")
+
+// volatile reports whether the header name matches one of patterns,
+// compared case-insensitively. A pattern ending in * matches every name
+// starting with the rest of it.
+func volatile(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			prefix := p[:len(p)-1]
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendRawHeader appends the header of msg to b as fetched, without
+// the fields matching volatile, with folded lines kept and line ends
+// normalized to LF.
+func appendRawHeader(b []byte, msg *imap.Message, patterns []string) ([]byte, error) {
+	body := msg.GetBody(headerSection)
+	if body == nil {
+		return b, errNoHeader
+	}
+	skip := false
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(line) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if i := bytes.IndexByte(line, ':'); i >= 0 {
+				name = line[:i]
+			}
+			skip = volatile(string(bytes.TrimSpace(name)), patterns)
+		}
+		if !skip {
+			b = append(append(b, line...), '\n')
+		}
+	}
+	return b, scanner.Err()
+}
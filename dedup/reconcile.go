@@ -0,0 +1,127 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// Prefer selects which copy of a sent and received pair Reconcile keeps.
+type Prefer string
+
+const (
+	// PreferInbox keeps the received copy and removes the sent one.
+	PreferInbox Prefer = "inbox"
+	// PreferSent keeps the sent copy and removes the received one.
+	PreferSent Prefer = "sent"
+)
+
+// envelopeCopies are the UIDs of the messages of a mailbox sharing a
+// Message-ID, with the sender of the first one.
+type envelopeCopies struct {
+	uids []uint32
+	from string
+}
+
+// Reconcile matches the messages of the sent mailbox against those of
+// inbox, such as messages BCC'd to oneself which end up in both. A pair
+// has the same Message-ID and the same From address; messages without
+// a Message-ID are never paired. For each pair the copies in the
+// mailbox not preferred are returned as duplicates of the first copy in
+// the preferred one, so the groups have a KeeperMailbox. Duplicates
+// within a single mailbox are left to Scan. Any two mailboxes can be
+// reconciled, with PreferInbox keeping the copies of the first.
+func Reconcile(ctx context.Context, c Client, inbox, sent string, prefer Prefer, cfg Config) ([]Group, error) {
+	keep, drop := inbox, sent
+	if prefer == PreferSent {
+		keep, drop = sent, inbox
+	}
+
+	kept, keptOrder, _, err := fetchCopies(ctx, c, keep, cfg)
+	if err != nil {
+		return nil, err
+	}
+	dropped, _, uidValidity, err := fetchCopies(ctx, c, drop, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []Group
+	for _, id := range keptOrder {
+		k, d := kept[id], dropped[id]
+		if d == nil || !strings.EqualFold(k.from, d.from) {
+			continue
+		}
+		groups = append(groups, Group{
+			Mailbox:       drop,
+			Key:           fmt.Sprintf("%x", keyDigest([]byte(id))),
+			HashVersion:   HashVersion,
+			Keeper:        k.uids[0],
+			KeeperMailbox: keep,
+			Duplicates:    d.uids,
+			UIDValidity:   uidValidity,
+			Strategy:      StrategyEnvelope,
+		})
+	}
+	return groups, nil
+}
+
+// fetchCopies examines mbox and returns the copies of its messages by
+// Message-ID, with the Message-IDs in the order first seen, and the
+// UIDVALIDITY of mbox. Messages arriving during the fetch are left out.
+func fetchCopies(ctx context.Context, c Client, mbox string, cfg Config) (map[string]*envelopeCopies, []string, uint32, error) {
+	if ctx.Err() != nil {
+		return nil, nil, 0, canceled(ctx, mbox, PhaseSelect)
+	}
+	done := cfg.Metrics.Track(mbox, PhaseSelect)
+	st, err := c.Select(mbox, true)
+	done(1, 0)
+	if err != nil {
+		return nil, nil, 0, selectError(mbox, err)
+	}
+	if st.Messages == 0 {
+		return nil, nil, st.UidValidity, nil
+	}
+
+	seqset := &imap.SeqSet{}
+	seqset.AddRange(1, math.MaxUint32)
+	msgChan := make(chan *imap.Message, cfg.FetchBuffer)
+	errChan := make(chan error, 1)
+	fetch := cfg.Metrics.Track(mbox, PhaseFetch)
+	go func() {
+		errChan <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, msgChan)
+	}()
+
+	copies := make(map[string]*envelopeCopies)
+	var order []string
+	n := 0
+	for msg := range msgChan {
+		n++
+		if ctx.Err() != nil || msg.Envelope == nil || msg.Envelope.MessageId == "" || (st.UidNext != 0 && msg.Uid >= st.UidNext) {
+			continue
+		}
+		id := msg.Envelope.MessageId
+		cp, ok := copies[id]
+		if !ok {
+			cp = &envelopeCopies{}
+			if from := msg.Envelope.From; len(from) > 0 {
+				cp.from = from[0].MailboxName + "@" + from[0].HostName
+			}
+			copies[id] = cp
+			order = append(order, id)
+		}
+		cp.uids = append(cp.uids, msg.Uid)
+	}
+	err = <-errChan
+	fetch(1, n)
+	if err != nil {
+		return nil, nil, 0, &Error{Op: "fetch", Mailbox: mbox, Set: seqset, Err: err}
+	}
+	if ctx.Err() != nil {
+		return nil, nil, 0, canceled(ctx, mbox, PhaseFetch)
+	}
+	return copies, order, st.UidValidity, nil
+}
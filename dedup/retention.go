@@ -0,0 +1,82 @@
+package dedup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// senderMessage is a scanned message of a sender, for PerSenderCap.
+type senderMessage struct {
+	uid  uint32
+	date int64
+}
+
+// senderMessages collects the scanned messages by sender if
+// PerSenderCap is set.
+type senderMessages map[string][]senderMessage
+
+// add records msg under its first From address.
+func (s senderMessages) add(msg *imap.Message) {
+	if s == nil || len(msg.Envelope.From) == 0 {
+		return
+	}
+	from := msg.Envelope.From[0]
+	sender := strings.ToLower(from.MailboxName + "@" + from.HostName)
+	s[sender] = append(s[sender], senderMessage{msg.Uid, msg.Envelope.Date.Unix()})
+}
+
+// capPerSender returns a group for every sender of mbox with more
+// than cfg.PerSenderCap messages left once groups are removed. Its
+// Keeper is the newest message kept, its Duplicates are the messages
+// beyond the cap, oldest by date first removed.
+func capPerSender(mbox string, senders senderMessages, groups []Group, cfg Config) []Group {
+	removed := make(map[uint32]bool)
+	for _, g := range groups {
+		for _, uid := range g.Duplicates {
+			removed[uid] = true
+		}
+	}
+
+	names := make([]string, 0, len(senders))
+	for sender := range senders {
+		names = append(names, sender)
+	}
+	sort.Strings(names)
+
+	var capped []Group
+	for _, sender := range names {
+		var kept []senderMessage
+		for _, m := range senders[sender] {
+			if !removed[m.uid] {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) <= cfg.PerSenderCap {
+			continue
+		}
+		// newest first, later UIDs first among the same date
+		sort.Slice(kept, func(i, j int) bool {
+			if kept[i].date != kept[j].date {
+				return kept[i].date > kept[j].date
+			}
+			return kept[i].uid > kept[j].uid
+		})
+		g := Group{
+			Mailbox:     mbox,
+			Key:         fmt.Sprintf("%x", keyDigest([]byte(sender))),
+			HashVersion: HashVersion,
+			Keeper:      kept[0].uid,
+			Sender:      sender,
+		}
+		for _, m := range kept[cfg.PerSenderCap:] {
+			g.Duplicates = append(g.Duplicates, m.uid)
+		}
+		sort.Slice(g.Duplicates, func(i, j int) bool { return g.Duplicates[i] < g.Duplicates[j] })
+		cfg.progress(Event{Kind: EventSenderCapped, Mailbox: mbox, From: sender, Count: len(g.Duplicates), Total: len(kept)})
+		capped = append(capped, g)
+	}
+	return capped
+}
@@ -0,0 +1,51 @@
+package dedup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// TestScanPerSenderCap caps a sender of reports whose subjects repeat,
+// which are not copies of each other, and checks that the oldest are
+// removed by date rather than by UID.
+func TestScanPerSenderCap(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 8, 0, 0, 0, time.UTC) }
+	report := func(id, subject string, d int) imaptest.Message {
+		return imaptest.Message{From: "reports@example.org", MessageID: id, Subject: subject, Date: day(d)}
+	}
+	c := newFake(
+		report("<1@example.org>", "Daily report", 2),
+		report("<2@example.org>", "Weekly digest", 3),
+		report("<3@example.org>", "Daily report", 4),
+		// a copy of 1, removed as such
+		report("<1@example.org>", "Daily report", 2),
+		report("<5@example.org>", "Weekly digest", 6),
+		// the oldest, arriving last
+		report("<6@example.org>", "Daily report", 1),
+		imaptest.Message{From: "Someone@Example.org", Subject: "Daily report", Date: day(5)},
+		imaptest.Message{From: "someone@example.org", Subject: "Hello", Date: day(7)},
+	)
+	var events []Event
+	groups := scan(t, c, Config{PerSenderCap: 2, Progress: func(e Event) {
+		if e.Kind == EventSenderCapped {
+			events = append(events, e)
+		}
+	}})
+	if want := [][]uint32{{1, 4}, {5, 1, 2, 6}}; !reflect.DeepEqual(copies(groups), want) {
+		t.Errorf("got copies %v, want %v", copies(groups), want)
+	}
+	if g := groups[len(groups)-1]; g.Sender != "reports@example.org" || g.Strategy != "" {
+		t.Errorf("got group %+v", g)
+	}
+	if len(events) != 1 || events[0].From != "reports@example.org" || events[0].Count != 3 || events[0].Total != 5 {
+		t.Errorf("got events %+v", events)
+	}
+
+	// a cap at what the senders have removes nothing
+	if groups := scan(t, c, Config{PerSenderCap: 5}); !reflect.DeepEqual(copies(groups), [][]uint32{{1, 4}}) {
+		t.Errorf("cap of 5: got copies %v", copies(groups))
+	}
+}
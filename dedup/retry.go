@@ -0,0 +1,260 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// RetryClient is a Client retrying commands which failed transiently,
+// such as Gmail's "NO [SERVERBUG] Internal error occurred", with
+// exponential backoff. Failures which no retry overcomes, e.g. BAD
+// responses or rejected logins, are returned right away. So is a lost
+// connection unless Reconnect is set: the command is then retried on a
+// new session, on which the mailbox selected last is selected again.
+// Errors of commands which were retried wrap the error of the last
+// attempt.
+//
+// A retried fetch only passes on the messages not delivered by an
+// earlier attempt, a retried expunge passes on the sequence numbers
+// reported by every attempt, as each names a message gone. Stores asked
+// to report updates on a channel are not retried, as the channel is
+// closed after the first attempt. Commands issued with Execute are not
+// retried either.
+type RetryClient struct {
+	Client
+	// Retries is the number of times a command is retried.
+	Retries int
+	// Backoff is the wait before the first retry, doubled for each
+	// further one. It defaults to a second.
+	Backoff time.Duration
+	// Ctx stops the waiting between attempts once done, if set.
+	Ctx context.Context
+	// OnRetry is called before each retry of the command op, e.g.
+	// "fetch", with the error of the previous attempt if set.
+	OnRetry func(op string, attempt int, err error)
+	// Reconnect returns a new session replacing Client once its
+	// connection was lost, if set. A mailbox whose UIDVALIDITY changed
+	// meanwhile is not selected again, the command then fails with
+	// ErrUIDValidityChanged.
+	Reconnect func() (Client, error)
+
+	// selected is the mailbox selected last, read-only if readOnly,
+	// with the UIDVALIDITY it had.
+	selected    string
+	readOnly    bool
+	uidValidity uint32
+}
+
+// failure is the kind of error a command failed with.
+type failure int
+
+const (
+	// permanent failures are returned right away.
+	permanent failure = iota
+	// transient failures are retried on the same session.
+	transient
+	// lost connections are retried on a new session, see
+	// RetryClient.Reconnect.
+	lost
+)
+
+// transientTexts are parts of the texts of responses worth retrying.
+// go-imap drops response codes such as [SERVERBUG] or [UNAVAILABLE],
+// so the text is all there is to go by.
+var transientTexts = []string{
+	"internal error", "server error", "try again", "temporar", "unavailable",
+	"timed out", "timeout", "too many", "throttl", "in use", "system error",
+}
+
+// lostTexts are parts of the texts of errors of commands whose
+// connection is gone, as go-imap reports a BYE or a closed connection
+// with errors of its own.
+var lostTexts = []string{
+	"connection closed", "use of closed network connection", "broken pipe", "connection reset",
+}
+
+// classify returns the kind of failure err is.
+func classify(err error) failure {
+	var netErr net.Error
+	if errors.Is(err, client.ErrNotLoggedIn) || errors.Is(err, client.ErrAlreadyLoggedOut) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return lost
+	}
+	text := strings.ToLower(err.Error())
+	for _, t := range lostTexts {
+		if strings.Contains(text, t) {
+			return lost
+		}
+	}
+	for _, t := range transientTexts {
+		if strings.Contains(text, t) {
+			return transient
+		}
+	}
+	return permanent
+}
+
+// delay returns the wait before the retry numbered attempt, counting
+// from 1.
+func (c *RetryClient) delay(attempt int) time.Duration {
+	backoff := c.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	return backoff << (attempt - 1)
+}
+
+// retry runs cmd until it succeeds, fails permanently or was retried
+// c.Retries times, and returns its last error, wrapped if it was
+// retried.
+func (c *RetryClient) retry(op string, cmd func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := cmd()
+		if err == nil {
+			return nil
+		}
+		kind := classify(err)
+		if kind == permanent || (kind == lost && c.Reconnect == nil) || attempt > c.Retries {
+			return c.gaveUp(op, attempt, err)
+		}
+		if c.OnRetry != nil {
+			c.OnRetry(op, attempt, err)
+		}
+		var done <-chan struct{}
+		if c.Ctx != nil {
+			done = c.Ctx.Done()
+		}
+		select {
+		case <-time.After(c.delay(attempt)):
+		case <-done:
+			return c.gaveUp(op, attempt, err)
+		}
+		if kind == lost {
+			if err := c.reconnect(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// gaveUp returns err of the attempt numbered attempt of op, wrapped if
+// op was retried.
+func (c *RetryClient) gaveUp(op string, attempt int, err error) error {
+	if attempt == 1 {
+		return err
+	}
+	return fmt.Errorf("%s failed %d times: %w", op, attempt, err)
+}
+
+// reconnect replaces Client by a new session and selects the mailbox
+// selected last on it again.
+func (c *RetryClient) reconnect() error {
+	nc, err := c.Reconnect()
+	if err != nil {
+		return fmt.Errorf("cannot reconnect: %w", err)
+	}
+	c.Client = nc
+	if c.selected == "" {
+		return nil
+	}
+	st, err := nc.Select(c.selected, c.readOnly)
+	if err != nil {
+		return fmt.Errorf("cannot select %s again after reconnecting: %w", c.selected, err)
+	}
+	if c.uidValidity != 0 && st.UidValidity != c.uidValidity {
+		return fmt.Errorf("%w: %s has %d after reconnecting, not %d", ErrUIDValidityChanged, c.selected, st.UidValidity, c.uidValidity)
+	}
+	return nil
+}
+
+func (c *RetryClient) Select(name string, readOnly bool) (st *imap.MailboxStatus, err error) {
+	err = c.retry("select", func() error {
+		st, err = c.Client.Select(name, readOnly)
+		return err
+	})
+	if err == nil {
+		c.selected, c.readOnly, c.uidValidity = name, readOnly, st.UidValidity
+	}
+	return st, err
+}
+
+func (c *RetryClient) Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.fetch("fetch", ch, func(in chan *imap.Message) error { return c.Client.Fetch(seqset, items, in) })
+}
+
+func (c *RetryClient) UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.fetch("fetch", ch, func(in chan *imap.Message) error { return c.Client.UidFetch(seqset, items, in) })
+}
+
+// fetch runs a fetch on a channel of its own per attempt, passing on
+// each message once by sequence number, and closes ch when done.
+func (c *RetryClient) fetch(op string, ch chan *imap.Message, fetch func(chan *imap.Message) error) error {
+	defer close(ch)
+	sent := make(map[uint32]bool)
+	return c.retry(op, func() error {
+		in := make(chan *imap.Message, cap(ch))
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- fetch(in)
+		}()
+		for msg := range in {
+			if sent[msg.SeqNum] {
+				continue
+			}
+			sent[msg.SeqNum] = true
+			ch <- msg
+		}
+		return <-errChan
+	})
+}
+
+func (c *RetryClient) UidSearch(criteria *imap.SearchCriteria) (uids []uint32, err error) {
+	err = c.retry("search", func() error {
+		uids, err = c.Client.UidSearch(criteria)
+		return err
+	})
+	return uids, err
+}
+
+func (c *RetryClient) UidStore(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error {
+	if ch != nil {
+		return c.Client.UidStore(seqset, item, value, ch)
+	}
+	return c.retry("store", func() error { return c.Client.UidStore(seqset, item, value, nil) })
+}
+
+func (c *RetryClient) Expunge(ch chan uint32) error {
+	if ch == nil {
+		return c.retry("expunge", func() error { return c.Client.Expunge(nil) })
+	}
+	defer close(ch)
+	return c.retry("expunge", func() error {
+		in := make(chan uint32)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- c.Client.Expunge(in)
+		}()
+		for seqNum := range in {
+			ch <- seqNum
+		}
+		return <-errChan
+	})
+}
+
+// Capabilities returns the capabilities of the wrapped Client, if it
+// knows them.
+func (c *RetryClient) Capabilities() Capabilities {
+	return capabilitiesOf(c.Client)
+}
+
+func (c *RetryClient) Noop() error {
+	return c.retry("noop", func() error { return c.Client.Noop() })
+}
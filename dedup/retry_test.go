@@ -0,0 +1,228 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/tomasvitek/imap-clean-dup/internal/fakeimap"
+)
+
+func TestClassify(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want failure
+	}{
+		{errors.New("[SERVERBUG] Internal error occurred. Refer to server log for more information."), transient},
+		{errors.New("Server Unavailable. 15"), transient},
+		{errors.New("[UNAVAILABLE] Temporary authentication failure"), transient},
+		{errors.New("Too many simultaneous connections"), transient},
+		{errors.New("Mailbox is in use, try again later"), transient},
+		{errors.New("Command timed out"), transient},
+		{errors.New("Throttled"), transient},
+		{errors.New("imap: connection closed"), lost},
+		{errors.New("imap: connection closed during command execution"), lost},
+		{fmt.Errorf("fetch: %w", io.EOF), lost},
+		{io.ErrUnexpectedEOF, lost},
+		{client.ErrNotLoggedIn, lost},
+		{client.ErrAlreadyLoggedOut, lost},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, lost},
+		{errors.New("write tcp 127.0.0.1:1->127.0.0.1:2: write: broken pipe"), lost},
+		{errors.New("Invalid messageset"), permanent},
+		{errors.New("Could not parse command"), permanent},
+		{errors.New("[AUTHENTICATIONFAILED] Invalid credentials (Failure)"), permanent},
+		{errors.New("Mailbox doesn't exist: Archive"), permanent},
+		{errors.New("[READ-ONLY] Mailbox is read-only"), permanent},
+	} {
+		if got := classify(test.err); got != test.want {
+			t.Errorf("classify(%q) = %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, test := range []struct {
+		backoff time.Duration
+		want    []time.Duration
+	}{
+		{0, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{10 * time.Millisecond, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond}},
+	} {
+		c := &RetryClient{Backoff: test.backoff}
+		var got []time.Duration
+		for attempt := 1; attempt <= len(test.want); attempt++ {
+			got = append(got, c.delay(attempt))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("backoff %s: got delays %v, want %v", test.backoff, got, test.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	internal := errors.New("[SERVERBUG] Internal error occurred")
+	invalid := errors.New("Invalid messageset")
+	for _, test := range []struct {
+		name string
+		// errs are returned by the attempts in turn, nil once used up.
+		errs       []error
+		retries    int
+		reconnect  bool
+		attempts   int
+		retried    int
+		reconnects int
+		err        error
+	}{
+		{"success", nil, 2, false, 1, 0, 0, nil},
+		{"transient once", []error{internal}, 2, false, 2, 1, 0, nil},
+		{"transient twice", []error{internal, internal}, 2, false, 3, 2, 0, nil},
+		{"transient too often", []error{internal, internal, internal}, 2, false, 3, 2, 0, internal},
+		{"no retries", []error{internal}, 0, false, 1, 0, 0, internal},
+		{"permanent", []error{invalid}, 2, false, 1, 0, 0, invalid},
+		{"permanent after transient", []error{internal, invalid}, 2, false, 2, 1, 0, invalid},
+		{"lost without reconnect", []error{io.EOF}, 2, false, 1, 0, 0, io.EOF},
+		{"lost", []error{io.EOF}, 2, true, 2, 1, 1, nil},
+		{"lost and transient", []error{io.EOF, internal}, 2, true, 3, 2, 1, nil},
+		{"lost too often", []error{io.EOF, io.EOF, io.EOF}, 2, true, 3, 2, 2, io.EOF},
+	} {
+		attempts, retried, reconnects := 0, 0, 0
+		c := &RetryClient{
+			Client:  fakeimap.New(),
+			Retries: test.retries,
+			Backoff: time.Microsecond,
+			OnRetry: func(string, int, error) { retried++ },
+		}
+		if test.reconnect {
+			c.Reconnect = func() (Client, error) {
+				reconnects++
+				return fakeimap.New(), nil
+			}
+		}
+		err := c.retry("fetch", func() error {
+			attempts++
+			if attempts <= len(test.errs) {
+				return test.errs[attempts-1]
+			}
+			return nil
+		})
+		if attempts != test.attempts || retried != test.retried || reconnects != test.reconnects {
+			t.Errorf("%s: got %d attempts, %d retries, %d reconnects", test.name, attempts, retried, reconnects)
+		}
+		if (err == nil) != (test.err == nil) || (err != nil && !errors.Is(err, test.err)) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	internal := errors.New("[SERVERBUG] Internal error occurred")
+	c := &RetryClient{Client: fakeimap.New(), Retries: 5, Backoff: time.Hour, Ctx: ctx}
+	attempts := 0
+	err := c.retry("fetch", func() error {
+		attempts++
+		return internal
+	})
+	if attempts != 1 || !errors.Is(err, internal) {
+		t.Errorf("got %d attempts, error %v", attempts, err)
+	}
+}
+
+// TestRetryReselect loses the connection of a session with INBOX
+// selected and checks that the command is retried on a new session with
+// INBOX selected again, read-only as before.
+func TestRetryReselect(t *testing.T) {
+	fake, _ := fiveMessages()
+	fake.Errors = map[int]error{2: errors.New("imap: connection closed")}
+	var next *fakeimap.Client
+	c := &RetryClient{
+		Client:  fake,
+		Retries: 1,
+		Backoff: time.Microsecond,
+		Reconnect: func() (Client, error) {
+			next = &fakeimap.Client{Mailboxes: fake.Mailboxes}
+			return next, nil
+		},
+	}
+	if _, err := c.Select("INBOX", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := next.Commands(); !reflect.DeepEqual(got, []string{"EXAMINE INBOX", "NOOP"}) {
+		t.Errorf("got commands %q on the new session", got)
+	}
+
+	// a mailbox recreated meanwhile is not selected again
+	fake, _ = fiveMessages()
+	fake.Errors = map[int]error{2: io.EOF}
+	c = &RetryClient{
+		Client:  fake,
+		Retries: 1,
+		Backoff: time.Microsecond,
+		Reconnect: func() (Client, error) {
+			fake.Mailboxes["INBOX"].UIDValidity = 7
+			return &fakeimap.Client{Mailboxes: fake.Mailboxes}, nil
+		},
+	}
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Noop(); !errors.Is(err, ErrUIDValidityChanged) {
+		t.Errorf("got error %v", err)
+	}
+}
+
+// TestRetryNthCommand fails each command of a scan and removal in turn,
+// transiently and by losing the connection, and checks that the run
+// still removes exactly the duplicates.
+func TestRetryNthCommand(t *testing.T) {
+	run := func(fake *fakeimap.Client, reconnect func() (Client, error)) ([]uint32, error) {
+		c := &RetryClient{Client: fake, Retries: 1, Backoff: time.Microsecond, Reconnect: reconnect}
+		ctx := context.Background()
+		groups, err := Scan(ctx, c, "INBOX", Config{FetchChunk: 2, ReadOnly: true})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := Apply(ctx, c, groups, ActionDelete, nil); err != nil {
+			return nil, err
+		}
+		return fake.UIDs("INBOX"), nil
+	}
+
+	fake, _ := fiveMessages()
+	want, err := run(fake, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, []uint32{1, 3}) {
+		t.Fatalf("got UIDs %v left without failures", want)
+	}
+	commands := fake.Commands()
+
+	for n := 1; n <= len(commands); n++ {
+		for _, failure := range []error{errors.New("NO [SERVERBUG] Internal error occurred"), io.EOF} {
+			fake, _ := fiveMessages()
+			fake.Errors = map[int]error{n: failure}
+			var reconnect func() (Client, error)
+			if failure == io.EOF {
+				reconnect = func() (Client, error) {
+					return &fakeimap.Client{Mailboxes: fake.Mailboxes}, nil
+				}
+			}
+			got, err := run(fake, reconnect)
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("%s failing with %q: got UIDs %v left, error %v", commands[n-1], failure, got, err)
+			}
+		}
+	}
+}
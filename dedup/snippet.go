@@ -0,0 +1,246 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+)
+
+// SnippetBytes is how much of the text part of a message Snippets
+// fetches.
+const SnippetBytes = 2048
+
+// textPart is the part of a message a snippet is taken from.
+type textPart struct {
+	path     []int
+	encoding string
+	charset  string
+	html     bool
+}
+
+// Snippets returns the start of the text of the messages uids of mbox,
+// cut to n characters, by UID. The text is taken from the first
+// text/plain part which is no attachment, or else the first text/html
+// one with its markup removed; messages with neither have none. Only
+// the first SnippetBytes bytes of the part are fetched. Whitespace is
+// collapsed to single spaces.
+//
+// As with subjects, only the UTF-8, US-ASCII and ISO-8859-1 charsets
+// are decoded unless imap.CharsetReader is set; text in other charsets
+// is taken as UTF-8.
+func Snippets(ctx context.Context, c Client, mbox string, uids []uint32, n int, metrics *Metrics) (map[uint32]string, error) {
+	snippets := make(map[uint32]string)
+	if len(uids) == 0 {
+		return snippets, nil
+	}
+	if ctx.Err() != nil {
+		return nil, canceled(ctx, mbox, PhaseSelect)
+	}
+	done := metrics.Track(mbox, PhaseSelect)
+	_, err := c.Select(mbox, true)
+	done(1, 0)
+	if err != nil {
+		return nil, selectError(mbox, err)
+	}
+
+	seqset := &imap.SeqSet{}
+	seqset.AddNum(uids...)
+	parts := make(map[uint32]textPart)
+	err = fetchMessages(c, mbox, seqset, []imap.FetchItem{imap.FetchUid, imap.FetchBodyStructure}, metrics, func(msg *imap.Message) {
+		if p, ok := findTextPart(msg.BodyStructure); ok {
+			parts[msg.Uid] = p
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// messages whose text is in the same part are fetched together
+	sets := make(map[string]*imap.SeqSet)
+	var order []string
+	sections := make(map[string]*imap.BodySectionName)
+	for _, uid := range uids {
+		p, ok := parts[uid]
+		if !ok {
+			continue
+		}
+		key := fmt.Sprint(p.path)
+		if sets[key] == nil {
+			sets[key] = &imap.SeqSet{}
+			order = append(order, key)
+			sections[key] = &imap.BodySectionName{
+				BodyPartName: imap.BodyPartName{Path: p.path},
+				Peek:         true,
+				Partial:      []int{0, SnippetBytes},
+			}
+		}
+		sets[key].AddNum(uid)
+	}
+	for _, key := range order {
+		if ctx.Err() != nil {
+			return nil, canceled(ctx, mbox, PhaseFetch)
+		}
+		err := fetchMessages(c, mbox, sets[key], []imap.FetchItem{imap.FetchUid, sections[key].FetchItem()}, metrics, func(msg *imap.Message) {
+			p, ok := parts[msg.Uid]
+			if !ok {
+				return
+			}
+			for _, body := range msg.Body {
+				b, err := ioutil.ReadAll(body)
+				if err == nil {
+					snippets[msg.Uid] = snippet(b, p, n)
+				}
+				return
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snippets, nil
+}
+
+// fetchMessages fetches items of the messages set of mbox, calling f for
+// each message.
+func fetchMessages(c Client, mbox string, set *imap.SeqSet, items []imap.FetchItem, metrics *Metrics, f func(*imap.Message)) error {
+	msgChan := make(chan *imap.Message, 16)
+	errChan := make(chan error, 1)
+	fetch := metrics.Track(mbox, PhaseFetch)
+	go func() {
+		errChan <- c.UidFetch(set, items, msgChan)
+	}()
+	n := 0
+	for msg := range msgChan {
+		n++
+		if msg.Uid != 0 {
+			f(msg)
+		}
+	}
+	err := <-errChan
+	fetch(1, n)
+	if err != nil {
+		return &Error{Op: "fetch", Mailbox: mbox, Set: set, Err: err}
+	}
+	return nil
+}
+
+// findTextPart returns the first text/plain part of bs which is no
+// attachment, or else the first such text/html part.
+func findTextPart(bs *imap.BodyStructure) (textPart, bool) {
+	if bs == nil {
+		return textPart{}, false
+	}
+	var plain, htmlPart *textPart
+	bs.Walk(func(path []int, part *imap.BodyStructure) bool {
+		if strings.EqualFold(part.MIMEType, "message") {
+			// an attached message has text of its own
+			return false
+		}
+		name, _ := part.Filename()
+		if !strings.EqualFold(part.MIMEType, "text") || name != "" || strings.EqualFold(part.Disposition, "attachment") {
+			return true
+		}
+		p := &textPart{path: path, encoding: strings.ToLower(part.Encoding), charset: strings.ToLower(part.Params["charset"])}
+		switch strings.ToLower(part.MIMESubType) {
+		case "plain":
+			if plain == nil {
+				plain = p
+			}
+		case "html":
+			if htmlPart == nil {
+				p.html = true
+				htmlPart = p
+			}
+		}
+		return true
+	})
+	if plain != nil {
+		return *plain, true
+	}
+	if htmlPart != nil {
+		return *htmlPart, true
+	}
+	return textPart{}, false
+}
+
+var (
+	// invisibleElement matches a style or script element, whose text is
+	// not shown.
+	invisibleElement = regexp.MustCompile(`(?is)<(style|script)\b.*?</(style|script)\s*>`)
+	// markup matches an HTML tag or comment.
+	markup = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+)
+
+// snippet decodes the start b of the text part p and returns its text
+// cut to n characters.
+func snippet(b []byte, p textPart, n int) string {
+	switch p.encoding {
+	case "base64":
+		// the fetch may have cut the last group of four
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, b)
+		clean = clean[:len(clean)/4*4]
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		m, _ := base64.StdEncoding.Decode(decoded, clean)
+		b = decoded[:m]
+	case "quoted-printable":
+		// keep what decodes before an escape cut by the fetch
+		decoded, _ := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(b)))
+		b = decoded
+	}
+	text := decodeCharset(b, p.charset)
+	if p.html {
+		text = invisibleElement.ReplaceAllString(text, " ")
+		text = markup.ReplaceAllString(text, " ")
+		text = html.UnescapeString(text)
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) > n {
+		text = string([]rune(text)[:n]) + "…"
+	}
+	return text
+}
+
+// decodeCharset returns b in charset as a string, dropping a character
+// cut at the end.
+func decodeCharset(b []byte, charset string) string {
+	switch charset {
+	case "", "utf-8", "us-ascii":
+	case "iso-8859-1", "latin1":
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	default:
+		if imap.CharsetReader != nil {
+			if r, err := imap.CharsetReader(charset, bytes.NewReader(b)); err == nil {
+				if decoded, err := ioutil.ReadAll(r); err == nil || err == io.ErrUnexpectedEOF {
+					b = decoded
+				}
+			}
+		}
+	}
+	for len(b) > 0 && !utf8.Valid(b) {
+		if r, size := utf8.DecodeLastRune(b); r == utf8.RuneError && size <= 1 {
+			b = b[:len(b)-1]
+			continue
+		}
+		break
+	}
+	return strings.ToValidUTF8(string(b), "�")
+}
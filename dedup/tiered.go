@@ -0,0 +1,123 @@
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// confirmByBody fetches the bodies of all messages in candidate groups
+// with more than one member and splits each group by body hash. A
+// candidate group may so dissolve into several confirmed groups, or
+// into singletons which are all kept. The returned duplicates are in
+// UID order, confirmedGroups holds the first UID and size of each
+// confirmed group. With cfg.BodyBytes only the start of each body and
+// the message size are compared. Once ctx is done the bodies still in flight are
+// drained without hashing.
+func confirmByBody(ctx context.Context, c Client, mbox string, groups map[digest]candidate, dups []uint32, dupKeys []digest, cfg Config) (confirmed []uint32, confirmedKeys []digest, confirmedGroups map[digest]candidate, err error) {
+	metrics := cfg.Metrics
+	type member struct {
+		uid uint32
+		key digest
+	}
+	members := make([]member, 0, 2*len(dups))
+	seqset := &imap.SeqSet{}
+	for key, g := range groups {
+		if g.size > 1 {
+			members = append(members, member{g.first, key})
+			seqset.AddNum(g.first)
+		}
+	}
+	for i, uid := range dups {
+		members = append(members, member{uid, dupKeys[i]})
+		seqset.AddNum(uid)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].uid < members[j].uid })
+
+	confirmedGroups = make(map[digest]candidate)
+	if len(members) == 0 {
+		return nil, nil, confirmedGroups, nil
+	}
+
+	section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.TextSpecifier}, Peek: true}
+	items := []imap.FetchItem{imap.FetchUid}
+	if cfg.BodyBytes > 0 {
+		// the size stands in for the rest of the body
+		section.Partial = []int{0, cfg.BodyBytes}
+		items = append(items, imap.FetchRFC822Size)
+	}
+	items = append(items, section.FetchItem())
+	msgChan := make(chan *imap.Message, 100)
+	errChan := make(chan error, 1)
+	fetchStart, fetchBytes := time.Now(), metrics.Bytes()
+	go func() {
+		errChan <- c.UidFetch(seqset, items, msgChan)
+	}()
+
+	bodies := make(map[uint32][sha256.Size]byte, len(members))
+	var hashTime time.Duration
+	for msg := range msgChan {
+		if ctx.Err() != nil {
+			continue
+		}
+		start := time.Now()
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+		hash := sha256.New()
+		if cfg.BodyBytes > 0 {
+			fmt.Fprintf(hash, "size:%d\n", msg.Size)
+		}
+		if _, err := io.Copy(hash, body); err != nil {
+			continue
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], hash.Sum(nil))
+		bodies[msg.Uid] = sum
+		hashTime += time.Since(start)
+	}
+	err = <-errChan
+	metrics.Add(mbox, PhaseFetch, PhaseStats{
+		Duration: time.Since(fetchStart) - hashTime,
+		Bytes:    metrics.Bytes() - fetchBytes,
+		Commands: 1,
+		Messages: len(bodies),
+	})
+	metrics.Add(mbox, PhaseHash, PhaseStats{Duration: hashTime, Messages: len(bodies)})
+	if err != nil {
+		return nil, nil, nil, &Error{Op: "fetch", Mailbox: mbox, Set: seqset, Err: err}
+	}
+	if ctx.Err() != nil {
+		return nil, nil, nil, canceled(ctx, mbox, PhaseFetch)
+	}
+
+	for _, m := range members {
+		body, ok := bodies[m.uid]
+		if !ok {
+			// without a body the message cannot be confirmed, keep it
+			cfg.progress(Event{Kind: EventBodyMissing, Mailbox: mbox, UID: m.uid})
+			continue
+		}
+		key := keyDigest(append(m.key[:], body[:]...))
+		g, found := confirmedGroups[key]
+		if !found {
+			g.first = m.uid
+		}
+		g.size++
+		confirmedGroups[key] = g
+		if found {
+			confirmed = append(confirmed, m.uid)
+			confirmedKeys = append(confirmedKeys, key)
+			cfg.progress(Event{Kind: EventConfirmed, Mailbox: mbox, UID: m.uid})
+		} else if m.uid != groups[m.key].first {
+			cfg.progress(Event{Kind: EventBodyMismatch, Mailbox: mbox, UID: m.uid})
+		}
+	}
+	return confirmed, confirmedKeys, confirmedGroups, nil
+}
@@ -0,0 +1,67 @@
+package dedup
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+func TestTieredSplit(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		bodies []string
+		copies [][]uint32
+		// mismatched are the copies whose body matches no earlier copy
+		// of their candidate group
+		mismatched []uint32
+	}{
+		{"all equal", []string{"a", "a", "a"}, [][]uint32{{1, 2, 3}}, nil},
+		{"all different", []string{"a", "b", "c"}, nil, []uint32{2, 3}},
+		{"two groups", []string{"a", "b", "a", "b"}, [][]uint32{{1, 3}, {2, 4}}, []uint32{2}},
+		{"one confirmed pair", []string{"a", "b", "b"}, [][]uint32{{2, 3}}, []uint32{2}},
+	} {
+		var msgs []imaptest.Message
+		for _, body := range test.bodies {
+			msgs = append(msgs, imaptest.Message{MessageID: "<a@example.org>", Body: body})
+		}
+		// a message without copies has no body fetched
+		msgs = append(msgs, imaptest.Message{MessageID: "<single@example.org>"})
+		c := newFake(msgs...)
+		var mismatched []uint32
+		groups := scan(t, c, Config{Strategy: StrategyTiered, Progress: func(e Event) {
+			if e.Kind == EventBodyMismatch {
+				mismatched = append(mismatched, e.UID)
+			}
+		}})
+		if got := copies(groups); !reflect.DeepEqual(got, test.copies) {
+			t.Errorf("%s: got copies %v, want %v", test.name, got, test.copies)
+		}
+		if !reflect.DeepEqual(mismatched, test.mismatched) {
+			t.Errorf("%s: got body mismatches %v, want %v", test.name, mismatched, test.mismatched)
+		}
+		for _, g := range groups {
+			if g.Strategy != StrategyTiered {
+				t.Errorf("%s: got strategy %s", test.name, g.Strategy)
+			}
+		}
+		commands := c.Commands()
+		if want := fmt.Sprintf("UID FETCH 1:%d", len(test.bodies)); commands[len(commands)-1] != want {
+			t.Errorf("%s: got commands %q, want bodies fetched with %q", test.name, commands, want)
+		}
+	}
+}
+
+func TestTieredBodyBytes(t *testing.T) {
+	c := newFake(
+		imaptest.Message{MessageID: "<a@example.org>", Body: "same start, one end"},
+		imaptest.Message{MessageID: "<a@example.org>", Body: "same start, another end"},
+		imaptest.Message{MessageID: "<a@example.org>", Body: "same start, one end"},
+	)
+	// the sizes tell the second message apart
+	groups := scan(t, c, Config{Strategy: StrategyTiered, BodyBytes: 10})
+	if want := [][]uint32{{1, 3}}; !reflect.DeepEqual(copies(groups), want) {
+		t.Errorf("got copies %v, want %v", copies(groups), want)
+	}
+}
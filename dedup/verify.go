@@ -0,0 +1,78 @@
+package dedup
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap"
+)
+
+// Verification is the outcome of Verify.
+type Verification struct {
+	Mailbox string
+	// MissingKeepers are the UIDs of kept copies no longer in the
+	// mailbox.
+	MissingKeepers []uint32
+	// Duplicates are the groups a new scan still finds, as if
+	// removing them had been ignored by the server.
+	Duplicates []Group
+}
+
+// OK reports whether the verification found no discrepancy.
+func (v Verification) OK() bool {
+	return len(v.MissingKeepers) == 0 && len(v.Duplicates) == 0
+}
+
+// Verify checks the work of Apply on the groups of mbox: it scans the
+// mailbox again with cfg, which should be the Config of the original
+// scan so that keys compare alike, and checks that every kept copy
+// still exists and that no duplicates are left. Progress is not
+// reported and the mailbox is examined read-only. Keepers of groups
+// of other mailboxes, and keepers removed as the duplicates of another
+// group, are not checked.
+func Verify(ctx context.Context, c Client, mbox string, groups []Group, cfg Config) (v Verification, err error) {
+	v.Mailbox = mbox
+	cfg.ReadOnly = true
+	cfg.Progress = nil
+	if v.Duplicates, err = Scan(ctx, c, mbox, cfg); err != nil {
+		return v, err
+	}
+
+	removed := make(map[uint32]bool)
+	for _, g := range groups {
+		if g.Mailbox == mbox {
+			for _, uid := range g.Duplicates {
+				removed[uid] = true
+			}
+		}
+	}
+	keepers := &imap.SeqSet{}
+	var want []uint32
+	for _, g := range groups {
+		if g.Mailbox == mbox && g.KeeperMailbox == "" && !removed[g.Keeper] {
+			keepers.AddNum(g.Keeper)
+			want = append(want, g.Keeper)
+		}
+	}
+	if len(want) == 0 {
+		return v, nil
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = keepers
+	done := cfg.Metrics.Track(mbox, PhaseSelect)
+	found, err := c.UidSearch(criteria)
+	done(1, len(found))
+	if err != nil {
+		return v, &Error{Op: "search", Mailbox: mbox, Set: keepers, Err: err}
+	}
+	exists := make(map[uint32]bool, len(found))
+	for _, uid := range found {
+		exists[uid] = true
+	}
+	for _, uid := range want {
+		if !exists[uid] {
+			v.MissingKeepers = append(v.MissingKeepers, uid)
+		}
+	}
+	return v, nil
+}
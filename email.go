@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// emailTimeout bounds sending the -email-report, so that a dead SMTP
+// server cannot hang the end of a run.
+const emailTimeout = 30 * time.Second
+
+// emailSettings are the addresses and SMTP settings of -email-report.
+type emailSettings struct {
+	to   []string
+	from *mail.Address
+	// server is the SMTP server as host:port.
+	server   string
+	user     string
+	password string
+	// html adds an HTML part to the plain text.
+	html bool
+}
+
+// smtpAddress returns server with the submission port 587 added if it
+// has no port.
+func smtpAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "587")
+}
+
+// parseRecipients parses the comma-separated addresses of
+// -email-report.
+func parseRecipients(s string) ([]string, error) {
+	list, err := mail.ParseAddressList(s)
+	if err != nil {
+		return nil, err
+	}
+	to := make([]string, len(list))
+	for i, a := range list {
+		to[i] = a.Address
+	}
+	return to, nil
+}
+
+// sortedResults returns the results sorted by mailbox name.
+func (s *Summary) sortedResults() []MailboxResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted()
+}
+
+// joinNames joins names as in English prose, e.g. "INBOX, Lists and
+// Archive".
+func joinNames(names []string) string {
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// emailHeadline returns the sentence opening the -email-report of the
+// run summarized by n with results, e.g.
+//
+//	Removed 58 duplicate messages (210.0 MiB) from INBOX and Archive.
+func emailHeadline(n Notification, results []MailboxResult) string {
+	var found, removed []string
+	for _, r := range results {
+		if r.Found > 0 {
+			found = append(found, r.Mailbox)
+		}
+		if r.Removed > 0 {
+			removed = append(removed, r.Mailbox)
+		}
+	}
+	var s string
+	switch {
+	case n.Removed > 0:
+		s = fmt.Sprintf("Removed %d duplicate messages (%s) from %s.", n.Removed, byteSize(n.ReclaimedBytes), joinNames(removed))
+	case n.Found > 0 && n.DryRun:
+		s = fmt.Sprintf("Found %d duplicate messages in %s, none removed as this was a dry run.", n.Found, joinNames(found))
+	case n.Found > 0:
+		s = fmt.Sprintf("Found %d duplicate messages in %s, none removed.", n.Found, joinNames(found))
+	default:
+		s = fmt.Sprintf("No duplicate messages in %d mailboxes.", len(results))
+	}
+	if len(n.Errors) > 0 {
+		s += fmt.Sprintf(" %d errors occurred.", len(n.Errors))
+	}
+	return s
+}
+
+// emailReport is what the text and HTML of the -email-report show.
+type emailReport struct {
+	Headline string
+	Server   string
+	Command  string
+	Results  []MailboxResult
+	Errors   []string
+	Quota    []string
+	Footer   string
+}
+
+func newEmailReport(n Notification, results []MailboxResult) emailReport {
+	r := emailReport{
+		Headline: emailHeadline(n, results),
+		Server:   n.Server,
+		Command:  n.Command,
+		Results:  results,
+		Errors:   n.Errors,
+		Footer: fmt.Sprintf("imap-clean-dup %s, %s on %s, %s, exit code %d",
+			n.Version, n.Command, n.Server, (time.Duration(n.DurationSeconds * float64(time.Second))).String(), n.ExitCode),
+	}
+	var quota bytes.Buffer
+	printQuota(&quota, n.Quota)
+	for _, line := range strings.Split(strings.TrimSpace(quota.String()), "\n") {
+		if line != "" {
+			r.Quota = append(r.Quota, line)
+		}
+	}
+	return r
+}
+
+// text returns the plain text of the report.
+func (r emailReport) text() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n\n", r.Headline)
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "mailbox\tscanned\tfound\tremoved\tfreed\tstatus")
+	for _, m := range r.Results {
+		status := "ok"
+		if m.Err != nil {
+			status = "failed"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\n", m.Mailbox, m.Scanned, m.Found, m.Removed, byteSize(m.Reclaimed), status)
+	}
+	tw.Flush()
+	if len(r.Errors) > 0 {
+		fmt.Fprintln(&b, "\nerrors:")
+		for _, e := range r.Errors {
+			fmt.Fprintf(&b, "  %s\n", e)
+		}
+	}
+	if len(r.Quota) > 0 {
+		fmt.Fprintln(&b)
+		for _, q := range r.Quota {
+			fmt.Fprintln(&b, q)
+		}
+	}
+	fmt.Fprintf(&b, "\n-- \n%s\n", r.Footer)
+	return b.String()
+}
+
+// emailHTML renders the HTML part of the report.
+var emailHTML = template.Must(template.New("report").Funcs(template.FuncMap{"size": byteSize}).Parse(`<!DOCTYPE html>
+<html><body style="font-family: sans-serif">
+<p><strong>{{.Headline}}</strong></p>
+<table cellpadding="4" style="border-collapse: collapse">
+<tr><th align="left">mailbox</th><th align="right">scanned</th><th align="right">found</th><th align="right">removed</th><th align="right">freed</th><th align="left">status</th></tr>
+{{range .Results}}<tr><td>{{.Mailbox}}</td><td align="right">{{.Scanned}}</td><td align="right">{{.Found}}</td><td align="right">{{.Removed}}</td><td align="right">{{size .Reclaimed}}</td><td>{{if .Err}}failed{{else}}ok{{end}}</td></tr>
+{{end}}</table>
+{{if .Errors}}<p>errors:</p><ul>{{range .Errors}}<li>{{.}}</li>{{end}}</ul>
+{{end}}{{if .Quota}}<p>{{range .Quota}}{{.}}<br>{{end}}</p>
+{{end}}<p style="color: gray">{{.Footer}}</p>
+</body></html>
+`))
+
+// compose returns the message of the report from and to the addresses
+// of s: plain text, with an HTML alternative if s.html is set.
+func (r emailReport) compose(s emailSettings, now time.Time) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "imap-clean-dup on "+r.Server+": "+r.Headline))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	domain := s.from.Address[strings.LastIndex(s.from.Address, "@")+1:]
+	fmt.Fprintf(&b, "Message-ID: <%d.%d@%s>\r\n", now.UnixNano(), os.Getpid(), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	text := r.text()
+	if !s.html {
+		writePart(&b, "text/plain", text)
+		return b.Bytes(), nil
+	}
+	var html bytes.Buffer
+	if err := emailHTML.Execute(&html, r); err != nil {
+		return nil, err
+	}
+	boundary := fmt.Sprintf("imap-clean-dup-%d", now.UnixNano())
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	writePart(&b, "text/plain", text)
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	writePart(&b, "text/html", html.String())
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+// writePart writes the header and quoted-printable body of a UTF-8 part
+// of type contentType to b.
+func writePart(b *bytes.Buffer, contentType, body string) {
+	fmt.Fprintf(b, "Content-Type: %s; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n", contentType)
+	qp := quotedprintable.NewWriter(b)
+	qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	qp.Close()
+}
+
+// sendEmail sends msg as set by s. The connection is upgraded with
+// STARTTLS if the server offers it; without it the password is never
+// sent, so only servers accepting mail without login, such as a local
+// relay, are used unencrypted.
+func sendEmail(s emailSettings, msg []byte) error {
+	addr := smtpAddress(s.server)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, emailTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	} else if s.user != "" {
+		return errors.New(addr + " does not offer STARTTLS, not sending -smtp-password unencrypted")
+	}
+	if s.user != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.user, s.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from.Address); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("%s: %s", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// emailSummary sends the -email-report of the run summarized by n and
+// summary as set by s.
+func emailSummary(s emailSettings, n Notification, summary *Summary) error {
+	msg, err := newEmailReport(n, summary.sortedResults()).compose(s, time.Now())
+	if err != nil {
+		return err
+	}
+	return sendEmail(s, msg)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the names of the environment variables setting
+// flags.
+const envPrefix = "IMAPCLEANDUP_"
+
+// envName returns the environment variable setting the named flag, so
+// that dry-run is set by IMAPCLEANDUP_DRY_RUN.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// isBoolFlag reports whether f is a flag which needs no value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// applyEnv sets the flags not given explicitly from their environment
+// variables. Boolean flags also accept 1/0 and yes/no.
+func applyEnv() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if isBoolFlag(f) {
+			switch strings.ToLower(v) {
+			case "yes":
+				v = "true"
+			case "no":
+				v = "false"
+			}
+		}
+		if e := flag.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s: %s", name, e)
+		}
+	})
+	return err
+}
+
+// usage prints the commands and flags followed by their environment
+// variables.
+func usage() {
+	printCommands()
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Flags:\n")
+	flag.PrintDefaults()
+	printEnvUsage(w)
+}
+
+// printEnvUsage lists the environment variables of all flags.
+func printEnvUsage(w io.Writer) {
+	fmt.Fprintf(w, "\nEvery flag not given explicitly can be set by an environment variable,\n")
+	fmt.Fprintf(w, "boolean ones accept 1/0, true/false and yes/no. Flags take precedence over\n")
+	fmt.Fprintf(w, "environment variables, which take precedence over the -config file:\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "  %-32s -%s\n", envName(f.Name), f.Name)
+	})
+}
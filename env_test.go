@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+func TestEnvName(t *testing.T) {
+	for flagName, want := range map[string]string{
+		"server":              "IMAPCLEANDUP_SERVER",
+		"dry-run":             "IMAPCLEANDUP_DRY_RUN",
+		"ignore-reply-to":     "IMAPCLEANDUP_IGNORE_REPLY_TO",
+		"oauth2-credentials":  "IMAPCLEANDUP_OAUTH2_CREDENTIALS",
+		"max-duplicates-kept": "IMAPCLEANDUP_MAX_DUPLICATES_KEPT",
+	} {
+		if got := envName(flagName); got != want {
+			t.Errorf("envName(%q) = %s, want %s", flagName, got, want)
+		}
+	}
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	s := imaptest.NewServer(t)
+	for _, mbox := range []string{"INBOX", "Flag", "Env", "Profile", "Config"} {
+		s.AppendMessages(t, mbox,
+			imaptest.Message{MessageID: "<a@example.org>"},
+			imaptest.Message{MessageID: "<a@example.org>"},
+		)
+	}
+	config := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(config, []byte("mbox = \"Config\"\n\n[profiles.p]\nmbox = \"Profile\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.toml")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name  string
+		env   []string
+		flags []string
+		mbox  string
+	}{
+		{"default", nil, []string{"-config", empty}, "INBOX"},
+		{"config", nil, nil, "Config"},
+		{"profile over config", nil, []string{"-profile", "p"}, "Profile"},
+		{"env over config", []string{"IMAPCLEANDUP_MBOX=Env"}, nil, "Env"},
+		{"env over profile", []string{"IMAPCLEANDUP_MBOX=Env"}, []string{"-profile", "p"}, "Env"},
+		{"flag over env", []string{"IMAPCLEANDUP_MBOX=Env"}, []string{"-mbox", "Flag"}, "Flag"},
+	} {
+		code, stdout, stderr := runMain(t, test.env, args(s, "scan", append([]string{"-config", config}, test.flags...)...)...)
+		if code != 0 || !strings.Contains(stdout, test.mbox+": 2 copies of ") || strings.Count(stdout, " copies of ") != 1 {
+			t.Errorf("%s: got exit code %d, stdout:\n%s\nstderr:\n%s", test.name, code, stdout, stderr)
+		}
+	}
+}
+
+func TestEnvBool(t *testing.T) {
+	for _, test := range []struct {
+		value   string
+		removed bool
+		code    int
+	}{
+		{"1", false, 0},
+		{"yes", false, 0},
+		{"TRUE", false, 0},
+		{"no", true, 0},
+		{"0", true, 0},
+		{"maybe", false, 1},
+	} {
+		s := dupServer(t)
+		code, _, stderr := runMain(t, []string{"IMAPCLEANDUP_DRY_RUN=" + test.value}, args(s, "clean")...)
+		if code != test.code {
+			t.Errorf("%s: got exit code %d, stderr:\n%s", test.value, code, stderr)
+		}
+		if removed := len(s.UIDs(t, "INBOX")) < 6; removed != test.removed {
+			t.Errorf("%s: removed %t", test.value, removed)
+		}
+		if test.code != 0 && !strings.Contains(stderr, "invalid environment: IMAPCLEANDUP_DRY_RUN: ") {
+			t.Errorf("%s: got stderr:\n%s", test.value, stderr)
+		}
+	}
+}
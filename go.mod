@@ -1,5 +1,15 @@
 module github.com/tomasvitek/imap-clean-dup
 
-go 1.14
+go 1.21
 
-require github.com/emersion/go-imap v1.0.5
+require (
+	github.com/emersion/go-imap v1.0.5
+	github.com/emersion/go-sasl v0.0.0-20191210011802-430746ea8b9b
+)
+
+require (
+	github.com/emersion/go-message v0.11.1 // indirect
+	github.com/emersion/go-textwrapper v0.0.0-20160606182133-d0e65e56babe // indirect
+	github.com/martinlindhe/base36 v1.0.0 // indirect
+	golang.org/x/text v0.3.2 // indirect
+)
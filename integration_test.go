@@ -0,0 +1,381 @@
+//go:build integration
+// +build integration
+
+// The integration tests run imap-clean-dup against Dovecot in a Docker
+// container, to catch what the memory backend of the other tests does
+// not exercise: literals, modified UTF-7 names, PERMANENTFLAGS,
+// keywords and COMPRESS=DEFLATE as a real server handles them. They
+// need docker on the PATH and are only built with the integration tag:
+//
+//	go test -tags integration -run Integration .
+//
+// DOVECOT_IMAGE overrides the image, DOVECOT_PASSWORD the password its
+// static passdb accepts for any user.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/tomasvitek/imap-clean-dup/seed"
+)
+
+// dovecotImage is the image started unless DOVECOT_IMAGE is set.
+const dovecotImage = "dovecot/dovecot:2.3.21"
+
+// dovecot is the container shared by the tests, started by the first
+// of them. Each test logs in as a user of its own, which the static
+// userdb of the image creates on first login, so tests never see each
+// other's mailboxes.
+var dovecot struct {
+	once     sync.Once
+	id       string
+	addr     string
+	password string
+	err      error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if dovecot.id != "" {
+		exec.Command("docker", "rm", "-f", dovecot.id).Run()
+	}
+	os.Exit(code)
+}
+
+// startDovecot starts the container, with COMPRESS=DEFLATE enabled by
+// testdata/dovecot/compress.conf, and waits for its greeting.
+func startDovecot() (id, addr string, err error) {
+	image := os.Getenv("DOVECOT_IMAGE")
+	if image == "" {
+		image = dovecotImage
+	}
+	conf, err := filepath.Abs(filepath.Join("testdata", "dovecot", "compress.conf"))
+	if err != nil {
+		return "", "", err
+	}
+	out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::143", "-v", conf+":/etc/dovecot/conf.d/compress.conf:ro", image).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("docker run %s: %w", image, err)
+	}
+	id = strings.TrimSpace(string(out))
+	out, err = exec.Command("docker", "port", id, "143/tcp").Output()
+	if err != nil {
+		return id, "", fmt.Errorf("docker port: %w", err)
+	}
+	addr = strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(time.Second))
+			greeting, _ := bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+			if strings.HasPrefix(greeting, "* OK") {
+				return id, addr, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return id, "", fmt.Errorf("no greeting from %s within 30s", addr)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// dovecotUser is a user of the container.
+type dovecotUser struct {
+	addr, username, password string
+}
+
+// newUser returns a user of its own for t, starting the
+// container if it is not yet running. t is skipped without docker.
+func newUser(t *testing.T) dovecotUser {
+	t.Helper()
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not installed")
+	}
+	dovecot.once.Do(func() {
+		dovecot.password = os.Getenv("DOVECOT_PASSWORD")
+		if dovecot.password == "" {
+			dovecot.password = "pass"
+		}
+		dovecot.id, dovecot.addr, dovecot.err = startDovecot()
+	})
+	if dovecot.err != nil {
+		t.Fatal(dovecot.err)
+	}
+	name := strings.ToLower(strings.NewReplacer("/", "-", "_", "-").Replace(t.Name()))
+	return dovecotUser{addr: dovecot.addr, username: name, password: dovecot.password}
+}
+
+// args returns command followed by the flags connecting as the user
+// and flags.
+func (a dovecotUser) args(command string, flags ...string) []string {
+	host, port, _ := net.SplitHostPort(a.addr)
+	return append([]string{command, "-server", host, "-port", port, "-tls=false", "-username", a.username, "-password", a.password}, flags...)
+}
+
+// dial returns a session of the user, which is logged out when t
+// ends.
+func (a dovecotUser) dial(t *testing.T) *client.Client {
+	t.Helper()
+	c, err := client.Dial(a.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Login(a.username, a.password); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	return c
+}
+
+// seed appends msgs to mbox, creating it unless it is INBOX, and
+// returns their UIDs in order.
+func (a dovecotUser) seed(t *testing.T, mbox string, msgs []seed.Message) []uint32 {
+	t.Helper()
+	c := a.dial(t)
+	if mbox != "INBOX" {
+		if err := c.Create(mbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range msgs {
+		if err := c.Append(mbox, nil, m.Date, bytes.NewBuffer(m.Raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uids := a.uids(t, mbox)
+	if len(uids) != len(msgs) {
+		t.Fatalf("%s: got %d messages after appending %d", mbox, len(uids), len(msgs))
+	}
+	return uids
+}
+
+// uids returns the UIDs of the messages in mbox, in order.
+func (a dovecotUser) uids(t *testing.T, mbox string) []uint32 {
+	t.Helper()
+	c := a.dial(t)
+	if _, err := c.Select(mbox, true); err != nil {
+		t.Fatal(err)
+	}
+	uids, err := c.UidSearch(imap.NewSearchCriteria())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uids
+}
+
+// flags returns the flags of the message uid of mbox.
+func (a dovecotUser) flags(t *testing.T, mbox string, uid uint32) []string {
+	t.Helper()
+	c := a.dial(t)
+	if _, err := c.Select(mbox, true); err != nil {
+		t.Fatal(err)
+	}
+	set := new(imap.SeqSet)
+	set.AddNum(uid)
+	msgs := make(chan *imap.Message, 1)
+	if err := c.UidFetch(set, []imap.FetchItem{imap.FetchFlags}, msgs); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgs
+	if msg == nil {
+		t.Fatalf("%s: no message %d", mbox, uid)
+	}
+	return msg.Flags
+}
+
+// fixture returns the messages appended by the tests, with duplicates of
+// every style.
+func fixture() []seed.Message {
+	return seed.Generate(seed.Config{Messages: 40, DuplicateRatio: 0.3, MinSize: 512, MaxSize: 4096, Seed: 7})
+}
+
+// kept returns the UIDs of msgs appended as uids which a clean with the
+// default configuration leaves: the originals and the near-duplicates,
+// which differ in Message-ID and body.
+func kept(msgs []seed.Message, uids []uint32) []uint32 {
+	var left []uint32
+	for i, m := range msgs {
+		if m.Original < 0 || m.Style == seed.StyleTracking {
+			left = append(left, uids[i])
+		}
+	}
+	return left
+}
+
+func TestIntegrationScanClean(t *testing.T) {
+	a := newUser(t)
+	msgs := fixture()
+	uids := a.seed(t, "INBOX", msgs)
+	want := kept(msgs, uids)
+
+	code, stdout, stderr := runMain(t, nil, a.args("scan", "-fail-on-duplicates")...)
+	if code != exitDuplicates {
+		t.Fatalf("scan: exit code %d, stdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+	}
+	if got := a.uids(t, "INBOX"); len(got) != len(msgs) {
+		t.Fatalf("scan: got %d messages left of %d", len(got), len(msgs))
+	}
+
+	code, stdout, stderr = runMain(t, nil, a.args("clean")...)
+	if code != 0 {
+		t.Fatalf("clean: exit code %d, stderr:\n%s", code, stderr)
+	}
+	if !strings.Contains(stdout, fmt.Sprintf("will remove %d messages", len(msgs)-len(want))) {
+		t.Errorf("clean: got stdout:\n%s", stdout)
+	}
+	if got := a.uids(t, "INBOX"); !reflect.DeepEqual(got, want) {
+		t.Errorf("clean: got UIDs %v left, want %v", got, want)
+	}
+
+	code, stdout, stderr = runMain(t, nil, a.args("scan", "-fail-on-duplicates")...)
+	if code != 0 {
+		t.Errorf("scan after clean: exit code %d, stdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+	}
+}
+
+func TestIntegrationBackup(t *testing.T) {
+	a := newUser(t)
+	msgs := fixture()
+	uids := a.seed(t, "INBOX", msgs)
+	want := kept(msgs, uids)
+	dir := t.TempDir()
+
+	code, _, stderr := runMain(t, nil, a.args("clean", "-backup-dir", dir)...)
+	if code != 0 {
+		t.Fatalf("clean: exit code %d, stderr:\n%s", code, stderr)
+	}
+	if got := a.uids(t, "INBOX"); !reflect.DeepEqual(got, want) {
+		t.Errorf("clean: got UIDs %v left, want %v", got, want)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(msgs)-len(want) {
+		t.Fatalf("got %d backups of %d duplicates", len(files), len(msgs)-len(want))
+	}
+
+	// the backups restored to another mailbox are the duplicates again
+	c := a.dial(t)
+	if err := c.Create("Restored"); err != nil {
+		t.Fatal(err)
+	}
+	code, _, stderr = runMain(t, nil, a.args("restore", "-mbox", "Restored", filepath.Dir(files[0]))...)
+	if code != 0 {
+		t.Fatalf("restore: exit code %d, stderr:\n%s", code, stderr)
+	}
+	if got := a.uids(t, "Restored"); len(got) != len(files) {
+		t.Errorf("restore: got %d messages of %d", len(got), len(files))
+	}
+}
+
+func TestIntegrationPlan(t *testing.T) {
+	a := newUser(t)
+	msgs := fixture()
+	uids := a.seed(t, "INBOX", msgs)
+	path := filepath.Join(t.TempDir(), "plan.json")
+
+	code, _, stderr := runMain(t, nil, a.args("scan", "-plan", path)...)
+	if code != 0 {
+		t.Fatalf("scan: exit code %d, stderr:\n%s", code, stderr)
+	}
+	code, _, stderr = runMain(t, nil, a.args("apply", path)...)
+	if code != 0 {
+		t.Fatalf("apply: exit code %d, stderr:\n%s", code, stderr)
+	}
+	if got, want := a.uids(t, "INBOX"), kept(msgs, uids); !reflect.DeepEqual(got, want) {
+		t.Errorf("apply: got UIDs %v left, want %v", got, want)
+	}
+}
+
+func TestIntegrationMailboxNames(t *testing.T) {
+	a := newUser(t)
+	msgs := fixture()
+	for _, name := range []string{"Arbeitsfläche", "Отправленные"} {
+		uids := a.seed(t, name, msgs)
+		code, _, stderr := runMain(t, nil, a.args("clean", "-mbox", name)...)
+		if code != 0 {
+			t.Fatalf("%s: exit code %d, stderr:\n%s", name, code, stderr)
+		}
+		if got, want := a.uids(t, name), kept(msgs, uids); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got UIDs %v left, want %v", name, got, want)
+		}
+	}
+	code, stdout, stderr := runMain(t, nil, a.args("list-mailboxes")...)
+	for _, name := range []string{"Arbeitsfläche", "Отправленные"} {
+		if code != 0 || !strings.Contains(stdout, name+"\n") {
+			t.Errorf("list-mailboxes: exit code %d, stdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+		}
+	}
+}
+
+// TestIntegrationMergeFlags checks that keywords, which Dovecot only
+// accepts as PERMANENTFLAGS allow, are merged into the kept copy.
+func TestIntegrationMergeFlags(t *testing.T) {
+	a := newUser(t)
+	msgs := seed.Generate(seed.Config{Messages: 2, DuplicateRatio: 0.5, Styles: []seed.Style{seed.StyleExact}})
+	uids := a.seed(t, "INBOX", msgs)
+	c := a.dial(t)
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	set := new(imap.SeqSet)
+	set.AddNum(uids[1])
+	if err := c.UidStore(set, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.FlaggedFlag, "$Label1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, stderr := runMain(t, nil, a.args("clean", "-merge-flags")...)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	if got := a.uids(t, "INBOX"); !reflect.DeepEqual(got, uids[:1]) {
+		t.Errorf("got UIDs %v left", got)
+	}
+	flags := strings.Join(a.flags(t, "INBOX", uids[0]), " ")
+	for _, want := range []string{imap.FlaggedFlag, "$Label1"} {
+		if !strings.Contains(flags, want) {
+			t.Errorf("got flags %s on the kept copy, want %s", flags, want)
+		}
+	}
+}
+
+// TestIntegrationCompress cleans a mailbox over a session compressed
+// with COMPRESS=DEFLATE and checks that -timing reports the saving.
+func TestIntegrationCompress(t *testing.T) {
+	a := newUser(t)
+	if ok, err := a.dial(t).Support("COMPRESS=DEFLATE"); err != nil || !ok {
+		t.Fatalf("Dovecot does not advertise COMPRESS=DEFLATE, is testdata/dovecot/compress.conf mounted? %v", err)
+	}
+	msgs := fixture()
+	uids := a.seed(t, "INBOX", msgs)
+	want := kept(msgs, uids)
+
+	code, stdout, stderr := runMain(t, nil, a.args("clean", "-compress", "auto", "-timing")...)
+	if code != 0 {
+		t.Fatalf("clean: exit code %d, stderr:\n%s", code, stderr)
+	}
+	if got := a.uids(t, "INBOX"); !reflect.DeepEqual(got, want) {
+		t.Errorf("clean: got UIDs %v left, want %v", got, want)
+	}
+	if !strings.Contains(stdout+stderr, "COMPRESS=DEFLATE: ") {
+		t.Errorf("no compression reported, stdout:\n%s\nstderr:\n%s", stdout, stderr)
+	}
+}
@@ -0,0 +1,408 @@
+// Package fakeimap provides a scripted IMAP client for tests. It serves
+// mailboxes held in memory, without a server or a socket, records the
+// commands issued to it and fails those it is told to, so that the
+// decisions of scans and removals can be tested command by command.
+//
+// Client has the methods of dedup.Client.
+package fakeimap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/responses"
+)
+
+// Client is a scripted IMAP client. Its exported fields are set up
+// before it is used and may be inspected once the commands returned.
+type Client struct {
+	// Mailboxes are the mailboxes by name.
+	Mailboxes map[string]*Mailbox
+	// Errors fails commands: the command numbered n, counting from 1
+	// in the order they are issued, returns Errors[n] without being
+	// carried out.
+	Errors map[int]error
+
+	mu       sync.Mutex
+	commands []string
+	selected *Mailbox
+	readOnly bool
+}
+
+// Mailbox is a mailbox of a Client.
+type Mailbox struct {
+	// UIDValidity is reported by SELECT, 1 if zero.
+	UIDValidity uint32
+	// UIDNext is reported by SELECT, one above the highest UID if
+	// zero.
+	UIDNext uint32
+	// Messages are the messages in sequence order. A UID may be
+	// repeated to have it returned twice, as by a broken server.
+	Messages []*Message
+}
+
+// Message is a message of a Mailbox.
+type Message struct {
+	UID   uint32
+	Flags []string
+	// Date is the internal date.
+	Date time.Time
+	// Raw is the message in RFC 5322 format, its size is the size of
+	// the message.
+	Raw []byte
+}
+
+// New returns a Client with an empty INBOX.
+func New() *Client {
+	return &Client{Mailboxes: map[string]*Mailbox{"INBOX": {}}}
+}
+
+// Append appends messages in RFC 5322 format to mbox, creating it if
+// needed, and returns their UIDs.
+func (c *Client) Append(mbox string, raw ...[]byte) []uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.Mailboxes[mbox]
+	if !ok {
+		m = &Mailbox{}
+		c.Mailboxes[mbox] = m
+	}
+	uids := make([]uint32, len(raw))
+	for i, r := range raw {
+		uids[i] = m.uidNext()
+		m.Messages = append(m.Messages, &Message{UID: uids[i], Raw: r})
+	}
+	return uids
+}
+
+// UIDs returns the UIDs of the messages in mbox, in order.
+func (c *Client) UIDs(mbox string) []uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var uids []uint32
+	if m, ok := c.Mailboxes[mbox]; ok {
+		for _, msg := range m.Messages {
+			uids = append(uids, msg.UID)
+		}
+	}
+	return uids
+}
+
+// Commands returns the commands issued so far, as the lines of the
+// protocol without tags and fetch items, e.g. "UID FETCH 1:10".
+func (c *Client) Commands() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.commands...)
+}
+
+// issue records cmd and returns the error it is to fail with. c.mu must
+// be held.
+func (c *Client) issue(cmd string) error {
+	c.commands = append(c.commands, cmd)
+	return c.Errors[len(c.commands)]
+}
+
+// ErrNoMailboxSelected is returned by commands needing a selected
+// mailbox when there is none.
+var ErrNoMailboxSelected = errors.New("fakeimap: no mailbox selected")
+
+func (c *Client) Select(name string, readOnly bool) (*imap.MailboxStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := "SELECT"
+	if readOnly {
+		cmd = "EXAMINE"
+	}
+	if err := c.issue(cmd + " " + name); err != nil {
+		return nil, err
+	}
+	m, ok := c.Mailboxes[name]
+	if !ok {
+		c.selected = nil
+		return nil, fmt.Errorf("fakeimap: no such mailbox %s", name)
+	}
+	c.selected, c.readOnly = m, readOnly
+	st := imap.NewMailboxStatus(name, nil)
+	st.ReadOnly = readOnly
+	st.Messages = uint32(len(m.Messages))
+	st.UidValidity = m.UIDValidity
+	if st.UidValidity == 0 {
+		st.UidValidity = 1
+	}
+	st.UidNext = m.UIDNext
+	if st.UidNext == 0 {
+		st.UidNext = m.uidNext()
+	}
+	return st, nil
+}
+
+func (c *Client) Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.fetch(false, seqset, items, ch)
+}
+
+func (c *Client) UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.fetch(true, seqset, items, ch)
+}
+
+func (c *Client) fetch(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	defer close(ch)
+	c.mu.Lock()
+	msgs, err := c.fetched(uid, seqset, items)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// sent without holding mu, the receiver may issue commands
+	for _, msg := range msgs {
+		ch <- msg
+	}
+	return nil
+}
+
+// fetched returns the messages fetched by FETCH or UID FETCH. c.mu must
+// be held.
+func (c *Client) fetched(uid bool, seqset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
+	if err := c.issue(uidPrefix(uid) + "FETCH " + seqset.String()); err != nil {
+		return nil, err
+	}
+	if c.selected == nil {
+		return nil, ErrNoMailboxSelected
+	}
+	var msgs []*imap.Message
+	for i, m := range c.selected.Messages {
+		seqNum, id := uint32(i+1), uint32(i+1)
+		if uid {
+			id = m.UID
+		}
+		if !seqset.Contains(id) {
+			continue
+		}
+		msg, err := m.memory().Fetch(seqNum, items)
+		if err != nil {
+			return nil, err
+		}
+		// body sections are returned as a server names them, without
+		// PEEK and with only the origin of a partial fetch
+		body := make(map[*imap.BodySectionName]imap.Literal, len(msg.Body))
+		for section, l := range msg.Body {
+			resp := &imap.BodySectionName{BodyPartName: section.BodyPartName}
+			if len(section.Partial) > 0 {
+				resp.Partial = section.Partial[:1]
+			}
+			body[resp] = l
+		}
+		msg.Body = body
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (c *Client) UidSearch(criteria *imap.SearchCriteria) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.issue("UID SEARCH " + format(criteria.Format())); err != nil {
+		return nil, err
+	}
+	if c.selected == nil {
+		return nil, ErrNoMailboxSelected
+	}
+	var uids []uint32
+	for i, m := range c.selected.Messages {
+		ok, err := m.memory().Match(uint32(i+1), criteria)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			uids = append(uids, m.UID)
+		}
+	}
+	return uids, nil
+}
+
+func (c *Client) UidStore(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error {
+	if ch != nil {
+		defer close(ch)
+	}
+	c.mu.Lock()
+	msgs, err := c.store(seqset, item, value)
+	c.mu.Unlock()
+	if err != nil || ch == nil {
+		return err
+	}
+	for _, msg := range msgs {
+		ch <- msg
+	}
+	return nil
+}
+
+// store carries out UID STORE and returns the updated messages unless
+// it is silent. c.mu must be held.
+func (c *Client) store(seqset *imap.SeqSet, item imap.StoreItem, value interface{}) ([]*imap.Message, error) {
+	var flags []string
+	values, _ := value.([]interface{})
+	for _, v := range values {
+		flags = append(flags, fmt.Sprint(v))
+	}
+	if err := c.issue(fmt.Sprintf("UID STORE %s %s (%s)", seqset, item, strings.Join(flags, " "))); err != nil {
+		return nil, err
+	}
+	if c.selected == nil {
+		return nil, ErrNoMailboxSelected
+	}
+	if c.readOnly {
+		return nil, errors.New("fakeimap: mailbox is read-only")
+	}
+	op, silent, err := imap.ParseFlagsOp(item)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*imap.Message
+	for i, m := range c.selected.Messages {
+		if !seqset.Contains(m.UID) {
+			continue
+		}
+		m.Flags = backendutil.UpdateFlags(m.Flags, op, flags)
+		if !silent {
+			msg := imap.NewMessage(uint32(i+1), []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+			msg.Flags, msg.Uid = m.Flags, m.UID
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+func (c *Client) Expunge(ch chan uint32) error {
+	if ch != nil {
+		defer close(ch)
+	}
+	c.mu.Lock()
+	seqNums, err := c.expunge("EXPUNGE", nil)
+	c.mu.Unlock()
+	if err != nil || ch == nil {
+		return err
+	}
+	for _, seqNum := range seqNums {
+		ch <- seqNum
+	}
+	return nil
+}
+
+// expunge removes the messages flagged \Deleted whose UIDs are in uids,
+// all if uids is nil, and returns their sequence numbers, each as
+// reported in turn. c.mu must be held.
+func (c *Client) expunge(cmd string, uids *imap.SeqSet) ([]uint32, error) {
+	if err := c.issue(cmd); err != nil {
+		return nil, err
+	}
+	if c.selected == nil {
+		return nil, ErrNoMailboxSelected
+	}
+	if c.readOnly {
+		return nil, errors.New("fakeimap: mailbox is read-only")
+	}
+	var seqNums []uint32
+	msgs := c.selected.Messages
+	for i := 0; i < len(msgs); {
+		m := msgs[i]
+		if !m.deleted() || (uids != nil && !uids.Contains(m.UID)) {
+			i++
+			continue
+		}
+		msgs = append(msgs[:i], msgs[i+1:]...)
+		seqNums = append(seqNums, uint32(i+1))
+	}
+	c.selected.Messages = msgs
+	return seqNums, nil
+}
+
+func (c *Client) Noop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.issue("NOOP")
+}
+
+// Execute carries out UID EXPUNGE, sending the expunged sequence
+// numbers to a *responses.Expunge handler. Other commands are recorded
+// and fail.
+func (c *Client) Execute(cmdr imap.Commander, h responses.Handler) (*imap.StatusResp, error) {
+	cmd := cmdr.Command()
+	line := strings.TrimSpace(cmd.Name + " " + format(cmd.Arguments))
+	c.mu.Lock()
+	if cmd.Name != "UID" || len(cmd.Arguments) != 2 || fmt.Sprint(cmd.Arguments[0]) != "EXPUNGE" {
+		err := c.issue(line)
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return &imap.StatusResp{Type: imap.StatusRespBad, Info: "fakeimap: command not supported"}, nil
+	}
+	uids, _ := cmd.Arguments[1].(*imap.SeqSet)
+	seqNums, err := c.expunge(line, uids)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if h, ok := h.(*responses.Expunge); ok {
+		for _, seqNum := range seqNums {
+			h.SeqNums <- seqNum
+		}
+	}
+	return &imap.StatusResp{Type: imap.StatusRespOk}, nil
+}
+
+// uidNext returns the UID following the highest UID of m.
+func (m *Mailbox) uidNext() uint32 {
+	var next uint32 = 1
+	for _, msg := range m.Messages {
+		if msg.UID >= next {
+			next = msg.UID + 1
+		}
+	}
+	return next
+}
+
+func (m *Message) deleted() bool {
+	for _, f := range m.Flags {
+		if f == imap.DeletedFlag {
+			return true
+		}
+	}
+	return false
+}
+
+// memory returns m as a message of the memory backend, which fetches
+// and matches it.
+func (m *Message) memory() *memory.Message {
+	return &memory.Message{Uid: m.UID, Date: m.Date, Size: uint32(len(m.Raw)), Flags: m.Flags, Body: m.Raw}
+}
+
+func uidPrefix(uid bool) string {
+	if uid {
+		return "UID "
+	}
+	return ""
+}
+
+// format formats the arguments of a command as on the wire, lists in
+// parentheses.
+func format(fields []interface{}) string {
+	s := make([]string, len(fields))
+	for i, f := range fields {
+		switch f := f.(type) {
+		case []interface{}:
+			s[i] = "(" + format(f) + ")"
+		case *imap.SeqSet:
+			s[i] = f.String()
+		default:
+			s[i] = fmt.Sprint(f)
+		}
+	}
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,177 @@
+package imaptest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+// errDenied is the error of mailboxes denied by Server.Deny.
+var errDenied = errors.New("Permission denied")
+
+// lockedBackend wraps the memory backend, holding mu during every call
+// to it, its users and mailboxes. The mailboxes in denied cannot be
+// opened.
+type lockedBackend struct {
+	mu     *sync.Mutex
+	be     *memory.Backend
+	denied map[string]bool
+}
+
+func (b *lockedBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u, err := b.be.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedUser{mu: b.mu, u: u, denied: b.denied}, nil
+}
+
+type lockedUser struct {
+	mu     *sync.Mutex
+	u      backend.User
+	denied map[string]bool
+}
+
+func (u *lockedUser) Username() string {
+	return u.u.Username()
+}
+
+func (u *lockedUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	list, err := u.u.ListMailboxes(subscribed)
+	for i, m := range list {
+		list[i] = &lockedMailbox{mu: u.mu, m: m.(*memory.Mailbox)}
+	}
+	return list, err
+}
+
+func (u *lockedUser) GetMailbox(name string) (backend.Mailbox, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.denied[name] {
+		return nil, errDenied
+	}
+	m, err := u.u.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedMailbox{mu: u.mu, m: m.(*memory.Mailbox)}, nil
+}
+
+func (u *lockedUser) CreateMailbox(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.u.CreateMailbox(name)
+}
+
+func (u *lockedUser) DeleteMailbox(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.u.DeleteMailbox(name)
+}
+
+func (u *lockedUser) RenameMailbox(existingName, newName string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.u.RenameMailbox(existingName, newName)
+}
+
+func (u *lockedUser) Logout() error {
+	return nil
+}
+
+type lockedMailbox struct {
+	mu *sync.Mutex
+	m  *memory.Mailbox
+}
+
+func (m *lockedMailbox) Name() string {
+	return m.m.Name()
+}
+
+func (m *lockedMailbox) Info() (*imap.MailboxInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.m.Info()
+}
+
+func (m *lockedMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.m.Status(items)
+}
+
+func (m *lockedMailbox) SetSubscribed(subscribed bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.m.SetSubscribed(subscribed)
+}
+
+func (m *lockedMailbox) Check() error {
+	return nil
+}
+
+func (m *lockedMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.m.ListMessages(uid, seqset, items, ch)
+}
+
+func (m *lockedMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.m.SearchMessages(uid, criteria)
+}
+
+func (m *lockedMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.m.CreateMessage(flags, date, body)
+}
+
+func (m *lockedMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.m.UpdateMessagesFlags(uid, seqset, op, flags)
+}
+
+func (m *lockedMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.m.CopyMessages(uid, seqset, dest)
+}
+
+func (m *lockedMailbox) Expunge() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.m.Expunge()
+}
+
+// expunge removes the messages flagged \Deleted whose UIDs are in uids
+// and returns their sequence numbers, each as reported in turn.
+func (m *lockedMailbox) expunge(uids *imap.SeqSet) []uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var seqNums []uint32
+	for i := 0; i < len(m.m.Messages); {
+		msg := m.m.Messages[i]
+		deleted := false
+		for _, f := range msg.Flags {
+			deleted = deleted || f == imap.DeletedFlag
+		}
+		if !deleted || (uids != nil && !uids.Contains(msg.Uid)) {
+			i++
+			continue
+		}
+		m.m.Messages = append(m.m.Messages[:i], m.m.Messages[i+1:]...)
+		seqNums = append(seqNums, uint32(i+1))
+	}
+	return seqNums
+}
@@ -0,0 +1,445 @@
+// Package imaptest runs an IMAP server in-process on the memory backend
+// of go-imap, for the tests and benchmarks of imap-clean-dup. Mailboxes
+// are filled and inspected through the backend directly, so that
+// fixtures are set up without a round trip per message and checked
+// without disturbing the session under test.
+package imaptest
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/tomasvitek/imap-clean-dup/seed"
+)
+
+// Username and Password log in to the server.
+const (
+	Username = "username"
+	Password = "password"
+)
+
+// Date is the Date of a Message which has none set.
+var Date = time.Date(2016, 5, 11, 14, 31, 59, 0, time.UTC)
+
+// Server is an IMAP server listening on a loopback port. Its INBOX is
+// empty to begin with.
+type Server struct {
+	srv *server.Server
+	// Addr is the address the server listens on, as host:port.
+	Addr string
+
+	// mu serializes all access to the backend, which the memory
+	// backend does not do itself, so that tests with several sessions
+	// pass the race detector.
+	mu     sync.Mutex
+	user   backend.User
+	denied map[string]bool
+}
+
+// NewServer starts a server with extensions, such as UIDPlus, which is
+// closed when tb ends.
+func NewServer(tb testing.TB, extensions ...server.Extension) *Server {
+	tb.Helper()
+	be := memory.New()
+	s := &Server{denied: make(map[string]bool)}
+	user, err := be.Login(nil, Username, Password)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s.user = user
+	// the memory backend comes with a message in INBOX
+	inbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	inbox.(*memory.Mailbox).Messages = nil
+
+	s.srv = server.New(&lockedBackend{mu: &s.mu, be: be, denied: s.denied})
+	s.srv.AllowInsecureAuth = true
+	s.srv.ErrorLog = nopLogger{}
+	s.srv.Enable(extensions...)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s.Addr = l.Addr().String()
+	go s.srv.Serve(l)
+	tb.Cleanup(func() { s.srv.Close() })
+	return s
+}
+
+// Host returns the host the server listens on.
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return host
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// Args returns the flags connecting imap-clean-dup to the server.
+func (s *Server) Args() []string {
+	return []string{"-server", s.Host(), "-port", strconv.Itoa(s.Port()), "-tls=false", "-username", Username, "-password", Password}
+}
+
+// Dial returns a session logged in to the server, which is logged out
+// when tb ends.
+func (s *Server) Dial(tb testing.TB) *client.Client {
+	tb.Helper()
+	c, err := client.Dial(s.Addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := c.Login(Username, Password); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Logout() })
+	return c
+}
+
+// mailbox returns the mailbox called name, creating it if needed. s.mu
+// must be held.
+func (s *Server) mailbox(tb testing.TB, name string) *memory.Mailbox {
+	tb.Helper()
+	m, err := s.user.GetMailbox(name)
+	if err != nil {
+		if err := s.user.CreateMailbox(name); err != nil {
+			tb.Fatal(err)
+		}
+		if m, err = s.user.GetMailbox(name); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return m.(*memory.Mailbox)
+}
+
+// Create creates the mailbox called name if it does not exist.
+func (s *Server) Create(tb testing.TB, name string) {
+	tb.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mailbox(tb, name)
+}
+
+// Delete deletes the mailbox called name.
+func (s *Server) Delete(tb testing.TB, name string) {
+	tb.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.user.DeleteMailbox(name); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// Deny makes selecting, examining or appending to the mailbox called
+// name fail with "Permission denied", as for a shared folder which is
+// listed but cannot be read. It is still listed.
+func (s *Server) Deny(tb testing.TB, name string) {
+	tb.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied[name] = true
+}
+
+// Append appends raw to mbox, creating it if needed, with the internal
+// date date and flags, and returns its UID.
+func (s *Server) Append(tb testing.TB, mbox string, date time.Time, raw []byte, flags ...string) uint32 {
+	tb.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.mailbox(tb, mbox)
+	if err := m.CreateMessage(flags, date, bytes.NewReader(raw)); err != nil {
+		tb.Fatal(err)
+	}
+	return m.Messages[len(m.Messages)-1].Uid
+}
+
+// AppendMessages appends msgs to mbox in order and returns their UIDs.
+func (s *Server) AppendMessages(tb testing.TB, mbox string, msgs ...Message) []uint32 {
+	tb.Helper()
+	uids := make([]uint32, len(msgs))
+	for i, m := range msgs {
+		uids[i] = s.Append(tb, mbox, m.date(), m.Bytes(), m.Flags...)
+	}
+	return uids
+}
+
+// AppendSeed appends the generated msgs to mbox in order, with their
+// Date as internal date, and returns their UIDs.
+func (s *Server) AppendSeed(tb testing.TB, mbox string, msgs []seed.Message) []uint32 {
+	tb.Helper()
+	uids := make([]uint32, len(msgs))
+	for i, m := range msgs {
+		uids[i] = s.Append(tb, mbox, m.Date, m.Raw)
+	}
+	return uids
+}
+
+// UIDs returns the UIDs of the messages in mbox, in order.
+func (s *Server) UIDs(tb testing.TB, mbox string) []uint32 {
+	tb.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var uids []uint32
+	for _, m := range s.mailbox(tb, mbox).Messages {
+		uids = append(uids, m.Uid)
+	}
+	return uids
+}
+
+// Flags returns the flags of the message uid of mbox, nil if there is
+// no such message.
+func (s *Server) Flags(tb testing.TB, mbox string, uid uint32) []string {
+	tb.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.mailbox(tb, mbox).Messages {
+		if m.Uid == uid {
+			return append([]string{}, m.Flags...)
+		}
+	}
+	return nil
+}
+
+// SetFlags replaces the flags of the message uid of mbox.
+func (s *Server) SetFlags(tb testing.TB, mbox string, uid uint32, flags ...string) {
+	tb.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.mailbox(tb, mbox).Messages {
+		if m.Uid == uid {
+			m.Flags = append([]string{}, flags...)
+			return
+		}
+	}
+	tb.Fatalf("no message %d in %s", uid, mbox)
+}
+
+// Message is a message to append. Header fields which are empty are
+// left out, except for From and Date.
+type Message struct {
+	MessageID string
+	// From defaults to a@example.org.
+	From                          string
+	Sender, ReplyTo, To, Cc, Bcc  string
+	Subject                       string
+	InReplyTo, References, ListID string
+	// Date is the Date and internal date, Date by default.
+	Date time.Time
+	Body string
+	// Flags are set on the appended message.
+	Flags []string
+}
+
+func (m Message) date() time.Time {
+	if m.Date.IsZero() {
+		return Date
+	}
+	return m.Date
+}
+
+// Bytes returns the message in RFC 5322 format.
+func (m Message) Bytes() []byte {
+	var b bytes.Buffer
+	from := m.From
+	if from == "" {
+		from = "a@example.org"
+	}
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	for _, f := range []struct{ name, value string }{
+		{"Sender", m.Sender}, {"Reply-To", m.ReplyTo}, {"To", m.To}, {"Cc", m.Cc}, {"Bcc", m.Bcc},
+		{"Subject", m.Subject}, {"Message-ID", m.MessageID}, {"In-Reply-To", m.InReplyTo},
+		{"References", m.References}, {"List-Id", m.ListID},
+	} {
+		if f.value != "" {
+			fmt.Fprintf(&b, "%s: %s\r\n", f.name, f.value)
+		}
+	}
+	fmt.Fprintf(&b, "Date: %s\r\n", m.date().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Content-Type: text/plain\r\n\r\n%s\r\n", m.Body)
+	return b.Bytes()
+}
+
+// nopLogger drops the errors of the server, such as connections closed
+// by tests without logging out.
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
+func (nopLogger) Println(...interface{})        {}
+
+// UIDPlus makes the server advertise UIDPLUS and accept UID EXPUNGE
+// (RFC 4315). Other parts of UIDPLUS, such as APPENDUID, are left out.
+var UIDPlus server.Extension = uidPlus{}
+
+type uidPlus struct{}
+
+func (uidPlus) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"UIDPLUS"}
+	}
+	return nil
+}
+
+func (uidPlus) Command(name string) server.HandlerFactory {
+	if name != "EXPUNGE" {
+		return nil
+	}
+	return func() server.Handler { return &uidExpunge{} }
+}
+
+// uidExpunge is EXPUNGE, which with UID expunges only the messages of
+// its sequence set.
+type uidExpunge struct {
+	server.Expunge
+	uids *imap.SeqSet
+}
+
+func (cmd *uidExpunge) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	s, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	cmd.uids, err = imap.ParseSeqSet(s)
+	return err
+}
+
+func (cmd *uidExpunge) UidHandle(conn server.Conn) error {
+	ctx := conn.Context()
+	m, ok := ctx.Mailbox.(*lockedMailbox)
+	if !ok {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	for _, seqNum := range m.expunge(cmd.uids) {
+		if err := conn.WriteResp(&imap.DataResp{Fields: []interface{}{seqNum, imap.RawString("EXPUNGE")}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoginDisabled makes the server advertise LOGINDISABLED before login,
+// as servers do on connections without TLS, and reject LOGIN so that a
+// client ignoring it fails loudly.
+var LoginDisabled server.Extension = loginDisabled{}
+
+type loginDisabled struct{}
+
+func (loginDisabled) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.NotAuthenticatedState != 0 {
+		return []string{"LOGINDISABLED"}
+	}
+	return nil
+}
+
+func (loginDisabled) Command(name string) server.HandlerFactory {
+	if name != "LOGIN" {
+		return nil
+	}
+	return func() server.Handler { return &disabledLogin{} }
+}
+
+type disabledLogin struct {
+	server.Login
+}
+
+func (*disabledLogin) Handle(server.Conn) error {
+	return errors.New("LOGIN sent despite LOGINDISABLED")
+}
+
+// Compress makes the server advertise COMPRESS=DEFLATE after login and
+// accept COMPRESS DEFLATE (RFC 4978), deflating the session from its
+// tagged OK on.
+var Compress server.Extension = compress{}
+
+type compress struct{}
+
+func (compress) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"COMPRESS=DEFLATE"}
+	}
+	return nil
+}
+
+func (compress) Command(name string) server.HandlerFactory {
+	if name != "COMPRESS" {
+		return nil
+	}
+	return func() server.Handler { return &compressCmd{} }
+}
+
+type compressCmd struct {
+	mechanism string
+}
+
+func (cmd *compressCmd) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("COMPRESS takes one mechanism")
+	}
+	var err error
+	cmd.mechanism, err = imap.ParseString(fields[0])
+	return err
+}
+
+func (cmd *compressCmd) Handle(conn server.Conn) error {
+	if conn.Context().State&imap.AuthenticatedState == 0 {
+		return server.ErrNotAuthenticated
+	}
+	if !strings.EqualFold(cmd.mechanism, "DEFLATE") {
+		return fmt.Errorf("unsupported mechanism %s", cmd.mechanism)
+	}
+	return nil
+}
+
+func (cmd *compressCmd) Upgrade(conn server.Conn) error {
+	return conn.Upgrade(func(sock net.Conn) (net.Conn, error) {
+		conn.WaitReady()
+		zw, err := flate.NewWriter(sock, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		return &deflateConn{Conn: sock, r: flate.NewReader(sock), zw: zw}, nil
+	})
+}
+
+// deflateConn is a connection deflated both ways, each write flushed.
+type deflateConn struct {
+	net.Conn
+	r  io.Reader
+	zw *flate.Writer
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *deflateConn) Write(b []byte) (int, error) {
+	n, err := c.zw.Write(b)
+	if err == nil {
+		err = c.zw.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// errTooManyFailures ends -interval once more cycles in a row failed
+// than -max-consecutive-failures.
+var errTooManyFailures = errors.New("too many consecutive cycles failed")
+
+// repeat runs a cycle over mailboxes every interval after the first
+// pass, until ctx is done or more than maxFailures cycles in a row
+// failed, 0 allowing any number. The keys of each mailbox are fetched
+// once, by the second cycle, later cycles only fetch the messages which
+// arrived since, or scan the mailbox again if the configuration needs
+// that (see dedup.Index). A failed cycle reconnects before the next
+// one. The duplicates found and removed are added to summary.
+func (cl *cleaner) repeat(ctx context.Context, mailboxes []string, interval time.Duration, maxFailures int, summary *Summary, reopen func() (*client.Client, error)) error {
+	indexes := make(map[string]*dedup.Index)
+	failures := 0
+	for cycle := 2; ; cycle++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+
+		start := time.Now()
+		found, removed, failed := 0, 0, 0
+		for _, mbox := range mailboxes {
+			if ctx.Err() != nil {
+				break
+			}
+			res := cl.cycle(ctx, mbox, indexes)
+			if res.Err != nil {
+				failed++
+			}
+			found, removed = found+res.Found, removed+res.Removed
+			summary.Merge(res)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		cl.logger.Info("cycle done", "cycle", cycle, "mailboxes", len(mailboxes), "found", found, "removed", removed, "failed", failed, "took", time.Since(start))
+		fmt.Printf("%s cycle %d: %d mailboxes, found %d, removed %d, %d failed\n", start.Format(time.RFC3339), cycle, len(mailboxes), found, removed, failed)
+
+		if failed == 0 {
+			failures = 0
+			continue
+		}
+		failures++
+		if maxFailures > 0 && failures > maxFailures {
+			return fmt.Errorf("%w: %d", errTooManyFailures, failures)
+		}
+		if !cl.reconnect(ctx, reopen) {
+			return nil
+		}
+		// the indexes are kept, they are checked against UIDVALIDITY
+	}
+}
+
+// cycle removes the duplicates among the messages of mbox which arrived
+// since the last cycle, fetching the keys of all its messages first if
+// indexes has none for it yet.
+func (cl *cleaner) cycle(ctx context.Context, mbox string, indexes map[string]*dedup.Index) MailboxResult {
+	res := MailboxResult{Mailbox: mbox}
+	release, err := cl.locks.hold(mbox)
+	if err != nil {
+		cl.logger.Error("cannot lock mailbox", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot find duplicates: %s\n", err)
+		res.Err = err
+		return res
+	}
+	defer release()
+	index := indexes[mbox]
+	if index == nil {
+		if index, err = dedup.NewIndex(ctx, cl.retrying(ctx, cl.scan), mbox, cl.config(mbox)); err != nil {
+			cl.logger.Error("cannot find duplicates", "mailbox", mbox, "err", err)
+			fmt.Fprintf(os.Stderr, "cannot find duplicates: %s\n", err)
+			res.Err = err
+			return res
+		}
+		indexes[mbox] = index
+	}
+	groups, err := index.Update(ctx, cl.retrying(ctx, cl.scan))
+	if err != nil {
+		cl.logger.Error("cannot find duplicates", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot find duplicates: %s\n", err)
+		res.Err = err
+		return res
+	}
+	if len(groups) == 0 {
+		return res
+	}
+	if cl.sorted != nil {
+		cl.sorted.flush(os.Stdout)
+	}
+	return cl.apply(ctx, mbox, groups)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+func TestRunInterval(t *testing.T) {
+	a := imaptest.Message{MessageID: "<a@example.org>", Subject: "A"}
+	b := imaptest.Message{MessageID: "<b@example.org>", Subject: "B"}
+	c := imaptest.Message{MessageID: "<c@example.org>", Subject: "C"}
+	d := imaptest.Message{MessageID: "<d@example.org>", Subject: "D"}
+	for _, test := range []struct {
+		flags []string
+		left  []uint32
+	}{
+		{nil, []uint32{1, 2, 4, 7}},
+		// the settings apply to later cycles as to the first
+		{[]string{"-min-group-size", "3"}, []uint32{1, 2, 4, 6, 7, 8}},
+	} {
+		s := imaptest.NewServer(t)
+		s.AppendMessages(t, "INBOX", a, b, a, d)
+		arrive(t, s, "INBOX", 300*time.Millisecond, a, b, c, c)
+		flags := append([]string{"-interval", "50ms", "-max-duration", "1s"}, test.flags...)
+		_, stdout, stderr := runMain(t, nil, args(s, "clean", flags...)...)
+		if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, test.left) {
+			t.Errorf("%q: got UIDs %v left, want %v; stderr:\n%s", test.flags, uids, test.left, stderr)
+		}
+		if !strings.Contains(stdout, " cycle 2: 1 mailboxes, found 0, removed 0, 0 failed\n") {
+			t.Errorf("%q: got stdout:\n%s", test.flags, stdout)
+		}
+	}
+}
+
+func TestRunIntervalFailures(t *testing.T) {
+	s := imaptest.NewServer(t)
+	s.AppendMessages(t, "Archive", imaptest.Message{Subject: "A"})
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		s.Delete(t, "Archive")
+	}()
+	code, stdout, stderr := runMain(t, nil, args(s, "clean", "-mbox", "Archive", "-interval", "100ms", "-max-consecutive-failures", "1", "-max-duration", "10s")...)
+	if code != 1 || !strings.Contains(stderr, "stopping: too many consecutive cycles failed: 2") {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	if !strings.Contains(stdout, "1 mailboxes, found 0, removed 0, 1 failed\n") {
+		t.Errorf("got stdout:\n%s", stdout)
+	}
+}
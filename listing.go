@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// sortKeys are the orders the listing of scanned messages can be
+// sorted in, each comparing a before b.
+var sortKeys = map[string]func(a, b dedup.Event, groupSize map[string]int) bool{
+	"uid": func(a, b dedup.Event, _ map[string]int) bool {
+		return a.UID < b.UID
+	},
+	"subject": func(a, b dedup.Event, _ map[string]int) bool {
+		return strings.ToLower(a.Subject) < strings.ToLower(b.Subject)
+	},
+	"date": func(a, b dedup.Event, _ map[string]int) bool {
+		return a.Date.Before(b.Date)
+	},
+	"sender": func(a, b dedup.Event, _ map[string]int) bool {
+		return strings.ToLower(a.From) < strings.ToLower(b.From)
+	},
+	"size": func(a, b dedup.Event, _ map[string]int) bool {
+		return a.Size < b.Size
+	},
+	"group-size": func(a, b dedup.Event, groupSize map[string]int) bool {
+		return groupSize[a.Key] < groupSize[b.Key]
+	},
+}
+
+// sortedListing buffers the listing of the scanned messages of a
+// mailbox to print it sorted once the scan is done.
+type sortedListing struct {
+	by           string
+	descending   bool
+	listOnlyDups bool
+	cfg          dedup.Config
+	// limit caps the messages buffered in memory, 0 buffers all.
+	// Beyond it they are moved to a spill file if spill is "file",
+	// otherwise the rest of the mailbox is listed unsorted.
+	limit     int
+	spill     string
+	events    []dedup.Event
+	groupSize map[string]int
+	file      *spillFile
+	streaming bool
+}
+
+func (l *sortedListing) add(e dedup.Event) {
+	if l.groupSize == nil {
+		l.groupSize = map[string]int{}
+	}
+	l.groupSize[e.Key]++
+	if l.streaming {
+		printMessage(os.Stdout, e, l.listOnlyDups, l.cfg)
+		return
+	}
+	l.events = append(l.events, e)
+	if l.limit == 0 || len(l.events) < l.limit {
+		return
+	}
+	if l.spill == "file" {
+		first := l.file == nil
+		err := l.spillEvents()
+		if err == nil {
+			if first {
+				fmt.Fprintf(os.Stderr, "%s: more than %d messages, -dedup-group-report-limit reached, spilling the listing to a temporary file\n", e.Mailbox, l.limit)
+			}
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s: cannot spill the listing: %s\n", e.Mailbox, err)
+	}
+	fmt.Fprintf(os.Stderr, "%s: warning: more than %d messages, -dedup-group-report-limit reached, listing the rest unsorted\n", e.Mailbox, l.limit)
+	l.flush(os.Stdout)
+	l.streaming = true
+}
+
+// spillEvents moves the buffered messages to a run of the spill file.
+func (l *sortedListing) spillEvents() error {
+	if l.file == nil {
+		f, err := newSpillFile()
+		if err != nil {
+			return err
+		}
+		l.file = f
+	}
+	for _, e := range l.events {
+		if err := l.file.write(newRecord(e)); err != nil {
+			return err
+		}
+	}
+	if err := l.file.endRun(); err != nil {
+		return err
+	}
+	l.events = l.events[:0]
+	return nil
+}
+
+// less reports whether a is listed before b.
+func (l *sortedListing) less(a, b dedup.Event) bool {
+	if l.descending {
+		return sortKeys[l.by](b, a, l.groupSize)
+	}
+	return sortKeys[l.by](a, b, l.groupSize)
+}
+
+// flush prints the buffered messages sorted to w and empties the
+// buffer. Messages which compare equal stay in UID order.
+func (l *sortedListing) flush(w io.Writer) {
+	if l.file != nil {
+		if err := l.flushSpilled(w); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot list the spilled messages: %s\n", err)
+		}
+	} else {
+		sort.SliceStable(l.events, func(i, j int) bool { return l.less(l.events[i], l.events[j]) })
+		for _, e := range l.events {
+			printMessage(w, e, l.listOnlyDups, l.cfg)
+		}
+	}
+	l.events = l.events[:0]
+	l.groupSize = nil
+	l.streaming = false
+}
+
+// flushSpilled prints the spilled and buffered messages sorted to w
+// while holding no more than limit of them in memory: each run of the
+// spill file is sorted into a run of another one, and those runs are
+// merged. The spill files are removed.
+func (l *sortedListing) flushSpilled(w io.Writer) error {
+	defer func() {
+		l.file.close()
+		l.file = nil
+	}()
+	if err := l.spillEvents(); err != nil {
+		return err
+	}
+	sorted, err := newSpillFile()
+	if err != nil {
+		return err
+	}
+	defer sorted.close()
+	for i := range l.file.runs {
+		var events []dedup.Event
+		next := l.file.reader(i)
+		for {
+			r, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			events = append(events, r.event())
+		}
+		sort.SliceStable(events, func(i, j int) bool { return l.less(events[i], events[j]) })
+		for _, e := range events {
+			if err := sorted.write(newRecord(e)); err != nil {
+				return err
+			}
+		}
+		if err := sorted.endRun(); err != nil {
+			return err
+		}
+	}
+
+	// the first message of each run, taking those of earlier runs
+	// first among equal ones keeps the merge stable
+	runs := make([]func() (record, error), len(sorted.runs))
+	heads := make([]*dedup.Event, len(sorted.runs))
+	advance := func(i int) error {
+		r, err := runs[i]()
+		if err == io.EOF {
+			heads[i] = nil
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := r.event()
+		heads[i] = &e
+		return nil
+	}
+	for i := range runs {
+		runs[i] = sorted.reader(i)
+		if err := advance(i); err != nil {
+			return err
+		}
+	}
+	for {
+		min := -1
+		for i, e := range heads {
+			if e != nil && (min < 0 || l.less(*e, *heads[min])) {
+				min = i
+			}
+		}
+		if min < 0 {
+			return nil
+		}
+		printMessage(w, *heads[min], l.listOnlyDups, l.cfg)
+		if err := advance(min); err != nil {
+			return err
+		}
+	}
+}
+
+// printMessage prints the listing line of a scanned message: its
+// mailbox, UID, status, key and quoted subject, e.g.
+//
+//	INBOX: 12 duplicate <a@example.org> "Hello"
+//
+// The status is "first" for the first copy seen of a key and
+// "duplicate" for later ones, or "candidate" if they are still to be
+// confirmed by body or to be in the same conversation.
+func printMessage(w io.Writer, e dedup.Event, listOnlyDups bool, cfg dedup.Config) {
+	if !e.Duplicate && listOnlyDups {
+		return
+	}
+	status := "first"
+	if e.Duplicate {
+		status = "duplicate"
+		if cfg.Strategy == dedup.StrategyTiered || cfg.Scope == dedup.ScopeConversation {
+			status = "candidate"
+		}
+	}
+	fmt.Fprintf(w, "%s: %d %s %s %q\n", e.Mailbox, e.UID, status, e.Key, e.Subject)
+}
+
+// groupListing replaces the listing of scanned messages by a line per
+// group of duplicates and a tally, printed once the scan of a mailbox
+// is done, for -dedup-report-duplicates-only-summary.
+type groupListing struct {
+	// messages are the scanned duplicates by mailbox and UID. The
+	// other messages, most of which are in no group, are only counted
+	// in scanned; a group is listed with the key and subject of a
+	// duplicate and the sizes its scan recorded.
+	messages map[string]map[uint32]dedup.Event
+	scanned  map[string]int
+	// limit caps the messages held in messages, 0 holds all. Beyond
+	// it they are moved to a spill file if spill is "file", otherwise
+	// only counted in dropped, leaving their subject out of the
+	// listing.
+	limit   int
+	spill   string
+	held    int
+	file    *spillFile
+	dropped map[string]int
+}
+
+func (l *groupListing) add(e dedup.Event) {
+	if l.messages == nil {
+		l.messages = make(map[string]map[uint32]dedup.Event)
+		l.scanned = make(map[string]int)
+	}
+	l.scanned[e.Mailbox]++
+	if !e.Duplicate {
+		return
+	}
+	if l.messages[e.Mailbox] == nil {
+		l.messages[e.Mailbox] = make(map[uint32]dedup.Event)
+	}
+	if _, ok := l.messages[e.Mailbox][e.UID]; !ok && l.limit > 0 && l.held >= l.limit {
+		l.overflow(e)
+		return
+	}
+	if _, ok := l.messages[e.Mailbox][e.UID]; !ok {
+		l.held++
+	}
+	l.messages[e.Mailbox][e.UID] = e
+}
+
+// overflow keeps e beyond the limit.
+func (l *groupListing) overflow(e dedup.Event) {
+	if l.spill == "file" {
+		first := l.file == nil
+		err := l.spillEvent(e)
+		if err == nil {
+			if first {
+				fmt.Fprintf(os.Stderr, "%s: more than %d duplicates, -dedup-group-report-limit reached, spilling the listing to a temporary file\n", e.Mailbox, l.limit)
+			}
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s: cannot spill the listing: %s\n", e.Mailbox, err)
+		l.spill = ""
+	}
+	if l.dropped == nil {
+		l.dropped = make(map[string]int)
+	}
+	if l.dropped[e.Mailbox] == 0 {
+		fmt.Fprintf(os.Stderr, "%s: warning: more than %d duplicates, -dedup-group-report-limit reached, the subjects of their groups may be left out\n", e.Mailbox, l.limit)
+	}
+	l.dropped[e.Mailbox]++
+}
+
+func (l *groupListing) spillEvent(e dedup.Event) error {
+	if l.file == nil {
+		f, err := newSpillFile()
+		if err != nil {
+			return err
+		}
+		l.file = f
+	}
+	return l.file.write(newRecord(e))
+}
+
+// unspill reads the spilled messages of the groups of mbox back,
+// keepers in other mailboxes included, and returns them by mailbox and
+// UID. The spill file is rewritten without the messages of mbox.
+func (l *groupListing) unspill(mbox string, groups []dedup.Group) (map[string]map[uint32]dedup.Event, error) {
+	if l.file == nil {
+		return nil, nil
+	}
+	if err := l.file.endRun(); err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]map[uint32]bool)
+	want := func(mbox string, uid uint32) {
+		if wanted[mbox] == nil {
+			wanted[mbox] = make(map[uint32]bool)
+		}
+		wanted[mbox][uid] = true
+	}
+	for _, g := range groups {
+		if g.Mailbox != mbox {
+			continue
+		}
+		keeperMbox := mbox
+		if g.KeeperMailbox != "" {
+			keeperMbox = g.KeeperMailbox
+		}
+		want(keeperMbox, g.Keeper)
+		for _, uid := range g.Duplicates {
+			want(mbox, uid)
+		}
+	}
+
+	rest, err := newSpillFile()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]map[uint32]dedup.Event)
+	left := 0
+	err = l.file.each(func(r record) error {
+		if wanted[r.Mailbox][r.UID] {
+			if found[r.Mailbox] == nil {
+				found[r.Mailbox] = make(map[uint32]dedup.Event)
+			}
+			found[r.Mailbox][r.UID] = r.event()
+		}
+		if r.Mailbox == mbox {
+			return nil
+		}
+		left++
+		return rest.write(r)
+	})
+	if err != nil {
+		rest.close()
+		return nil, err
+	}
+	l.file.close()
+	l.file = nil
+	if left == 0 {
+		rest.close()
+	} else {
+		l.file = rest
+	}
+	return found, nil
+}
+
+// flush prints the groups of mbox to w, each as the number of copies,
+// key and quoted subject followed by the UID kept and those removed,
+// e.g.
+//
+//	INBOX: 3 copies of <a@example.org> "Hello": keeping 7, removing 12 15
+//
+// and a tally of the duplicates, their size and the messages scanned.
+// The snippet of the first copy fetched, if any, is printed below each
+// group. The scanned messages of mbox are then forgotten.
+func (l *groupListing) flush(w io.Writer, mbox string, groups []dedup.Group, snippets map[uint32]string) {
+	spilled, err := l.unspill(mbox, groups)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: cannot read the spilled listing: %s\n", mbox, err)
+	}
+	find := func(mbox string, uid uint32) (dedup.Event, bool) {
+		if e, ok := l.messages[mbox][uid]; ok {
+			return e, ok
+		}
+		e, ok := spilled[mbox][uid]
+		return e, ok
+	}
+	for _, g := range groups {
+		if g.Mailbox != mbox {
+			continue
+		}
+		removing := make([]string, len(g.Duplicates))
+		for i, uid := range g.Duplicates {
+			removing[i] = fmt.Sprint(uid)
+		}
+		keeper := fmt.Sprint(g.Keeper)
+		if g.KeeperMailbox != "" {
+			keeper = fmt.Sprintf("%d in %s", g.Keeper, g.KeeperMailbox)
+		}
+		if g.Sender != "" {
+			fmt.Fprintf(w, "%s: %d older messages of %s: keeping %s, removing %s\n", mbox, len(g.Duplicates), g.Sender, keeper, strings.Join(removing, " "))
+			printGroupSnippet(w, mbox, g, snippets)
+			continue
+		}
+		first, ok := find(mbox, g.Keeper)
+		if g.KeeperMailbox != "" {
+			first, ok = find(g.KeeperMailbox, g.Keeper)
+		}
+		// the keeper is usually the first copy, which was no
+		// duplicate when it was scanned
+		for i := 0; !ok && i < len(g.Duplicates); i++ {
+			first, ok = find(mbox, g.Duplicates[i])
+		}
+		key, subject := g.Key, ""
+		if ok {
+			key, subject = first.Key, first.Subject
+		}
+		fmt.Fprintf(w, "%s: %d copies of %s %q: keeping %s, removing %s\n", mbox, len(g.Duplicates)+1, key, subject, keeper, strings.Join(removing, " "))
+		printGroupSnippet(w, mbox, g, snippets)
+	}
+	sizes := make(map[uint32]uint32)
+	for _, g := range groups {
+		if g.Mailbox != mbox {
+			continue
+		}
+		for uid, size := range g.Sizes {
+			sizes[uid] = size
+		}
+	}
+	uids := dedup.DuplicateUIDs(groups, mbox)
+	var size int64
+	for _, uid := range uids {
+		s, ok := sizes[uid]
+		if !ok {
+			e, _ := find(mbox, uid)
+			s = e.Size
+		}
+		size += int64(s)
+	}
+	fmt.Fprintf(w, "%s: %d duplicates, %s, of %d messages scanned\n", mbox, len(uids), byteSize(size), l.scanned[mbox])
+	l.held -= len(l.messages[mbox])
+	delete(l.messages, mbox)
+	delete(l.scanned, mbox)
+	delete(l.dropped, mbox)
+}
+
+// printGroupSnippet prints the quoted snippet of the keeper of g, or of
+// its first duplicate which has one, indented below the line of g.
+func printGroupSnippet(w io.Writer, mbox string, g dedup.Group, snippets map[uint32]string) {
+	uids := g.Duplicates
+	if g.KeeperMailbox == "" {
+		uids = append([]uint32{g.Keeper}, uids...)
+	}
+	for _, uid := range uids {
+		if s, ok := snippets[uid]; ok {
+			fmt.Fprintf(w, "%s:   %d: %q\n", mbox, uid, s)
+			return
+		}
+	}
+}
+
+// printSnippets prints the quoted snippets of the messages of mbox in
+// groups, keepers first, e.g.
+//
+//	INBOX: 12 snippet "Hi all, the minutes of Monday are attached…"
+func printSnippets(w io.Writer, mbox string, groups []dedup.Group, snippets map[uint32]string) {
+	if len(snippets) == 0 {
+		return
+	}
+	for _, g := range groups {
+		if g.Mailbox != mbox {
+			continue
+		}
+		uids := g.Duplicates
+		if g.KeeperMailbox == "" {
+			uids = append([]uint32{g.Keeper}, uids...)
+		}
+		for _, uid := range uids {
+			if s, ok := snippets[uid]; ok {
+				fmt.Fprintf(w, "%s: %d snippet %q\n", mbox, uid, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// listingServer returns a server whose INBOX has copies keyed by
+// Message-ID and by envelope hash, subjects needing quotes and escapes,
+// and copies of another body.
+func listingServer(t *testing.T) *imaptest.Server {
+	s := imaptest.NewServer(t)
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 8, 0, 0, 0, time.UTC) }
+	s.AppendMessages(t, "INBOX",
+		imaptest.Message{MessageID: "<a@example.org>", Subject: `Quarterly "results"`, Date: day(3)},
+		imaptest.Message{MessageID: "<b@example.org>", Subject: "Café ☕", Date: day(1)},
+		imaptest.Message{MessageID: "<a@example.org>", Subject: `Quarterly "results"`, Date: day(3)},
+		imaptest.Message{Subject: "Build failed", Body: "first run", Date: day(2)},
+		imaptest.Message{Subject: "Build failed", Body: "second run", Date: day(2)},
+		imaptest.Message{Subject: "Build failed", Body: "first run", Date: day(2)},
+		imaptest.Message{Subject: "", Date: day(4)},
+	)
+	return s
+}
+
+// TestListingGolden compares the output of scan in each listing format
+// to testdata/listing/<name>.txt, rewritten by go test -run
+// TestListingGolden -update after a deliberate change of the format.
+func TestListingGolden(t *testing.T) {
+	s := listingServer(t)
+	for _, test := range []struct {
+		name  string
+		flags []string
+	}{
+		{"summary", nil},
+		{"messages", []string{"-report", "messages"}},
+		{"list-only-dups", []string{"-list-only-dups"}},
+		{"sort-date", []string{"-sort", "date"}},
+		{"sort-subject", []string{"-sort", "subject"}},
+		{"tiered", []string{"-report", "messages", "-strategy", "tiered"}},
+		{"tiered-summary", []string{"-strategy", "tiered"}},
+	} {
+		code, stdout, stderr := runMain(t, nil, args(s, "scan", append([]string{"-mbox", "INBOX"}, test.flags...)...)...)
+		if code != 0 {
+			t.Fatalf("%s: exit code %d, stderr:\n%s", test.name, code, stderr)
+		}
+		golden := filepath.Join("testdata", "listing", test.name+".txt")
+		if *updateGolden {
+			if err := os.WriteFile(golden, []byte(stdout), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stdout != string(want) {
+			t.Errorf("%s: the listing differs from %s, run go test -run TestListingGolden -update if that is intended, got:\n%s", test.name, golden, stdout)
+		}
+	}
+}
+
+// TestGroupListingDuplicatesOnly checks that the group listing holds the
+// duplicates only, and still lists each group and tallies the sizes
+// and the messages scanned.
+func TestGroupListingDuplicatesOnly(t *testing.T) {
+	l := &groupListing{}
+	for uid := uint32(1); uid <= 1000; uid++ {
+		l.add(dedup.Event{Kind: dedup.EventMessage, Mailbox: "INBOX", UID: uid, Key: fmt.Sprintf("<%d@example.org>", uid), Subject: "Unique", Size: 10})
+	}
+	l.add(dedup.Event{Kind: dedup.EventMessage, Mailbox: "INBOX", UID: 1001, Key: "<1@example.org>", Subject: "Unique", Size: 10, Duplicate: true})
+	l.add(dedup.Event{Kind: dedup.EventMessage, Mailbox: "INBOX", UID: 1002, Key: "<2@example.org>", Subject: "Unique", Size: 20, Duplicate: true})
+	if held := len(l.messages["INBOX"]); held != 2 {
+		t.Fatalf("got %d messages held, want 2", held)
+	}
+
+	groups := []dedup.Group{
+		{Mailbox: "INBOX", Keeper: 1, Duplicates: []uint32{1001}, Sizes: map[uint32]uint32{1: 10, 1001: 10}},
+		// the larger copy is kept, the first becomes a duplicate
+		{Mailbox: "INBOX", Keeper: 1002, Duplicates: []uint32{2}, Sizes: map[uint32]uint32{2: 10, 1002: 20}},
+	}
+	var b strings.Builder
+	l.flush(&b, "INBOX", groups, nil)
+	want := `INBOX: 2 copies of <1@example.org> "Unique": keeping 1, removing 1001
+INBOX: 2 copies of <2@example.org> "Unique": keeping 1002, removing 2
+INBOX: 2 duplicates, 20 B, of 1002 messages scanned
+`
+	if b.String() != want {
+		t.Errorf("got listing\n%s\nwant\n%s", b.String(), want)
+	}
+	if len(l.messages) != 0 || l.held != 0 {
+		t.Errorf("got %d messages held after the flush", l.held)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lockDir returns the directory of the lock files,
+// $XDG_STATE_HOME/imap-clean-dup/locks or
+// ~/.local/state/imap-clean-dup/locks.
+func lockDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "imap-clean-dup", "locks"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "imap-clean-dup", "locks"), nil
+}
+
+// lockName returns the name of the lock file of mbox of username on
+// server. Mailbox names may contain any character, so the key is
+// hashed.
+func lockName(server, username, mbox string) string {
+	sum := sha256.Sum256([]byte(server + "\x00" + username + "\x00" + mbox))
+	return fmt.Sprintf("%x.lock", sum[:16])
+}
+
+// lockHolder is the run recorded in a lock file.
+type lockHolder struct {
+	pid     int
+	started time.Time
+}
+
+// lockedError is returned if another run holds the lock of a mailbox.
+type lockedError struct {
+	mbox   string
+	path   string
+	holder lockHolder
+	// stale is set if the holder no longer runs.
+	stale bool
+}
+
+func (e *lockedError) Error() string {
+	started := e.holder.started.Local().Format("2006-01-02 15:04")
+	if today := time.Now().Format("2006-01-02 "); strings.HasPrefix(started, today) {
+		started = strings.TrimPrefix(started, today)
+	}
+	msg := fmt.Sprintf("another run (pid %d, started %s) holds the lock on %s", e.holder.pid, started, e.mbox)
+	if e.stale {
+		msg += fmt.Sprintf(", but no longer runs; use -force-lock to take it over or remove %s", e.path)
+	}
+	return msg
+}
+
+// locks are the lock files of the mailboxes of username on server held
+// by this run. Locks are advisory: they only keep out other runs of
+// this tool on the same machine.
+type locks struct {
+	dir      string
+	server   string
+	username string
+	// force takes over locks of runs which no longer exist.
+	force bool
+
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+// acquire creates the lock file of mbox, holding the PID and start time
+// of this run. If another run holds it, acquire fails with a
+// *lockedError, unless force is set and that run no longer exists.
+func (l *locks) acquire(mbox string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(l.dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(l.dir, lockName(l.server, l.username, mbox))
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n%s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return err
+			}
+			if l.held == nil {
+				l.held = make(map[string]bool)
+			}
+			l.held[path] = true
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		holder, err := readLock(path)
+		if err != nil && (!l.force || attempt > 0) {
+			return fmt.Errorf("cannot read lock %s: %w, use -force-lock to take it over", path, err)
+		}
+		if err == nil {
+			stale := !running(holder.pid)
+			if !stale || !l.force || attempt > 0 {
+				return &lockedError{mbox: mbox, path: path, holder: holder, stale: stale}
+			}
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+}
+
+// release removes the lock file of mbox if this run holds it.
+func (l *locks) release(mbox string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	path := filepath.Join(l.dir, lockName(l.server, l.username, mbox))
+	if l.held[path] {
+		os.Remove(path)
+		delete(l.held, path)
+	}
+}
+
+// releaseAll removes all lock files this run holds, for exiting
+// without running deferred calls. It does nothing on a nil *locks.
+func (l *locks) releaseAll() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for path := range l.held {
+		os.Remove(path)
+		delete(l.held, path)
+	}
+}
+
+// readLock returns the run recorded in the lock file at path.
+func readLock(path string) (lockHolder, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return lockHolder{}, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		return lockHolder{}, fmt.Errorf("malformed lock file")
+	}
+	pid, err := strconv.Atoi(lines[0])
+	if err != nil {
+		return lockHolder{}, fmt.Errorf("malformed lock file: %w", err)
+	}
+	started, err := time.Parse(time.RFC3339, lines[1])
+	if err != nil {
+		return lockHolder{}, fmt.Errorf("malformed lock file: %w", err)
+	}
+	return lockHolder{pid, started}, nil
+}
+
+// running reports whether a process with pid exists. Where signals
+// cannot be sent to check, processes are assumed to run.
+func running(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH)
+}
+
+// hold acquires the lock of mbox and returns its release. A nil *locks,
+// as for runs which do not modify mailboxes, holds nothing.
+func (l *locks) hold(mbox string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if err := l.acquire(mbox); err != nil {
+		return nil, err
+	}
+	return func() { l.release(mbox) }, nil
+}
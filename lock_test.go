@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// deadPID returns the PID of a process which exited.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+// writeLock writes the lock file of mbox in dir as held by pid since
+// started, and returns its path.
+func writeLock(t *testing.T, dir, server, username, mbox string, pid int, started time.Time) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, lockName(server, username, mbox))
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%d\n%s\n", pid, started.Format(time.RFC3339))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLockAcquire(t *testing.T) {
+	l := &locks{dir: filepath.Join(t.TempDir(), "locks"), server: "imap.example.org", username: "user"}
+	release, err := l.hold("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(l.dir, lockName(l.server, l.username, "INBOX"))
+	holder, err := readLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder.pid != os.Getpid() || time.Since(holder.started) > time.Minute {
+		t.Errorf("lock held by %+v", holder)
+	}
+	if fi, err := os.Stat(l.dir); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("lock directory: %v, %v", fi, err)
+	}
+
+	// other mailboxes, servers and users have their own locks
+	if err := l.acquire("Archive"); err != nil {
+		t.Error(err)
+	}
+	other := &locks{dir: l.dir, server: "imap.example.org", username: "other"}
+	if err := other.acquire("INBOX"); err != nil {
+		t.Error(err)
+	}
+	other.releaseAll()
+
+	release()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock left after release: %v", err)
+	}
+	l.releaseAll()
+	if entries, _ := os.ReadDir(l.dir); len(entries) != 0 {
+		t.Errorf("locks left after releaseAll: %v", entries)
+	}
+
+	// releasing a lock not held leaves the holder's lock file
+	writeLock(t, l.dir, l.server, l.username, "INBOX", os.Getpid(), time.Now())
+	l.release("INBOX")
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("lock of another run removed: %v", err)
+	}
+
+	// a nil *locks holds nothing
+	var none *locks
+	if release, err := none.hold("INBOX"); err != nil {
+		t.Error(err)
+	} else {
+		release()
+	}
+	none.releaseAll()
+}
+
+// TestLockContention checks that a lock held by a running process keeps
+// out other runs even with -force-lock, and that one held by a process
+// which no longer runs is reported stale and taken over with it.
+func TestLockContention(t *testing.T) {
+	dead := deadPID(t)
+	started := time.Now().Add(-time.Hour)
+	for _, test := range []struct {
+		pid   int
+		force bool
+		err   string
+	}{
+		{os.Getpid(), false, fmt.Sprintf("another run (pid %d, started %s) holds the lock on INBOX", os.Getpid(), started.Format("15:04"))},
+		{os.Getpid(), true, fmt.Sprintf("another run (pid %d, started %s) holds the lock on INBOX", os.Getpid(), started.Format("15:04"))},
+		{dead, false, fmt.Sprintf("another run (pid %d, started %s) holds the lock on INBOX, but no longer runs; use -force-lock to take it over", dead, started.Format("15:04"))},
+		{dead, true, ""},
+	} {
+		l := &locks{dir: t.TempDir(), server: "imap.example.org", username: "user", force: test.force}
+		path := writeLock(t, l.dir, l.server, l.username, "INBOX", test.pid, started)
+		err := l.acquire("INBOX")
+		holder, rerr := readLock(path)
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		if test.err == "" {
+			if err != nil || holder.pid != os.Getpid() {
+				t.Errorf("pid %d, force %v: got error %v, lock held by %d", test.pid, test.force, err, holder.pid)
+			}
+			continue
+		}
+		le, ok := err.(*lockedError)
+		if !ok || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("pid %d, force %v: got error %v, want %q", test.pid, test.force, err, test.err)
+		} else if le.stale != (test.pid == dead) {
+			t.Errorf("pid %d, force %v: stale is %v", test.pid, test.force, le.stale)
+		}
+		if holder.pid != test.pid {
+			t.Errorf("pid %d, force %v: lock taken over by %d", test.pid, test.force, holder.pid)
+		}
+	}
+
+	// a lock from another day shows the date it was taken
+	err := &lockedError{mbox: "INBOX", holder: lockHolder{1234, time.Date(2020, 1, 2, 12, 3, 0, 0, time.Local)}}
+	if want := "another run (pid 1234, started 2020-01-02 12:03) holds the lock on INBOX"; err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+}
+
+func TestLockMalformed(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		l := &locks{dir: t.TempDir(), server: "imap.example.org", username: "user", force: force}
+		path := filepath.Join(l.dir, lockName(l.server, l.username, "INBOX"))
+		if err := os.WriteFile(path, []byte("garbage"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := l.acquire("INBOX")
+		if force {
+			if err != nil {
+				t.Errorf("force: %v", err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), "malformed lock file, use -force-lock to take it over") {
+			t.Errorf("got error %v", err)
+		}
+	}
+}
+
+// TestRunLocked runs against a mailbox locked by another run and checks
+// that it fails before modifying it, takes over a stale lock with
+// -force-lock and releases the lock it took on exit.
+func TestRunLocked(t *testing.T) {
+	dead := deadPID(t)
+	for _, test := range []struct {
+		pid   int
+		flags []string
+		code  int
+		left  int
+	}{
+		{os.Getpid(), nil, 1, 6},
+		{os.Getpid(), []string{"-force-lock"}, 1, 6},
+		{dead, nil, 1, 6},
+		{dead, []string{"-force-lock"}, 0, 3},
+	} {
+		s := dupServer(t)
+		state := t.TempDir()
+		path := writeLock(t, filepath.Join(state, "imap-clean-dup", "locks"), s.Host(), imaptest.Username, "INBOX", test.pid, time.Now())
+		code, _, stderr := runMain(t, []string{"XDG_STATE_HOME=" + state}, args(s, "clean", test.flags...)...)
+		if code != test.code {
+			t.Errorf("pid %d %v: exit code %d, stderr:\n%s", test.pid, test.flags, code, stderr)
+		}
+		if uids := s.UIDs(t, "INBOX"); len(uids) != test.left {
+			t.Errorf("pid %d %v: got UIDs %v left", test.pid, test.flags, uids)
+		}
+		_, err := os.Stat(path)
+		if test.code == 0 {
+			if !os.IsNotExist(err) {
+				t.Errorf("pid %d %v: lock left: %v", test.pid, test.flags, err)
+			}
+		} else if err != nil {
+			t.Errorf("pid %d %v: lock of the other run removed: %v", test.pid, test.flags, err)
+		} else if want := fmt.Sprintf("another run (pid %d, started ", test.pid); !strings.Contains(stderr, want) {
+			t.Errorf("pid %d %v: stderr:\n%s", test.pid, test.flags, stderr)
+		}
+	}
+}
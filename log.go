@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// logFileName inserts the date of t into path, so that
+// "/var/log/imap-clean-dup.log" becomes
+// "/var/log/imap-clean-dup-2024-01-02.log". Runs on the same day
+// share a file, which leaves rotation to external tools.
+func logFileName(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	if ext == "" {
+		ext = ".log"
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "-" + t.Format("2006-01-02") + ext
+}
+
+// openLog opens the dated log file for path in append mode and returns
+// a logger writing to it. An empty path yields a logger discarding
+// everything and a nil file.
+func openLog(path string) (*slog.Logger, *os.File, error) {
+	if path == "" {
+		return slog.New(slog.NewTextHandler(io.Discard, nil)), nil, nil
+	}
+	f, err := os.OpenFile(logFileName(path, time.Now()), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return slog.New(slog.NewTextHandler(f, nil)), f, nil
+}
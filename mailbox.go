@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap/utf7"
+)
+
+// decodeMailbox returns name decoded if it is given in modified UTF-7,
+// the encoding of mailbox names on the wire, e.g. Arbeitsfl&AOQ-che
+// copied from a server log for Arbeitsfläche. go-imap encodes names
+// itself, so such a name would otherwise be encoded twice and not be
+// found. decoded reports whether name was decoded; names which are not
+// canonical modified UTF-7 are returned as given.
+func decodeMailbox(name string) (_ string, decoded bool) {
+	if !strings.Contains(name, "&") {
+		return name, false
+	}
+	dec, err := utf7.Encoding.NewDecoder().String(name)
+	if err != nil || dec == name {
+		return name, false
+	}
+	if enc, err := utf7.Encoding.NewEncoder().String(dec); err != nil || enc != name {
+		return name, false
+	}
+	return dec, true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+func TestDecodeMailbox(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		want    string
+		decoded bool
+	}{
+		{"INBOX", "INBOX", false},
+		{"Arbeitsfläche", "Arbeitsfläche", false},
+		{"Arbeitsfl&AOQ-che", "Arbeitsfläche", true},
+		{"&BB4EQgQ,BEAEMAQyBDsENQQ9BD0ESwQ1-", "Отправленные", true},
+		{"Tom &- Jerry", "Tom & Jerry", true},
+		// not modified UTF-7, taken as given
+		{"AT&T", "AT&T", false},
+		{"Tom & Jerry", "Tom & Jerry", false},
+		// modified UTF-7, but not as an encoder writes it
+		{"&AGEAYgBj-", "&AGEAYgBj-", false},
+	} {
+		got, decoded := decodeMailbox(test.name)
+		if got != test.want || decoded != test.decoded {
+			t.Errorf("decodeMailbox(%q) = %q, %t, want %q, %t", test.name, got, decoded, test.want, test.decoded)
+		}
+	}
+}
+
+// TestRunMailboxNames scans mailboxes with non-ASCII names, which cross
+// the wire in modified UTF-7, given as is and encoded.
+func TestRunMailboxNames(t *testing.T) {
+	s := imaptest.NewServer(t)
+	for _, name := range []string{"Arbeitsfläche", "Отправленные"} {
+		s.AppendMessages(t, name,
+			imaptest.Message{MessageID: "<a@example.org>", Subject: "A"},
+			imaptest.Message{MessageID: "<a@example.org>", Subject: "A"},
+		)
+	}
+	for _, test := range []struct {
+		mbox, name string
+		note       bool
+	}{
+		{"Arbeitsfläche", "Arbeitsfläche", false},
+		{"Arbeitsfl&AOQ-che", "Arbeitsfläche", true},
+		{"Отправленные", "Отправленные", false},
+		{"&BB4EQgQ,BEAEMAQyBDsENQQ9BD0ESwQ1-", "Отправленные", true},
+	} {
+		code, stdout, stderr := runMain(t, nil, args(s, "scan", "-mbox", test.mbox)...)
+		if code != 0 || !strings.Contains(stdout, test.name+`: 2 copies of <a@example.org> "A"`) {
+			t.Errorf("-mbox %s: exit code %d, stdout:\n%s\nstderr:\n%s", test.mbox, code, stdout, stderr)
+		}
+		if note := strings.Contains(stderr, "is encoded in modified UTF-7, using "); note != test.note {
+			t.Errorf("-mbox %s: got stderr:\n%s", test.mbox, stderr)
+		}
+	}
+
+	// listed names are decoded for display
+	code, stdout, stderr := runMain(t, nil, args(s, "list-mailboxes")...)
+	for _, name := range []string{"Arbeitsfläche", "Отправленные"} {
+		if code != 0 || !strings.Contains(stdout, name+"\n") {
+			t.Errorf("list-mailboxes: exit code %d, stdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+		}
+	}
+}
@@ -7,198 +7,1901 @@
 package main
 
 import (
-	"crypto/sha1"
+	"context"
 	"crypto/tls"
-	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
-	"math"
+	"io"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
 )
 
 func main() {
+	os.Exit(run(os.Args[1:], nil))
+}
+
+// run parses the flags of args and processes the mailboxes, returning
+// the exit code. With acct it runs the profile of an account of
+// -all-profiles or -profiles, whose summary it records there; the flags
+// must then be defined anew on an empty flag.CommandLine.
+func run(args []string, acct *account) (code int) {
 	username := flag.String("username", "", "IMAP user (required)")
-	password := flag.String("password", "", "IMAP password (required)")
+	password := flag.String("password", "", "IMAP password (required unless -oauth2-credentials)")
+	oauth2Creds := flag.String("oauth2-credentials", "", "JSON file with client_id, client_secret, refresh_token and token_url; access tokens are obtained from it and sent with XOAUTH2 instead of -password")
 	server := flag.String("server", "", "IMAP server (required)")
-	mbox := flag.String("mbox", "", "Mailbox to remove duplicates from (required)")
+	port := flag.Int("port", 0, "IMAP port, defaults to 993 with TLS and 143 otherwise")
+	useTLS := flag.Bool("tls", true, "Connect using TLS, use -tls=false for a plain connection")
+	useStartTLS := flag.Bool("starttls", false, "If present, a plain connection is upgraded with STARTTLS")
+	tlsMin := flag.String("tls-min-version", "1.2", "Oldest TLS version accepted, 1.0, 1.1, 1.2 or 1.3; lower it only for legacy servers")
+	tlsMax := flag.String("tls-max-version", "", "Newest TLS version offered, 1.0, 1.1, 1.2 or 1.3, the newest supported if empty")
+	compress := flag.String("compress", "auto", "COMPRESS=DEFLATE: auto compresses the traffic after login if the server advertises it, off never does")
+	scanServer := flag.String("scan-server", "", "Server, as host or host:port, scanned instead of -server, e.g. a read replica; removal is checked against the UIDVALIDITY seen there")
+	deleteServer := flag.String("delete-server", "", "Server, as host or host:port, duplicates are removed on instead of -server")
+	debugIMAP := flag.Bool("debug-imap", false, "If present, the IMAP commands and responses are traced to stderr, with the credentials of LOGIN left out")
+	serverURL := flag.String("server-url", "", "IMAP URL such as imaps://user@host:993/INBOX, replacing -server, -port, -tls, -starttls, -username and -mbox")
+	mbox := flag.String("mbox", "", "Mailbox to remove duplicates from, INBOX if not given or '*', unless -all-mailboxes is given")
+	allMailboxes := flag.Bool("all-mailboxes", false, "If present, duplicates are removed from every selectable mailbox, a failing mailbox does not stop the others unless -strict")
 	listOnlyDups := flag.Bool("list-only-dups", false, "If present, only duplicated messages are output")
+	groupSummary := flag.Bool("dedup-report-duplicates-only-summary", false, "If present, instead of a line per message a line per group of duplicates and a tally are printed after the scan of each mailbox; the default of scan and clean, see -report")
+	report := flag.String("report", "summary", "Output of scan and clean for each mailbox: summary prints a line per group of duplicates and a tally, messages a line per scanned message as without a command; -sort and -list-only-dups imply messages")
+	snippetLen := flag.Int("snippet", 0, "If set, e.g. to 120, the first characters of the text of the messages in groups of duplicates are printed after the listing, fetching at most 2048 bytes of each")
+	reportLimit := flag.Int("dedup-group-report-limit", 1000000, "Most messages of a mailbox held in memory for -sort, or duplicates for -dedup-report-duplicates-only-summary, 0 for no limit; see -dedup-group-report-spill for the rest")
+	reportSpill := flag.String("dedup-group-report-spill", "file", "What happens to the messages beyond -dedup-group-report-limit: file moves them to a temporary file, stream lists them unsorted or groups without subject")
+	sortBy := flag.String("sort", "", "Print the listing of messages after the scan sorted by uid, subject, date, sender, size or group-size instead of in fetch order")
+	sortOrder := flag.String("sort-order", "asc", "Order of -sort, asc or desc")
 	ignoreMessageID := flag.Bool("ignore-message-id", false, "If present, MessageId is ignored, a hash for each message is instead calculated")
+	ignoreFields := map[dedup.AddressField]*bool{}
+	for _, af := range dedup.AddressFields {
+		ignoreFields[af.Field] = flag.Bool("ignore-"+af.Name, false, "If present, "+af.Name+" addresses are left out of the calculated hash")
+	}
+	normalizeSubject := flag.Bool("normalize-subject", false, "If present, case, whitespace and Re:/Fwd: markers of the subject are ignored in the calculated hash")
+	dateWindow := flag.Duration("date-window", 0, "If set, dates within the same window (e.g. 24h) are treated as equal in the calculated hash")
+	useListID := flag.Bool("list-id", false, "If present, the List-Id header is included in the calculated hash")
+	attachmentNames := flag.Bool("dedup-attachment-name-only", false, "If present, the file names and sizes of the attachments are included in every key, read from the BODYSTRUCTURE without fetching attachments")
+	scopeBySender := flag.Bool("scope-by-sender", false, "If present, messages without a Message-ID are only duplicates if their first From address is the same, even with -ignore-from, -key-template or -dedup-hash-header-raw")
+	keySize := flag.Bool("key-include-size", false, "If present, the RFC822.SIZE of each message is included in every key, keeping apart copies of a different size without fetching bodies")
+	rawHeader := flag.Bool("dedup-hash-header-raw", false, "If present, the whole header without -volatile-headers is hashed instead of Message-ID and envelope, without fetching bodies")
+	volatileHeaders := flag.String("volatile-headers", strings.Join(dedup.DefaultVolatileHeaders, ","), "Comma-separated headers left out by -dedup-hash-header-raw, a trailing * matches any rest")
+	ignoreResent := flag.Bool("dedup-ignore-resent-headers", false, "If present, the Resent-* headers are left out by -dedup-hash-header-raw too, so that redistributed messages are copies of the original")
+	preset := flag.String("preset", "", "Defaults for a use case: exact, aggressive or newsletters, individual flags still override them")
+	sentReconcile := flag.Bool("dedup-sent-reconcile", false, "If present, messages in both -mbox and -sent-mbox with the same Message-ID and From are reconciled instead, keeping the copy of -prefer")
+	sentMbox := flag.String("sent-mbox", "Sent", "Mailbox of sent messages for -dedup-sent-reconcile")
+	prefer := flag.String("prefer", string(dedup.PreferInbox), "Copy kept by -dedup-sent-reconcile: inbox (the -mbox copy) or sent")
+	keepRole := flag.String("keep-role", "", "Special-use role of the mailbox whose copies are kept, e.g. inbox or archive; copies of its messages in -mbox or every mailbox are removed")
+	draftsMode := flag.String("drafts-mode", "skip", "Handling of the drafts mailbox, whose versions of a draft share a Message-ID: skip it with -all-mailboxes, safe (only identical bodies, keeping the newest) or normal")
+	mergeFlags := flag.Bool("merge-flags", false, "If present, the flags of removed duplicates, such as \\Seen, \\Flagged and keywords, are added to the copy kept")
+	backupDir := flag.String("backup-dir", "", "Save removed duplicates as .eml files below this directory first, together with a restore.sh")
+	newServerURL := flag.String("new-server-url", "", "IMAP URL of the mailbox a migration copied -mbox to, e.g. imaps://user@new.example.org/INBOX, compared by cross-server")
+	newPassword := flag.String("new-password", "", "Password of the user of -new-server-url")
+	deleteMigrated := flag.Bool("delete-migrated", false, "If present, cross-server removes the messages found on both servers from the old one, never touching the new one")
+	appendPath := flag.String("append", "", "Append the .eml files of this directory to -mbox instead of removing duplicates, e.g. to restore a backup")
+	planPath := flag.String("plan", "", "Write the duplicates found to this JSON file, to be reviewed and removed later by apply; needs scan or -dry-run")
+	applyPlan := flag.String("apply-plan", "", "Remove the duplicates of this file written by -plan instead of scanning, leaving alone those whose messages changed since")
+	tui := flag.Bool("tui", false, "If present, the groups of duplicates are reviewed in the terminal before scan writes -plan or apply removes them, choosing which copies to keep; only confirmed groups are kept")
+	appendFlags := flag.String("append-flags", "", "Flags set on messages uploaded by -append, e.g. '\\Seen,\\Flagged'")
+	watch := flag.Bool("watch", false, "If present, after the first pass the connection is kept open and duplicates of messages arriving in -mbox are handled as they arrive, using IDLE if the server has it, until interrupted")
+	interval := flag.Duration("interval", 0, "If set, e.g. 1h, the run repeats this long after each cycle until interrupted, only fetching the messages arrived since after the first pass")
+	maxFailures := flag.Int("max-consecutive-failures", 3, "Number of failed -interval cycles in a row after which the run exits with 1, 0 never exits")
+	countOnly := flag.Bool("count-only", false, "If present, only the number of duplicates is printed and nothing is removed")
+	failOnDuplicates := flag.Bool("fail-on-duplicates", false, "If present, the exit code is 4 if any duplicates were found")
 	dryRun := flag.Bool("dry-run", false, "If present, no removal will be performed")
-	flag.Parse()
+	keepLargest := flag.Bool("dedup-preserve-largest", false, "If present, the largest copy of each group is kept instead of the first, e.g. the one with attachments")
+	keepSmallest := flag.Bool("dedup-preserve-smallest", false, "If present, the smallest copy of each group is kept instead of the first")
+	scope := flag.String("scope", string(dedup.ScopeMailbox), "Where copies are looked for: mailbox, or conversation for copies within a thread linked by Message-ID, In-Reply-To and References only")
+	minGroupSize := flag.Int("min-group-size", 2, "Only groups with at least this many copies have their duplicates removed")
+	minWasted := flag.Int64("report-threshold-bytes", 0, "Only groups whose duplicates take at least this many bytes together are reported and removed, 0 handles all")
+	listCapabilities := flag.Bool("list-capabilities", false, "If present, the capabilities of the server and which of them this tool uses are printed after login, nothing else is done")
+	overview := flag.Bool("overview", false, "If present, list-mailboxes and stats print the number of messages, unseen messages and the next UID of each mailbox, asked with STATUS without selecting it")
+	analyze := flag.Bool("analyze", false, "If present, stats scans each mailbox read-only and reports its size, date range, duplicates by strategy, top senders and a size histogram")
+	stats := flag.Bool("stats", false, "If present, the mailbox status including its flags and permanent flags is printed")
+	format := flag.String("format", "text", "Format of the mailbox status report and -always-report, text or json")
+	compareStrategies := flag.Bool("compare-strategies", false, "If present, the duplicates found by keying with message-id, envelope-hash, body-hash and tiered are counted and compared in a table instead, fetching the bodies once; nothing is removed")
+	strategy := flag.String("strategy", string(dedup.StrategyEnvelope), "How duplicates are detected: envelope compares Message-IDs or envelope hashes, tiered additionally confirms them by comparing bodies")
+	dedupKey := flag.String("dedup-key", "body", "What -strategy tiered compares: body for whole bodies or body-first-n-bytes for the first -body-bytes bytes and the message size")
+	bodyBytes := flag.Int("body-bytes", 4096, "Number of body bytes compared with -dedup-key body-first-n-bytes")
+	fetchBuffer := flag.Int("fetch-buffer", 1000, "Number of fetched messages buffered ahead of the key calculation")
+	hashWorkers := flag.Int("hash-workers", 1, "Number of goroutines calculating message keys")
+	fetchChunk := flag.Int("fetch-chunk", 0, "Number of messages fetched per command, 0 fetches the whole mailbox at once")
+	maxDups := flag.Int("max-dups", 0, "Stop scanning between chunks once this many duplicates were found, 0 scans the whole mailbox")
+	uidFrom := flag.String("uid-from", "1", "Lowest UID scanned, * leaves the range open")
+	uidTo := flag.String("uid-to", "*", "Highest UID scanned, * leaves the range open")
+	limit := flag.Int("limit", 0, "Scan only the first this many messages of each mailbox in UID order, e.g. to try settings on a slice, 0 scans all")
+	keyTemplate := flag.String("key-template", "", "Go template evaluated on each message giving its key, e.g. '{{.Subject}}|{{index .From 0}}'; replaces Message-ID and envelope hash")
+	perSenderCap := flag.Int("preserve-newest-per-sender", 0, "Keep at most this many messages of each sender, removing the older ones after duplicates, 0 keeps all")
+	noopKeepAlive := flag.Duration("noop-keepalive", 0, "Send a NOOP between fetch chunks once this long passed since the last one, 0 disables it")
+	messageDelay := flag.Duration("per-message-delay", 0, "Wait this long between removing two messages, e.g. 500ms, for servers failing under quick successions of STORE and EXPUNGE")
+	opRetries := flag.Int("op-retries", 2, "Number of times an IMAP command failing transiently, e.g. with an internal server error or a lost connection, is retried")
+	maxDuration := flag.Duration("max-duration", 0, "Stop the run after this long, e.g. 30m, 0 runs until done")
+	strict := flag.Bool("strict", false, "If present, the run stops at the first mailbox failing with -all-mailboxes instead of continuing with the others")
+	alwaysReport := flag.Bool("always-report", false, "If present, the summary with the scan parameters is printed in -format at the end of every run, also with no duplicates or on failure")
+	fullExpunge := flag.Bool("allow-full-expunge", false, "If present, on servers without UIDPLUS duplicates are also removed from mailboxes where other messages are flagged \\Deleted, which EXPUNGE then removes too")
+	verifyBefore := flag.Bool("verify-before-delete", false, "If present, the Message-ID and subject of every kept copy and duplicate are fetched again before removal, duplicates of a message which changed since the scan are not removed")
+	verifyAfter := flag.Bool("verify-after", false, "If present, each mailbox duplicates were removed from is scanned again to check that all kept copies exist and no duplicates are left")
+	forceLock := flag.Bool("force-lock", false, "If present, the lock of a mailbox held by a run which no longer exists is taken over")
+	notifyURL := flag.String("notify-url", "", "POST a JSON summary of the run to this URL at its end, e.g. a Slack or Matrix incoming webhook")
+	notifyOn := flag.String("notify-on", "always", "When -notify-url is posted to: always, changes (duplicates found or errors) or errors")
+	emailReport := flag.String("email-report", "", "Email a short summary of the run to these comma-separated addresses at its end, sent through -smtp-server")
+	emailOn := flag.String("email-on", "always", "When -email-report is sent: always, changes (duplicates found or errors) or errors")
+	emailFrom := flag.String("email-from", "", "Sender address of -email-report, -smtp-user by default")
+	emailHTML := flag.Bool("email-html", false, "If present, -email-report also has an HTML version")
+	smtpServer := flag.String("smtp-server", "", "SMTP server sending -email-report, as host or host:port, port 587 by default; STARTTLS is used if offered")
+	smtpUser := flag.String("smtp-user", "", "SMTP user logging in to -smtp-server, none if empty")
+	smtpPassword := flag.String("smtp-password", "", "Password of -smtp-user")
+	summaryFile := flag.String("summary-json-file", "", "Write a JSON summary of the run to this file, whatever the outcome")
+	timing := flag.Bool("timing", false, "If present, time, traffic and command counts of each phase are printed")
+	logFile := flag.String("log-file", "", "Append diagnostics to a dated file derived from this path, e.g. imap-clean-dup-2024-01-02.log")
+	configPath := flag.String("config", "", "TOML file setting flags by name, e.g. ~/.config/imap-clean-dup/config.toml; flags given explicitly take precedence")
+	profile := flag.String("profile", "", "Profile of the -config file to apply on top of its top level values, e.g. work for [profiles.work]")
+	allProfiles := flag.Bool("all-profiles", false, "If present, the command is run for every profile of the -config file in turn, e.g. one per account, followed by a table of all")
+	profileList := flag.String("profiles", "", "Comma-separated profiles of the -config file to run the command for in turn, like -all-profiles")
+	showVersion := flag.Bool("version", false, "If present, the version is printed")
+	flag.Usage = usage
+	if len(args) > 0 && args[0] == "seed" {
+		return runSeed(args[1:])
+	}
+	command, rest, err := parseArgs(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return exitUsage
+	}
+	if *showVersion {
+		fmt.Println(currentVersion())
+		return 0
+	}
+	if command == "completion" {
+		completionScripts[rest[0]](os.Stdout)
+		return 0
+	}
+	if command == "" && flag.NFlag() > 0 {
+		fmt.Fprintln(os.Stderr, "warning: running without a command is deprecated, use scan or clean")
+	}
 
-	if *username == "" || *password == "" || *server == "" || *mbox == "" {
+	if err := applyEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid environment: %s\n", err)
+		return 1
+	}
+
+	if acct == nil && (*allProfiles || *profileList != "") {
+		var p problems
+		p.check(*configPath != "", "-all-profiles and -profiles need -config")
+		p.check(!*allProfiles || *profileList == "", "-all-profiles cannot be combined with -profiles")
+		p.check(*profile == "", "-profile cannot be combined with -all-profiles or -profiles")
+		if len(p) > 0 {
+			p.print(os.Stderr, command)
+			return exitUsage
+		}
+		var names []string
+		if *profileList != "" {
+			for _, name := range strings.Split(*profileList, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+		return runAccounts(command, args, *configPath, names)
+	}
+	if acct != nil {
+		*profile = acct.profile
+	}
+
+	if *configPath != "" {
+		if err := loadConfig(*configPath, *profile); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -config: %s\n", err)
+			return 1
+		}
+	} else if *profile != "" {
+		fmt.Fprintln(os.Stderr, "-profile needs -config")
+		return 1
+	}
+
+	if err := applyPreset(*preset); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -preset: %s\n", err)
+		return 1
+	}
+
+	if *serverURL != "" {
+		if err := applyServerURL(*serverURL, username, server, mbox, port, useTLS, useStartTLS); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -server-url: %s\n", err)
+			return 1
+		}
+	}
+	if *useStartTLS {
+		*useTLS = false
+	}
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{{"mbox", mbox}, {"sent-mbox", sentMbox}} {
+		if dec, ok := decodeMailbox(*f.value); ok {
+			fmt.Fprintf(os.Stderr, "note: -%s %q is encoded in modified UTF-7, using %q\n", f.name, *f.value, dec)
+			*f.value = dec
+		}
+	}
+
+	// without a command, the usage is only printed if neither flags,
+	// the environment nor a configuration set anything
+	if command == "" && flag.NFlag() == 0 {
 		flag.Usage()
-		return
+		return 0
+	}
+
+	var p problems
+	p.check(*server != "", "-server is required")
+	p.check(*username != "", "-username is required")
+	p.check(*password != "" || *oauth2Creds != "", "-password is required unless -oauth2-credentials is given")
+	p.check(*password == "" || *oauth2Creds == "", "-password cannot be combined with -oauth2-credentials")
+	if command != "list-mailboxes" && !*listCapabilities {
+		p.check(*mbox == "" || !*allMailboxes, "-mbox cannot be combined with -all-mailboxes")
+		// '*' names the default explicitly, e.g. to override a -mbox of
+		// the configuration
+		if (*mbox == "" && !*allMailboxes) || *mbox == "*" {
+			*mbox = "INBOX"
+		}
+	}
+	p.check(*minGroupSize >= 2, "-min-group-size must be at least 2, not %d", *minGroupSize)
+	p.check(*minWasted >= 0, "-report-threshold-bytes must not be negative")
+	p.check(*fetchBuffer >= 0, "-fetch-buffer cannot be negative")
+	p.check(*hashWorkers >= 1, "-hash-workers must be at least 1, not %d", *hashWorkers)
+	p.check(*fetchChunk >= 0, "-fetch-chunk cannot be negative")
+	p.check(*maxDups >= 0, "-max-dups cannot be negative")
+	p.check(*limit >= 0, "-limit cannot be negative")
+	p.check(*perSenderCap >= 0, "-preserve-newest-per-sender cannot be negative")
+	p.check(*opRetries >= 0, "-op-retries cannot be negative")
+	p.check(*messageDelay >= 0, "-per-message-delay cannot be negative")
+	p.check(*maxDuration >= 0, "-max-duration cannot be negative")
+	p.check(*noopKeepAlive >= 0, "-noop-keepalive cannot be negative")
+	p.check(*dateWindow >= 0, "-date-window cannot be negative")
+	p.check(*bodyBytes >= 1, "-body-bytes must be at least 1, not %d", *bodyBytes)
+	p.oneOf("format", *format, "text", "json")
+	p.oneOf("notify-on", *notifyOn, flagValues("notify-on")...)
+	if *notifyURL != "" {
+		u, err := url.Parse(*notifyURL)
+		p.check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "-notify-url must be an http(s) URL, not %q", *notifyURL)
+	}
+	var email emailSettings
+	if *emailReport != "" {
+		var err error
+		email.to, err = parseRecipients(*emailReport)
+		p.check(err == nil, "invalid -email-report: %v", err)
+		p.oneOf("email-on", *emailOn, flagValues("email-on")...)
+		p.check(*smtpServer != "", "-smtp-server is required with -email-report")
+		p.check((*smtpUser == "") == (*smtpPassword == ""), "-smtp-user and -smtp-password must be given together")
+		from := *emailFrom
+		if from == "" {
+			from = *smtpUser
+		}
+		p.check(from != "", "-email-from is required with -email-report unless -smtp-user is an address")
+		if from != "" {
+			email.from, err = mail.ParseAddress(from)
+			p.check(err == nil, "invalid -email-from: %v", err)
+		}
+		email.server, email.user, email.password, email.html = *smtpServer, *smtpUser, *smtpPassword, *emailHTML
+	}
+	p.oneOf("tls-min-version", *tlsMin, flagValues("tls-min-version")...)
+	if *tlsMax != "" {
+		p.oneOf("tls-max-version", *tlsMax, flagValues("tls-max-version")...)
+		p.check(tlsVersions[*tlsMax] == 0 || tlsVersions[*tlsMin] <= tlsVersions[*tlsMax], "-tls-min-version %s is above -tls-max-version %s", *tlsMin, *tlsMax)
+	}
+	p.oneOf("compress", *compress, flagValues("compress")...)
+	p.oneOf("strategy", *strategy, string(dedup.StrategyEnvelope), string(dedup.StrategyTiered))
+	p.oneOf("scope", *scope, string(dedup.ScopeMailbox), string(dedup.ScopeConversation))
+	p.oneOf("dedup-key", *dedupKey, "body", "body-first-n-bytes")
+	p.oneOf("prefer", *prefer, string(dedup.PreferInbox), string(dedup.PreferSent))
+	p.oneOf("sort-order", *sortOrder, "asc", "desc")
+	if *sortBy != "" {
+		p.oneOf("sort", *sortBy, flagValues("sort")...)
+		p.check(!*groupSummary, "-sort cannot be combined with -dedup-report-duplicates-only-summary")
+	}
+	p.oneOf("report", *report, flagValues("report")...)
+	p.check(!*groupSummary || *report == "summary", "-report messages cannot be combined with -dedup-report-duplicates-only-summary")
+	// scan and clean print the grouped summary unless the listing of
+	// every message is asked for, or the output is not a scan's
+	if (command == "scan" || command == "clean") && *report == "summary" && *sortBy == "" && !*listOnlyDups &&
+		!*countOnly && !*compareStrategies && !*sentReconcile && *keepRole == "" {
+		*groupSummary = true
+	}
+	p.check(*snippetLen >= 0, "-snippet must not be negative")
+	p.check(*reportLimit == 0 || *reportLimit >= 1000, "-dedup-group-report-limit must be 0 or at least 1000")
+	p.oneOf("dedup-group-report-spill", *reportSpill, flagValues("dedup-group-report-spill")...)
+	p.check(*dedupKey != "body-first-n-bytes" || dedup.Strategy(*strategy) == dedup.StrategyTiered, "-dedup-key body-first-n-bytes needs -strategy tiered")
+	p.check(!*compareStrategies || *dryRun, "-compare-strategies never removes anything, use scan or -dry-run")
+	p.check(!*compareStrategies || !*sentReconcile, "-compare-strategies cannot be combined with -dedup-sent-reconcile")
+	p.check(!*keepLargest || !*keepSmallest, "-dedup-preserve-largest cannot be combined with -dedup-preserve-smallest")
+	var newURL *ServerURL
+	if command == "cross-server" {
+		p.check(*newServerURL != "", "-new-server-url is required")
+		p.check(*newPassword != "", "-new-password is required")
+		p.check(!*mergeFlags, "-merge-flags cannot be combined with cross-server, whose kept copies are on the new server")
+		if *newServerURL != "" {
+			newURL, err = ParseServerURL(*newServerURL)
+			p.check(err == nil, "invalid -new-server-url: %v", err)
+		}
+	}
+	p.check(*appendPath == "" || !*allMailboxes, "-append cannot be combined with -all-mailboxes")
+	if *planPath != "" {
+		p.check(*dryRun, "-plan needs scan or -dry-run")
+		p.check(!*countOnly && !*compareStrategies && !*watch && *interval == 0, "-plan cannot be combined with -count-only, -compare-strategies, -watch or -interval")
+		p.check(*applyPlan == "", "-plan cannot be combined with apply")
+	}
+	var plan *Plan
+	if *applyPlan != "" {
+		p.check(!*allMailboxes && !*sentReconcile && *keepRole == "", "apply cannot be combined with -all-mailboxes, -dedup-sent-reconcile or -keep-role")
+		p.check(!*countOnly && !*compareStrategies && !*watch && *interval == 0, "apply cannot be combined with -count-only, -compare-strategies, -watch or -interval")
+		if plan, err = readPlan(*applyPlan); err != nil {
+			p.check(false, "invalid plan %s: %v", *applyPlan, err)
+		}
+	}
+	if *tui {
+		p.check(*planPath != "" || *applyPlan != "", "-tui needs scan -plan or apply")
+		p.check(isTerminal(os.Stdin) && isTerminal(os.Stdout), "%s", errNoTerminal)
+	}
+	p.oneOf("drafts-mode", *draftsMode, flagValues("drafts-mode")...)
+	if *keepRole != "" {
+		p.oneOf("keep-role", strings.ToLower(*keepRole), flagValues("keep-role")...)
+		p.check(!*sentReconcile, "-keep-role cannot be combined with -dedup-sent-reconcile")
+		p.check(!*compareStrategies, "-compare-strategies cannot be combined with -keep-role")
+		p.check(*perSenderCap == 0, "-keep-role cannot be combined with -preserve-newest-per-sender")
+		p.check(*limit == 0, "-keep-role cannot be combined with -limit")
+		p.check(dedup.Scope(*scope) == dedup.ScopeMailbox, "-keep-role cannot be combined with -scope %s", *scope)
+	}
+	if *watch {
+		p.check(*mbox != "" && !*allMailboxes, "-watch needs a single -mbox")
+		p.check(!*sentReconcile && *keepRole == "" && !*compareStrategies, "-watch cannot be combined with -dedup-sent-reconcile, -keep-role or -compare-strategies")
+		p.check(!*countOnly && !*failOnDuplicates, "-watch cannot be combined with -count-only or -fail-on-duplicates")
+		p.check(*scanServer == "" && *deleteServer == "", "-watch cannot be combined with -scan-server or -delete-server")
+		p.check(*limit == 0, "-watch cannot be combined with -limit")
+	}
+	if *interval != 0 {
+		p.check(*interval > 0, "-interval must be positive")
+		p.check(!*watch, "-interval cannot be combined with -watch")
+		p.check(!*sentReconcile && *keepRole == "" && !*compareStrategies, "-interval cannot be combined with -dedup-sent-reconcile, -keep-role or -compare-strategies")
+		p.check(!*countOnly && !*failOnDuplicates, "-interval cannot be combined with -count-only or -fail-on-duplicates")
+		p.check(*scanServer == "" && *deleteServer == "", "-interval cannot be combined with -scan-server or -delete-server")
+		p.check(*limit == 0, "-interval cannot be combined with -limit")
+	}
+	p.check(!*analyze || !*overview, "-analyze cannot be combined with -overview")
+	p.check(*maxFailures >= 0, "-max-consecutive-failures must not be negative")
+	if *sentReconcile {
+		p.check(!*allMailboxes, "-dedup-sent-reconcile cannot be combined with -all-mailboxes")
+		p.check(*perSenderCap == 0, "-dedup-sent-reconcile cannot be combined with -preserve-newest-per-sender")
+		p.check(*limit == 0, "-dedup-sent-reconcile cannot be combined with -limit")
+		p.check(dedup.Scope(*scope) == dedup.ScopeMailbox, "-dedup-sent-reconcile cannot be combined with -scope %s", *scope)
+		p.check(*sentMbox != "", "-dedup-sent-reconcile needs -sent-mbox")
+		p.check(*sentMbox != *mbox, "-sent-mbox must differ from -mbox")
 	}
 
-	port := 0
-	useTLS := true
-	useStartTLS := false
+	from, err := parseUIDBound(*uidFrom)
+	p.check(err == nil, "invalid -uid-from: %v", err)
+	to, err := parseUIDBound(*uidTo)
+	p.check(err == nil, "invalid -uid-to: %v", err)
+	p.check(from == 0 || to == 0 || from <= to, "invalid UID range: -uid-from %d is above -uid-to %d", from, to)
+
+	var tmpl *template.Template
+	if *keyTemplate != "" {
+		tmpl, err = template.New("key").Option("missingkey=error").Parse(*keyTemplate)
+		p.check(err == nil, "invalid -key-template: %v", err)
+	}
+	p.check(!*rawHeader || tmpl == nil, "-dedup-hash-header-raw cannot be combined with -key-template")
+	var volatile []string
+	for _, name := range strings.Split(*volatileHeaders, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			volatile = append(volatile, name)
+		}
+	}
+	if volatile == nil {
+		volatile = []string{}
+	}
+	if len(p) > 0 {
+		p.print(os.Stderr, command)
+		return exitUsage
+	}
+
+	if acct != nil {
+		acct.namespace(logFile, summaryFile, backupDir)
+	}
+	logger, logf, err := openLog(*logFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open log file: %s\n", err)
+		return 1
+	}
+	if logf != nil {
+		defer logf.Close()
+	}
 
 	// Set default port
-	if port == 0 {
-		port = 143
-		if useTLS {
-			port = 993
+	if *port == 0 {
+		*port = 143
+		if *useTLS {
+			*port = 993
+		}
+	}
+	scanHost, scanPort, err := splitServer(*scanServer, *server, *port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -scan-server: %s\n", err)
+		return 1
+	}
+	deleteHost, deletePort, err := splitServer(*deleteServer, *server, *port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -delete-server: %s\n", err)
+		return 1
+	}
+	var tokens *oauth2Tokens
+	if *oauth2Creds != "" {
+		if tokens, err = loadOAuth2Credentials(*oauth2Creds); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot read -oauth2-credentials: %s\n", err)
+			return exitLogin
+		}
+	}
+
+	// runs modifying mailboxes lock each of them on the server they
+	// modify it on
+	var lk *locks
+	if !*dryRun && !*countOnly && command != "stats" && command != "list-mailboxes" && !*listCapabilities {
+		dir, err := lockDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot find lock directory: %s\n", err)
+			return 1
+		}
+		lk = &locks{dir: dir, server: deleteHost, username: *username, force: *forceLock}
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	if *maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxDuration)
+		defer cancel()
+	}
+
+	// The first signal stops the run gracefully: the fetch in flight is
+	// drained, flagged duplicates are expunged, the summary printed and
+	// the session logged out. A second one exits immediately.
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		sig := <-sigs
+		logger.Warn("interrupted, stopping", "signal", sig.String())
+		fmt.Fprintln(os.Stderr, "stopping after the current step, interrupt again to exit immediately")
+		stop()
+		sig = <-sigs
+		logger.Warn("interrupted again, exiting", "signal", sig.String())
+		restoreTerminal()
+		lk.releaseAll()
+		if logf != nil {
+			logf.Close()
+		}
+		os.Exit(1)
+	}()
+
+	metrics := dedup.NewMetrics()
+	if *timing {
+		defer metrics.Print(os.Stdout)
+	}
+	summary := &Summary{Parameters: runParameters(command)}
+	if acct != nil {
+		acct.summary = summary
+	}
+	if *alwaysReport {
+		defer func() {
+			if err := summary.PrintReport(os.Stdout, *format, code, metrics); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot print summary: %s\n", err)
+			}
+		}()
+	}
+	if *notifyURL != "" {
+		start := time.Now()
+		defer func() {
+			n := summary.Notification(deleteHost, *dryRun, code, time.Since(start))
+			if !n.Due(*notifyOn) {
+				return
+			}
+			if err := notify(*notifyURL, n); err != nil {
+				logger.Error("cannot send notification", "err", err)
+				fmt.Fprintf(os.Stderr, "cannot post to -notify-url: %s\n", err)
+			}
+		}()
+	}
+	if *emailReport != "" {
+		start := time.Now()
+		defer func() {
+			n := summary.Notification(deleteHost, *dryRun, code, time.Since(start))
+			if !n.Due(*emailOn) {
+				return
+			}
+			if err := emailSummary(email, n, summary); err != nil {
+				logger.Error("cannot send email report", "err", err)
+				fmt.Fprintf(os.Stderr, "warning: cannot send -email-report: %s\n", err)
+				return
+			}
+			logger.Info("sent email report", "to", strings.Join(email.to, ", "))
+		}()
+	}
+	if *summaryFile != "" {
+		defer func() {
+			if err := summary.WriteJSON(*summaryFile, code, metrics); err != nil {
+				logger.Error("cannot write summary", "file", *summaryFile, "err", err)
+				fmt.Fprintf(os.Stderr, "cannot write -summary-json-file: %s\n", err)
+			}
+		}()
+	}
+
+	logger.Info("starting", "version", currentVersion().String(), "command", command)
+	caps := make(map[*client.Client]dedup.Capabilities)
+	// greetings are the capabilities before login, for
+	// -list-capabilities
+	greetings := make(map[string]dedup.Capabilities)
+	open := func(server string, port int) (*client.Client, error) {
+		done := metrics.Track("", dedup.PhaseConnect)
+		logger.Info("connecting", "server", server, "port", port, "tls", *useTLS, "starttls", *useStartTLS)
+		tlsConfig := &tls.Config{ServerName: server, MinVersion: tlsVersions[*tlsMin], MaxVersion: tlsVersions[*tlsMax]}
+		var preLogin func(map[string]bool)
+		if *listCapabilities {
+			preLogin = func(list map[string]bool) { greetings[server] = dedup.NewCapabilities(list) }
+		}
+		c, err := connect(ctx, metrics, server, port, *useTLS, *useStartTLS, tlsConfig, *username, *password, tokens, preLogin, *compress == "auto", debugTrace(*debugIMAP, os.Stderr))
+		done(1, 0)
+		if err != nil && ctx.Err() != nil {
+			// the dial or login failed as the run stopped
+			return nil, err
+		}
+		if err != nil {
+			logger.Error("cannot set up session", "server", server, "username", *username, "err", err)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+		logger.Info("logged in", "server", server, "username", *username)
+		// Capabilities change with login, so they are only asked for
+		// now. Without them no extension is used.
+		list, err := c.Capability()
+		if err != nil {
+			logger.Warn("cannot get capabilities", "server", server, "err", err)
+			fmt.Fprintf(os.Stderr, "warning: cannot get the capabilities of %s, using no extensions: %s\n", server, err)
+		}
+		caps[c] = dedup.NewCapabilities(list)
+		logger.Info("capabilities", "server", server, "capabilities", strings.Join(caps[c].Names(), " "))
+		if *debugIMAP {
+			fmt.Fprintf(os.Stderr, "capabilities of %s: %s\n", server, strings.Join(caps[c].Names(), " "))
+		}
+		return c, nil
+	}
+	// stoppedConnecting reports the run stopped as ctx is done while
+	// the sessions are set up.
+	stoppedConnecting := func() int {
+		err := ctx.Err()
+		logger.Error("stopped", "phase", dedup.PhaseConnect, "err", err)
+		fmt.Fprintf(os.Stderr, "stopped during %s: %s\n", dedup.PhaseConnect, err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			fmt.Fprintf(os.Stderr, "the run reached -max-duration %s and is partial, run it again to resume\n", *maxDuration)
+		}
+		summary.Fail(err)
+		return stoppedCode(err)
+	}
+	c, err := open(deleteHost, deletePort)
+	if err != nil {
+		if ctx.Err() != nil {
+			return stoppedConnecting()
+		}
+		summary.Fail(err)
+		return exitCode(err)
+	}
+	defer c.Logout()
+	// sc scans, c removes; they only differ with -scan-server or
+	// -delete-server
+	sc := c
+	if scanHost != deleteHost || scanPort != deletePort {
+		if sc, err = open(scanHost, scanPort); err != nil {
+			if ctx.Err() != nil {
+				return stoppedConnecting()
+			}
+			summary.Fail(err)
+			return exitCode(err)
+		}
+		defer sc.Logout()
+	}
+	if ctx.Err() != nil {
+		return stoppedConnecting()
+	}
+
+	if *listCapabilities {
+		printCapabilities(os.Stdout, deleteHost, greetings[deleteHost], caps[c])
+		if sc != c {
+			fmt.Println()
+			printCapabilities(os.Stdout, scanHost, greetings[scanHost], caps[sc])
+		}
+		return 0
+	}
+
+	if command == "list-mailboxes" {
+		names, err := listMailboxes(sc)
+		if err != nil {
+			logger.Error("cannot list mailboxes", "err", err)
+			fmt.Fprintf(os.Stderr, "cannot list mailboxes: %s\n", err)
+			summary.Fail(err)
+			return 1
+		}
+		if !*overview {
+			for _, name := range names {
+				fmt.Println(name)
+			}
+			return 0
+		}
+		counts := mailboxOverview(sc, names)
+		if err := printOverview(os.Stdout, counts, *format); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot print overview: %s\n", err)
+			return 1
 		}
+		return overviewFailures(logger, counts)
 	}
 
-	connectionString := fmt.Sprintf("%s:%d", *server, port)
-	tlsConfig := &tls.Config{ServerName: *server}
+	if *appendPath != "" {
+		release, err := lk.hold(*mbox)
+		if err != nil {
+			logger.Error("cannot lock mailbox", "mailbox", *mbox, "err", err)
+			fmt.Fprintf(os.Stderr, "cannot append: %s\n", err)
+			summary.Fail(err)
+			return 1
+		}
+		defer release()
+		res, err := appendDir(c, caps[c].UIDPlus, *mbox, *appendPath, parseFlags(*appendFlags))
+		if err != nil {
+			logger.Error("cannot append", "mailbox", *mbox, "dir", *appendPath, "err", err)
+			fmt.Fprintf(os.Stderr, "cannot append: %s\n", err)
+			summary.Fail(err)
+			return 1
+		}
+		var failed []string
+		for path := range res.Failed {
+			failed = append(failed, path)
+		}
+		sort.Strings(failed)
+		for _, path := range failed {
+			logger.Error("cannot append", "mailbox", *mbox, "file", path, "err", res.Failed[path])
+			fmt.Fprintf(os.Stderr, "cannot append %s: %s\n", path, res.Failed[path])
+		}
+		logger.Info("appended", "mailbox", *mbox, "dir", *appendPath, "count", res.Appended, "failed", len(failed))
+		fmt.Printf("appended %d of %d messages to %s\n", res.Appended, res.Appended+len(failed), *mbox)
+		printAppended(logger, *mbox, res)
+		if len(failed) > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	cfg := dedup.Config{
+		IgnoreMessageID:     *ignoreMessageID,
+		IgnoreFields:        ignored(ignoreFields),
+		NormalizeSubject:    *normalizeSubject,
+		DateWindow:          *dateWindow,
+		ListID:              *useListID,
+		AttachmentNames:     *attachmentNames,
+		KeySize:             *keySize,
+		ScopeBySender:       *scopeBySender,
+		RawHeader:           *rawHeader,
+		VolatileHeaders:     volatile,
+		IgnoreResentHeaders: *ignoreResent,
+		MinGroupSize:        *minGroupSize,
+		MinWastedBytes:      *minWasted,
+		Strategy:            dedup.Strategy(*strategy),
+		Keep:                keepPolicy(*keepLargest, *keepSmallest),
+		Scope:               dedup.Scope(*scope),
+		FetchBuffer:         *fetchBuffer,
+		HashWorkers:         *hashWorkers,
+		BodyBytes:           bodyLimit(*dedupKey, *bodyBytes),
+		FetchChunk:          *fetchChunk,
+		MaxDups:             *maxDups,
+		UIDFrom:             from,
+		UIDTo:               to,
+		Limit:               *limit,
+		NoopInterval:        *noopKeepAlive,
+		KeyTemplate:         tmpl,
+		PerSenderCap:        *perSenderCap,
+		ReadOnly:            *dryRun || *countOnly,
+		RecordEnvelopes:     (*verifyBefore && !*dryRun && !*countOnly) || *planPath != "",
+		RecordSizes:         !*countOnly && (!*dryRun || *groupSummary),
+		Metrics:             metrics,
+	}
+	var sorted *sortedListing
+	if *sortBy != "" {
+		sorted = &sortedListing{by: *sortBy, descending: *sortOrder == "desc", listOnlyDups: *listOnlyDups, cfg: cfg, limit: *reportLimit, spill: *reportSpill}
+	}
+	var groupList *groupListing
+	if *groupSummary {
+		groupList = &groupListing{limit: *reportLimit, spill: *reportSpill}
+	}
+	if !*countOnly {
+		cfg.Progress = printProgress(*listOnlyDups, cfg, sorted, groupList)
+	}
+	cl := &cleaner{
+		c:          c,
+		scan:       sc,
+		caps:       caps,
+		retries:    *opRetries,
+		delay:      *messageDelay,
+		cfg:        cfg,
+		dryRun:     *dryRun,
+		countOnly:  *countOnly,
+		sorted:     sorted,
+		groups:     groupList,
+		snippet:    *snippetLen,
+		backupDir:  *backupDir,
+		stats:      *stats,
+		format:     *format,
+		metrics:    metrics,
+		logger:     logger,
+		locks:      lk,
+		verify:     *verifyAfter,
+		mergeFlags: *mergeFlags,
+		action:     removeAction(*fullExpunge),
+	}
+
+	if command == "cross-server" {
+		// the new server is only examined, its user defaults to that of
+		// the old one
+		newUser, newPort := newURL.Username, newURL.Port
+		if newUser == "" {
+			newUser = *username
+		}
+		if newPort == 0 {
+			newPort = 143
+			if newURL.TLS {
+				newPort = 993
+			}
+		}
+		done := metrics.Track("", dedup.PhaseConnect)
+		logger.Info("connecting", "server", newURL.Server, "port", newPort, "tls", newURL.TLS, "starttls", !newURL.TLS)
+		tlsConfig := &tls.Config{ServerName: newURL.Server, MinVersion: tlsVersions[*tlsMin], MaxVersion: tlsVersions[*tlsMax]}
+		nc, err := connect(ctx, metrics, newURL.Server, newPort, newURL.TLS, !newURL.TLS, tlsConfig, newUser, *newPassword, nil, nil, *compress == "auto", debugTrace(*debugIMAP, os.Stderr))
+		done(1, 0)
+		if err != nil && ctx.Err() != nil {
+			return stoppedConnecting()
+		}
+		if err != nil {
+			logger.Error("cannot set up session", "server", newURL.Server, "err", err)
+			fmt.Fprintf(os.Stderr, "new server: %s\n", err)
+			summary.Fail(err)
+			return exitCode(err)
+		}
+		defer nc.Logout()
+		newMbox := newURL.Mbox
+		if newMbox == "" {
+			newMbox = *mbox
+		}
+		res := cl.crossServer(ctx, *mbox, nc, newMbox, *deleteMigrated)
+		summary.Add(res)
+		if res.Err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	if *planPath != "" {
+		cl.plan = newPlan(deleteHost, *username)
+	}
+	if plan != nil && (plan.Server != deleteHost || plan.Username != *username) {
+		fmt.Fprintf(os.Stderr, "the plan %s was made for %s on %s, not %s on %s\n", *applyPlan, plan.Username, plan.Server, *username, deleteHost)
+		return exitUsage
+	}
+	if plan != nil && *tui {
+		groups, action, err := cl.review(ctx, plan.Groups, true)
+		if err != nil {
+			logger.Error("cannot review plan", "file", *applyPlan, "err", err)
+			fmt.Fprintf(os.Stderr, "cannot review the plan: %s\n", err)
+			return 1
+		}
+		if action == reviewAbandon {
+			fmt.Printf("review abandoned, %s was left as it was\n", *applyPlan)
+			return 0
+		}
+		plan.Groups = groups
+		if err := plan.write(*applyPlan); err != nil {
+			logger.Error("cannot write plan", "file", *applyPlan, "err", err)
+			fmt.Fprintf(os.Stderr, "cannot write the reviewed plan: %s\n", err)
+			return 1
+		}
+		if action == reviewSave {
+			fmt.Printf("wrote the reviewed plan of %d duplicates to %s, remove them with: %s apply %s\n", plan.Count(), *applyPlan, os.Args[0], *applyPlan)
+			return 0
+		}
+		fmt.Printf("wrote the reviewed plan of %d duplicates to %s\n", plan.Count(), *applyPlan)
+	}
+
+	mailboxes := []string{*mbox}
+	if plan != nil {
+		mailboxes = plan.Mailboxes()
+		if len(mailboxes) == 0 {
+			fmt.Println("the plan has no duplicates, nothing to do")
+		}
+	} else if *allMailboxes {
+		if mailboxes, err = listMailboxes(sc); err != nil {
+			logger.Error("cannot list mailboxes", "err", err)
+			fmt.Fprintf(os.Stderr, "cannot list mailboxes: %s\n", err)
+			summary.Fail(err)
+			return 1
+		}
+	}
+
+	// drafts are skipped or scanned safely by the commands removing
+	// duplicates, see -drafts-mode
+	if *draftsMode != "normal" && command != "stats" && !*compareStrategies && plan == nil {
+		if cl.drafts, err = draftsMailboxes(sc); err != nil {
+			logger.Error("cannot find drafts mailbox", "err", err)
+			fmt.Fprintf(os.Stderr, "cannot find drafts mailbox: %s\n", err)
+			summary.Fail(err)
+			return 1
+		}
+		if *allMailboxes && *draftsMode == "skip" {
+			kept := mailboxes[:0]
+			for _, name := range mailboxes {
+				if !cl.drafts[name] {
+					kept = append(kept, name)
+					continue
+				}
+				logger.Info("skipping drafts mailbox", "mailbox", name)
+				if !*countOnly {
+					fmt.Printf("%s: NOTE: skipped as drafts mailbox, its drafts share Message-IDs with their earlier versions; -drafts-mode safe or normal includes it\n", name)
+				}
+			}
+			mailboxes = kept
+		}
+	}
+
+	keepMbox := ""
+	if *keepRole != "" {
+		if keepMbox, err = roleMailbox(sc, *keepRole); err != nil {
+			logger.Error("cannot find mailbox of role", "role", *keepRole, "err", err)
+			fmt.Fprintf(os.Stderr, "cannot find mailbox of role %s: %s\n", *keepRole, err)
+			summary.Fail(err)
+			return 1
+		}
+		logger.Info("keeping copies in mailbox of role", "role", *keepRole, "mailbox", keepMbox)
+	}
+
+	if *sentReconcile {
+		summary.Add(cl.reconcile(ctx, *mbox, *sentMbox, dedup.Prefer(*prefer)))
+	}
+	overviewed := command == "stats" && *overview
+	if overviewed {
+		counts := mailboxOverview(sc, mailboxes)
+		if err := printOverview(os.Stdout, counts, *format); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot print overview: %s\n", err)
+		}
+		overviewFailures(logger, counts)
+		for _, m := range counts {
+			summary.Add(MailboxResult{Mailbox: m.Name, Err: m.Err})
+		}
+	}
+	reopen := func() (*client.Client, error) {
+		return open(deleteHost, deletePort)
+	}
+	cl.reopen = reopen
+	// c may have been replaced after its connection was lost
+	defer func() {
+		if cl.c != c {
+			cl.c.Logout()
+		}
+	}()
+	// runs removing duplicates report the quota of the mailbox, that
+	// of INBOX with -all-mailboxes
+	quotaMbox := *mbox
+	if quotaMbox == "" {
+		quotaMbox = "INBOX"
+	}
+	var quotaBefore []dedup.Quota
+	if lk != nil {
+		quotaBefore = cl.quota(quotaMbox)
+	}
+	for i, name := range mailboxes {
+		if *sentReconcile || overviewed {
+			break
+		}
+		if ctx.Err() != nil {
+			summary.Stop(stopReason(ctx.Err()), mailboxes[i:])
+			break
+		}
+		var res MailboxResult
+		if command == "stats" && *analyze {
+			res = cl.analyze(ctx, name)
+		} else if command == "stats" {
+			res = cl.status(name)
+		} else if plan != nil {
+			res = cl.applyPlan(ctx, name, plan.groups(name))
+		} else if *compareStrategies {
+			res = cl.compare(ctx, name)
+		} else if keepMbox != "" {
+			if name == keepMbox {
+				continue
+			}
+			res = cl.reconcile(ctx, keepMbox, name, dedup.PreferInbox)
+		} else {
+			res = cl.process(ctx, name)
+			if *watch && res.Err == nil {
+				res = cl.watch(ctx, name, res, reopen)
+			}
+		}
+		summary.Add(res)
+		if res.Err != nil && *strict && i < len(mailboxes)-1 {
+			logger.Warn("stopping after failed mailbox", "mailbox", name, "left", len(mailboxes)-i-1)
+			summary.Stop("after the first failure", mailboxes[i+1:])
+			break
+		}
+	}
+	if *interval > 0 && ctx.Err() == nil {
+		if err := cl.repeat(ctx, mailboxes, *interval, *maxFailures, summary, reopen); err != nil {
+			logger.Error("stopping", "err", err)
+			fmt.Fprintf(os.Stderr, "stopping: %s\n", err)
+			summary.Fail(err)
+			summary.Print(os.Stdout)
+			return 1
+		}
+	}
+	if cl.plan != nil && *tui {
+		groups, action, err := cl.review(ctx, cl.plan.Groups, false)
+		if err != nil {
+			logger.Error("cannot review plan", "err", err)
+			fmt.Fprintf(os.Stderr, "cannot review the plan: %s\n", err)
+			summary.Fail(err)
+			return 1
+		}
+		if action == reviewAbandon {
+			fmt.Println("review abandoned, no plan written")
+			cl.plan = nil
+		} else {
+			cl.plan.Groups = groups
+		}
+	}
+	if cl.plan != nil {
+		if err := cl.plan.write(*planPath); err != nil {
+			logger.Error("cannot write plan", "file", *planPath, "err", err)
+			fmt.Fprintf(os.Stderr, "cannot write -plan: %s\n", err)
+			summary.Fail(err)
+			return 1
+		}
+		fmt.Printf("wrote the plan of %d duplicates to %s, remove them with: %s apply %s\n", cl.plan.Count(), *planPath, os.Args[0], *planPath)
+	}
+	if quotaBefore != nil {
+		qs := quotaSummary(quotaBefore, cl.quota(quotaMbox))
+		printQuota(os.Stdout, qs)
+		summary.SetQuota(qs)
+	}
+	if *countOnly {
+		fmt.Println(summary.Found())
+	} else if (*allMailboxes || ctx.Err() != nil) && !*alwaysReport && !overviewed {
+		summary.Print(os.Stdout)
+	}
+	if err := ctx.Err(); err != nil && !((*watch || *interval > 0) && errors.Is(err, context.Canceled)) {
+		logger.Error("stopped", "err", err)
+		fmt.Fprintf(os.Stderr, "stopped: %s\n", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			fmt.Fprintf(os.Stderr, "the run reached -max-duration %s and is partial, run it again to resume\n", *maxDuration)
+		}
+		summary.Fail(err)
+		return stoppedCode(err)
+	}
+	if err := summary.Err(); err != nil {
+		logger.Error("mailboxes failed", "err", err)
+		return 1
+	}
+	if *failOnDuplicates && summary.Found() > 0 {
+		return exitDuplicates
+	}
+	return 0
+}
+
+// Exit codes besides 0 for success and 1 for all other failures.
+const (
+	exitConnect = 2
+	exitLogin   = 3
+	// exitDuplicates is returned with -fail-on-duplicates.
+	exitDuplicates = 4
+	// exitUsage is returned if the flags are invalid.
+	exitUsage = 5
+	// exitPartial is returned if the run stopped at -max-duration, to
+	// be resumed by running it again.
+	exitPartial = 6
+)
+
+// stoppedCode returns the exit code of a run stopped as its context
+// is done with err: exitPartial at -max-duration, 1 if interrupted.
+func stoppedCode(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return exitPartial
+	}
+	return 1
+}
+
+// stopReason words why the run stopped as its context is done with
+// err, for the mailboxes left out.
+func stopReason(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "at -max-duration"
+	}
+	return "as interrupted"
+}
+
+// connectError is a failure to set up a session, worded for users.
+type connectError struct {
+	msg  string
+	hint string
+	err  error
+}
+
+func (e *connectError) Error() string {
+	return fmt.Sprintf("%s — %s (%s)", e.msg, e.hint, e.err)
+}
+
+func (e *connectError) Unwrap() error {
+	return e.err
+}
+
+// errAuth is wrapped by the errors of sessions the server did not let
+// log in.
+var errAuth = errors.New("authentication failed")
+
+// exitCode returns the exit code for a failure to set up a session.
+func exitCode(err error) int {
+	var ce *connectError
+	switch {
+	case errors.Is(err, errAuth):
+		return exitLogin
+	case errors.As(err, &ce):
+		return exitConnect
+	}
+	return 1
+}
+
+// connect dials server, starts TLS with tlsConfig as configured and
+// logs in, with XOAUTH2 and an access token of tokens if it is set and
+// with password otherwise. If preLogin is set, it is called with the
+// capabilities advertised before login. Errors are *connectError. If a
+// session was established but setting it up failed, it is logged out
+// before returning. If debug is set, the session is traced to it from
+// the first command on. If compress is set, the session is compressed
+// after login if the server advertises COMPRESS=DEFLATE.
+func connect(ctx context.Context, metrics *dedup.Metrics, server string, port int, useTLS, useStartTLS bool, tlsConfig *tls.Config, username, password string, tokens *oauth2Tokens, preLogin func(map[string]bool), compress bool, debug io.Writer) (*client.Client, error) {
+	addr := fmt.Sprintf("%s:%d", server, port)
 	var c *client.Client
 	var err error
-	if useTLS {
-		c, err = client.DialTLS(connectionString, tlsConfig)
+	// sess is the connection of a session which may be compressed,
+	// which starts TLS itself
+	var sess *sessionConn
+	if compress {
+		d := &sessionDialer{dialer: metrics.Dialer(ctx), metrics: metrics}
+		if useTLS {
+			d.tlsConfig = tlsConfig
+		}
+		c, err = client.DialWithDialer(d, addr)
+		sess = d.conn
+	} else if useTLS {
+		c, err = client.DialWithDialerTLS(metrics.Dialer(ctx), addr, tlsConfig)
 	} else {
-		c, err = client.Dial(connectionString)
+		c, err = client.DialWithDialer(metrics.Dialer(ctx), addr)
 	}
-
 	if err != nil {
-		panic(err)
+		return nil, &connectError{
+			msg:  fmt.Sprintf("connection failed: cannot reach %s", addr),
+			hint: tlsHint("check -server, -port and -tls", err),
+			err:  err,
+		}
 	}
-	// Start a TLS session
+	if debug != nil {
+		c.SetDebug(debug)
+	}
+
 	if useStartTLS {
-		if err = c.StartTLS(tlsConfig); err != nil {
-			panic(err)
+		startTLS := c.StartTLS
+		if sess != nil {
+			startTLS = func(tlsConfig *tls.Config) error { return sess.startTLS(c, tlsConfig) }
+		}
+		if err := startTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, &connectError{
+				msg:  fmt.Sprintf("STARTTLS failed on %s", server),
+				hint: tlsHint("check that the server offers STARTTLS, or use -tls", err),
+				err:  err,
+			}
 		}
 	}
 
-	err = c.Login(*username, *password)
-	if err != nil {
-		panic(err)
+	if preLogin != nil {
+		if list, err := c.Capability(); err == nil {
+			preLogin(list)
+		}
 	}
-	defer c.Logout()
 
-	uids, err := FindDups(c, *mbox, *ignoreMessageID, *listOnlyDups)
+	if tokens != nil {
+		if err := authenticate(ctx, c, server, username, tokens); err != nil {
+			return c, err
+		}
+		return c, compressSession(c, sess, server)
+	}
+
+	// LOGIN would only fail with a bare NO, tell the user how to get
+	// a connection the server accepts it on instead.
+	if disabled, err := c.Support("LOGINDISABLED"); err == nil && disabled {
+		c.Logout()
+		hint := "use -starttls or -tls"
+		if useTLS || useStartTLS {
+			hint = "the server does not accept passwords on this connection"
+		}
+		return nil, &connectError{
+			msg:  fmt.Sprintf("login disabled by %s", server),
+			hint: hint,
+			err:  fmt.Errorf("%w: server advertises LOGINDISABLED", errAuth),
+		}
+	}
+
+	if err := c.Login(username, password); err != nil {
+		c.Logout()
+		return nil, &connectError{
+			msg:  fmt.Sprintf("login failed: authentication rejected by %s", server),
+			hint: "check username/password",
+			err:  fmt.Errorf("%w: %v", errAuth, err),
+		}
+	}
+	return c, compressSession(c, sess, server)
+}
+
+// authenticate logs c in to server with XOAUTH2 and an access token of
+// tokens, logging it out if that fails.
+func authenticate(ctx context.Context, c *client.Client, server, username string, tokens *oauth2Tokens) error {
+	if ok, err := c.SupportAuth("XOAUTH2"); err == nil && !ok {
+		c.Logout()
+		return &connectError{
+			msg:  fmt.Sprintf("login failed: %s does not offer XOAUTH2", server),
+			hint: "use -password instead of -oauth2-credentials",
+			err:  fmt.Errorf("%w: no AUTH=XOAUTH2 capability", errAuth),
+		}
+	}
+	token, err := tokens.Token(ctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cannot find duplicates: %s\n", err)
-		return
+		c.Logout()
+		return &connectError{
+			msg:  "login failed: cannot get an OAuth2 access token",
+			hint: "check -oauth2-credentials, the refresh token may have been revoked or expired",
+			err:  fmt.Errorf("%w: %v", errAuth, err),
+		}
 	}
+	if err := c.Authenticate(sasl.NewXoauth2Client(username, token)); err != nil {
+		c.Logout()
+		return &connectError{
+			msg:  fmt.Sprintf("login failed: access token rejected by %s", server),
+			hint: "check -username and the scope the refresh token was granted",
+			err:  fmt.Errorf("%w: %v", errAuth, err),
+		}
+	}
+	return nil
+}
 
-	if !*dryRun {
-		fmt.Println("will remove", len(uids), "messages")
-		err = RemoveDups(c, *mbox, uids)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "cannot find duplicates: %s\n", err)
-			return
+// cleaner removes duplicates from mailboxes. Mailboxes are scanned
+// on scan, which may be a read replica of the server of c they are
+// removed on.
+type cleaner struct {
+	c    *client.Client
+	scan *client.Client
+	// caps are the capabilities of the servers of c and scan.
+	caps    map[*client.Client]dedup.Capabilities
+	retries int
+	// delay paces the commands removing messages.
+	delay     time.Duration
+	cfg       dedup.Config
+	dryRun    bool
+	countOnly bool
+	sorted    *sortedListing
+	// groups collects the scanned messages for
+	// -dedup-report-duplicates-only-summary.
+	groups *groupListing
+	// snippet is how many characters of the text of duplicates are
+	// printed, none if 0.
+	snippet   int
+	backupDir string
+	stats     bool
+	format    string
+	metrics   *dedup.Metrics
+	logger    *slog.Logger
+	// locks holds the mailboxes modified, nil if none are.
+	locks *locks
+	// verify scans mailboxes again after removing duplicates.
+	verify bool
+	// mergeFlags adds the flags of duplicates to their keepers before
+	// removing them.
+	mergeFlags bool
+	// drafts holds the drafts mailboxes, which process scans with
+	// draftsConfig.
+	drafts map[string]bool
+	// action is what is done with duplicates, see -allow-full-expunge.
+	action dedup.Action
+	// plan collects the duplicates found for -plan, nil without it.
+	plan *Plan
+	// reopen opens a new session replacing c once its connection was
+	// lost, if set.
+	reopen func() (*client.Client, error)
+}
+
+// retrying returns the session of c retrying commands which failed
+// transiently, as often as configured. If c removes duplicates, a lost
+// connection is reopened.
+func (cl *cleaner) retrying(ctx context.Context, c *client.Client) dedup.Client {
+	rc := &dedup.RetryClient{
+		Client:  cl.session(ctx, c),
+		Retries: cl.retries,
+		Ctx:     ctx,
+		OnRetry: func(op string, attempt int, err error) {
+			cl.logger.Warn("retrying command", "op", op, "attempt", attempt, "err", err)
+			fmt.Fprintf(os.Stderr, "warning: %s failed, retrying (%d of %d): %s\n", op, attempt, cl.retries, err)
+		},
+	}
+	if cl.reopen != nil && c == cl.c {
+		rc.Reconnect = func() (dedup.Client, error) {
+			nc, err := cl.resume()
+			if err != nil {
+				return nil, err
+			}
+			return cl.session(ctx, nc), nil
 		}
-		fmt.Println("done")
-	} else {
-		fmt.Println("would have removed", len(uids), "messages")
 	}
+	return rc
+}
 
+// session returns c with the capabilities of its server and the
+// commands removing messages paced by the delay.
+func (cl *cleaner) session(ctx context.Context, c *client.Client) dedup.Client {
+	var inner dedup.Client = c
+	if cl.delay > 0 {
+		inner = &dedup.PacedClient{Client: c, Delay: cl.delay, Ctx: ctx}
+	}
+	return dedup.WithCapabilities(inner, cl.caps[c])
 }
 
-func FindDups(c *client.Client, mbox string, ignoreMessageID bool, listOnlyDups bool) (uids []uint32, err error) {
-	st, err := c.Select(mbox, false)
+// resume replaces the lost session c by a new one, also as scan if it
+// scanned too.
+func (cl *cleaner) resume() (*client.Client, error) {
+	nc, err := cl.reopen()
 	if err != nil {
 		return nil, err
 	}
+	cl.logger.Warn("reconnected after the connection was lost")
+	fmt.Fprintln(os.Stderr, "warning: the connection was lost, reconnected")
+	old := cl.c
+	if cl.scan == old {
+		cl.scan = nc
+	}
+	cl.c = nc
+	old.Terminate()
+	return nc, nil
+}
 
-	fmt.Println("MBOX UID", st.UidValidity)
+// process finds and, unless running dry, removes the duplicates of mbox.
+func (cl *cleaner) process(ctx context.Context, mbox string) MailboxResult {
+	cfg := cl.config(mbox)
+	if cl.drafts[mbox] {
+		cl.logger.Info("scanning drafts mailbox safely", "mailbox", mbox)
+		if !cl.countOnly {
+			fmt.Printf("%s: NOTE: drafts mailbox, only copies with identical bodies are duplicates and the newest is kept, see -drafts-mode\n", mbox)
+		}
+	}
+	scanned, skipped, newer, empty, partial := 0, 0, 0, false, false
+	if progress := cfg.Progress; progress != nil {
+		cfg.Progress = func(e dedup.Event) {
+			switch e.Kind {
+			case dedup.EventMessage:
+				scanned++
+			case dedup.EventNoEnvelope:
+				skipped++
+				cl.logger.Warn("message without envelope skipped", "mailbox", mbox, "uid", e.UID)
+			case dedup.EventNewer:
+				newer = e.Count
+				cl.logger.Info("ignored messages arrived during the scan", "mailbox", mbox, "count", e.Count)
+			case dedup.EventEmpty:
+				empty = true
+				cl.logger.Info("mailbox is empty", "mailbox", mbox, "deleted", e.Count)
+			case dedup.EventLimited:
+				partial = true
+				cl.logger.Info("scanning part of the mailbox", "mailbox", mbox, "limit", e.Count, "messages", e.Total)
+			}
+			progress(e)
+		}
+	}
+	release, err := cl.locks.hold(mbox)
+	if err != nil {
+		cl.logger.Error("cannot lock mailbox", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot find duplicates: %s\n", err)
+		return MailboxResult{Mailbox: mbox, Err: err}
+	}
+	defer release()
+	groups, err := dedup.Scan(ctx, cl.retrying(ctx, cl.scan), mbox, cfg)
+	if cl.sorted != nil {
+		cl.sorted.flush(os.Stdout)
+	}
+	if err != nil {
+		cl.logger.Error("cannot find duplicates", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot find duplicates: %s\n", err)
+		return MailboxResult{Mailbox: mbox, Scanned: scanned, Skipped: skipped, Newer: newer, Partial: partial, Err: err}
+	}
+	if empty {
+		return MailboxResult{Mailbox: mbox}
+	}
+	res := cl.apply(ctx, mbox, groups)
+	res.Scanned, res.Skipped, res.Newer, res.Partial = scanned, skipped, newer, partial
+	if cl.verify && res.Err == nil && res.Removed > 0 {
+		res.Err = cl.verifyRemoval(ctx, mbox, groups)
+	}
+	return res
+}
 
-	seqset := &imap.SeqSet{}
-	seqset.AddRange(1, math.MaxUint32)
+// applyPlan removes the duplicates of groups, read from a plan, from
+// mbox without scanning it.
+func (cl *cleaner) applyPlan(ctx context.Context, mbox string, groups []dedup.Group) MailboxResult {
+	release, err := cl.locks.hold(mbox)
+	if err != nil {
+		cl.logger.Error("cannot lock mailbox", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot apply plan: %s\n", err)
+		return MailboxResult{Mailbox: mbox, Err: err}
+	}
+	defer release()
+	cl.logger.Info("applying plan", "mailbox", mbox, "groups", len(groups))
+	return cl.apply(ctx, mbox, groups)
+}
 
-	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}
-	msgChan := make(chan *imap.Message, 1000)
-	errChan := make(chan error, 1)
-	go func() {
-		err = c.UidFetch(seqset, items, msgChan)
+// quota returns the quota roots of mbox on the server duplicates are
+// removed on, or nil if it has no QUOTA. Servers advertising QUOTA but
+// failing GETQUOTAROOT are only warned about.
+func (cl *cleaner) quota(mbox string) []dedup.Quota {
+	if !cl.caps[cl.c].Quota {
+		return nil
+	}
+	qs, err := dedup.QuotaRoots(cl.c, mbox)
+	if err != nil {
+		cl.logger.Warn("cannot get quota", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "warning: cannot get the quota of %s: %s\n", mbox, err)
+		return nil
+	}
+	cl.logger.Info("quota", "mailbox", mbox, "roots", len(qs))
+	return qs
+}
+
+// errVerification is wrapped by the errors of mailboxes which failed
+// -verify-after.
+var errVerification = errors.New("verification failed")
+
+// verifyRemoval scans mbox again on the server duplicates were removed
+// on, with the settings of the first scan, and reports loudly if a
+// kept copy of groups is gone or duplicates are left.
+func (cl *cleaner) verifyRemoval(ctx context.Context, mbox string, groups []dedup.Group) error {
+	v, err := dedup.Verify(ctx, cl.retrying(ctx, cl.c), mbox, groups, cl.config(mbox))
+	if err != nil {
+		cl.logger.Error("cannot verify removal", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot verify removal: %s\n", err)
+		return err
+	}
+	if v.OK() {
+		cl.logger.Info("verified removal", "mailbox", mbox)
+		fmt.Printf("%s: verified, all kept copies exist and no duplicates are left\n", mbox)
+		return nil
+	}
+	var problems []string
+	if n := len(v.MissingKeepers); n > 0 {
+		cl.logger.Error("kept copies missing", "mailbox", mbox, "uids", uidList(v.MissingKeepers))
+		fmt.Fprintf(os.Stderr, "%s: VERIFICATION FAILED: %d kept copies are gone, UIDs: %s\n", mbox, n, uidList(v.MissingKeepers))
+		problems = append(problems, fmt.Sprintf("%d kept copies gone", n))
+	}
+	if n := dedup.Count(v.Duplicates); n > 0 {
+		uids := dedup.DuplicateUIDs(v.Duplicates, mbox)
+		cl.logger.Error("duplicates left", "mailbox", mbox, "uids", uidList(uids))
+		fmt.Fprintf(os.Stderr, "%s: VERIFICATION FAILED: %d duplicates are still there, UIDs: %s\n", mbox, n, uidList(uids))
+		problems = append(problems, fmt.Sprintf("%d duplicates left", n))
+	}
+	return fmt.Errorf("%w: %s", errVerification, strings.Join(problems, ", "))
+}
+
+// status prints the status of mbox, examined read-only.
+func (cl *cleaner) status(mbox string) MailboxResult {
+	done := cl.metrics.Track(mbox, dedup.PhaseSelect)
+	st, err := cl.scan.Select(mbox, true)
+	done(1, 0)
+	if err != nil {
+		err = &dedup.Error{Op: "select", Mailbox: mbox, Err: err}
+		cl.logger.Error("cannot select mailbox", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot get status: %s\n", err)
+		return MailboxResult{Mailbox: mbox, Err: err}
+	}
+	NewMailboxReport(st).Print(os.Stdout, cl.format)
+	return MailboxResult{Mailbox: mbox}
+}
+
+// analyze prints the analysis of mbox.
+func (cl *cleaner) analyze(ctx context.Context, mbox string) MailboxResult {
+	a, err := dedup.Analyze(ctx, cl.retrying(ctx, cl.scan), mbox, cl.cfg)
+	if err != nil {
+		cl.logger.Error("cannot analyze mailbox", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot analyze mailbox: %s\n", err)
+		return MailboxResult{Mailbox: mbox, Err: err}
+	}
+	cl.logger.Info("analyzed mailbox", "mailbox", mbox, "messages", a.Messages, "bytes", a.Bytes)
+	if err := printAnalysis(os.Stdout, a, cl.format); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot print analysis: %s\n", err)
+	}
+	return MailboxResult{Mailbox: mbox}
+}
+
+// compare prints how many duplicates each way of keying finds in mbox.
+func (cl *cleaner) compare(ctx context.Context, mbox string) MailboxResult {
+	results, err := dedup.Compare(ctx, cl.retrying(ctx, cl.scan), mbox, cl.cfg)
+	if err != nil {
+		cl.logger.Error("cannot compare strategies", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot compare strategies: %s\n", err)
+		return MailboxResult{Mailbox: mbox, Err: err}
+	}
+	fmt.Printf("%s:\n", mbox)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "strategy\tduplicates\tgroups")
+	for _, r := range results {
+		cl.logger.Info("compared strategy", "mailbox", mbox, "strategy", r.Strategy, "duplicates", r.Duplicates, "groups", r.Groups)
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", r.Strategy, r.Duplicates, r.Groups)
+	}
+	tw.Flush()
+	return MailboxResult{Mailbox: mbox}
+}
+
+// reconcile removes the copies of messages both in inbox and sent from
+// the mailbox not preferred, unless running dry.
+func (cl *cleaner) reconcile(ctx context.Context, inbox, sent string, prefer dedup.Prefer) MailboxResult {
+	mbox := sent
+	if prefer == dedup.PreferSent {
+		mbox = inbox
+	}
+	release, err := cl.locks.hold(mbox)
+	if err != nil {
+		cl.logger.Error("cannot lock mailbox", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot reconcile %s: %s\n", mbox, err)
+		return MailboxResult{Mailbox: mbox, Err: err}
+	}
+	defer release()
+	groups, err := dedup.Reconcile(ctx, cl.retrying(ctx, cl.scan), inbox, sent, prefer, cl.cfg)
+	if err != nil {
+		cl.logger.Error("cannot reconcile mailboxes", "inbox", inbox, "sent", sent, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot reconcile %s with %s: %s\n", sent, inbox, err)
+		return MailboxResult{Mailbox: mbox, Err: err}
+	}
+	if !cl.countOnly {
+		for _, g := range groups {
+			for _, uid := range g.Duplicates {
+				fmt.Printf("%s: %d duplicate of %s %d\n", g.Mailbox, uid, g.KeeperMailbox, g.Keeper)
+			}
+		}
+	}
+	return cl.apply(ctx, mbox, groups)
+}
+
+// apply removes the duplicates of groups found in mbox unless running
+// dry.
+func (cl *cleaner) apply(ctx context.Context, mbox string, groups []dedup.Group) MailboxResult {
+	res := MailboxResult{Mailbox: mbox}
+	res.Found = dedup.Count(groups)
+	cl.logger.Info("found duplicates", "mailbox", mbox, "count", res.Found)
+	if cl.countOnly {
+		return res
+	}
+	var snippets map[uint32]string
+	if cl.snippet > 0 && res.Found > 0 {
+		snippets = cl.snippets(ctx, mbox, groups)
+	}
+	if cl.groups != nil {
+		cl.groups.flush(os.Stdout, mbox, groups, snippets)
+	} else {
+		printSnippets(os.Stdout, mbox, groups, snippets)
+	}
+
+	if cl.stats {
+		NewMailboxReport(cl.scan.Mailbox()).Print(os.Stdout, cl.format)
+	}
+
+	if cl.plan != nil {
+		cl.plan.add(groups)
+	}
+	if cl.dryRun {
+		fmt.Println("would have removed", res.Found, "messages")
+		return res
+	}
+
+	if cl.backupDir != "" && res.Found > 0 {
+		dir, err := backup(cl.retrying(ctx, cl.scan), mbox, groups, cl.backupDir)
 		if err != nil {
-			errChan <- err
+			cl.logger.Error("cannot back up duplicates", "mailbox", mbox, "dir", dir, "err", err)
+			fmt.Fprintf(os.Stderr, "cannot back up duplicates of %s, nothing removed: %s\n", mbox, err)
+			res.Err = err
+			return res
 		}
-		close(errChan)
-	}()
+		cl.logger.Info("backed up duplicates", "mailbox", mbox, "dir", dir)
+		fmt.Println("backed up to", dir)
+	}
+
+	if cl.mergeFlags && res.Found > 0 {
+		merged, err := dedup.MergeFlags(ctx, cl.retrying(ctx, cl.c), groups, cl.metrics)
+		for _, m := range merged {
+			cl.logger.Info("merged flags", "mailbox", m.Mailbox, "uid", m.UID, "flags", strings.Join(m.Added, " "))
+		}
+		if err != nil {
+			cl.logger.Error("cannot merge flags", "mailbox", mbox, "err", err)
+			fmt.Fprintf(os.Stderr, "cannot merge the flags of duplicates of %s, nothing removed: %s\n", mbox, err)
+			res.Err = err
+			return res
+		}
+		if len(merged) > 0 {
+			fmt.Printf("%s: gave %d kept copies the flags of their duplicates\n", mbox, len(merged))
+		}
+	}
+
+	fmt.Println("will remove", res.Found, "messages")
+	applied, err := dedup.Apply(ctx, cl.retrying(ctx, cl.c), groups, cl.action, cl.metrics)
+	res.Removed = applied.Removed
+	res.Expunged = applied.Purged[mbox]
+	res.Reclaimed = reclaimed(groups, mbox, applied.Expunged[mbox])
+	mismatchErr := cl.reportMismatches(mbox, applied.Mismatched[mbox])
+	if others, ok := applied.FullExpunged[mbox]; ok {
+		cl.logger.Warn("expunged without UIDPLUS", "mailbox", mbox, "others", others)
+		if others > 0 {
+			fmt.Fprintf(os.Stderr, "%s: the server lacks UIDPLUS, EXPUNGE also removed %d messages other clients had flagged \\Deleted (-allow-full-expunge)\n", mbox, others)
+		} else {
+			fmt.Printf("%s: the server lacks UIDPLUS, expunged with EXPUNGE as no other message was flagged \\Deleted\n", mbox)
+		}
+	}
+	if errors.Is(err, dedup.ErrFullExpunge) {
+		cl.logger.Error("not removing duplicates without UIDPLUS", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "%s: nothing removed: %s\n", mbox, err)
+		fmt.Fprintf(os.Stderr, "%s: expunge or undelete those messages in your mail client first, or rerun with -allow-full-expunge to remove them too\n", mbox)
+		res.Err = err
+		return res
+	}
+	if err != nil {
+		cl.logger.Error("cannot remove duplicates", "mailbox", mbox, "err", err,
+			"expunged", uidList(applied.Expunged[mbox]), "flagged", uidList(applied.Flagged[mbox]))
+		fmt.Fprintf(os.Stderr, "cannot remove duplicates: %s\n", err)
+		fmt.Fprintf(os.Stderr, "%s: expunged UIDs: %s\n", mbox, uidList(applied.Expunged[mbox]))
+		if uids := applied.Flagged[mbox]; len(uids) > 0 {
+			fmt.Fprintf(os.Stderr, "%s: flagged \\Deleted but not expunged UIDs: %s\n", mbox, uidList(uids))
+		}
+		res.Err = err
+		return res
+	}
+	cl.logger.Info("removed duplicates", "mailbox", mbox, "count", res.Removed, "expunged", res.Expunged)
+	fmt.Printf("expunged %d messages (%d were marked by this run)\n", res.Expunged, res.Removed)
+	if res.Expunged != res.Removed {
+		cl.logger.Warn("expunged messages differ from those marked", "mailbox", mbox, "expunged", res.Expunged, "marked", res.Removed)
+		fmt.Fprintf(os.Stderr, "%s: warning: the server expunged %d messages, but this run marked %d\n", mbox, res.Expunged, res.Removed)
+	}
+	res.Err = mismatchErr
+	return res
+}
+
+// reclaimed returns the total size of the duplicates of groups
+// expunged from mbox, by the sizes the scan recorded.
+func reclaimed(groups []dedup.Group, mbox string, expunged []uint32) int64 {
+	sizes := make(map[uint32]uint32)
+	for _, g := range groups {
+		if g.Mailbox != mbox {
+			continue
+		}
+		for uid, size := range g.Sizes {
+			sizes[uid] = size
+		}
+	}
+	var n int64
+	for _, uid := range expunged {
+		n += int64(sizes[uid])
+	}
+	return n
+}
 
-	uniqueIDs := make(map[string]struct{})
-	var dups []uint32
+// errMismatch is wrapped by the errors of mailboxes in which
+// -verify-before-delete found messages changed since the scan.
+var errMismatch = errors.New("messages changed since the scan")
 
-	for msg := range msgChan {
-		messageID := msg.Envelope.MessageId
+// reportMismatches reports loudly the messages of mbox which
+// -verify-before-delete found changed since the scan, and returns an
+// error if there are any.
+func (cl *cleaner) reportMismatches(mbox string, mismatches []dedup.Mismatch) error {
+	if len(mismatches) == 0 {
+		return nil
+	}
+	for _, m := range mismatches {
+		what := "duplicate"
+		if m.Keeper {
+			what = "kept copy"
+		}
+		cl.logger.Error("message changed since the scan", "mailbox", mbox, "uid", m.UID, "keeper", m.Keeper, "gone", m.Gone,
+			"scanned_message_id", m.Scanned.MessageID, "found_message_id", m.Found.MessageID)
+		if m.Gone {
+			fmt.Fprintf(os.Stderr, "%s: NOT REMOVED: %s %d %s %q is gone\n", mbox, what, m.UID, m.Scanned.MessageID, m.Scanned.Subject)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: NOT REMOVED: %s %d was %s %q, is %s %q\n", mbox, what, m.UID, m.Scanned.MessageID, m.Scanned.Subject, m.Found.MessageID, m.Found.Subject)
+	}
+	return fmt.Errorf("%w: %d in %s, left alone with their duplicates", errMismatch, len(mismatches), mbox)
+}
 
-		// instead hash the message contents
-		if ignoreMessageID {
-			messageID = ""
+// snippets fetches the start of the text of the messages of mbox in
+// groups, by UID. Keepers in other mailboxes are left out. A failure is
+// only warned about, since the snippets are merely informative.
+func (cl *cleaner) snippets(ctx context.Context, mbox string, groups []dedup.Group) map[uint32]string {
+	var uids []uint32
+	for _, g := range groups {
+		if g.Mailbox != mbox {
+			continue
 		}
+		if g.KeeperMailbox == "" {
+			uids = append(uids, g.Keeper)
+		}
+		uids = append(uids, g.Duplicates...)
+	}
+	snippets, err := dedup.Snippets(ctx, cl.retrying(ctx, cl.scan), mbox, uids, cl.snippet, cl.metrics)
+	if err != nil {
+		cl.logger.Warn("cannot fetch snippets", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "%s: warning: cannot fetch snippets: %s\n", mbox, err)
+	}
+	return snippets
+}
 
-		if messageID == "" {
-			hash := sha1.New()
-			builder := strings.Builder{}
-			builder.WriteString("date:")
-			builder.WriteString(msg.Envelope.Date.String())
-			builder.WriteString("\nsubject:")
-			builder.WriteString(msg.Envelope.Subject)
-			for _, f := range msg.Envelope.From {
-				builder.WriteString("\nfrom:")
-				builder.WriteString(f.Address())
-			}
-			for _, f := range msg.Envelope.Sender {
-				builder.WriteString("\nsender:")
-				builder.WriteString(f.Address())
-			}
-			for _, f := range msg.Envelope.ReplyTo {
-				builder.WriteString("\nreply-to:")
-				builder.WriteString(f.Address())
+// printProgress returns a progress callback for scans configured by
+// cfg, printing the listing of scanned messages, limited to duplicates
+// if listOnlyDups is set. If sorted or groups is set the messages are
+// collected there instead.
+func printProgress(listOnlyDups bool, cfg dedup.Config, sorted *sortedListing, groups *groupListing) func(dedup.Event) {
+	return func(e dedup.Event) {
+		switch e.Kind {
+		case dedup.EventSelected:
+			fmt.Printf("%s: %d messages, UIDVALIDITY %d\n", e.Mailbox, e.Status.Messages, e.Status.UidValidity)
+		case dedup.EventNewer:
+			fmt.Printf("%s: %d messages arrived during the scan, ignored\n", e.Mailbox, e.Count)
+		case dedup.EventLimited:
+			fmt.Printf("%s: partial run, scanning the first %d of %d messages\n", e.Mailbox, e.Count, e.Total)
+		case dedup.EventEmpty:
+			if e.Count > 0 {
+				fmt.Printf("%s: mailbox is empty, nothing to do (%d messages flagged \\Deleted)\n", e.Mailbox, e.Count)
+			} else {
+				fmt.Printf("%s: mailbox is empty, nothing to do\n", e.Mailbox)
 			}
-			for _, f := range msg.Envelope.To {
-				builder.WriteString("\nto:")
-				builder.WriteString(f.Address())
+		case dedup.EventMessage:
+			if groups != nil {
+				groups.add(e)
+				return
 			}
-			for _, f := range msg.Envelope.Cc {
-				builder.WriteString("\ncc:")
-				builder.WriteString(f.Address())
+			if sorted != nil {
+				sorted.add(e)
+				return
 			}
-			for _, f := range msg.Envelope.Bcc {
-				builder.WriteString("\nbcc:")
-				builder.WriteString(f.Address())
-			}
-			builder.WriteString("\nin-reply-to:")
-			builder.WriteString(msg.Envelope.InReplyTo)
-			messageID = base64.StdEncoding.EncodeToString(hash.Sum([]byte(builder.String())))
+			printMessage(os.Stdout, e, listOnlyDups, cfg)
+		case dedup.EventConfirmed:
+			fmt.Printf("%s: %d duplicate\n", e.Mailbox, e.UID)
+		case dedup.EventBodyMismatch:
+			fmt.Printf("%s: %d differs in body, kept\n", e.Mailbox, e.UID)
+		case dedup.EventBodyMissing:
+			fmt.Printf("%s: %d body not available, kept\n", e.Mailbox, e.UID)
+		case dedup.EventBelowThreshold:
+			fmt.Printf("%s: keeping %d duplicates of messages with less than %d copies\n", e.Mailbox, e.Count, cfg.MinGroupSize)
+		case dedup.EventBelowBytes:
+			fmt.Printf("%s: keeping %d duplicates of %d messages whose copies take less than %d bytes\n", e.Mailbox, e.Count, e.Total, cfg.MinWastedBytes)
+		case dedup.EventKeyError:
+			fmt.Printf("%s: %d key failed, kept: %s\n", e.Mailbox, e.UID, e.Err)
+		case dedup.EventRepeatedUID:
+			fmt.Printf("%s: warning: UID %d returned again by the server, skipped\n", e.Mailbox, e.UID)
+		case dedup.EventKeeper:
+			fmt.Printf("%s: keeping %d of %d bytes instead of %d\n", e.Mailbox, e.UID, e.Size, e.Count)
+		case dedup.EventSenderCapped:
+			fmt.Printf("%s: %s has %d messages, removing the %d oldest\n", e.Mailbox, e.From, e.Total, e.Count)
+		case dedup.EventNoEnvelope:
+			fmt.Printf("%s: warning: UID %d returned without envelope by the server, skipped\n", e.Mailbox, e.UID)
+		case dedup.EventTruncated:
+			fmt.Printf("%s: scan truncated after %d of %d messages, duplicate budget of %d reached, this was not a full pass\n", e.Mailbox, e.Count, e.Total, cfg.MaxDups)
 		}
+	}
+}
+
+// tlsVersions maps the values of -tls-min-version and -tls-max-version
+// to crypto/tls versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsHint returns hint for a failed connection, or a pointer to the TLS
+// version flags if err says that the server and client share no TLS
+// version.
+func tlsHint(hint string, err error) string {
+	if strings.Contains(err.Error(), "protocol version") {
+		return "the server does not support the TLS versions allowed, see -tls-min-version and -tls-max-version"
+	}
+	return hint
+}
 
-		if !listOnlyDups {
-			fmt.Printf("%s: %s %d %s:", mbox, msg.Envelope.Subject, msg.Uid, messageID)
+// splitServer returns the host and port of s, given as host or
+// host:port, defaulting to host and port if s is empty or has no port.
+func splitServer(s, host string, port int) (string, int, error) {
+	if s == "" {
+		return host, port, nil
+	}
+	h, p, err := net.SplitHostPort(s)
+	if err != nil {
+		// no port, or a bare IPv6 address
+		return s, port, nil
+	}
+	n, err := strconv.Atoi(p)
+	if err != nil || n < 1 || n > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", p)
+	}
+	return h, n, nil
+}
+
+// overviewFailures logs the mailboxes of counts STATUS failed for and
+// returns the exit code, 1 if there were any.
+func overviewFailures(logger *slog.Logger, counts []mailboxCounts) int {
+	code := 0
+	for _, m := range counts {
+		if m.Err != nil {
+			logger.Error("cannot get mailbox status", "mailbox", m.Name, "err", m.Err)
+			fmt.Fprintf(os.Stderr, "cannot get status of %s: %s\n", m.Name, m.Err)
+			code = 1
 		}
-		if _, found := uniqueIDs[messageID]; found {
-			dups = append(dups, msg.Uid)
-			if listOnlyDups {
-				fmt.Printf("%s: %s %d %s:", mbox, msg.Envelope.Subject, msg.Uid, messageID)
-			}
-			fmt.Println("duplicate")
-			if listOnlyDups {
-				fmt.Println("")
+	}
+	return code
+}
+
+// listMailboxes returns the names of all selectable mailboxes.
+func listMailboxes(c *client.Client) ([]string, error) {
+	ch := make(chan *imap.MailboxInfo, 100)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.List("", "*", ch)
+	}()
+
+	var names []string
+	for info := range ch {
+		selectable := true
+		for _, attr := range info.Attributes {
+			if attr == imap.NoSelectAttr {
+				selectable = false
 			}
-			continue
 		}
-		if !listOnlyDups {
-			fmt.Println("")
+		if selectable {
+			names = append(names, info.Name)
 		}
-		uniqueIDs[messageID] = struct{}{}
 	}
-	err = <-errChan
-	return dups, err
+	return names, <-errChan
 }
 
-func RemoveDups(c *client.Client, mbox string, uids []uint32) (err error) {
-	_, err = c.Select(mbox, false)
+// applyServerURL fills the connection flags from an IMAP URL. Flags
+// given explicitly must agree with the URL.
+func applyServerURL(s string, username, server, mbox *string, port *int, useTLS, useStartTLS *bool) error {
+	u, err := ParseServerURL(s)
 	if err != nil {
 		return err
 	}
+	if err := mergeURLValue("username", username, u.Username); err != nil {
+		return err
+	}
+	if err := mergeURLValue("server", server, u.Server); err != nil {
+		return err
+	}
+	if err := mergeURLValue("mbox", mbox, u.Mbox); err != nil {
+		return err
+	}
 
-	for _, uid := range uids {
-		seqSet := &imap.SeqSet{}
-		seqSet.AddNum(uid)
-		err = c.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
-		if err != nil {
-			return err
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if u.Port != 0 {
+		if set["port"] && *port != u.Port {
+			return fmt.Errorf("-port %d conflicts with -server-url", *port)
+		}
+		*port = u.Port
+	}
+	if (set["tls"] && *useTLS != u.TLS) || (set["starttls"] && *useStartTLS == u.TLS) {
+		return fmt.Errorf("-tls and -starttls conflict with the scheme of -server-url")
+	}
+	*useTLS, *useStartTLS = u.TLS, !u.TLS
+	return nil
+}
+
+// ignored combines the address fields whose flag is set.
+func ignored(flags map[dedup.AddressField]*bool) (fields dedup.AddressField) {
+	for f, set := range flags {
+		if *set {
+			fields |= f
 		}
 	}
+	return fields
+}
+
+// keepPolicy returns the copy kept of each group as selected by
+// -dedup-preserve-largest and -dedup-preserve-smallest.
+func keepPolicy(largest, smallest bool) dedup.Keep {
+	switch {
+	case largest:
+		return dedup.KeepLargest
+	case smallest:
+		return dedup.KeepSmallest
+	}
+	return dedup.KeepFirst
+}
+
+// removeAction returns the action of dedup.Apply, with fullExpunge
+// for -allow-full-expunge.
+func removeAction(fullExpunge bool) dedup.Action {
+	if fullExpunge {
+		return dedup.ActionDeleteExpungeAll
+	}
+	return dedup.ActionDelete
+}
+
+// config returns the configuration mbox is scanned with.
+func (cl *cleaner) config(mbox string) dedup.Config {
+	if cl.drafts[mbox] {
+		return draftsConfig(cl.cfg)
+	}
+	return cl.cfg
+}
+
+// draftsConfig returns cfg made safe for a drafts mailbox, where the
+// versions of a draft saved while writing it share its Message-ID:
+// copies are only duplicates if their whole bodies are the same, and
+// the one saved last is kept.
+func draftsConfig(cfg dedup.Config) dedup.Config {
+	cfg.Strategy = dedup.StrategyTiered
+	cfg.BodyBytes = 0
+	cfg.Keep = dedup.KeepLast
+	return cfg
+}
+
+// bodyLimit returns the BodyBytes of the -dedup-key.
+func bodyLimit(dedupKey string, n int) int {
+	if dedupKey == "body-first-n-bytes" {
+		return n
+	}
+	return 0
+}
 
-	return c.Expunge(nil)
+// uidList formats uids as an IMAP sequence set, or "none".
+func uidList(uids []uint32) string {
+	if len(uids) == 0 {
+		return "none"
+	}
+	seqset := &imap.SeqSet{}
+	seqset.AddNum(uids...)
+	return seqset.String()
+}
+
+// parseUIDBound parses the bound of a UID range, * yields 0 for an
+// open range.
+func parseUIDBound(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	uid, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if uid == 0 {
+		return 0, fmt.Errorf("UIDs start at 1")
+	}
+	return uint32(uid), nil
 }
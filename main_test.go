@@ -0,0 +1,1215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// runMain runs the command line args with a fresh flag.CommandLine and
+// returns the exit code and what was printed. IMAPCLEANDUP_* variables
+// are cleared unless set in env, given as name=value, and locks are
+// taken in a temporary directory.
+func runMain(t *testing.T, env []string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		if name := strings.SplitN(kv, "=", 2)[0]; strings.HasPrefix(name, envPrefix) {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	for _, kv := range env {
+		nv := strings.SplitN(kv, "=", 2)
+		t.Setenv(nv[0], nv[1])
+	}
+
+	outFile, errFile := tempFile(t), tempFile(t)
+	oldOut, oldErr, oldUsage, oldFlags := os.Stdout, os.Stderr, flag.Usage, flag.CommandLine
+	os.Stdout, os.Stderr = outFile, errFile
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	// the flags of the test binary are needed again by -count
+	defer func() {
+		os.Stdout, os.Stderr, flag.Usage, flag.CommandLine = oldOut, oldErr, oldUsage, oldFlags
+	}()
+	code = run(args, nil)
+	return code, readFile(t, outFile), readFile(t, errFile)
+}
+
+func tempFile(t *testing.T) *os.File {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func readFile(t *testing.T, f *os.File) string {
+	t.Helper()
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// args returns command followed by the flags connecting to s and
+// flags.
+func args(s *imaptest.Server, command string, flags ...string) []string {
+	return append(append([]string{command}, s.Args()...), flags...)
+}
+
+// dupServer returns a server with extensions whose INBOX holds two
+// copies of one message and three of another, next to a unique one.
+func dupServer(t *testing.T, extensions ...server.Extension) *imaptest.Server {
+	s := imaptest.NewServer(t, extensions...)
+	s.AppendMessages(t, "INBOX",
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "A"},
+		imaptest.Message{MessageID: "<b@example.org>", Subject: "B"},
+		imaptest.Message{MessageID: "<a@example.org>", Subject: "A"},
+		imaptest.Message{Subject: "C"},
+		imaptest.Message{Subject: "C"},
+		imaptest.Message{Subject: "C"},
+	)
+	return s
+}
+
+func TestRunClean(t *testing.T) {
+	s := dupServer(t)
+	code, stdout, stderr := runMain(t, nil, args(s, "clean")...)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1, 2, 4}) {
+		t.Errorf("got UIDs %v left", uids)
+	}
+	if !strings.Contains(stdout, "will remove 3 messages") {
+		t.Errorf("got stdout:\n%s", stdout)
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	for _, a := range [][]string{{"scan"}, {"clean", "-dry-run"}} {
+		s := dupServer(t)
+		code, stdout, stderr := runMain(t, nil, args(s, a[0], a[1:]...)...)
+		if code != 0 {
+			t.Fatalf("%v: exit code %d, stderr:\n%s", a, code, stderr)
+		}
+		if uids := s.UIDs(t, "INBOX"); len(uids) != 6 {
+			t.Errorf("%v: got UIDs %v left", a, uids)
+		}
+		if !strings.Contains(stdout, "would have removed 3 messages") || strings.Contains(stdout, "will remove") {
+			t.Errorf("%v: got stdout:\n%s", a, stdout)
+		}
+	}
+}
+
+// TestRunReadOnly checks in the command trace that runs which do not
+// remove anything only examine the mailbox, and that clean selects it.
+func TestRunReadOnly(t *testing.T) {
+	command := regexp.MustCompile(`(?m)^C: \S+ (SELECT|EXAMINE) INBOX\r?$`)
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"scan"}, "EXAMINE"},
+		{[]string{"clean", "-dry-run"}, "EXAMINE"},
+		{[]string{"clean", "-count-only"}, "EXAMINE"},
+		{[]string{"clean"}, "SELECT"},
+	} {
+		s := dupServer(t)
+		code, _, stderr := runMain(t, nil, args(s, test.args[0], append(test.args[1:], "-mbox", "INBOX", "-debug-imap")...)...)
+		if code != 0 {
+			t.Errorf("%v: exit code %d, stderr:\n%s", test.args, code, stderr)
+			continue
+		}
+		matches := command.FindAllStringSubmatch(stderr, -1)
+		if len(matches) == 0 {
+			t.Errorf("%v: INBOX not selected, stderr:\n%s", test.args, stderr)
+		}
+		for _, m := range matches {
+			if m[1] != test.want {
+				t.Errorf("%v: got %s", test.args, m[0])
+			}
+		}
+	}
+}
+
+func TestRunListOnlyDups(t *testing.T) {
+	s := dupServer(t)
+	_, all, _ := runMain(t, nil, args(s, "scan", "-report", "messages")...)
+	code, dups, stderr := runMain(t, nil, args(s, "scan", "-list-only-dups")...)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	for _, uid := range []string{"1", "2", "4"} {
+		line := "INBOX: " + uid + " first "
+		if !strings.Contains(all, line) || strings.Contains(dups, line) {
+			t.Errorf("line of UID %s: got stdout:\n%s\nwithout -list-only-dups:\n%s", uid, dups, all)
+		}
+	}
+	for _, line := range []string{`INBOX: 3 duplicate <a@example.org> "A"`, "INBOX: 5 duplicate ", "INBOX: 6 duplicate "} {
+		if !strings.Contains(dups, line) {
+			t.Errorf("missing %q in stdout:\n%s", line, dups)
+		}
+	}
+}
+
+// TestRunReport checks that scan prints the grouped summary unless the
+// listing of every message is asked for.
+func TestRunReport(t *testing.T) {
+	s := dupServer(t)
+	summary := []string{
+		`INBOX: 2 copies of <a@example.org> "A": keeping 1, removing 3`,
+		`INBOX: 3 copies of 5e9f79d3a3826f77027a5ae625ce9890 "C": keeping 4, removing 5 6`,
+		"INBOX: 3 duplicates, 335 B, of 6 messages scanned",
+	}
+	messages := []string{"INBOX: 1 first ", `INBOX: 3 duplicate <a@example.org> "A"`, "INBOX: 6 duplicate "}
+	for _, test := range []struct {
+		args []string
+		want []string
+		// not are left out of the output.
+		not []string
+	}{
+		{args(s, "scan"), summary, messages},
+		{args(s, "clean", "-dry-run"), summary, messages},
+		{args(s, "scan", "-dedup-report-duplicates-only-summary"), summary, messages},
+		{args(s, "scan", "-report", "messages"), messages, summary},
+		{args(s, "scan", "-sort", "uid"), messages, summary},
+		{args(s, "scan", "-list-only-dups"), messages[1:], summary},
+		// without a command, the output is as it always was
+		{append(s.Args(), "-dry-run"), messages, summary},
+	} {
+		code, stdout, stderr := runMain(t, nil, test.args...)
+		if code != 0 {
+			t.Errorf("%v: exit code %d, stderr:\n%s", test.args, code, stderr)
+			continue
+		}
+		for _, line := range test.want {
+			if !strings.Contains(stdout, line) {
+				t.Errorf("%v: missing %q in stdout:\n%s", test.args, line, stdout)
+			}
+		}
+		for _, line := range test.not {
+			if strings.Contains(stdout, line) {
+				t.Errorf("%v: got %q in stdout:\n%s", test.args, line, stdout)
+			}
+		}
+	}
+}
+
+// TestRunWithoutUIDPLUS removes duplicates where another client flagged
+// a message \Deleted, on servers with and without UIDPLUS, and checks
+// that without it EXPUNGE is only used with -allow-full-expunge, and
+// that the path taken is said.
+func TestRunWithoutUIDPLUS(t *testing.T) {
+	for _, test := range []struct {
+		uidPlus bool
+		flags   []string
+		code    int
+		left    []uint32
+		// said are printed to stdout and stderr.
+		said []string
+	}{
+		{true, nil, 0, []uint32{1, 2, 4, 7}, []string{"will remove 3 messages"}},
+		{false, nil, 1, []uint32{1, 2, 3, 4, 5, 6, 7}, []string{
+			"INBOX: nothing removed: ",
+			"INBOX: expunge or undelete those messages in your mail client first, or rerun with -allow-full-expunge to remove them too",
+		}},
+		{false, []string{"-allow-full-expunge"}, 0, []uint32{1, 2, 4}, []string{
+			"INBOX: the server lacks UIDPLUS, EXPUNGE also removed 1 messages other clients had flagged \\Deleted (-allow-full-expunge)",
+		}},
+	} {
+		s := dupServer(t)
+		if test.uidPlus {
+			s = dupServer(t, imaptest.UIDPlus)
+		}
+		s.AppendMessages(t, "INBOX", imaptest.Message{Subject: "deleted elsewhere", Flags: []string{imap.DeletedFlag}})
+		code, stdout, stderr := runMain(t, nil, args(s, "clean", test.flags...)...)
+		if code != test.code {
+			t.Errorf("UIDPLUS %t %v: exit code %d, stderr:\n%s", test.uidPlus, test.flags, code, stderr)
+		}
+		if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, test.left) {
+			t.Errorf("UIDPLUS %t %v: got UIDs %v left, want %v", test.uidPlus, test.flags, uids, test.left)
+		}
+		for _, want := range test.said {
+			if !strings.Contains(stdout+stderr, want) {
+				t.Errorf("UIDPLUS %t %v: missing %q in stdout:\n%s\nstderr:\n%s", test.uidPlus, test.flags, want, stdout, stderr)
+			}
+		}
+		if lacks := strings.Contains(stdout+stderr, "lacks UIDPLUS"); lacks == test.uidPlus {
+			t.Errorf("UIDPLUS %t %v: said the server lacks UIDPLUS: %t", test.uidPlus, test.flags, lacks)
+		}
+	}
+
+	// without other messages flagged, EXPUNGE is used as it is
+	s := dupServer(t)
+	code, stdout, stderr := runMain(t, nil, args(s, "clean")...)
+	if want := "INBOX: the server lacks UIDPLUS, expunged with EXPUNGE as no other message was flagged \\Deleted"; code != 0 || !strings.Contains(stdout, want) {
+		t.Errorf("exit code %d, stdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+	}
+}
+
+func TestRunMinGroupSize(t *testing.T) {
+	s := dupServer(t)
+	code, stdout, stderr := runMain(t, nil, args(s, "clean", "-min-group-size", "3")...)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	// the pair of A is reported but kept
+	if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1, 2, 3, 4}) {
+		t.Errorf("got UIDs %v left", uids)
+	}
+	if !strings.Contains(stdout, "INBOX: keeping 1 duplicates of messages with less than 3 copies") {
+		t.Errorf("got stdout:\n%s", stdout)
+	}
+}
+
+// TestRunAllMailboxesFailure checks that -all-mailboxes cleans the
+// mailboxes it can despite one it cannot select, and reports it.
+func TestRunAllMailboxesFailure(t *testing.T) {
+	s := imaptest.NewServer(t)
+	a := imaptest.Message{MessageID: "<a@example.org>", Subject: "A"}
+	b := imaptest.Message{MessageID: "<b@example.org>", Subject: "B"}
+	for _, mbox := range []string{"INBOX", "Archive", "Shared"} {
+		s.AppendMessages(t, mbox, a, a, b)
+	}
+	s.Deny(t, "Shared")
+	code, stdout, stderr := runMain(t, nil, args(s, "clean", "-all-mailboxes")...)
+	if code != 1 {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	for _, mbox := range []string{"INBOX", "Archive"} {
+		if uids := s.UIDs(t, mbox); !reflect.DeepEqual(uids, []uint32{1, 3}) {
+			t.Errorf("%s: got UIDs %v left", mbox, uids)
+		}
+	}
+	if uids := s.UIDs(t, "Shared"); len(uids) != 3 {
+		t.Errorf("Shared: got UIDs %v left", uids)
+	}
+	for _, want := range []string{"1 of 3 mailboxes failed:\n  Shared: select Shared: Permission denied", "INBOX    1      1        1 "} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("missing %q in stdout:\n%s", want, stdout)
+		}
+	}
+	if !strings.Contains(stderr, "cannot find duplicates: select Shared: Permission denied") {
+		t.Errorf("got stderr:\n%s", stderr)
+	}
+}
+
+// TestRunMaxDuration stops a run at -max-duration before it scans
+// anything, which exits exitPartial with nothing removed.
+func TestRunMaxDuration(t *testing.T) {
+	s := dupServer(t)
+	code, _, stderr := runMain(t, nil, args(s, "clean", "-mbox", "INBOX", "-max-duration", "1ns")...)
+	if code != exitPartial {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	for _, want := range []string{"stopped during connect: context deadline exceeded", "the run reached -max-duration 1ns and is partial"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("missing %q in stderr:\n%s", want, stderr)
+		}
+	}
+	if got := s.UIDs(t, "INBOX"); len(got) != 6 {
+		t.Errorf("left UIDs %v", got)
+	}
+}
+
+// slowProxy returns the address of a proxy to s which holds back each
+// read from s for delay, as a slow server.
+func slowProxy(t *testing.T, s *imaptest.Server, delay time.Duration) (host string, port int) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", s.Addr)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.Close()
+			}()
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 32<<10)
+				for {
+					n, err := upstream.Read(buf)
+					time.Sleep(delay)
+					if _, werr := conn.Write(buf[:n]); werr != nil || err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// TestRunMaxDurationWindDown runs against a slow server until
+// -max-duration and checks that the run winds down: a scan stops after
+// the fetch window in progress and removes nothing, a removal expunges
+// the duplicates flagged so far, and both exit partial, naming where
+// they stopped.
+func TestRunMaxDurationWindDown(t *testing.T) {
+	s := imaptest.NewServer(t)
+	copies := make([]imaptest.Message, 40)
+	for i := range copies {
+		copies[i] = imaptest.Message{MessageID: "<a@example.org>", Subject: "A"}
+	}
+	s.AppendMessages(t, "INBOX", copies...)
+	host, port := slowProxy(t, s, 100*time.Millisecond)
+	proxied := func(command string, flags ...string) []string {
+		a := append([]string{command}, s.Args()...)
+		a[2], a[4] = host, strconv.Itoa(port)
+		return append(a, flags...)
+	}
+
+	// each window of 5 messages takes 100ms
+	start := time.Now()
+	code, stdout, stderr := runMain(t, nil, proxied("clean", "-mbox", "INBOX", "-fetch-chunk", "5", "-max-duration", "1200ms")...)
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("scan: stopped after %s", took)
+	}
+	if code != exitPartial {
+		t.Errorf("scan: exit code %d, stderr:\n%s", code, stderr)
+	}
+	window := regexp.MustCompile(`cannot find duplicates: fetch INBOX messages (\d+):(\d+): canceled: context deadline exceeded`).FindStringSubmatch(stderr)
+	if window == nil || window[1] == "1" || window[2] == "40" {
+		t.Errorf("scan: stop not named or not part way, stderr:\n%s", stderr)
+	}
+	if !strings.Contains(stderr, "the run reached -max-duration 1.2s and is partial, run it again to resume") || !strings.Contains(stdout, "stopped") {
+		t.Errorf("scan: got stdout:\n%s\nstderr:\n%s", stdout, stderr)
+	}
+	if uids := s.UIDs(t, "INBOX"); len(uids) != 40 {
+		t.Errorf("scan: got UIDs %v left", uids)
+	}
+
+	// removing the 39 duplicates takes 4s
+	start = time.Now()
+	code, stdout, stderr = runMain(t, nil, proxied("clean", "-mbox", "INBOX", "-max-duration", "2s")...)
+	if took := time.Since(start); took > 3500*time.Millisecond {
+		t.Errorf("removal: stopped after %s", took)
+	}
+	if code != exitPartial {
+		t.Errorf("removal: exit code %d, stderr:\n%s", code, stderr)
+	}
+	left := s.UIDs(t, "INBOX")
+	if len(left) < 2 || len(left) == 40 {
+		t.Fatalf("removal: got UIDs %v left", left)
+	}
+	for _, uid := range left {
+		for _, f := range s.Flags(t, "INBOX", uid) {
+			if f == imap.DeletedFlag {
+				t.Errorf("removal: UID %d left flagged \\Deleted", uid)
+			}
+		}
+	}
+	// duplicates are removed from the highest UID down
+	var expunged []uint32
+	for uid := uint32(len(left) + 1); uid <= 40; uid++ {
+		expunged = append(expunged, uid)
+	}
+	for _, want := range []string{"cannot remove duplicates: store INBOX: canceled: context deadline exceeded", "INBOX: expunged UIDs: " + uidList(expunged) + "\n", "the run reached -max-duration 2s and is partial"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("removal: missing %q in stderr:\n%s", want, stderr)
+		}
+	}
+	if want := fmt.Sprintf("INBOX    39     %d", 40-len(left)); !strings.Contains(stdout, want) || !strings.Contains(stdout, "stopped") {
+		t.Errorf("removal: no summary of the stopped run in stdout:\n%s", stdout)
+	}
+}
+
+// childArgs is the environment variable TestRunInterruptChild takes the
+// command line to run from, one argument per line.
+const childArgs = "CLEANDUP_TEST_CHILD_ARGS"
+
+// TestRunInterruptChild runs the command line of childArgs in the
+// process TestRunInterrupt starts and signals.
+func TestRunInterruptChild(t *testing.T) {
+	a := os.Getenv(childArgs)
+	if a == "" {
+		t.Skip("only run by TestRunInterrupt")
+	}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Exit(run(strings.Split(a, "\n"), nil))
+}
+
+// childCommand returns the command running args in a child process by
+// TestRunInterruptChild, with the IMAPCLEANDUP_* variables cleared and
+// locks taken in a temporary directory.
+func childCommand(t *testing.T, args []string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRunInterruptChild$")
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envPrefix) {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, childArgs+"="+strings.Join(args, "\n"), "XDG_STATE_HOME="+t.TempDir())
+	return cmd
+}
+
+// TestRunInterrupt interrupts a child process while it removes
+// duplicates and checks that it winds down: the messages flagged so
+// far are expunged and named, and the summary printed.
+func TestRunInterrupt(t *testing.T) {
+	s := imaptest.NewServer(t)
+	copies := make([]imaptest.Message, 31)
+	for i := range copies {
+		copies[i] = imaptest.Message{MessageID: "<a@example.org>", Subject: "A"}
+	}
+	s.AppendMessages(t, "INBOX", copies...)
+
+	// removing all duplicates takes 1.5s
+	cmd := childCommand(t, args(s, "clean", "-mbox", "INBOX", "-per-message-delay", "50ms"))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(out)
+	var stdout strings.Builder
+	for !strings.Contains(stdout.String(), "will remove 30 messages") {
+		line, err := r.ReadString('\n')
+		stdout.WriteString(line)
+		if err != nil {
+			cmd.Wait()
+			t.Fatalf("no removal started, stdout:\n%s\nstderr:\n%s", stdout.String(), stderr.String())
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	start := time.Now()
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(r)
+	stdout.Write(rest)
+	cmd.Wait()
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("exited %s after the signal", took)
+	}
+	if code := cmd.ProcessState.ExitCode(); code != 1 {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "stopping after the current step, interrupt again to exit immediately") {
+		t.Errorf("got stderr:\n%s", stderr.String())
+	}
+
+	left := s.UIDs(t, "INBOX")
+	kept := make(map[uint32]bool)
+	for _, uid := range left {
+		kept[uid] = true
+		for _, f := range s.Flags(t, "INBOX", uid) {
+			if f == imap.DeletedFlag {
+				t.Errorf("UID %d left flagged \\Deleted", uid)
+			}
+		}
+	}
+	if len(left) < 2 || len(left) == 31 {
+		t.Errorf("got UIDs %v left", left)
+	}
+	var expunged []uint32
+	for uid := uint32(2); uid <= 31; uid++ {
+		if !kept[uid] {
+			expunged = append(expunged, uid)
+		}
+	}
+	if want := "INBOX: expunged UIDs: " + uidList(expunged) + "\n"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("missing %q in stderr:\n%s", want, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "stopped") {
+		t.Errorf("no summary of the stopped run in stdout:\n%s", stdout.String())
+	}
+}
+
+// TestRunInterruptTwice interrupts a child process waiting for a
+// server which does not answer EXAMINE, which the first signal cannot
+// stop, and checks that the second one exits at once.
+func TestRunInterruptTwice(t *testing.T) {
+	srv := newScriptedServer(t, "[CAPABILITY IMAP4rev1] ready", map[string]string{"SELECT": "", "EXAMINE": ""})
+	cmd := childCommand(t, srv.args("scan"))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	waiting := func() bool {
+		for _, name := range srv.Commands() {
+			if name == "SELECT" || name == "EXAMINE" {
+				return true
+			}
+		}
+		return false
+	}
+	for deadline := time.Now().Add(5 * time.Second); !waiting(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			<-done
+			t.Fatalf("no mailbox selected, commands %v, stderr:\n%s", srv.Commands(), stderr.String())
+		}
+	}
+
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Fatalf("exited on the first signal, stderr:\n%s", stderr.String())
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		<-done
+		t.Fatal("did not exit on the second signal")
+	}
+	if code := cmd.ProcessState.ExitCode(); code != 1 {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "stopping after the current step, interrupt again to exit immediately") {
+		t.Errorf("got stderr:\n%s", stderr.String())
+	}
+}
+
+func TestRunEmpty(t *testing.T) {
+	s := imaptest.NewServer(t)
+	code, stdout, stderr := runMain(t, nil, args(s, "clean")...)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	if !strings.Contains(stdout, "INBOX: mailbox is empty, nothing to do") {
+		t.Errorf("got stdout:\n%s", stdout)
+	}
+}
+
+func TestIgnoreFieldFlags(t *testing.T) {
+	s := imaptest.NewServer(t)
+	s.AppendMessages(t, "INBOX",
+		imaptest.Message{Subject: "Report", To: "b@example.org", Cc: "c@example.org"},
+		imaptest.Message{Subject: "Report", To: "b@example.org", Cc: "d@example.org"},
+	)
+	for _, test := range []struct {
+		flags []string
+		found bool
+	}{
+		{nil, false},
+		{[]string{"-ignore-to"}, false},
+		{[]string{"-ignore-cc"}, true},
+		{[]string{"-ignore-to", "-ignore-cc"}, true},
+	} {
+		_, stdout, stderr := runMain(t, nil, args(s, "scan", test.flags...)...)
+		if found := strings.Contains(stdout, "would have removed 1 messages"); found != test.found {
+			t.Errorf("%v: got stdout:\n%s\nstderr:\n%s", test.flags, stdout, stderr)
+		}
+	}
+}
+
+func TestParseUIDBound(t *testing.T) {
+	for _, test := range []struct {
+		s   string
+		uid uint32
+		ok  bool
+	}{
+		{"1", 1, true},
+		{"4294967295", 4294967295, true},
+		{"*", 0, true},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"4294967296", 0, false},
+		{"", 0, false},
+	} {
+		uid, err := parseUIDBound(test.s)
+		if uid != test.uid || (err == nil) != test.ok {
+			t.Errorf("parseUIDBound(%q) = %d, %v", test.s, uid, err)
+		}
+	}
+}
+
+func TestRunUIDRange(t *testing.T) {
+	s := imaptest.NewServer(t)
+	s.AppendMessages(t, "INBOX",
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<b@example.org>"},
+		imaptest.Message{MessageID: "<b@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>"},
+	)
+	for _, test := range []struct {
+		flags []string
+		code  int
+		out   string
+	}{
+		{nil, 0, "would have removed 3 messages"},
+		{[]string{"-uid-from", "3"}, 0, "would have removed 1 messages"},
+		{[]string{"-uid-from", "2", "-uid-to", "*"}, 0, "would have removed 2 messages"},
+		{[]string{"-uid-to", "2"}, 0, "would have removed 1 messages"},
+		{[]string{"-uid-from", "4", "-uid-to", "2"}, exitUsage, "invalid UID range: -uid-from 4 is above -uid-to 2"},
+		{[]string{"-uid-from", "0"}, exitUsage, "invalid -uid-from: UIDs start at 1"},
+	} {
+		code, stdout, stderr := runMain(t, nil, args(s, "scan", test.flags...)...)
+		if code != test.code || !strings.Contains(stdout+stderr, test.out) {
+			t.Errorf("%v: got exit code %d, stdout:\n%s\nstderr:\n%s", test.flags, code, stdout, stderr)
+		}
+	}
+}
+
+func TestRunPlan(t *testing.T) {
+	s := dupServer(t)
+	path := t.TempDir() + "/plan.json"
+	code, stdout, stderr := runMain(t, nil, args(s, "scan", "-plan", path)...)
+	if code != 0 {
+		t.Fatalf("scan: exit code %d, stderr:\n%s", code, stderr)
+	}
+	if !strings.Contains(stdout, "wrote the plan of 3 duplicates to "+path) {
+		t.Errorf("scan: got stdout:\n%s", stdout)
+	}
+	plan, err := readPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := plan.groups("INBOX"); len(got) != 2 || got[0].Envelopes == nil {
+		t.Fatalf("got groups %+v", got)
+	}
+	if uids := s.UIDs(t, "INBOX"); len(uids) != 6 {
+		t.Fatalf("scan: got UIDs %v left", uids)
+	}
+
+	code, stdout, stderr = runMain(t, nil, args(s, "apply", "-dry-run", path)...)
+	if code != 0 || !strings.Contains(stdout, "would have removed 3 messages") {
+		t.Errorf("apply -dry-run: exit code %d, stdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+	}
+	if uids := s.UIDs(t, "INBOX"); len(uids) != 6 {
+		t.Fatalf("apply -dry-run: got UIDs %v left", uids)
+	}
+
+	// a plan of another user is refused
+	other := t.TempDir() + "/plan.json"
+	plan.Username = "someone"
+	if err := plan.write(other); err != nil {
+		t.Fatal(err)
+	}
+	code, _, stderr = runMain(t, nil, args(s, "apply", other)...)
+	if code != exitUsage || !strings.Contains(stderr, "was made for someone on") {
+		t.Errorf("apply of another user: exit code %d, stderr:\n%s", code, stderr)
+	}
+
+	code, stdout, stderr = runMain(t, nil, args(s, "apply", path)...)
+	if code != 0 {
+		t.Fatalf("apply: exit code %d, stderr:\n%s", code, stderr)
+	}
+	if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1, 2, 4}) {
+		t.Errorf("apply: got UIDs %v left", uids)
+	}
+	if !strings.Contains(stdout, "will remove 3 messages") {
+		t.Errorf("apply: got stdout:\n%s", stdout)
+	}
+}
+
+func TestRunPlanChanged(t *testing.T) {
+	s := dupServer(t)
+	path := t.TempDir() + "/plan.json"
+	if code, _, stderr := runMain(t, nil, args(s, "scan", "-plan", path)...); code != 0 {
+		t.Fatalf("scan: exit code %d, stderr:\n%s", code, stderr)
+	}
+	// the duplicate 3 of 1 is gone, the copies of C are left
+	c := s.Dial(t)
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	s.SetFlags(t, "INBOX", 3, `\Deleted`)
+	if err := c.Expunge(nil); err != nil {
+		t.Fatal(err)
+	}
+	code, _, stderr := runMain(t, nil, args(s, "apply", path)...)
+	if code != 1 || !strings.Contains(stderr, "NOT REMOVED: duplicate 3 <a@example.org> \"A\" is gone") {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1, 2, 4}) {
+		t.Errorf("got UIDs %v left", uids)
+	}
+}
+
+func TestReadPlan(t *testing.T) {
+	for _, test := range []struct {
+		json string
+		err  string
+	}{
+		{`{"groups": [{"mailbox": "INBOX", "keeper": 1, "duplicates": [2]}]}`, ""},
+		{`{"groups": []}`, ""},
+		{`{"groups": [{"keeper": 1, "duplicates": [2]}]}`, "group 1 needs a mailbox, keeper and duplicates"},
+		{`{"groups": [{"mailbox": "INBOX", "keeper": 1, "duplicates": []}]}`, "group 1 needs a mailbox, keeper and duplicates"},
+		{`{"groups": [{"mailbox": "INBOX", "keeper": 1, "duplicates": [2]}, {"mailbox": "INBOX", "keeper": 3, "duplicates": [3]}]}`, "group 2: invalid duplicate UID 3"},
+		{`{"groups": [{"mailbox": "INBOX", "keeper": 1, "duplicates": [0]}]}`, "group 1: invalid duplicate UID 0"},
+		{`{"groups": {}}`, "cannot unmarshal"},
+	} {
+		path := t.TempDir() + "/plan.json"
+		if err := os.WriteFile(path, []byte(test.json), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readPlan(path)
+		if (err == nil) != (test.err == "") || (err != nil && !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got error %v, want %q", test.json, err, test.err)
+		}
+	}
+}
+
+func TestReclaimed(t *testing.T) {
+	groups := []dedup.Group{
+		{Mailbox: "INBOX", Keeper: 1, Duplicates: []uint32{2, 3}, Sizes: map[uint32]uint32{1: 100, 2: 200, 3: 300}},
+		{Mailbox: "Sent", Keeper: 1, Duplicates: []uint32{4}, Sizes: map[uint32]uint32{1: 10, 4: 40}},
+		// groups read from a plan have no sizes
+		{Mailbox: "INBOX", Keeper: 5, Duplicates: []uint32{6}},
+	}
+	// duplicates left alone by Apply, such as 2, do not count
+	if got := reclaimed(groups, "INBOX", []uint32{3, 4, 6}); got != 300 {
+		t.Errorf("got %d bytes reclaimed, want 300", got)
+	}
+}
+
+func TestRunLoginDisabled(t *testing.T) {
+	s := imaptest.NewServer(t, imaptest.LoginDisabled)
+	code, _, stderr := runMain(t, nil, args(s, "scan")...)
+	want := "login disabled by " + s.Host() + " — use -starttls or -tls"
+	if code != exitLogin || !strings.Contains(stderr, want) {
+		t.Errorf("exit code %d, stderr:\n%s\nwant %q", code, stderr, want)
+	}
+}
+
+// scriptedServer serves IMAP sessions on a local port, answering each
+// command by its name with the status response of script, OK if it has
+// none, and records the commands issued. Lines before the last one of a
+// response are sent untagged ahead of it. An empty response leaves the
+// command unanswered.
+type scriptedServer struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	commands []string
+}
+
+func newScriptedServer(t *testing.T, greeting string, script map[string]string) *scriptedServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &scriptedServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, greeting, script)
+		}
+	}()
+	return s
+}
+
+func (s *scriptedServer) serve(conn net.Conn, greeting string, script map[string]string) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "* OK %s\r\n", greeting)
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return
+		}
+		tag, name := fields[0], strings.ToUpper(fields[1])
+		s.mu.Lock()
+		s.commands = append(s.commands, name)
+		s.mu.Unlock()
+		if name == "LOGOUT" {
+			fmt.Fprintf(conn, "* BYE logging out\r\n%s OK LOGOUT completed\r\n", tag)
+			return
+		}
+		resp, ok := script[name]
+		if !ok {
+			resp = "OK " + name + " completed"
+		}
+		if i := strings.LastIndex(resp, "\r\n"); i >= 0 {
+			fmt.Fprint(conn, resp[:i+2])
+			resp = resp[i+2:]
+		}
+		if resp != "" {
+			fmt.Fprintf(conn, "%s %s\r\n", tag, resp)
+		}
+	}
+}
+
+// Commands returns the names of the commands issued so far.
+func (s *scriptedServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *scriptedServer) args(command string) []string {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return []string{command, "-server", addr.IP.String(), "-port", strconv.Itoa(addr.Port), "-tls=false", "-username", "user", "-password", "secret"}
+}
+
+// TestRunConnectFailures sets up sessions failing at each step and
+// checks the message and exit code of each, and that a session which
+// was established is logged out.
+func TestRunConnectFailures(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	s := imaptest.NewServer(t)
+
+	for _, test := range []struct {
+		name     string
+		greeting string
+		script   map[string]string
+		flags    []string
+		code     int
+		want     string
+		// commands are those the scripted server got
+		commands []string
+	}{
+		{
+			name:     "starttls rejected",
+			greeting: "[CAPABILITY IMAP4rev1 STARTTLS] ready",
+			script:   map[string]string{"STARTTLS": "BAD STARTTLS not available"},
+			flags:    []string{"-starttls"},
+			code:     exitConnect,
+			want:     "STARTTLS failed on 127.0.0.1 — check that the server offers STARTTLS, or use -tls (STARTTLS not available)",
+			commands: []string{"STARTTLS", "LOGOUT"},
+		},
+		{
+			name:     "login rejected",
+			greeting: "[CAPABILITY IMAP4rev1] ready",
+			script:   map[string]string{"LOGIN": "NO [AUTHENTICATIONFAILED] Invalid credentials"},
+			code:     exitLogin,
+			want:     "login failed: authentication rejected by 127.0.0.1 — check username/password (authentication failed: Invalid credentials)",
+			commands: []string{"LOGIN", "LOGOUT"},
+		},
+		{
+			name:     "login disabled",
+			greeting: "[CAPABILITY IMAP4rev1 LOGINDISABLED] ready",
+			code:     exitLogin,
+			want:     "login disabled by 127.0.0.1 — use -starttls or -tls (authentication failed: server advertises LOGINDISABLED)",
+			commands: []string{"LOGOUT"},
+		},
+	} {
+		srv := newScriptedServer(t, test.greeting, test.script)
+		code, _, stderr := runMain(t, nil, append(srv.args("scan"), test.flags...)...)
+		if code != test.code || !strings.Contains(stderr, test.want) {
+			t.Errorf("%s: exit code %d, stderr:\n%s\nwant %q", test.name, code, stderr, test.want)
+		}
+		if got := srv.Commands(); !reflect.DeepEqual(got, test.commands) {
+			t.Errorf("%s: got commands %v, want %v", test.name, got, test.commands)
+		}
+	}
+
+	// failures against the memory server
+	for _, test := range []struct {
+		name  string
+		flags []string
+		code  int
+		want  string
+	}{
+		{"unreachable", []string{"-port", strconv.Itoa(closed)}, exitConnect, fmt.Sprintf("connection failed: cannot reach 127.0.0.1:%d — check -server, -port and -tls", closed)},
+		{"no starttls", []string{"-starttls"}, exitConnect, "STARTTLS failed on 127.0.0.1 — check that the server offers STARTTLS, or use -tls"},
+		{"wrong password", []string{"-password", "wrong"}, exitLogin, "login failed: authentication rejected by 127.0.0.1 — check username/password"},
+	} {
+		code, stdout, stderr := runMain(t, nil, append(args(s, "scan"), test.flags...)...)
+		if code != test.code || !strings.Contains(stderr, test.want) {
+			t.Errorf("%s: exit code %d, stderr:\n%s\nwant %q", test.name, code, stderr, test.want)
+		}
+		if strings.Contains(stderr, "goroutine ") || stdout != "" {
+			t.Errorf("%s: got stdout:\n%s\nstderr:\n%s", test.name, stdout, stderr)
+		}
+	}
+}
+
+func TestRunKeepSize(t *testing.T) {
+	for _, test := range []struct {
+		flag string
+		left []uint32
+	}{
+		{"-dedup-preserve-largest", []uint32{2}},
+		{"-dedup-preserve-smallest", []uint32{3}},
+	} {
+		s := imaptest.NewServer(t)
+		s.AppendMessages(t, "INBOX",
+			imaptest.Message{MessageID: "<a@example.org>", Body: "stripped"},
+			imaptest.Message{MessageID: "<a@example.org>", Body: "with attachment " + strings.Repeat("x", 1000)},
+			imaptest.Message{MessageID: "<a@example.org>"},
+		)
+		code, _, stderr := runMain(t, nil, args(s, "clean", test.flag)...)
+		if code != 0 {
+			t.Fatalf("%s: exit code %d, stderr:\n%s", test.flag, code, stderr)
+		}
+		if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, test.left) {
+			t.Errorf("%s: got UIDs %v left, want %v", test.flag, uids, test.left)
+		}
+	}
+
+	s := dupServer(t)
+	code, _, stderr := runMain(t, nil, args(s, "clean", "-dedup-preserve-largest", "-dedup-preserve-smallest")...)
+	if code != exitUsage || !strings.Contains(stderr, "-dedup-preserve-largest cannot be combined with -dedup-preserve-smallest") {
+		t.Errorf("both policies: exit code %d, stderr:\n%s", code, stderr)
+	}
+}
+
+func TestRunKeyIncludeSize(t *testing.T) {
+	for _, test := range []struct {
+		flags []string
+		left  []uint32
+	}{
+		{nil, []uint32{1}},
+		{[]string{"-key-include-size"}, []uint32{1, 2}},
+	} {
+		s := imaptest.NewServer(t)
+		s.AppendMessages(t, "INBOX",
+			imaptest.Message{MessageID: "<a@example.org>", Body: "stripped"},
+			imaptest.Message{MessageID: "<a@example.org>", Body: "with attachment " + strings.Repeat("x", 1000)},
+			imaptest.Message{MessageID: "<a@example.org>", Body: "stripped"},
+		)
+		code, _, stderr := runMain(t, nil, args(s, "clean", test.flags...)...)
+		if code != 0 {
+			t.Fatalf("%v: exit code %d, stderr:\n%s", test.flags, code, stderr)
+		}
+		if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, test.left) {
+			t.Errorf("%v: got UIDs %v left, want %v", test.flags, uids, test.left)
+		}
+	}
+}
+
+func TestRunIgnoreResentHeaders(t *testing.T) {
+	msg := imaptest.Message{Subject: "Minutes"}
+	resent := append([]byte("Resent-From: list@example.org\r\nResent-Date: Mon, 4 Mar 2024 09:00:00 +0000\r\nResent-Message-ID: <resent@example.org>\r\n"), msg.Bytes()...)
+	for _, test := range []struct {
+		flags []string
+		left  []uint32
+	}{
+		{[]string{"-dedup-hash-header-raw"}, []uint32{1, 2}},
+		{[]string{"-dedup-hash-header-raw", "-dedup-ignore-resent-headers"}, []uint32{1}},
+		// the volatile headers given are still left out
+		{[]string{"-dedup-hash-header-raw", "-dedup-ignore-resent-headers", "-volatile-headers", ""}, []uint32{1}},
+	} {
+		s := imaptest.NewServer(t)
+		s.Append(t, "INBOX", time.Time{}, msg.Bytes())
+		s.Append(t, "INBOX", time.Time{}, resent)
+		code, _, stderr := runMain(t, nil, args(s, "clean", test.flags...)...)
+		if code != 0 {
+			t.Fatalf("%v: exit code %d, stderr:\n%s", test.flags, code, stderr)
+		}
+		if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, test.left) {
+			t.Errorf("%v: got UIDs %v left, want %v", test.flags, uids, test.left)
+		}
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	code, _, stderr := runMain(t, nil)
+	if code != 0 || !strings.Contains(stderr, "Usage: ") {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr)
+	}
+}
+
+// TestRunEnvOnly runs without any arguments, configured by the
+// environment alone as e.g. in a container.
+func TestRunEnvOnly(t *testing.T) {
+	s := dupServer(t)
+	env := []string{
+		"IMAPCLEANDUP_SERVER=" + s.Host(),
+		"IMAPCLEANDUP_PORT=" + strconv.Itoa(s.Port()),
+		"IMAPCLEANDUP_TLS=false",
+		"IMAPCLEANDUP_USERNAME=" + imaptest.Username,
+		"IMAPCLEANDUP_PASSWORD=" + imaptest.Password,
+	}
+	code, stdout, stderr := runMain(t, env)
+	if code != 0 || strings.Contains(stderr, "Usage: ") {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1, 2, 4}) {
+		t.Errorf("got UIDs %v left, stdout:\n%s", uids, stdout)
+	}
+}
+
+func TestRunValidation(t *testing.T) {
+	s := dupServer(t)
+	for _, test := range []struct {
+		args []string
+		// problems are all reported, none for a valid run.
+		problems []string
+	}{
+		{args(s, "scan"), nil},
+		{args(s, "clean", "-dry-run", "-fetch-chunk", "2", "-uid-from", "2", "-uid-to", "*"), nil},
+		{args(s, "scan", "-strategy", "tiered", "-dedup-key", "body-first-n-bytes", "-body-bytes", "10"), nil},
+		{[]string{"scan", "-username", "u", "-password", "p"}, []string{"-server is required"}},
+		{[]string{"scan", "-server", "imap.example.org"}, []string{"-username is required", "-password is required unless -oauth2-credentials is given"}},
+		{args(s, "scan", "-mbox", "Archive", "-all-mailboxes"), []string{"-mbox cannot be combined with -all-mailboxes"}},
+		{args(s, "scan", "-min-group-size", "1", "-fetch-chunk", "-1", "-hash-workers", "0"), []string{
+			"-min-group-size must be at least 2, not 1", "-hash-workers must be at least 1, not 0", "-fetch-chunk cannot be negative",
+		}},
+		{args(s, "scan", "-strategy", "fuzzy"), []string{`-strategy must be envelope or tiered, not "fuzzy"`}},
+		{args(s, "scan", "-dedup-key", "body-first-n-bytes"), []string{"-dedup-key body-first-n-bytes needs -strategy tiered"}},
+		{args(s, "scan", "-format", "yaml", "-sort-order", "up"), []string{`-format must be text or json, not "yaml"`, `-sort-order must be asc or desc, not "up"`}},
+		{args(s, "scan", "-sort", "size", "-dedup-report-duplicates-only-summary"), []string{"-sort cannot be combined with -dedup-report-duplicates-only-summary"}},
+		{args(s, "scan", "-report", "messages", "-dedup-report-duplicates-only-summary"), []string{"-report messages cannot be combined with -dedup-report-duplicates-only-summary"}},
+		{args(s, "scan", "-report", "groups"), []string{`-report must be summary or messages, not "groups"`}},
+		{args(s, "scan", "-key-template", "{{.Subject"), []string{"invalid -key-template: "}},
+		{args(s, "scan", "-key-template", "{{.Subject}}", "-dedup-hash-header-raw"), []string{"-dedup-hash-header-raw cannot be combined with -key-template"}},
+		{args(s, "scan", "-uid-from", "x"), []string{"invalid -uid-from: "}},
+		{args(s, "clean", "-compare-strategies"), []string{"-compare-strategies never removes anything, use scan or -dry-run"}},
+		{args(s, "clean", "-dedup-preserve-largest", "-dedup-preserve-smallest"), []string{"-dedup-preserve-largest cannot be combined with -dedup-preserve-smallest"}},
+		{args(s, "clean", "-watch", "-interval", "1h"), []string{"-interval cannot be combined with -watch"}},
+		{args(s, "clean", "-watch", "-all-mailboxes", "-limit", "10"), []string{"-watch needs a single -mbox", "-watch cannot be combined with -limit"}},
+		{args(s, "clean", "-interval", "1h", "-count-only"), []string{"-interval cannot be combined with -count-only or -fail-on-duplicates"}},
+		{args(s, "scan", "-notify-url", "ftp://example.org"), []string{`-notify-url must be an http(s) URL, not "ftp://example.org"`}},
+		{args(s, "scan", "-email-report", "a@example.org"), []string{"-smtp-server is required with -email-report", "-email-from is required with -email-report unless -smtp-user is an address"}},
+		{args(s, "scan", "-tls-min-version", "1.3", "-tls-max-version", "1.2"), []string{"-tls-min-version 1.3 is above -tls-max-version 1.2"}},
+		{args(s, "scan", "-dedup-sent-reconcile", "-sent-mbox", "INBOX"), []string{"-sent-mbox must differ from -mbox"}},
+		{args(s, "clean", "-plan", "plan.json"), []string{"-plan needs scan or -dry-run"}},
+		{args(s, "cross-server"), []string{"-new-server-url is required", "-new-password is required"}},
+	} {
+		code, _, stderr := runMain(t, nil, test.args...)
+		if test.problems == nil {
+			if code != 0 {
+				t.Errorf("%q: exit code %d, stderr:\n%s", test.args, code, stderr)
+			}
+			continue
+		}
+		if code != exitUsage {
+			t.Errorf("%q: exit code %d, want %d", test.args, code, exitUsage)
+		}
+		// all problems are reported on the first line
+		line := strings.SplitN(stderr, "\n", 2)[0]
+		for _, p := range test.problems {
+			if !strings.Contains(line, p) {
+				t.Errorf("%q: missing %q in stderr:\n%s", test.args, p, stderr)
+			}
+		}
+		if n := strings.Count(line, "; ") + 1; n != len(test.problems) {
+			t.Errorf("%q: got %d problems, want %d: %s", test.args, n, len(test.problems), line)
+		}
+	}
+}
+
+func TestRunLimit(t *testing.T) {
+	for _, test := range []struct {
+		limit string
+		left  []uint32
+	}{
+		{"3", []uint32{1, 2, 4, 5, 6}},
+		{"4", []uint32{1, 2, 4, 5, 6}},
+		{"5", []uint32{1, 2, 4, 6}},
+		{"6", []uint32{1, 2, 4}},
+	} {
+		s := dupServer(t)
+		code, stdout, stderr := runMain(t, nil, args(s, "clean", "-limit", test.limit, "-all-mailboxes")...)
+		if code != 0 {
+			t.Fatalf("-limit %s: exit code %d, stderr:\n%s", test.limit, code, stderr)
+		}
+		if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, test.left) {
+			t.Errorf("-limit %s: got UIDs %v left, want %v", test.limit, uids, test.left)
+		}
+		// the summary marks a mailbox partly scanned
+		if partial := strings.Contains(stdout, "partial"); partial != (test.limit != "6") {
+			t.Errorf("-limit %s: got stdout:\n%s", test.limit, stdout)
+		}
+	}
+}
+
+func TestRunMergeFlags(t *testing.T) {
+	s := imaptest.NewServer(t)
+	s.AppendMessages(t, "INBOX",
+		imaptest.Message{MessageID: "<a@example.org>"},
+		imaptest.Message{MessageID: "<a@example.org>", Flags: []string{`\Flagged`}},
+		imaptest.Message{MessageID: "<a@example.org>", Flags: []string{`\Seen`}},
+	)
+	code, stdout, stderr := runMain(t, nil, args(s, "clean", "-merge-flags")...)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1}) {
+		t.Errorf("got UIDs %v left", uids)
+	}
+	flags := s.Flags(t, "INBOX", 1)
+	sort.Strings(flags)
+	if !reflect.DeepEqual(flags, []string{`\Flagged`, `\Seen`}) {
+		t.Errorf("got flags %v on the kept copy", flags)
+	}
+	if !strings.Contains(stdout, "INBOX: gave 1 kept copies the flags of their duplicates") {
+		t.Errorf("got stdout:\n%s", stdout)
+	}
+}
+
+func TestRunScopeBySender(t *testing.T) {
+	for _, test := range []struct {
+		flags []string
+		left  []uint32
+	}{
+		{nil, []uint32{1}},
+		{[]string{"-scope-by-sender"}, []uint32{1, 2}},
+	} {
+		s := imaptest.NewServer(t)
+		s.AppendMessages(t, "INBOX",
+			imaptest.Message{From: "alerts@a.example.org", Subject: "Disk full"},
+			imaptest.Message{From: "alerts@b.example.org", Subject: "Disk full"},
+			imaptest.Message{From: "alerts@a.example.org", Subject: "Disk full"},
+			imaptest.Message{From: "alerts@b.example.org", Subject: "Disk full"},
+		)
+		flags := append([]string{"-key-template", "{{.Subject}}"}, test.flags...)
+		code, _, stderr := runMain(t, nil, args(s, "clean", flags...)...)
+		if code != 0 {
+			t.Fatalf("%q: exit code %d, stderr:\n%s", test.flags, code, stderr)
+		}
+		if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, test.left) {
+			t.Errorf("%q: got UIDs %v left, want %v", test.flags, uids, test.left)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// notifyAttempts is how often -notify-url is tried before the
+// notification is given up.
+const notifyAttempts = 3
+
+var (
+	// notifyBackoff is the wait after the first failed attempt, doubled
+	// after each further one.
+	notifyBackoff = time.Second
+	// notifyTimeout bounds each attempt, so that a dead webhook cannot
+	// hang the end of a run.
+	notifyTimeout = 10 * time.Second
+)
+
+// Notification is the JSON body posted to -notify-url at the end of a
+// run.
+type Notification struct {
+	// Text is a one-line summary of the run, shown as the message by
+	// Slack and Matrix incoming webhooks.
+	Text string `json:"text"`
+	// Version is the version of the tool sending the notification.
+	Version string `json:"version"`
+	Command string `json:"command"`
+	Server  string `json:"server"`
+	DryRun  bool   `json:"dry_run"`
+	// Mailboxes are the mailboxes processed, sorted by name.
+	Mailboxes []string `json:"mailboxes"`
+	// Scanned is the number of messages scanned in all mailboxes.
+	Scanned int `json:"scanned"`
+	Found   int `json:"found"`
+	Removed int `json:"removed"`
+	// ReclaimedBytes is the total size of the removed duplicates.
+	ReclaimedBytes  int64   `json:"reclaimed_bytes"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// Errors are the error which ended the run and those of the failed
+	// mailboxes, prefixed with the mailbox.
+	Errors   []string `json:"errors,omitempty"`
+	ExitCode int      `json:"exit_code"`
+	// Quota is the usage of the quota before and after the run, left
+	// out if the server has no QUOTA.
+	Quota []QuotaSummary `json:"quota,omitempty"`
+}
+
+// Notification returns the notification of the run on server exiting
+// with code after duration.
+func (s *Summary) Notification(server string, dryRun bool, code int, duration time.Duration) Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := Notification{
+		Version:         currentVersion().Version,
+		Command:         s.Parameters["command"],
+		Server:          server,
+		DryRun:          dryRun,
+		Mailboxes:       []string{},
+		DurationSeconds: duration.Round(time.Millisecond).Seconds(),
+		ExitCode:        code,
+		Quota:           s.quota,
+	}
+	if s.err != nil {
+		n.Errors = append(n.Errors, s.err.Error())
+	}
+	for _, r := range s.sorted() {
+		n.Mailboxes = append(n.Mailboxes, r.Mailbox)
+		n.Scanned += r.Scanned
+		n.Found += r.Found
+		n.Removed += r.Removed
+		n.ReclaimedBytes += r.Reclaimed
+		if r.Err != nil {
+			n.Errors = append(n.Errors, fmt.Sprintf("%s: %s", r.Mailbox, r.Err))
+		}
+	}
+	status := "ok"
+	if len(n.Errors) > 0 {
+		status = "failed"
+	}
+	n.Text = fmt.Sprintf("imap-clean-dup %s on %s: %d duplicates found in %d mailboxes, %d removed (%s), exit code %d, %s",
+		n.Command, server, n.Found, len(n.Mailboxes), n.Removed, byteSize(n.ReclaimedBytes), code, status)
+	return n
+}
+
+// Due reports whether the notification is sent with -notify-on when:
+// always, on changes if duplicates were found or anything failed, and
+// on errors only if anything failed.
+func (n Notification) Due(when string) bool {
+	failed := len(n.Errors) > 0 || (n.ExitCode != 0 && n.ExitCode != exitDuplicates)
+	switch when {
+	case "changes":
+		return n.Found > 0 || failed
+	case "errors":
+		return failed
+	}
+	return true
+}
+
+// notify posts n as JSON to url, trying up to notifyAttempts times and
+// waiting longer after each failure. Client errors other than 429 are
+// not retried.
+func notify(url string, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	wait := notifyBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := post(url, body)
+		if err == nil || !retry || attempt == notifyAttempts {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// post posts body to url once, reporting whether a failure is worth
+// retrying.
+func post(url string, body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("%s answered %s", url, resp.Status)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// webhook records the requests posted to it and answers them with the
+// status codes of statuses in turn, the last one once they run out.
+type webhook struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhook(t *testing.T, statuses ...int) *webhook {
+	w := &webhook{statuses: statuses}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.mu.Lock()
+		w.requests = append(w.requests, r)
+		w.bodies = append(w.bodies, body)
+		status := w.statuses[0]
+		if len(w.statuses) > 1 {
+			w.statuses = w.statuses[1:]
+		}
+		w.mu.Unlock()
+		rw.WriteHeader(status)
+	}))
+	t.Cleanup(w.Close)
+	return w
+}
+
+// posts returns the number of requests posted so far.
+func (w *webhook) posts() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.requests)
+}
+
+func TestRunNotify(t *testing.T) {
+	hook := newWebhook(t, http.StatusNoContent)
+	s := dupServer(t)
+	code, _, stderr := runMain(t, nil, args(s, "clean", "-notify-url", hook.URL+"/hook")...)
+	if code != 0 || hook.posts() != 1 {
+		t.Fatalf("exit code %d, %d posts, stderr:\n%s", code, hook.posts(), stderr)
+	}
+	r := hook.requests[0]
+	if r.Method != http.MethodPost || r.URL.Path != "/hook" || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %s %s, Content-Type %q", r.Method, r.URL, r.Header.Get("Content-Type"))
+	}
+
+	// the fields are those documented in the README, errors and quota
+	// left out as nothing failed and the server has no QUOTA
+	var fields map[string]interface{}
+	if err := json.Unmarshal(hook.bodies[0], &fields); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"command", "dry_run", "duration_seconds", "exit_code", "found", "mailboxes", "reclaimed_bytes", "removed", "scanned", "server", "text", "version"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got fields %v, want %v", names, want)
+	}
+
+	var n Notification
+	if err := json.Unmarshal(hook.bodies[0], &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Command != "clean" || n.Server != s.Host() || n.DryRun || !reflect.DeepEqual(n.Mailboxes, []string{"INBOX"}) ||
+		n.Scanned != 6 || n.Found != 3 || n.Removed != 3 || n.ReclaimedBytes != 335 || n.ExitCode != 0 || n.DurationSeconds <= 0 {
+		t.Errorf("got notification %+v", n)
+	}
+	if want := "imap-clean-dup clean on " + s.Host() + ": 3 duplicates found in 1 mailboxes, 3 removed (335 B), exit code 0, ok"; n.Text != want {
+		t.Errorf("got text %q, want %q", n.Text, want)
+	}
+}
+
+// TestRunNotifyOn checks which runs -notify-on posts, and that a
+// failed mailbox is in the errors.
+func TestRunNotifyOn(t *testing.T) {
+	for _, test := range []struct {
+		on     string
+		mbox   string
+		dups   bool
+		posted bool
+	}{
+		{"always", "INBOX", false, true},
+		{"changes", "INBOX", false, false},
+		{"changes", "INBOX", true, true},
+		{"errors", "INBOX", true, false},
+		{"errors", "Missing", false, true},
+	} {
+		hook := newWebhook(t, http.StatusOK)
+		s := dupServer(t)
+		if !test.dups {
+			s = imaptest.NewServer(t)
+			s.AppendMessages(t, "INBOX", imaptest.Message{MessageID: "<a@example.org>"})
+		}
+		runMain(t, nil, args(s, "scan", "-mbox", test.mbox, "-notify-url", hook.URL, "-notify-on", test.on)...)
+		if posted := hook.posts() == 1; posted != test.posted {
+			t.Errorf("-notify-on %s, %s, duplicates %t: posted %t", test.on, test.mbox, test.dups, posted)
+			continue
+		}
+		if !test.posted || test.mbox != "Missing" {
+			continue
+		}
+		var n Notification
+		if err := json.Unmarshal(hook.bodies[0], &n); err != nil {
+			t.Fatal(err)
+		}
+		if len(n.Errors) == 0 || !strings.HasPrefix(n.Errors[0], "Missing: ") || n.ExitCode != 1 || !strings.HasSuffix(n.Text, "exit code 1, failed") {
+			t.Errorf("-notify-on %s: got notification %+v", test.on, n)
+		}
+	}
+}
+
+// TestNotifyRetry checks that failed posts are retried with backoff,
+// except for client errors, and that a webhook not answering is given
+// up after the timeout.
+func TestNotifyRetry(t *testing.T) {
+	oldBackoff, oldTimeout := notifyBackoff, notifyTimeout
+	notifyBackoff, notifyTimeout = 10*time.Millisecond, 200*time.Millisecond
+	defer func() { notifyBackoff, notifyTimeout = oldBackoff, oldTimeout }()
+
+	for _, test := range []struct {
+		statuses []int
+		posts    int
+		err      string
+	}{
+		{[]int{http.StatusOK}, 1, ""},
+		{[]int{http.StatusBadGateway, http.StatusTooManyRequests, http.StatusOK}, 3, ""},
+		{[]int{http.StatusServiceUnavailable}, 3, "answered 503 Service Unavailable"},
+		{[]int{http.StatusNotFound, http.StatusOK}, 1, "answered 404 Not Found"},
+	} {
+		hook := newWebhook(t, test.statuses...)
+		err := notify(hook.URL, Notification{Text: "test"})
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%v: got error %v, want %q", test.statuses, err, test.err)
+		}
+		if hook.posts() != test.posts {
+			t.Errorf("%v: posted %d times, want %d", test.statuses, hook.posts(), test.posts)
+		}
+	}
+
+	hang := make(chan struct{})
+	dead := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer dead.Close()
+	defer close(hang)
+	start := time.Now()
+	err := notify(dead.URL, Notification{Text: "test"})
+	// three attempts and the waits between them
+	if took := time.Since(start); err == nil || took > 2*time.Second {
+		t.Errorf("dead webhook: got error %v after %s", err, took)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauth2Credentials are the contents of an -oauth2-credentials file, the
+// fields of Google's and Microsoft's client secrets plus a refresh token.
+type oauth2Credentials struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+	TokenURL     string `json:"token_url"`
+}
+
+// oauth2Expiry is how long before it expires an access token is
+// refreshed, so that it does not expire during a login.
+const oauth2Expiry = time.Minute
+
+// oauth2Tokens hands out access tokens for XOAUTH2, refreshing them with
+// the refresh token of its credentials as they expire. Access tokens are
+// only kept in memory for the run, a rotated refresh token is written
+// back to the credentials file at path.
+type oauth2Tokens struct {
+	creds  oauth2Credentials
+	path   string
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// loadOAuth2Credentials reads the credentials file at path, warning on
+// stderr if it is readable by group or others.
+func loadOAuth2Credentials(path string) (*oauth2Tokens, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var creds oauth2Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var missing []string
+	for _, f := range []struct{ name, value string }{
+		{"client_id", creds.ClientID},
+		{"refresh_token", creds.RefreshToken},
+		{"token_url", creds.TokenURL},
+	} {
+		if f.value == "" {
+			missing = append(missing, f.name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s: missing %s", path, strings.Join(missing, ", "))
+	}
+	if u, err := url.Parse(creds.TokenURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("%s: token_url %q is not an http(s) URL", path, creds.TokenURL)
+	}
+	if runtime.GOOS != "windows" {
+		if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0077 != 0 {
+			fmt.Fprintf(os.Stderr, "warning: %s contains a refresh token but is readable by others (mode %s), run chmod 600 %s\n", path, fi.Mode().Perm(), path)
+		}
+	}
+	return &oauth2Tokens{creds: creds, path: path, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// saveRefreshToken replaces the refresh token in the credentials file at
+// path by token, keeping its other fields and its mode. The file is
+// replaced by a new one, so that a failed write leaves the old file.
+func saveRefreshToken(path, token string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if fields["refresh_token"], err = json.Marshal(token); err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(fi.Mode().Perm()); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// tokenResponse is the answer of a token endpoint (RFC 6749 5.1, 5.2).
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Token returns an access token, refreshing it first if there is none
+// yet or it is about to expire.
+func (t *oauth2Tokens) Token(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && (t.expiry.IsZero() || time.Now().Add(oauth2Expiry).Before(t.expiry)) {
+		return t.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.creds.RefreshToken},
+		"client_id":     {t.creds.ClientID},
+	}
+	if t.creds.ClientSecret != "" {
+		form.Set("client_secret", t.creds.ClientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, t.creds.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("refreshing the OAuth2 token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("refreshing the OAuth2 token: %v", err)
+	}
+	var tr tokenResponse
+	jsonErr := json.Unmarshal(body, &tr)
+	switch {
+	case tr.Error != "":
+		msg := tr.Error
+		if tr.ErrorDescription != "" {
+			msg += ": " + tr.ErrorDescription
+		}
+		return "", fmt.Errorf("refreshing the OAuth2 token: %s answered %s", t.creds.TokenURL, msg)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("refreshing the OAuth2 token: %s answered %s", t.creds.TokenURL, resp.Status)
+	case jsonErr != nil:
+		return "", fmt.Errorf("refreshing the OAuth2 token: %s: %v", t.creds.TokenURL, jsonErr)
+	case tr.AccessToken == "":
+		return "", errors.New("refreshing the OAuth2 token: no access_token in the answer")
+	}
+	t.token = tr.AccessToken
+	t.expiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		t.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	// Some providers rotate refresh tokens and revoke the old one
+	// sooner or later, so the new one is saved for the next run.
+	if tr.RefreshToken != "" && tr.RefreshToken != t.creds.RefreshToken {
+		t.creds.RefreshToken = tr.RefreshToken
+		if err := saveRefreshToken(t.path, tr.RefreshToken); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: cannot save the new refresh token to %s, the next run may fail to log in: %v\n", t.path, err)
+		}
+	}
+	return t.token, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenEndpoint records the forms posted to it and answers them with
+// the status codes and bodies of answers in turn, the last one once
+// they run out.
+type tokenEndpoint struct {
+	*httptest.Server
+	mu      sync.Mutex
+	answers []tokenAnswer
+	forms   []url.Values
+}
+
+type tokenAnswer struct {
+	status int
+	body   string
+}
+
+func newTokenEndpoint(t *testing.T, answers ...tokenAnswer) *tokenEndpoint {
+	e := &tokenEndpoint{answers: answers}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		e.mu.Lock()
+		e.forms = append(e.forms, r.PostForm)
+		a := e.answers[0]
+		if len(e.answers) > 1 {
+			e.answers = e.answers[1:]
+		}
+		e.mu.Unlock()
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(a.status)
+		rw.Write([]byte(a.body))
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+// refreshes returns the number of refreshes requested so far.
+func (e *tokenEndpoint) refreshes() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.forms)
+}
+
+// oauth2File writes a credentials file for the token endpoint at
+// tokenURL and loads it.
+func oauth2File(t *testing.T, tokenURL string) (string, *oauth2Tokens) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "oauth2.json")
+	creds := `{"client_id": "id", "client_secret": "secret", "refresh_token": "r1", "token_url": "` + tokenURL + `", "note": "work account"}`
+	if err := os.WriteFile(path, []byte(creds), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := loadOAuth2Credentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, tokens
+}
+
+func TestOAuth2Refresh(t *testing.T) {
+	e := newTokenEndpoint(t, tokenAnswer{http.StatusOK, `{"access_token": "a1", "token_type": "Bearer", "expires_in": 3600}`})
+	_, tokens := oauth2File(t, e.URL)
+	token, err := tokens.Token(context.Background())
+	if err != nil || token != "a1" {
+		t.Fatalf("got token %q, error %v", token, err)
+	}
+	want := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"r1"}, "client_id": {"id"}, "client_secret": {"secret"}}
+	if e.refreshes() != 1 || e.forms[0].Encode() != want.Encode() {
+		t.Errorf("got forms %v", e.forms)
+	}
+}
+
+func TestOAuth2RefreshError(t *testing.T) {
+	for _, test := range []struct {
+		answer tokenAnswer
+		want   string
+	}{
+		{tokenAnswer{http.StatusBadRequest, `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`}, "answered invalid_grant: Token has been expired or revoked."},
+		{tokenAnswer{http.StatusUnauthorized, `{"error": "invalid_client"}`}, "answered invalid_client"},
+		{tokenAnswer{http.StatusBadGateway, `<html>Bad Gateway</html>`}, "answered 502 Bad Gateway"},
+		{tokenAnswer{http.StatusOK, `{"token_type": "Bearer"}`}, "no access_token"},
+	} {
+		e := newTokenEndpoint(t, test.answer)
+		_, tokens := oauth2File(t, e.URL)
+		token, err := tokens.Token(context.Background())
+		if err == nil || !strings.Contains(err.Error(), test.want) || token != "" {
+			t.Errorf("%s: got token %q, error %v", test.answer.body, token, err)
+		}
+	}
+}
+
+// TestOAuth2Expiry checks that an access token is reused until it is
+// about to expire and refreshed then.
+func TestOAuth2Expiry(t *testing.T) {
+	e := newTokenEndpoint(t,
+		tokenAnswer{http.StatusOK, `{"access_token": "a1", "expires_in": 3600}`},
+		tokenAnswer{http.StatusOK, `{"access_token": "a2", "expires_in": 30}`},
+		tokenAnswer{http.StatusOK, `{"access_token": "a3", "expires_in": 3600}`},
+	)
+	_, tokens := oauth2File(t, e.URL)
+	ctx := context.Background()
+	for i, want := range []string{"a1", "a1"} {
+		if token, err := tokens.Token(ctx); err != nil || token != want {
+			t.Fatalf("token %d: got %q, error %v, want %q", i, token, err, want)
+		}
+	}
+	if e.refreshes() != 1 {
+		t.Fatalf("got %d refreshes before expiry, want 1", e.refreshes())
+	}
+
+	tokens.expiry = time.Now().Add(-time.Second)
+	// a2 expires within oauth2Expiry and is refreshed right away
+	for i, want := range []string{"a2", "a3", "a3"} {
+		if token, err := tokens.Token(ctx); err != nil || token != want {
+			t.Fatalf("token %d after expiry: got %q, error %v, want %q", i, token, err, want)
+		}
+	}
+	if e.refreshes() != 3 {
+		t.Errorf("got %d refreshes, want 3", e.refreshes())
+	}
+}
+
+// TestOAuth2RotatedRefreshToken checks that a refresh token the
+// provider rotates is used for the next refresh and saved to the
+// credentials file, keeping its other fields and mode.
+func TestOAuth2RotatedRefreshToken(t *testing.T) {
+	e := newTokenEndpoint(t,
+		tokenAnswer{http.StatusOK, `{"access_token": "a1", "expires_in": 3600, "refresh_token": "r2"}`},
+		tokenAnswer{http.StatusOK, `{"access_token": "a2", "expires_in": 3600}`},
+	)
+	path, tokens := oauth2File(t, e.URL)
+	ctx := context.Background()
+	if _, err := tokens.Token(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tokens.expiry = time.Now().Add(-time.Second)
+	if _, err := tokens.Token(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.forms[1].Get("refresh_token"); got != "r2" {
+		t.Errorf("refreshed with %q, want r2", got)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]string
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved["refresh_token"] != "r2" || saved["client_id"] != "id" || saved["token_url"] != e.URL || saved["note"] != "work account" {
+		t.Errorf("got credentials file %s", data)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("got credentials file mode %v, want 0600", fi.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("got %d files next to the credentials, want none", len(entries)-1)
+	}
+
+	// a run started now uses the rotated token
+	reloaded, err := loadOAuth2Credentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.creds.RefreshToken != "r2" {
+		t.Errorf("reloaded refresh token %q, want r2", reloaded.creds.RefreshToken)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// mailboxCounts are the counts of a mailbox as returned by STATUS.
+type mailboxCounts struct {
+	Name     string `json:"name"`
+	Messages uint32 `json:"messages"`
+	Unseen   uint32 `json:"unseen"`
+	UidNext  uint32 `json:"uid_next"`
+	// Err is set if STATUS failed for the mailbox.
+	Err error `json:"-"`
+	// Error is the text of Err for the JSON overview.
+	Error string `json:"error,omitempty"`
+}
+
+// mailboxOverview returns the counts of each of names, asking with
+// STATUS rather than selecting them, which is far quicker on accounts
+// with many mailboxes. A mailbox STATUS fails for has Err set, the
+// others are still asked.
+func mailboxOverview(c *client.Client, names []string) []mailboxCounts {
+	items := []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen, imap.StatusUidNext}
+	counts := make([]mailboxCounts, len(names))
+	for i, name := range names {
+		counts[i].Name = name
+		st, err := c.Status(name, items)
+		if err != nil {
+			counts[i].Err = err
+			counts[i].Error = err.Error()
+			continue
+		}
+		counts[i].Messages, counts[i].Unseen, counts[i].UidNext = st.Messages, st.Unseen, st.UidNext
+	}
+	return counts
+}
+
+// printOverview writes counts to w in the given format, a table for
+// text or an array for json.
+func printOverview(w io.Writer, counts []mailboxCounts, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(counts)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "mailbox\tmessages\tunseen\tuid next")
+	for _, m := range counts {
+		if m.Err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t%s\n", m.Name, m.Err)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", m.Name, m.Messages, m.Unseen, m.UidNext)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// Plan holds the duplicates found by scan -plan, to be reviewed and
+// removed later by apply. Its UIDs only mean something on the server
+// and for the user they were scanned on, and apply leaves a mailbox
+// alone whose UIDVALIDITY changed since.
+type Plan struct {
+	// Version is the version of the tool writing the plan.
+	Version     string      `json:"version"`
+	HashVersion int         `json:"hash_version"`
+	Server      string      `json:"server"`
+	Username    string      `json:"username"`
+	Created     time.Time   `json:"created"`
+	Groups      []PlanGroup `json:"groups"`
+}
+
+// PlanGroup is a dedup.Group of a Plan.
+type PlanGroup struct {
+	Mailbox       string   `json:"mailbox"`
+	UIDValidity   uint32   `json:"uid_validity"`
+	Key           string   `json:"key,omitempty"`
+	Strategy      string   `json:"strategy,omitempty"`
+	Sender        string   `json:"sender,omitempty"`
+	Keeper        uint32   `json:"keeper"`
+	KeeperMailbox string   `json:"keeper_mailbox,omitempty"`
+	Duplicates    []uint32 `json:"duplicates"`
+	// Envelopes are checked by apply before removing anything, by UID.
+	Envelopes map[uint32]PlanEnvelope `json:"envelopes,omitempty"`
+}
+
+// PlanEnvelope is a dedup.Envelope of a PlanGroup.
+type PlanEnvelope struct {
+	MessageID string `json:"message_id"`
+	Subject   string `json:"subject"`
+}
+
+// newPlan returns an empty plan of the duplicates of username on server.
+func newPlan(server, username string) *Plan {
+	return &Plan{
+		Version:     currentVersion().Version,
+		HashVersion: dedup.HashVersion,
+		Server:      server,
+		Username:    username,
+		Created:     time.Now().UTC(),
+		Groups:      []PlanGroup{},
+	}
+}
+
+// add adds groups to the plan.
+func (p *Plan) add(groups []dedup.Group) {
+	for _, g := range groups {
+		pg := PlanGroup{
+			Mailbox:       g.Mailbox,
+			UIDValidity:   g.UIDValidity,
+			Key:           g.Key,
+			Strategy:      string(g.Strategy),
+			Sender:        g.Sender,
+			Keeper:        g.Keeper,
+			KeeperMailbox: g.KeeperMailbox,
+			Duplicates:    g.Duplicates,
+		}
+		if g.Envelopes != nil {
+			pg.Envelopes = make(map[uint32]PlanEnvelope, len(g.Envelopes))
+			for uid, env := range g.Envelopes {
+				pg.Envelopes[uid] = PlanEnvelope{MessageID: env.MessageID, Subject: env.Subject}
+			}
+		}
+		p.Groups = append(p.Groups, pg)
+	}
+}
+
+// Count returns the number of duplicates in the plan.
+func (p *Plan) Count() int {
+	n := 0
+	for _, g := range p.Groups {
+		n += len(g.Duplicates)
+	}
+	return n
+}
+
+// Mailboxes returns the mailboxes of the groups in the order they first
+// appear.
+func (p *Plan) Mailboxes() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, g := range p.Groups {
+		if !seen[g.Mailbox] {
+			seen[g.Mailbox] = true
+			names = append(names, g.Mailbox)
+		}
+	}
+	return names
+}
+
+// groups returns the groups of mbox for dedup.Apply.
+func (p *Plan) groups(mbox string) []dedup.Group {
+	var groups []dedup.Group
+	for _, pg := range p.Groups {
+		if pg.Mailbox != mbox {
+			continue
+		}
+		g := dedup.Group{
+			Mailbox:       pg.Mailbox,
+			Key:           pg.Key,
+			HashVersion:   p.HashVersion,
+			Keeper:        pg.Keeper,
+			KeeperMailbox: pg.KeeperMailbox,
+			Duplicates:    pg.Duplicates,
+			UIDValidity:   pg.UIDValidity,
+			Strategy:      dedup.Strategy(pg.Strategy),
+			Sender:        pg.Sender,
+		}
+		if pg.Envelopes != nil {
+			g.Envelopes = make(map[uint32]dedup.Envelope, len(pg.Envelopes))
+			for uid, env := range pg.Envelopes {
+				g.Envelopes[uid] = dedup.Envelope{MessageID: env.MessageID, Subject: env.Subject}
+			}
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// write writes the plan to path as indented JSON.
+func (p *Plan) write(path string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// readPlan reads the plan written to path. Groups without a mailbox,
+// keeper or duplicates, or whose keeper is among its duplicates, are
+// errors rather than left to apply.
+func readPlan(path string) (*Plan, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Plan
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	for i, g := range p.Groups {
+		if g.Mailbox == "" || g.Keeper == 0 || len(g.Duplicates) == 0 {
+			return nil, fmt.Errorf("group %d needs a mailbox, keeper and duplicates", i+1)
+		}
+		for _, uid := range g.Duplicates {
+			if uid == 0 || (uid == g.Keeper && g.KeeperMailbox == "") {
+				return nil, fmt.Errorf("group %d: invalid duplicate UID %d", i+1, uid)
+			}
+		}
+	}
+	return &p, nil
+}
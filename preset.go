@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// presets maps each preset to the flag values it sets. Presets only
+// provide defaults, flags given on the command line take precedence.
+var presets = map[string]map[string]string{
+	// exact only removes messages whose Message-ID or envelope and
+	// body match.
+	"exact": {
+		"strategy": string(dedup.StrategyTiered),
+	},
+	// aggressive matches on a reduced envelope even if Message-IDs
+	// differ.
+	"aggressive": {
+		"ignore-message-id": "true",
+		"ignore-sender":     "true",
+		"ignore-reply-to":   "true",
+		"ignore-bcc":        "true",
+		"normalize-subject": "true",
+	},
+	// newsletters matches issues of a mailing list by List-Id, sender
+	// and subject sent on the same day, whatever the recipients.
+	"newsletters": {
+		"ignore-message-id": "true",
+		"ignore-sender":     "true",
+		"ignore-reply-to":   "true",
+		"ignore-to":         "true",
+		"ignore-cc":         "true",
+		"ignore-bcc":        "true",
+		"normalize-subject": "true",
+		"date-window":       "24h",
+		"list-id":           "true",
+	},
+}
+
+// applyPreset sets the flags of the named preset which were not given
+// explicitly. An empty name applies nothing.
+func applyPreset(name string) error {
+	if name == "" {
+		return nil
+	}
+	values, ok := presets[name]
+	if !ok {
+		var names []string
+		for n := range presets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown preset %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for f, v := range values {
+		if set[f] {
+			continue
+		}
+		if err := flag.Set(f, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// QuotaSummary is the usage of a resource of a quota root before and
+// after the run. STORAGE is counted in units of 1024 octets.
+type QuotaSummary struct {
+	Root     string `json:"root"`
+	Resource string `json:"resource"`
+	Limit    int64  `json:"limit"`
+	Before   int64  `json:"before"`
+	After    int64  `json:"after"`
+	// Delta is After less Before, negative if the run freed some.
+	Delta int64 `json:"delta"`
+}
+
+// quotaSummary pairs the resources of the quota roots before and after
+// the run. Resources missing from either are left out.
+func quotaSummary(before, after []dedup.Quota) []QuotaSummary {
+	type resource struct{ root, name string }
+	usage := make(map[resource]int64)
+	for _, q := range before {
+		for _, r := range q.Resources {
+			usage[resource{q.Root, r.Name}] = r.Usage
+		}
+	}
+	var qs []QuotaSummary
+	for _, q := range after {
+		for _, r := range q.Resources {
+			b, ok := usage[resource{q.Root, r.Name}]
+			if !ok {
+				continue
+			}
+			qs = append(qs, QuotaSummary{Root: q.Root, Resource: r.Name, Limit: r.Limit, Before: b, After: r.Usage, Delta: r.Usage - b})
+		}
+	}
+	return qs
+}
+
+// printQuota writes a line per resource of qs to w, e.g.
+//
+//	quota "" STORAGE: 9.5 GiB of 10.0 GiB used, 120.0 MiB freed
+func printQuota(w io.Writer, qs []QuotaSummary) {
+	for _, q := range qs {
+		amount := func(n int64) string { return fmt.Sprint(n) }
+		if q.Resource == "STORAGE" {
+			amount = func(n int64) string { return byteSize(n * 1024) }
+		}
+		change := "unchanged"
+		if q.Delta < 0 {
+			change = amount(-q.Delta) + " freed"
+		} else if q.Delta > 0 {
+			change = amount(q.Delta) + " more"
+		}
+		fmt.Fprintf(w, "quota %q %s: %s of %s used, %s\n", q.Root, q.Resource, amount(q.After), amount(q.Limit), change)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// MailboxReport describes a mailbox as returned by SELECT.
+type MailboxReport struct {
+	// Version is the version of the tool writing the report.
+	Version string `json:"version"`
+	// HashVersion is the scheme of the envelope hash keys in listings.
+	HashVersion    int      `json:"hash_version"`
+	Name           string   `json:"name"`
+	ReadOnly       bool     `json:"read_only"`
+	Messages       uint32   `json:"messages"`
+	UidValidity    uint32   `json:"uid_validity"`
+	UidNext        uint32   `json:"uid_next"`
+	Flags          []string `json:"flags"`
+	PermanentFlags []string `json:"permanent_flags"`
+	// CustomKeywords is set if the server persists new keywords.
+	CustomKeywords bool `json:"custom_keywords"`
+}
+
+// NewMailboxReport builds the report of a selected mailbox.
+func NewMailboxReport(st *imap.MailboxStatus) MailboxReport {
+	r := MailboxReport{
+		Version:        currentVersion().Version,
+		HashVersion:    dedup.HashVersion,
+		Name:           st.Name,
+		ReadOnly:       st.ReadOnly,
+		Messages:       st.Messages,
+		UidValidity:    st.UidValidity,
+		UidNext:        st.UidNext,
+		Flags:          st.Flags,
+		PermanentFlags: st.PermanentFlags,
+	}
+	for _, f := range st.PermanentFlags {
+		if f == imap.TryCreateFlag {
+			r.CustomKeywords = true
+		}
+	}
+	return r
+}
+
+// Print writes the report to w in the given format, text or json.
+func (r MailboxReport) Print(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	keywords := "no"
+	if r.CustomKeywords {
+		keywords = "yes"
+	}
+	_, err := fmt.Fprintf(w, "mailbox %s\n  read only: %t\n  messages: %d\n  uid validity: %d\n  uid next: %d\n  flags: %s\n  permanent flags: %s\n  custom keywords: %s\n",
+		r.Name, r.ReadOnly, r.Messages, r.UidValidity, r.UidNext,
+		strings.Join(r.Flags, " "), strings.Join(r.PermanentFlags, " "), keywords)
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// specialUseRoles maps the roles accepted by -keep-role, in lower case,
+// to the SPECIAL-USE attribute (RFC 6154) marking their mailbox. \Inbox
+// is not part of SPECIAL-USE but sent by Gmail; without it INBOX itself
+// has the role.
+var specialUseRoles = map[string]string{
+	"all":       `\All`,
+	"archive":   `\Archive`,
+	"drafts":    `\Drafts`,
+	"flagged":   `\Flagged`,
+	"important": `\Important`,
+	"inbox":     `\Inbox`,
+	"junk":      `\Junk`,
+	"sent":      `\Sent`,
+	"trash":     `\Trash`,
+}
+
+// roleNames returns the roles accepted by -keep-role, sorted.
+func roleNames() []string {
+	names := make([]string, 0, len(specialUseRoles))
+	for name := range specialUseRoles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// roleMailbox returns the name of the selectable mailbox LIST marks
+// with the attribute of role, INBOX for the inbox role if none is
+// marked. It fails if no mailbox or more than one has the role, since
+// names vary by provider and guessing could keep the wrong copies.
+func roleMailbox(c *client.Client, role string) (string, error) {
+	attr := specialUseRoles[strings.ToLower(role)]
+	ch := make(chan *imap.MailboxInfo, 100)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.List("", "*", ch)
+	}()
+
+	var found []string
+	inbox := ""
+	for info := range ch {
+		selectable, marked := true, false
+		for _, a := range info.Attributes {
+			if a == imap.NoSelectAttr {
+				selectable = false
+			}
+			if strings.EqualFold(a, attr) {
+				marked = true
+			}
+		}
+		if !selectable {
+			continue
+		}
+		if marked {
+			found = append(found, info.Name)
+		}
+		if strings.EqualFold(info.Name, "INBOX") {
+			inbox = info.Name
+		}
+	}
+	if err := <-errChan; err != nil {
+		return "", err
+	}
+	if len(found) == 0 && attr == `\Inbox` && inbox != "" {
+		return inbox, nil
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no mailbox has the special-use role %s", attr)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("several mailboxes have the special-use role %s: %s", attr, strings.Join(found, ", "))
+}
+
+// draftsNames are the names, in lower case, taken for the drafts
+// mailbox on servers without SPECIAL-USE.
+var draftsNames = []string{"drafts", "draft"}
+
+// draftsMailboxes returns the selectable mailboxes holding drafts: those
+// LIST marks \Drafts or, if none is marked, those whose last name
+// component is one of draftsNames, e.g. INBOX.Drafts.
+func draftsMailboxes(c *client.Client) (map[string]bool, error) {
+	ch := make(chan *imap.MailboxInfo, 100)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.List("", "*", ch)
+	}()
+
+	marked, named := make(map[string]bool), make(map[string]bool)
+	for info := range ch {
+		selectable := true
+		for _, a := range info.Attributes {
+			if a == imap.NoSelectAttr {
+				selectable = false
+			}
+			if strings.EqualFold(a, specialUseRoles["drafts"]) {
+				marked[info.Name] = true
+			}
+		}
+		if !selectable {
+			delete(marked, info.Name)
+			continue
+		}
+		last := info.Name
+		if info.Delimiter != "" {
+			parts := strings.Split(info.Name, info.Delimiter)
+			last = parts[len(parts)-1]
+		}
+		if contains(draftsNames, strings.ToLower(last)) {
+			named[info.Name] = true
+		}
+	}
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+	if len(marked) > 0 {
+		return marked, nil
+	}
+	return named, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// gmailList is the LIST response of a Gmail account, whose mailboxes
+// are marked with SPECIAL-USE attributes.
+const gmailList = `* LIST (\HasNoChildren) "/" "INBOX"` + "\r\n" +
+	`* LIST (\HasChildren \Noselect) "/" "[Gmail]"` + "\r\n" +
+	`* LIST (\All \HasNoChildren) "/" "[Gmail]/All Mail"` + "\r\n" +
+	`* LIST (\Drafts \HasNoChildren) "/" "[Gmail]/Drafts"` + "\r\n" +
+	`* LIST (\HasNoChildren \Important) "/" "[Gmail]/Important"` + "\r\n" +
+	`* LIST (\HasNoChildren \Sent) "/" "[Gmail]/Sent Mail"` + "\r\n" +
+	`* LIST (\HasNoChildren \Junk) "/" "[Gmail]/Spam"` + "\r\n" +
+	`* LIST (\Flagged \HasNoChildren) "/" "[Gmail]/Starred"` + "\r\n" +
+	`* LIST (\HasNoChildren \Trash) "/" "[Gmail]/Trash"` + "\r\n" +
+	`* LIST (\HasNoChildren) "/" "Receipts"` + "\r\n" +
+	"OK LIST completed"
+
+// listClient returns a session logged in to a server answering LIST
+// with list.
+func listClient(t *testing.T, list string) *client.Client {
+	t.Helper()
+	srv := newScriptedServer(t, "[CAPABILITY IMAP4rev1 SPECIAL-USE] ready", map[string]string{"LIST": list})
+	c, err := client.Dial(srv.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	if err := c.Login("user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRoleMailbox(t *testing.T) {
+	for _, test := range []struct {
+		name, list, role string
+		want, err        string
+	}{
+		{"Gmail", gmailList, "all", "[Gmail]/All Mail", ""},
+		{"Gmail", gmailList, "Sent", "[Gmail]/Sent Mail", ""},
+		{"Gmail", gmailList, "important", "[Gmail]/Important", ""},
+		// Gmail does not mark INBOX \Inbox
+		{"Gmail", gmailList, "inbox", "INBOX", ""},
+		{"Gmail", gmailList, "archive", "", `no mailbox has the special-use role \Archive`},
+		{
+			"marked inbox",
+			`* LIST (\Inbox) "." "Posteingang"` + "\r\n" + `* LIST () "." "INBOX"` + "\r\nOK LIST completed",
+			"INBOX", "Posteingang", "",
+		},
+		{
+			"two archives",
+			`* LIST (\Archive) "." "Archive"` + "\r\n" + `* LIST (\Archive) "." "INBOX.Archive"` + "\r\nOK LIST completed",
+			"archive", "", `several mailboxes have the special-use role \Archive: Archive, INBOX.Archive`,
+		},
+		{
+			"archive not selectable",
+			`* LIST (\Archive \Noselect) "." "Archive"` + "\r\n" + `* LIST (\Archive) "." "Archive.2024"` + "\r\nOK LIST completed",
+			"archive", "Archive.2024", "",
+		},
+		{"LIST failing", "NO LIST failed", "all", "", "LIST failed"},
+	} {
+		got, err := roleMailbox(listClient(t, test.list), test.role)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s, role %s: got %q, error %v, want %q", test.name, test.role, got, err, test.err)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf("%s, role %s: got %q, error %v, want %q", test.name, test.role, got, err, test.want)
+		}
+	}
+}
+
+func TestDraftsMailboxes(t *testing.T) {
+	for _, test := range []struct {
+		name, list string
+		want       map[string]bool
+	}{
+		{"Gmail", gmailList, map[string]bool{"[Gmail]/Drafts": true}},
+		{
+			"without SPECIAL-USE",
+			`* LIST () "." "INBOX"` + "\r\n" + `* LIST () "." "INBOX.Drafts"` + "\r\n" + `* LIST () "." "Draft"` + "\r\n" + `* LIST (\Noselect) "." "Drafts"` + "\r\n" + `* LIST () "." "Drafts.Old"` + "\r\nOK LIST completed",
+			map[string]bool{"INBOX.Drafts": true, "Draft": true},
+		},
+		{
+			"marked over named",
+			`* LIST () "/" "Drafts"` + "\r\n" + `* LIST (\Drafts) "/" "Entw&APw-rfe"` + "\r\nOK LIST completed",
+			map[string]bool{"Entwürfe": true},
+		},
+	} {
+		got, err := draftsMailboxes(listClient(t, test.list))
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, error %v, want %v", test.name, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+	"github.com/tomasvitek/imap-clean-dup/seed"
+)
+
+// seedConnectionFlags are the flags of flag.CommandLine the seed command
+// accepts besides its own.
+var seedConnectionFlags = []string{"server", "port", "tls", "starttls", "tls-min-version", "tls-max-version", "compress", "username", "password", "debug-imap", "mbox"}
+
+// styleNames returns the names of the styles of package seed.
+func styleNames() []string {
+	names := make([]string, len(seed.Styles))
+	for i, s := range seed.Styles {
+		names[i] = string(s)
+	}
+	return names
+}
+
+// runSeed runs the seed command with args, appending messages generated
+// by package seed to -mbox, which is created if it does not exist. It
+// is left out of the usage, being meant for trying out and testing the
+// tool rather than for mailboxes in use: it refuses to append to a
+// mailbox which has messages unless -force is given.
+func runSeed(args []string) int {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	for _, name := range seedConnectionFlags {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	messages := fs.Int("messages", 100, "Number of messages, duplicates included")
+	ratio := fs.Float64("duplicate-ratio", 0.2, "Share of the messages which are duplicates, at most 0.5")
+	styles := fs.String("styles", strings.Join(styleNames(), ","), "Comma-separated styles of duplicates, used in turn: "+alternatives(styleNames()))
+	minSize := fs.Int("min-size", 1024, "Smallest body in bytes")
+	maxSize := fs.Int("max-size", 4096, "Largest body in bytes")
+	senders := fs.Int("senders", 5, "Number of distinct senders")
+	random := fs.Int64("seed", 1, "Seed of the random choices, the same seed yields the same messages")
+	force := fs.Bool("force", false, "If present, messages are also appended to a mailbox which is not empty")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s seed [flags]\n\nAppend synthetic messages with duplicates to an empty -mbox, to try out the tool.\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return exitUsage
+	}
+
+	value := func(name string) string { return flag.Lookup(name).Value.String() }
+	server, username, password, mbox := value("server"), value("username"), value("password"), value("mbox")
+	useTLS, _ := strconv.ParseBool(value("tls"))
+	useStartTLS, _ := strconv.ParseBool(value("starttls"))
+	debugIMAP, _ := strconv.ParseBool(value("debug-imap"))
+	port, _ := strconv.Atoi(value("port"))
+	tlsMin, tlsMax := value("tls-min-version"), value("tls-max-version")
+	compress := value("compress")
+
+	var p problems
+	p.check(server != "", "-server is required")
+	p.check(username != "", "-username is required")
+	p.check(password != "", "-password is required")
+	p.check(mbox != "", "-mbox is required")
+	p.check(*messages > 0, "-messages must be positive")
+	p.check(*ratio >= 0 && *ratio <= 0.5, "-duplicate-ratio must be between 0 and 0.5, not %g", *ratio)
+	p.check(*minSize >= 0 && *minSize <= *maxSize, "-min-size must be between 0 and -max-size")
+	p.check(*senders > 0, "-senders must be positive")
+	var cfgStyles []seed.Style
+	for _, name := range strings.Split(*styles, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			p.oneOf("styles", name, styleNames()...)
+			cfgStyles = append(cfgStyles, seed.Style(name))
+		}
+	}
+	p.check(len(cfgStyles) > 0, "-styles must name at least one style")
+	p.oneOf("compress", compress, flagValues("compress")...)
+	p.oneOf("tls-min-version", tlsMin, flagValues("tls-min-version")...)
+	if tlsMax != "" {
+		p.oneOf("tls-max-version", tlsMax, flagValues("tls-max-version")...)
+	}
+	if len(p) > 0 {
+		p.print(os.Stderr, "seed")
+		return exitUsage
+	}
+	if useStartTLS {
+		useTLS = false
+	}
+	if port == 0 {
+		port = 143
+		if useTLS {
+			port = 993
+		}
+	}
+
+	ctx := context.Background()
+	tlsConfig := &tls.Config{ServerName: server, MinVersion: tlsVersions[tlsMin], MaxVersion: tlsVersions[tlsMax]}
+	c, err := connect(ctx, dedup.NewMetrics(), server, port, useTLS, useStartTLS, tlsConfig, username, password, nil, nil, compress == "auto", debugTrace(debugIMAP, os.Stderr))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+	defer c.Logout()
+
+	st, err := c.Status(mbox, []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		if err := c.Create(mbox); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot create %s: %s\n", mbox, err)
+			return 1
+		}
+		fmt.Printf("created %s\n", mbox)
+	} else if st.Messages > 0 && !*force {
+		fmt.Fprintf(os.Stderr, "%s has %d messages, seed only appends to an empty mailbox unless -force is given\n", mbox, st.Messages)
+		return 1
+	}
+
+	msgs := seed.Generate(seed.Config{
+		Messages:       *messages,
+		DuplicateRatio: *ratio,
+		Styles:         cfgStyles,
+		MinSize:        *minSize,
+		MaxSize:        *maxSize,
+		Senders:        *senders,
+		Seed:           *random,
+	})
+	counts := make(map[seed.Style]int)
+	for i, msg := range msgs {
+		if err := c.Append(mbox, nil, msg.Date, bytes.NewBuffer(msg.Raw)); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot append message %d of %d: %s\n", i+1, len(msgs), err)
+			return 1
+		}
+		if msg.Style != "" {
+			counts[msg.Style]++
+		}
+	}
+	var dups []string
+	n := 0
+	for _, s := range seed.Styles {
+		if counts[s] > 0 {
+			dups = append(dups, fmt.Sprintf("%d %s", counts[s], s))
+			n += counts[s]
+		}
+	}
+	fmt.Printf("appended %d messages to %s, %d of them duplicates", len(msgs), mbox, n)
+	if len(dups) > 0 {
+		fmt.Printf(" (%s)", strings.Join(dups, ", "))
+	}
+	fmt.Println()
+	return 0
+}
@@ -0,0 +1,194 @@
+// Package seed generates synthetic messages with a controlled share of
+// duplicates, to fill a mailbox for trying out or testing the detection
+// of duplicates. The same Config always yields the same messages, so
+// fixtures built from it are consistent wherever they are used.
+package seed
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Style is how a duplicate differs from the message it copies.
+type Style string
+
+const (
+	// StyleExact is a byte for byte copy.
+	StyleExact Style = "exact"
+	// StyleRedated has the Message-ID of the original but a Date a few
+	// minutes later, as a message delivered twice. Scan finds it by
+	// Message-ID, not with IgnoreMessageID unless within DateWindow.
+	StyleRedated Style = "redated"
+	// StyleNoMessageID is a pair of identical messages without a
+	// Message-ID, found by the envelope hash.
+	StyleNoMessageID Style = "no-message-id"
+	// StyleTracking is a near-duplicate: the same newsletter with
+	// another Message-ID and other tracking URLs in the body. It is no
+	// duplicate by Message-ID or body, only by the envelope hash with
+	// IgnoreMessageID.
+	StyleTracking Style = "tracking"
+)
+
+// Styles are all styles, in the order Generate cycles through them.
+var Styles = []Style{StyleExact, StyleRedated, StyleNoMessageID, StyleTracking}
+
+// Config describes the messages Generate returns.
+type Config struct {
+	// Messages is the number of messages, duplicates included.
+	Messages int
+	// DuplicateRatio is the share of Messages which copy another
+	// message, between 0 and 1.
+	DuplicateRatio float64
+	// Styles are the styles of duplicates, used in turn. Styles is
+	// used if it is empty.
+	Styles []Style
+	// MinSize and MaxSize bound the size of the body in bytes, 1024
+	// if both are 0.
+	MinSize, MaxSize int
+	// Senders is the number of distinct senders, 5 if 0.
+	Senders int
+	// Seed seeds the random choices.
+	Seed int64
+	// Start is the Date of the first message, the following ones are
+	// an hour apart. 2020-01-01 UTC if zero.
+	Start time.Time
+}
+
+// Message is a generated message.
+type Message struct {
+	// Raw is the message in RFC 5322 format with CRLF line endings.
+	Raw []byte
+	// Date is its Date header, to be used as internal date.
+	Date time.Time
+	// Original is the index of the message this one copies, -1 for
+	// messages which are no duplicate.
+	Original int
+	// Style is how it copies Original, empty for originals.
+	Style Style
+}
+
+// words fill the bodies.
+var words = strings.Fields("lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor incididunt ut labore et dolore magna aliqua")
+
+// Generate returns the messages described by cfg in the order they
+// are to be appended. Each duplicate follows its original, at a random
+// distance. Originals have at most one duplicate, so DuplicateRatio is
+// capped at one half.
+func Generate(cfg Config) []Message {
+	if len(cfg.Styles) == 0 {
+		cfg.Styles = Styles
+	}
+	if cfg.MinSize == 0 && cfg.MaxSize == 0 {
+		cfg.MinSize, cfg.MaxSize = 1024, 1024
+	}
+	if cfg.MaxSize < cfg.MinSize {
+		cfg.MaxSize = cfg.MinSize
+	}
+	if cfg.Senders < 1 {
+		cfg.Senders = 5
+	}
+	if cfg.Start.IsZero() {
+		cfg.Start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	r := rand.New(rand.NewSource(cfg.Seed))
+
+	dups := int(float64(cfg.Messages)*cfg.DuplicateRatio + 0.5)
+	if dups > cfg.Messages/2 {
+		// every duplicate needs an original
+		dups = cfg.Messages / 2
+	}
+	originals := cfg.Messages - dups
+
+	msgs := make([]Message, 0, cfg.Messages)
+	var pending []Message
+	copied := 0
+	for n := 0; n < originals; n++ {
+		date := cfg.Start.Add(time.Duration(n) * time.Hour)
+		sender := fmt.Sprintf("sender%d@example.org", r.Intn(cfg.Senders))
+		size := cfg.MinSize + r.Intn(cfg.MaxSize-cfg.MinSize+1)
+		text := filler(r, size)
+		body := text
+		// the duplicates are spread evenly over the originals, whose
+		// header and body depend on the style of their copy
+		var style Style
+		if (n+1)*dups/originals > copied {
+			style = cfg.Styles[copied%len(cfg.Styles)]
+			copied++
+		}
+		id := fmt.Sprintf("<seed-%d-%d@example.org>", cfg.Seed, n)
+		if style == StyleNoMessageID {
+			id = ""
+		}
+		subject := fmt.Sprintf("Message %d", n)
+		if style == StyleTracking {
+			subject = fmt.Sprintf("Newsletter %d", n)
+			body = text + trackingLink(fmt.Sprintf("%d-a", n))
+		}
+		msgs = append(msgs, Message{Raw: message(sender, subject, id, date, body), Date: date, Original: -1})
+
+		if style != "" {
+			i := len(msgs) - 1
+			dup := Message{Raw: msgs[i].Raw, Date: date, Original: i, Style: style}
+			switch style {
+			case StyleRedated:
+				dup.Date = date.Add(time.Duration(1+r.Intn(30)) * time.Minute)
+				dup.Raw = message(sender, subject, id, dup.Date, body)
+			case StyleTracking:
+				id = fmt.Sprintf("<seed-%d-%d-resent@example.org>", cfg.Seed, n)
+				dup.Raw = message(sender, subject, id, date, text+trackingLink(fmt.Sprintf("%d-b", n)))
+			}
+			pending = append(pending, dup)
+		}
+		// release duplicates after their original at random, so that
+		// they are not always next to it
+		for len(pending) > 0 && (r.Intn(3) == 0 || n == originals-1) {
+			msgs = append(msgs, pending[0])
+			pending = pending[1:]
+		}
+	}
+	return msgs
+}
+
+// message returns a message with the given header fields and body.
+func message(sender, subject, messageID string, date time.Time, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", sender)
+	fmt.Fprintf(&b, "To: recipient@example.org\r\n")
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	if messageID != "" {
+		fmt.Fprintf(&b, "Message-ID: %s\r\n", messageID)
+	}
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\n")
+	b.WriteString(body)
+	return b.Bytes()
+}
+
+// filler returns about size bytes of text in lines of CRLF.
+func filler(r *rand.Rand, size int) string {
+	var b strings.Builder
+	line := 0
+	for b.Len() < size {
+		w := words[r.Intn(len(words))]
+		if line+len(w) > 72 {
+			b.WriteString("\r\n")
+			line = 0
+		} else if line > 0 {
+			b.WriteByte(' ')
+			line++
+		}
+		b.WriteString(w)
+		line += len(w)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// trackingLink returns the line of a newsletter with a link tracking
+// its recipient by token.
+func trackingLink(token string) string {
+	return fmt.Sprintf("Unsubscribe: https://example.org/u?t=%s\r\n", token)
+}
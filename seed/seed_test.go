@@ -0,0 +1,206 @@
+package seed_test
+
+import (
+	"bytes"
+	"context"
+	"net/mail"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+	"github.com/tomasvitek/imap-clean-dup/seed"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, test := range []struct {
+		cfg  seed.Config
+		dups int
+	}{
+		{seed.Config{Messages: 10}, 0},
+		{seed.Config{Messages: 10, DuplicateRatio: 0.2}, 2},
+		{seed.Config{Messages: 100, DuplicateRatio: 0.25, Seed: 3}, 25},
+		{seed.Config{Messages: 11, DuplicateRatio: 0.5}, 5},
+		// every duplicate needs an original
+		{seed.Config{Messages: 10, DuplicateRatio: 0.9}, 5},
+		{seed.Config{Messages: 1, DuplicateRatio: 0.5}, 0},
+	} {
+		msgs := seed.Generate(test.cfg)
+		if len(msgs) != test.cfg.Messages {
+			t.Errorf("%+v: got %d messages", test.cfg, len(msgs))
+		}
+		dups := 0
+		for i, m := range msgs {
+			if m.Original < 0 {
+				if m.Style != "" {
+					t.Errorf("%+v: original %d has style %s", test.cfg, i, m.Style)
+				}
+				continue
+			}
+			dups++
+			if m.Original >= i || msgs[m.Original].Original >= 0 {
+				t.Errorf("%+v: duplicate %d copies %d", test.cfg, i, m.Original)
+			}
+		}
+		if dups != test.dups {
+			t.Errorf("%+v: got %d duplicates, want %d", test.cfg, dups, test.dups)
+		}
+	}
+}
+
+func TestGenerateDeterministic(t *testing.T) {
+	cfg := seed.Config{Messages: 50, DuplicateRatio: 0.3, MinSize: 10, MaxSize: 500, Seed: 42}
+	a, b := seed.Generate(cfg), seed.Generate(cfg)
+	if !reflect.DeepEqual(a, b) {
+		t.Error("the same config yields other messages")
+	}
+	cfg.Seed = 43
+	if c := seed.Generate(cfg); reflect.DeepEqual(a, c) {
+		t.Error("another seed yields the same messages")
+	}
+}
+
+func TestGenerateStyles(t *testing.T) {
+	msgs := seed.Generate(seed.Config{Messages: 40, DuplicateRatio: 0.5})
+	// the duplicates of the originals in order cycle through the styles
+	var styles []seed.Style
+	byOriginal := make(map[int]seed.Style)
+	for _, m := range msgs {
+		if m.Original >= 0 {
+			byOriginal[m.Original] = m.Style
+		}
+	}
+	for i := range msgs {
+		if s, ok := byOriginal[i]; ok {
+			styles = append(styles, s)
+		}
+	}
+	for i, s := range styles {
+		if want := seed.Styles[i%len(seed.Styles)]; s != want {
+			t.Fatalf("got styles %v", styles)
+		}
+	}
+
+	for _, m := range msgs {
+		if m.Original < 0 {
+			continue
+		}
+		orig := msgs[m.Original]
+		id, origID := header(t, m.Raw, "Message-Id"), header(t, orig.Raw, "Message-Id")
+		switch m.Style {
+		case seed.StyleExact:
+			if !bytes.Equal(m.Raw, orig.Raw) || !m.Date.Equal(orig.Date) {
+				t.Errorf("%s copy differs", m.Style)
+			}
+		case seed.StyleRedated:
+			if id != origID || !m.Date.After(orig.Date) || m.Date.Sub(orig.Date) > 30*time.Minute {
+				t.Errorf("%s copy has Message-ID %s of %s, date %s of %s", m.Style, id, origID, m.Date, orig.Date)
+			}
+		case seed.StyleNoMessageID:
+			if id != "" || !bytes.Equal(m.Raw, orig.Raw) {
+				t.Errorf("%s copy has Message-ID %q", m.Style, id)
+			}
+		case seed.StyleTracking:
+			if id == origID || bytes.Equal(m.Raw, orig.Raw) || !m.Date.Equal(orig.Date) {
+				t.Errorf("%s copy has Message-ID %s of %s", m.Style, id, origID)
+			}
+		}
+	}
+
+	// only the given styles are used
+	for _, m := range seed.Generate(seed.Config{Messages: 20, DuplicateRatio: 0.5, Styles: []seed.Style{seed.StyleTracking}}) {
+		if m.Original >= 0 && m.Style != seed.StyleTracking {
+			t.Errorf("got style %s", m.Style)
+		}
+	}
+}
+
+func TestGenerateShape(t *testing.T) {
+	cfg := seed.Config{Messages: 60, DuplicateRatio: 0.2, MinSize: 100, MaxSize: 300, Senders: 3}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	senders := make(map[string]bool)
+	originals := 0
+	for i, m := range seed.Generate(cfg) {
+		msg, err := mail.ReadMessage(bytes.NewReader(m.Raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		senders[msg.Header.Get("From")] = true
+		if want := start.Add(time.Duration(originals) * time.Hour); m.Original < 0 && !m.Date.Equal(want) {
+			t.Errorf("message %d: got date %s, want %s", i, m.Date, want)
+		}
+		if m.Original < 0 {
+			originals++
+		}
+		if date, err := msg.Header.Date(); err != nil || !date.Equal(m.Date) {
+			t.Errorf("message %d: got Date %s, %v", i, date, err)
+		}
+		// the body ends the line of the word reaching the size
+		body := m.Raw[bytes.Index(m.Raw, []byte("\r\n\r\n"))+4:]
+		if len(body) < cfg.MinSize || len(body) > cfg.MaxSize+20 {
+			t.Errorf("message %d: got body of %d bytes", i, len(body))
+		}
+		if bytes.Contains(bytes.ReplaceAll(m.Raw, []byte("\r\n"), nil), []byte("\n")) {
+			t.Errorf("message %d has a bare LF", i)
+		}
+	}
+	if len(senders) > cfg.Senders || len(senders) < 2 {
+		t.Errorf("got senders %v", senders)
+	}
+}
+
+// TestGenerateDetection scans the duplicates of each style and checks
+// that they are found by the settings their documentation gives.
+func TestGenerateDetection(t *testing.T) {
+	for _, test := range []struct {
+		style seed.Style
+		cfg   dedup.Config
+		found bool
+	}{
+		{seed.StyleExact, dedup.Config{}, true},
+		{seed.StyleExact, dedup.Config{IgnoreMessageID: true}, true},
+		{seed.StyleRedated, dedup.Config{}, true},
+		{seed.StyleRedated, dedup.Config{IgnoreMessageID: true}, false},
+		{seed.StyleRedated, dedup.Config{IgnoreMessageID: true, DateWindow: time.Hour}, true},
+		{seed.StyleNoMessageID, dedup.Config{}, true},
+		{seed.StyleTracking, dedup.Config{}, false},
+		{seed.StyleTracking, dedup.Config{IgnoreMessageID: true}, true},
+		{seed.StyleTracking, dedup.Config{Strategy: dedup.StrategyTiered, IgnoreMessageID: true}, false},
+	} {
+		msgs := seed.Generate(seed.Config{Messages: 20, DuplicateRatio: 0.3, MinSize: 64, MaxSize: 256, Styles: []seed.Style{test.style}})
+		s := imaptest.NewServer(t)
+		uids := s.AppendSeed(t, "INBOX", msgs)
+		var want [][]uint32
+		if test.found {
+			for i, m := range msgs {
+				if m.Original >= 0 {
+					want = append(want, []uint32{uids[m.Original], uids[i]})
+				}
+			}
+		}
+		groups, err := dedup.Scan(context.Background(), s.Dial(t), "INBOX", test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got [][]uint32
+		for _, g := range groups {
+			got = append(got, append([]uint32{g.Keeper}, g.Duplicates...))
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i][0] < got[j][0] })
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s with %+v: got groups %v, want %v", test.style, test.cfg, got, want)
+		}
+	}
+}
+
+// header returns the field name of the header of raw.
+func header(t *testing.T, raw []byte, name string) string {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Header.Get(name)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+func TestRunSeed(t *testing.T) {
+	s := imaptest.NewServer(t)
+	seedArgs := args(s, "seed", "-mbox", "Seeded", "-messages", "20", "-min-size", "64", "-max-size", "128")
+	code, stdout, stderr := runMain(t, nil, seedArgs...)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	for _, want := range []string{"created Seeded", "appended 20 messages to Seeded, 4 of them duplicates (1 exact, 1 redated, 1 no-message-id, 1 tracking)"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("missing %q in stdout:\n%s", want, stdout)
+		}
+	}
+	if uids := s.UIDs(t, "Seeded"); len(uids) != 20 {
+		t.Fatalf("got UIDs %v", uids)
+	}
+
+	// all but the tracking copy are duplicates by default
+	code, stdout, stderr = runMain(t, nil, args(s, "scan", "-mbox", "Seeded")...)
+	if code != 0 || !strings.Contains(stdout, "would have removed 3 messages") {
+		t.Errorf("scan: exit code %d, stdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+	}
+
+	code, _, stderr = runMain(t, nil, seedArgs...)
+	if code != 1 || !strings.Contains(stderr, "Seeded has 20 messages, seed only appends to an empty mailbox unless -force is given") {
+		t.Errorf("seed again: exit code %d, stderr:\n%s", code, stderr)
+	}
+	code, stdout, stderr = runMain(t, nil, append(seedArgs, "-force", "-styles", "exact", "-seed", "2")...)
+	if code != 0 || !strings.Contains(stdout, "appended 20 messages to Seeded, 4 of them duplicates (4 exact)") {
+		t.Errorf("seed -force: exit code %d, stdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+	}
+	if uids := s.UIDs(t, "Seeded"); len(uids) != 40 {
+		t.Errorf("got %d messages after -force", len(uids))
+	}
+
+	for _, test := range []struct {
+		flags []string
+		want  string
+	}{
+		{[]string{"-duplicate-ratio", "0.6"}, "-duplicate-ratio must be between 0 and 0.5, not 0.6"},
+		{[]string{"-styles", "fuzzy"}, `-styles must be`},
+		{[]string{"-min-size", "10", "-max-size", "5"}, "-min-size must be between 0 and -max-size"},
+		{[]string{"-messages", "0", "-senders", "0"}, "-senders must be positive"},
+	} {
+		code, _, stderr := runMain(t, nil, append(args(s, "seed", "-mbox", "Other"), test.flags...)...)
+		if code != exitUsage || !strings.Contains(stderr, test.want) {
+			t.Errorf("%v: got exit code %d, stderr:\n%s", test.flags, code, stderr)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// record is what the listings keep of a scanned message, as written to
+// a spillFile.
+type record struct {
+	Mailbox   string
+	UID       uint32
+	Subject   string
+	From      string
+	Date      time.Time
+	Size      uint32
+	Key       string
+	Duplicate bool
+}
+
+func newRecord(e dedup.Event) record {
+	return record{Mailbox: e.Mailbox, UID: e.UID, Subject: e.Subject, From: e.From, Date: e.Date, Size: e.Size, Key: e.Key, Duplicate: e.Duplicate}
+}
+
+// event returns the EventMessage r was made of.
+func (r record) event() dedup.Event {
+	return dedup.Event{Kind: dedup.EventMessage, Mailbox: r.Mailbox, UID: r.UID, Subject: r.Subject, From: r.From, Date: r.Date, Size: r.Size, Key: r.Key, Duplicate: r.Duplicate}
+}
+
+// spillFile is a temporary file the listings move scanned messages to
+// beyond -dedup-group-report-limit. It holds runs of records, each a
+// gob stream of its own, which are read back one at a time.
+type spillFile struct {
+	f   *os.File
+	buf *bufio.Writer
+	enc *gob.Encoder
+	// start is the offset of the run being written.
+	start int64
+	// runs are the offsets and lengths of the finished runs.
+	runs [][2]int64
+}
+
+func newSpillFile() (*spillFile, error) {
+	f, err := ioutil.TempFile("", "imap-clean-dup-*.spill")
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{f: f}, nil
+}
+
+// write appends r to the current run, starting one if needed.
+func (s *spillFile) write(r record) error {
+	if s.enc == nil {
+		s.buf = bufio.NewWriter(s.f)
+		s.enc = gob.NewEncoder(s.buf)
+	}
+	return s.enc.Encode(r)
+}
+
+// endRun finishes the current run, if any.
+func (s *spillFile) endRun() error {
+	if s.enc == nil {
+		return nil
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	end, err := s.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, [2]int64{s.start, end - s.start})
+	s.start, s.buf, s.enc = end, nil, nil
+	return nil
+}
+
+// reader returns a reader of the records of run i.
+func (s *spillFile) reader(i int) func() (record, error) {
+	dec := gob.NewDecoder(bufio.NewReader(io.NewSectionReader(s.f, s.runs[i][0], s.runs[i][1])))
+	return func() (record, error) {
+		var r record
+		err := dec.Decode(&r)
+		return r, err
+	}
+}
+
+// each calls fn with every record of the finished runs in the order
+// they were written.
+func (s *spillFile) each(fn func(record) error) error {
+	for i := range s.runs {
+		next := s.reader(i)
+		for {
+			r, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close closes and removes the file.
+func (s *spillFile) close() {
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// MailboxResult is the outcome of processing a single mailbox.
+type MailboxResult struct {
+	Mailbox string
+	// Scanned is the number of messages scanned.
+	Scanned int
+	// Found is the number of duplicates found for removal.
+	Found int
+	// Removed is the number of duplicates removed.
+	Removed int
+	// Reclaimed is the total size of the duplicates expunged, 0 if
+	// their sizes were not recorded by the scan.
+	Reclaimed int64
+	// Expunged is the number of messages the server reported expunged,
+	// which includes any marked \Deleted by other clients.
+	Expunged int
+	// Skipped is the number of messages returned without an envelope,
+	// which were neither compared nor removed.
+	Skipped int
+	// Newer is the number of messages which arrived during the scan
+	// and were ignored.
+	Newer int
+	// Partial is set if -limit left messages of the mailbox unscanned.
+	Partial bool
+	// Err is set if processing the mailbox failed.
+	Err error
+}
+
+// Summary collects the results of all processed mailboxes. It is safe
+// for concurrent use, so that mailboxes processed in parallel can add
+// their results as they finish.
+type Summary struct {
+	mu      sync.Mutex
+	Results []MailboxResult
+	// err is the failure which ended the run before or between
+	// mailboxes, if any.
+	err error
+	// Parameters are the settings the run scanned with, as reported.
+	Parameters map[string]string
+	// NotProcessed are the mailboxes left out as the run stopped early,
+	// at a failing one with -strict or at -max-duration.
+	NotProcessed []string
+	// stopped words why they were left out.
+	stopped string
+	// quota is the usage of the quota before and after the run, if
+	// the server has QUOTA.
+	quota []QuotaSummary
+}
+
+// SetQuota records the usage of the quota before and after the run.
+func (s *Summary) SetQuota(qs []QuotaSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quota = qs
+}
+
+// Stop records mailboxes as left out for the reason given, such as
+// "after the first failure".
+func (s *Summary) Stop(reason string, mailboxes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = reason
+	s.NotProcessed = append(s.NotProcessed, mailboxes...)
+}
+
+// Err returns the errors of the failed mailboxes joined, each wrapped
+// with the name of its mailbox, or nil if none failed. errors.Is and
+// errors.As see through to the errors of all mailboxes.
+func (s *Summary) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, r := range s.sorted() {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.Mailbox, r.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sorted returns the results sorted by mailbox name.
+func (s *Summary) sorted() []MailboxResult {
+	results := append([]MailboxResult(nil), s.Results...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Mailbox < results[j].Mailbox })
+	return results
+}
+
+// runParameters returns the command and the values of the flags
+// configuring the detection of duplicates, which never include
+// credentials.
+func runParameters(command string) map[string]string {
+	params := map[string]string{"command": command}
+	for _, name := range append([]string{"dry-run"}, scanFlags...) {
+		params[name] = flag.Lookup(name).Value.String()
+	}
+	return params
+}
+
+// Fail records err as having ended the run.
+func (s *Summary) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Add records the result of a mailbox.
+func (s *Summary) Add(r MailboxResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Results = append(s.Results, r)
+}
+
+// Merge adds the counts of r, from a later cycle of -interval, to the
+// result recorded for its mailbox and replaces its error by that of r,
+// so that a mailbox counts as failed only if its last cycle did.
+func (s *Summary) Merge(r MailboxResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.Results {
+		if m := &s.Results[i]; m.Mailbox == r.Mailbox {
+			m.Found, m.Removed, m.Expunged = m.Found+r.Found, m.Removed+r.Removed, m.Expunged+r.Expunged
+			m.Scanned, m.Reclaimed = m.Scanned+r.Scanned, m.Reclaimed+r.Reclaimed
+			m.Err = r.Err
+			return
+		}
+	}
+	s.Results = append(s.Results, r)
+}
+
+// Found returns the number of duplicates found in all mailboxes.
+func (s *Summary) Found() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, r := range s.Results {
+		n += r.Found
+	}
+	return n
+}
+
+// Failed returns the number of mailboxes which failed.
+func (s *Summary) Failed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed()
+}
+
+func (s *Summary) failed() int {
+	n := 0
+	for _, r := range s.Results {
+		if r.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Print writes a table of all mailboxes sorted by name to w, so that
+// the output does not depend on the order mailboxes finished in,
+// followed by the error of each failed mailbox and the mailboxes not
+// processed.
+func (s *Summary) Print(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := s.sorted()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "mailbox\tfound\tremoved\texpunged\tskipped\tnewer\tstatus")
+	for _, r := range results {
+		status := "ok"
+		if errors.Is(r.Err, context.Canceled) || errors.Is(r.Err, context.DeadlineExceeded) {
+			status = "stopped"
+		} else if r.Err != nil {
+			status = "failed"
+		} else if r.Partial {
+			status = "partial"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%s\n", r.Mailbox, r.Found, r.Removed, r.Expunged, r.Skipped, r.Newer, status)
+	}
+	tw.Flush()
+	if n := s.failed(); n > 0 {
+		fmt.Fprintf(w, "%d of %d mailboxes failed:\n", n, len(s.Results))
+		for _, r := range results {
+			if r.Err != nil {
+				fmt.Fprintf(w, "  %s: %s\n", r.Mailbox, r.Err)
+			}
+		}
+	}
+	if len(s.NotProcessed) > 0 {
+		fmt.Fprintf(w, "stopped %s, %d mailboxes not processed: %s\n", s.stopped, len(s.NotProcessed), strings.Join(s.NotProcessed, ", "))
+	}
+}
+
+// SummaryReport is the summary of a run written by -summary-json-file.
+type SummaryReport struct {
+	// Version is the version of the tool writing the report.
+	Version     string `json:"version"`
+	HashVersion int    `json:"hash_version"`
+	ExitCode    int    `json:"exit_code"`
+	// Error is the failure which ended the run, if any. Failures of
+	// single mailboxes are reported with the mailbox.
+	Error string `json:"error,omitempty"`
+	// Parameters are the command and the scan flags of the run.
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Found      int               `json:"found"`
+	Removed    int               `json:"removed"`
+	Expunged   int               `json:"expunged"`
+	Skipped    int               `json:"skipped"`
+	// Newer is the number of messages arrived during the scans, which
+	// were ignored.
+	Newer  int `json:"newer"`
+	Failed int `json:"failed"`
+	// Partial is set if -limit left messages of any mailbox unscanned.
+	Partial bool `json:"partial,omitempty"`
+	// NotProcessed are the mailboxes left out as the run stopped
+	// early.
+	NotProcessed []string         `json:"not_processed,omitempty"`
+	Bytes        int64            `json:"bytes"`
+	Mailboxes    []MailboxSummary `json:"mailboxes"`
+	// Quota is the usage of the quota of the mailbox before and after
+	// the run, left out if the server has no QUOTA.
+	Quota []QuotaSummary `json:"quota,omitempty"`
+	// Phases are the numbers -timing prints, summed over all mailboxes
+	// and including connecting and logging in.
+	Phases map[dedup.Phase]PhaseSummary `json:"phases,omitempty"`
+}
+
+// PhaseSummary is the time, traffic and commands of a phase of a run.
+type PhaseSummary struct {
+	Milliseconds int64 `json:"ms"`
+	Bytes        int64 `json:"bytes"`
+	Commands     int   `json:"commands"`
+	Messages     int   `json:"messages"`
+}
+
+// phaseSummaries returns the summaries of the phases of byPhase.
+func phaseSummaries(byPhase map[dedup.Phase]dedup.PhaseStats) map[dedup.Phase]PhaseSummary {
+	if len(byPhase) == 0 {
+		return nil
+	}
+	sums := make(map[dedup.Phase]PhaseSummary, len(byPhase))
+	for p, s := range byPhase {
+		sums[p] = PhaseSummary{
+			Milliseconds: s.Duration.Milliseconds(),
+			Bytes:        s.Bytes,
+			Commands:     s.Commands,
+			Messages:     s.Messages,
+		}
+	}
+	return sums
+}
+
+// MailboxSummary is the summary of a single mailbox.
+type MailboxSummary struct {
+	Name     string `json:"name"`
+	Found    int    `json:"found"`
+	Removed  int    `json:"removed"`
+	Expunged int    `json:"expunged"`
+	Skipped  int    `json:"skipped"`
+	Newer    int    `json:"newer"`
+	Partial  bool   `json:"partial,omitempty"`
+	// Bytes is the traffic of the mailbox's select, fetch, store and
+	// expunge commands.
+	Bytes int64  `json:"bytes"`
+	Error string `json:"error,omitempty"`
+	// Phases are the numbers -timing prints for the mailbox.
+	Phases map[dedup.Phase]PhaseSummary `json:"phases,omitempty"`
+}
+
+// Report returns the summary of the run exiting with code, with the
+// traffic recorded by metrics. Mailboxes are sorted by name.
+func (s *Summary) Report(code int, metrics *dedup.Metrics) SummaryReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := SummaryReport{
+		Version:      currentVersion().Version,
+		HashVersion:  dedup.HashVersion,
+		ExitCode:     code,
+		Failed:       s.failed(),
+		Parameters:   s.Parameters,
+		NotProcessed: s.NotProcessed,
+		Bytes:        metrics.Bytes(),
+		Mailboxes:    []MailboxSummary{},
+		Quota:        s.quota,
+		Phases:       phaseSummaries(metrics.Totals()),
+	}
+	if s.err != nil {
+		r.Error = s.err.Error()
+	}
+	for _, res := range s.Results {
+		m := MailboxSummary{
+			Name:     res.Mailbox,
+			Found:    res.Found,
+			Removed:  res.Removed,
+			Expunged: res.Expunged,
+			Skipped:  res.Skipped,
+			Newer:    res.Newer,
+			Partial:  res.Partial,
+			Bytes:    metrics.MailboxBytes(res.Mailbox),
+			Phases:   phaseSummaries(metrics.Phases(res.Mailbox)),
+		}
+		if res.Err != nil {
+			m.Error = res.Err.Error()
+		}
+		r.Found += res.Found
+		r.Removed += res.Removed
+		r.Expunged += res.Expunged
+		r.Skipped += res.Skipped
+		r.Newer += res.Newer
+		r.Partial = r.Partial || res.Partial
+		r.Mailboxes = append(r.Mailboxes, m)
+	}
+	sort.SliceStable(r.Mailboxes, func(i, j int) bool { return r.Mailboxes[i].Name < r.Mailboxes[j].Name })
+	return r
+}
+
+// PrintReport writes the summary of the run exiting with code to w, as
+// the table of Print followed by the totals for format text, or as the
+// report of WriteJSON for json. Unlike Print it always writes
+// something, also without any mailbox processed.
+func (s *Summary) PrintReport(w io.Writer, format string, code int, metrics *dedup.Metrics) error {
+	r := s.Report(code, metrics)
+	if format == "json" {
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+	s.Print(w)
+	if r.Error != "" {
+		fmt.Fprintf(w, "stopped: %s\n", r.Error)
+	}
+	_, err := fmt.Fprintf(w, "%d duplicates found in %d mailboxes, %d removed, %d expunged, exit code %d\n", r.Found, len(r.Mailboxes), r.Removed, r.Expunged, r.ExitCode)
+	return err
+}
+
+// WriteJSON writes the summary of the run exiting with code to a new
+// or truncated file at path.
+func (s *Summary) WriteJSON(path string, code int, metrics *dedup.Metrics) error {
+	b, err := json.MarshalIndent(s.Report(code, metrics), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+func TestSummaryReport(t *testing.T) {
+	var s Summary
+	s.Add(MailboxResult{Mailbox: "INBOX", Found: 3, Removed: 3, Expunged: 4})
+	s.Add(MailboxResult{Mailbox: "Archive", Found: 1, Err: errors.New("store failed")})
+	metrics := dedup.NewMetrics()
+	metrics.Add("", dedup.PhaseConnect, dedup.PhaseStats{Duration: 20 * time.Millisecond, Bytes: 100, Commands: 3})
+	metrics.Add("INBOX", dedup.PhaseFetch, dedup.PhaseStats{Duration: time.Second, Bytes: 1000, Commands: 2, Messages: 10})
+	metrics.Add("INBOX", dedup.PhaseExpunge, dedup.PhaseStats{Duration: 5 * time.Millisecond, Bytes: 20, Commands: 1, Messages: 4})
+	metrics.Add("Archive", dedup.PhaseFetch, dedup.PhaseStats{Duration: 500 * time.Millisecond, Bytes: 300, Commands: 1, Messages: 2})
+
+	r := s.Report(exitPartial, metrics)
+	if r.Found != 4 || r.Removed != 3 || r.Expunged != 4 || r.Failed != 1 || r.ExitCode != exitPartial {
+		t.Errorf("got totals %+v", r)
+	}
+	if len(r.Mailboxes) != 2 || r.Mailboxes[0].Name != "Archive" || r.Mailboxes[0].Error != "store failed" {
+		t.Fatalf("got mailboxes %+v", r.Mailboxes)
+	}
+	want := map[dedup.Phase]PhaseSummary{
+		dedup.PhaseFetch:   {1000, 1000, 2, 10},
+		dedup.PhaseExpunge: {5, 20, 1, 4},
+	}
+	if inbox := r.Mailboxes[1]; inbox.Bytes != 1020 || !reflect.DeepEqual(inbox.Phases, want) {
+		t.Errorf("got INBOX %+v, want phases %+v", inbox, want)
+	}
+	want = map[dedup.Phase]PhaseSummary{
+		dedup.PhaseConnect: {20, 100, 3, 0},
+		dedup.PhaseFetch:   {1500, 1300, 3, 12},
+		dedup.PhaseExpunge: {5, 20, 1, 4},
+	}
+	if !reflect.DeepEqual(r.Phases, want) {
+		t.Errorf("got phases %+v, want %+v", r.Phases, want)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Phases map[string]map[string]int64 `json:"phases"`
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if fetch := decoded.Phases["fetch"]; fetch["ms"] != 1500 || fetch["bytes"] != 1300 || fetch["commands"] != 3 || fetch["messages"] != 12 {
+		t.Errorf("got JSON %s", b)
+	}
+}
+
+func TestSummaryMerge(t *testing.T) {
+	var s Summary
+	s.Merge(MailboxResult{Mailbox: "INBOX", Scanned: 10, Found: 2, Removed: 2, Err: errors.New("expunge failed")})
+	s.Merge(MailboxResult{Mailbox: "INBOX", Scanned: 3, Found: 1, Removed: 1})
+	if len(s.Results) != 1 {
+		t.Fatalf("got results %+v", s.Results)
+	}
+	// a mailbox fails only if its last cycle did
+	if r := s.Results[0]; r.Scanned != 13 || r.Found != 3 || r.Removed != 3 || r.Err != nil {
+		t.Errorf("got result %+v", r)
+	}
+	if s.Found() != 3 || s.Failed() != 0 {
+		t.Errorf("got %d found, %d failed", s.Found(), s.Failed())
+	}
+}
+
+// TestSummaryConcurrent adds the results and metrics of mailboxes from
+// goroutines while the totals are read, for go test -race.
+func TestSummaryConcurrent(t *testing.T) {
+	const mailboxes, cycles = 8, 50
+	var s Summary
+	metrics := dedup.NewMetrics()
+	var wg sync.WaitGroup
+	for i := 0; i < mailboxes; i++ {
+		wg.Add(1)
+		go func(mbox string) {
+			defer wg.Done()
+			for j := 0; j < cycles; j++ {
+				s.Merge(MailboxResult{Mailbox: mbox, Scanned: 2, Found: 1, Removed: 1})
+				metrics.Add(mbox, dedup.PhaseFetch, dedup.PhaseStats{Bytes: 10, Commands: 1, Messages: 2})
+				metrics.Track(mbox, dedup.PhaseStore)(1, 1)
+			}
+		}(fmt.Sprintf("Box%d", mailboxes-1-i))
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < cycles; j++ {
+			s.Found()
+			s.Print(io.Discard)
+			s.Report(0, metrics)
+		}
+	}()
+	wg.Wait()
+
+	r := s.Report(0, metrics)
+	if r.Found != mailboxes*cycles || r.Removed != mailboxes*cycles {
+		t.Errorf("got totals %+v", r)
+	}
+	if fetch := r.Phases[dedup.PhaseFetch]; fetch.Bytes != mailboxes*cycles*10 || fetch.Commands != mailboxes*cycles || fetch.Messages != mailboxes*cycles*2 {
+		t.Errorf("got fetch %+v", fetch)
+	}
+	if store := r.Phases[dedup.PhaseStore]; store.Commands != mailboxes*cycles {
+		t.Errorf("got store %+v", store)
+	}
+	for i, m := range r.Mailboxes {
+		if name := fmt.Sprintf("Box%d", i); m.Name != name || m.Found != cycles || m.Removed != cycles {
+			t.Errorf("got mailbox %d %+v, want %s with %d found", i, m, name, cycles)
+		}
+	}
+
+	var b strings.Builder
+	s.Print(&b)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != mailboxes+1 {
+		t.Fatalf("got table:\n%s", b.String())
+	}
+	for i, line := range lines[1:] {
+		if !strings.HasPrefix(line, fmt.Sprintf("Box%d ", i)) {
+			t.Errorf("line %d of table:\n%s", i+1, b.String())
+		}
+	}
+}
@@ -0,0 +1,53 @@
+# bash completion for imap-clean-dup, e.g. source <(imap-clean-dup completion bash)
+_imap_clean_dup() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W "scan clean apply list-mailboxes list-capabilities restore stats cross-server completion" -- "$cur"))
+		return
+	fi
+	case $prev in
+	-compress) COMPREPLY=($(compgen -W "auto off" -- "$cur")); return ;;
+	-dedup-group-report-spill) COMPREPLY=($(compgen -W "file stream" -- "$cur")); return ;;
+	-dedup-key) COMPREPLY=($(compgen -W "body body-first-n-bytes" -- "$cur")); return ;;
+	-drafts-mode) COMPREPLY=($(compgen -W "skip safe normal" -- "$cur")); return ;;
+	-email-on) COMPREPLY=($(compgen -W "always changes errors" -- "$cur")); return ;;
+	-format) COMPREPLY=($(compgen -W "text json" -- "$cur")); return ;;
+	-keep-role) COMPREPLY=($(compgen -W "all archive drafts flagged important inbox junk sent trash" -- "$cur")); return ;;
+	-notify-on) COMPREPLY=($(compgen -W "always changes errors" -- "$cur")); return ;;
+	-prefer) COMPREPLY=($(compgen -W "inbox sent" -- "$cur")); return ;;
+	-preset) COMPREPLY=($(compgen -W "aggressive exact newsletters" -- "$cur")); return ;;
+	-report) COMPREPLY=($(compgen -W "summary messages" -- "$cur")); return ;;
+	-scope) COMPREPLY=($(compgen -W "mailbox conversation" -- "$cur")); return ;;
+	-sort) COMPREPLY=($(compgen -W "date group-size sender size subject uid" -- "$cur")); return ;;
+	-sort-order) COMPREPLY=($(compgen -W "asc desc" -- "$cur")); return ;;
+	-strategy) COMPREPLY=($(compgen -W "envelope tiered" -- "$cur")); return ;;
+	-tls-max-version) COMPREPLY=($(compgen -W "1.0 1.1 1.2 1.3" -- "$cur")); return ;;
+	-tls-min-version) COMPREPLY=($(compgen -W "1.0 1.1 1.2 1.3" -- "$cur")); return ;;
+	-config|-log-file|-summary-json-file|-plan|-apply-plan) COMPREPLY=($(compgen -f -- "$cur")); return ;;
+	-backup-dir|-append) COMPREPLY=($(compgen -d -- "$cur")); return ;;
+	-mbox|-sent-mbox)
+		local IFS=$'\n'
+		COMPREPLY=($(compgen -W "$("${COMP_WORDS[0]}" list-mailboxes 2>/dev/null)" -- "$cur"))
+		return ;;
+	esac
+	local flags
+	case ${COMP_WORDS[1]} in
+	scan) flags="-username -password -oauth2-credentials -server -port -tls -starttls -tls-min-version -tls-max-version -compress -server-url -scan-server -delete-server -config -profile -profiles -all-profiles -log-file -debug-imap -timing -always-report -summary-json-file -notify-url -notify-on -email-report -email-on -email-from -email-html -smtp-server -smtp-user -smtp-password -max-duration -version -plan -tui -mbox -all-mailboxes -strict -list-only-dups -report -dedup-report-duplicates-only-summary -dedup-group-report-limit -dedup-group-report-spill -snippet -sort -sort-order -ignore-message-id -ignore-from -ignore-sender -ignore-reply-to -ignore-to -ignore-cc -ignore-bcc -normalize-subject -date-window -list-id -dedup-attachment-name-only -key-include-size -scope-by-sender -dedup-hash-header-raw -volatile-headers -dedup-ignore-resent-headers -key-template -preset -scope -min-group-size -report-threshold-bytes -dedup-preserve-largest -dedup-preserve-smallest -compare-strategies -strategy -dedup-key -body-bytes -fetch-buffer -hash-workers -fetch-chunk -max-dups -preserve-newest-per-sender -op-retries -uid-from -uid-to -limit -noop-keepalive -stats -format -count-only -fail-on-duplicates -dedup-sent-reconcile -sent-mbox -prefer -keep-role -drafts-mode" ;;
+	clean) flags="-username -password -oauth2-credentials -server -port -tls -starttls -tls-min-version -tls-max-version -compress -server-url -scan-server -delete-server -config -profile -profiles -all-profiles -log-file -debug-imap -timing -always-report -summary-json-file -notify-url -notify-on -email-report -email-on -email-from -email-html -smtp-server -smtp-user -smtp-password -max-duration -version -dry-run -plan -backup-dir -merge-flags -per-message-delay -allow-full-expunge -verify-before-delete -verify-after -watch -interval -max-consecutive-failures -force-lock -mbox -all-mailboxes -strict -list-only-dups -report -dedup-report-duplicates-only-summary -dedup-group-report-limit -dedup-group-report-spill -snippet -sort -sort-order -ignore-message-id -ignore-from -ignore-sender -ignore-reply-to -ignore-to -ignore-cc -ignore-bcc -normalize-subject -date-window -list-id -dedup-attachment-name-only -key-include-size -scope-by-sender -dedup-hash-header-raw -volatile-headers -dedup-ignore-resent-headers -key-template -preset -scope -min-group-size -report-threshold-bytes -dedup-preserve-largest -dedup-preserve-smallest -compare-strategies -strategy -dedup-key -body-bytes -fetch-buffer -hash-workers -fetch-chunk -max-dups -preserve-newest-per-sender -op-retries -uid-from -uid-to -limit -noop-keepalive -stats -format -count-only -fail-on-duplicates -dedup-sent-reconcile -sent-mbox -prefer -keep-role -drafts-mode" ;;
+	apply) flags="-username -password -oauth2-credentials -server -port -tls -starttls -tls-min-version -tls-max-version -compress -server-url -scan-server -delete-server -config -profile -profiles -all-profiles -log-file -debug-imap -timing -always-report -summary-json-file -notify-url -notify-on -email-report -email-on -email-from -email-html -smtp-server -smtp-user -smtp-password -max-duration -version -dry-run -tui -backup-dir -merge-flags -per-message-delay -allow-full-expunge -force-lock -op-retries -snippet -dedup-report-duplicates-only-summary -dedup-group-report-limit -dedup-group-report-spill" ;;
+	list-mailboxes) flags="-username -password -oauth2-credentials -server -port -tls -starttls -tls-min-version -tls-max-version -compress -server-url -scan-server -delete-server -config -profile -profiles -all-profiles -log-file -debug-imap -timing -always-report -summary-json-file -notify-url -notify-on -email-report -email-on -email-from -email-html -smtp-server -smtp-user -smtp-password -max-duration -version -overview -format" ;;
+	list-capabilities) flags="-username -password -oauth2-credentials -server -port -tls -starttls -tls-min-version -tls-max-version -compress -server-url -scan-server -delete-server -config -profile -profiles -all-profiles -log-file -debug-imap -timing -always-report -summary-json-file -notify-url -notify-on -email-report -email-on -email-from -email-html -smtp-server -smtp-user -smtp-password -max-duration -version" ;;
+	restore) flags="-username -password -oauth2-credentials -server -port -tls -starttls -tls-min-version -tls-max-version -compress -server-url -scan-server -delete-server -config -profile -profiles -all-profiles -log-file -debug-imap -timing -always-report -summary-json-file -notify-url -notify-on -email-report -email-on -email-from -email-html -smtp-server -smtp-user -smtp-password -max-duration -version -mbox -append-flags -force-lock" ;;
+	stats) flags="-username -password -oauth2-credentials -server -port -tls -starttls -tls-min-version -tls-max-version -compress -server-url -scan-server -delete-server -config -profile -profiles -all-profiles -log-file -debug-imap -timing -always-report -summary-json-file -notify-url -notify-on -email-report -email-on -email-from -email-html -smtp-server -smtp-user -smtp-password -max-duration -version -mbox -all-mailboxes -strict -overview -format -analyze -ignore-from -ignore-sender -ignore-reply-to -ignore-to -ignore-cc -ignore-bcc -normalize-subject -date-window -list-id -dedup-attachment-name-only -key-include-size -min-group-size -uid-from -uid-to -limit -fetch-buffer -hash-workers -fetch-chunk -op-retries" ;;
+	cross-server) flags="-username -password -oauth2-credentials -server -port -tls -starttls -tls-min-version -tls-max-version -compress -server-url -scan-server -delete-server -config -profile -profiles -all-profiles -log-file -debug-imap -timing -always-report -summary-json-file -notify-url -notify-on -email-report -email-on -email-from -email-html -smtp-server -smtp-user -smtp-password -max-duration -version -new-server-url -new-password -delete-migrated -backup-dir -per-message-delay -allow-full-expunge -force-lock -mbox -ignore-message-id -ignore-from -ignore-sender -ignore-reply-to -ignore-to -ignore-cc -ignore-bcc -normalize-subject -date-window -list-id -dedup-attachment-name-only -key-include-size -dedup-hash-header-raw -volatile-headers -dedup-ignore-resent-headers -key-template -uid-from -uid-to -limit -fetch-buffer -hash-workers -fetch-chunk -op-retries" ;;
+	completion) flags="-username -password -oauth2-credentials -server -port -tls -starttls -tls-min-version -tls-max-version -compress -server-url -scan-server -delete-server -config -profile -profiles -all-profiles -log-file -debug-imap -timing -always-report -summary-json-file -notify-url -notify-on -email-report -email-on -email-from -email-html -smtp-server -smtp-user -smtp-password -max-duration -version" ;;
+	esac
+	case ${COMP_WORDS[1]},$cur in
+	restore,-*|apply,-*|completion,-*) ;;
+	restore,*) COMPREPLY=($(compgen -d -- "$cur")); return ;;
+	apply,*) COMPREPLY=($(compgen -f -- "$cur")); return ;;
+	completion,*) COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")); return ;;
+	esac
+	COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+}
+complete -F _imap_clean_dup imap-clean-dup
@@ -0,0 +1,123 @@
+# fish completion for imap-clean-dup
+complete -c imap-clean-dup -f
+complete -c imap-clean-dup -n __fish_use_subcommand -a scan -d 'find and report duplicates without removing them'
+complete -c imap-clean-dup -n __fish_use_subcommand -a clean -d 'find and remove duplicates'
+complete -c imap-clean-dup -n __fish_use_subcommand -a apply -d 'remove the duplicates of a plan file written by scan -plan'
+complete -c imap-clean-dup -n __fish_use_subcommand -a list-mailboxes -d 'list the selectable mailboxes'
+complete -c imap-clean-dup -n __fish_use_subcommand -a list-capabilities -d 'print the capabilities of the server and which of them are used'
+complete -c imap-clean-dup -n __fish_use_subcommand -a restore -d 'append the .eml files of a backup directory to -mbox'
+complete -c imap-clean-dup -n __fish_use_subcommand -a stats -d 'print the status of mailboxes, or analyze them read-only'
+complete -c imap-clean-dup -n __fish_use_subcommand -a cross-server -d 'compare -mbox with its migrated copy on -new-server-url'
+complete -c imap-clean-dup -n __fish_use_subcommand -a completion -d 'print the completion script of a shell'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from restore' -x -a '(__fish_complete_directories)'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from apply' -F
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from completion' -x -a 'bash zsh fish'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o username -d 'IMAP user (required)' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o password -d 'IMAP password (required unless -oauth2-credentials)' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o oauth2-credentials -d 'JSON file with client_id, client_secret, refresh_token and token_url; access tokens are obtained from it and sent with XOAUTH2 instead of -password' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o server -d 'IMAP server (required)' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o port -d 'IMAP port, defaults to 993 with TLS and 143 otherwise' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o tls -d 'Connect using TLS, use -tls=false for a plain connection'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o starttls -d 'If present, a plain connection is upgraded with STARTTLS'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o tls-min-version -d 'Oldest TLS version accepted, 1.0, 1.1, 1.2 or 1.3; lower it only for legacy servers' -x -a '1.0 1.1 1.2 1.3'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o tls-max-version -d 'Newest TLS version offered, 1.0, 1.1, 1.2 or 1.3, the newest supported if empty' -x -a '1.0 1.1 1.2 1.3'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o compress -d 'COMPRESS=DEFLATE: auto compresses the traffic after login if the server advertises it, off never does' -x -a 'auto off'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o server-url -d 'IMAP URL such as imaps://user@host:993/INBOX, replacing -server, -port, -tls, -starttls, -username and -mbox' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o scan-server -d 'Server, as host or host:port, scanned instead of -server, e.g. a read replica; removal is checked against the UIDVALIDITY seen there' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o delete-server -d 'Server, as host or host:port, duplicates are removed on instead of -server' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o config -d 'TOML file setting flags by name, e.g. ~/.config/imap-clean-dup/config.toml; flags given explicitly take precedence' -r -F
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o profile -d 'Profile of the -config file to apply on top of its top level values, e.g. work for [profiles.work]' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o profiles -d 'Comma-separated profiles of the -config file to run the command for in turn, like -all-profiles' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o all-profiles -d 'If present, the command is run for every profile of the -config file in turn, e.g. one per account, followed by a table of all'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o log-file -d 'Append diagnostics to a dated file derived from this path, e.g. imap-clean-dup-2024-01-02.log' -r -F
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o debug-imap -d 'If present, the IMAP commands and responses are traced to stderr, with the credentials of LOGIN left out'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o timing -d 'If present, time, traffic and command counts of each phase are printed'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o always-report -d 'If present, the summary with the scan parameters is printed in -format at the end of every run, also with no duplicates or on failure'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o summary-json-file -d 'Write a JSON summary of the run to this file, whatever the outcome' -r -F
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o notify-url -d 'POST a JSON summary of the run to this URL at its end, e.g. a Slack or Matrix incoming webhook' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o notify-on -d 'When -notify-url is posted to: always, changes (duplicates found or errors) or errors' -x -a 'always changes errors'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o email-report -d 'Email a short summary of the run to these comma-separated addresses at its end, sent through -smtp-server' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o email-on -d 'When -email-report is sent: always, changes (duplicates found or errors) or errors' -x -a 'always changes errors'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o email-from -d 'Sender address of -email-report, -smtp-user by default' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o email-html -d 'If present, -email-report also has an HTML version'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o smtp-server -d 'SMTP server sending -email-report, as host or host:port, port 587 by default; STARTTLS is used if offered' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o smtp-user -d 'SMTP user logging in to -smtp-server, none if empty' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o smtp-password -d 'Password of -smtp-user' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o max-duration -d 'Stop the run after this long, e.g. 30m, 0 runs until done' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply list-mailboxes list-capabilities restore stats cross-server completion' -o version -d 'If present, the version is printed'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o plan -d 'Write the duplicates found to this JSON file, to be reviewed and removed later by apply; needs scan or -dry-run' -r -F
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan apply' -o tui -d 'If present, the groups of duplicates are reviewed in the terminal before scan writes -plan or apply removes them, choosing which copies to keep; only confirmed groups are kept'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean restore stats cross-server' -o mbox -d 'Mailbox to remove duplicates from, INBOX if not given or \'*\', unless -all-mailboxes is given' -x -a '(imap-clean-dup list-mailboxes 2>/dev/null)'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats' -o all-mailboxes -d 'If present, duplicates are removed from every selectable mailbox, a failing mailbox does not stop the others unless -strict'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats' -o strict -d 'If present, the run stops at the first mailbox failing with -all-mailboxes instead of continuing with the others'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o list-only-dups -d 'If present, only duplicated messages are output'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o report -d 'Output of scan and clean for each mailbox: summary prints a line per group of duplicates and a tally, messages a line per scanned message as without a command; -sort and -list-only-dups imply messages' -x -a 'summary messages'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply' -o dedup-report-duplicates-only-summary -d 'If present, instead of a line per message a line per group of duplicates and a tally are printed after the scan of each mailbox; the default of scan and clean, see -report'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply' -o dedup-group-report-limit -d 'Most messages of a mailbox held in memory for -sort, or duplicates for -dedup-report-duplicates-only-summary, 0 for no limit; see -dedup-group-report-spill for the rest' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply' -o dedup-group-report-spill -d 'What happens to the messages beyond -dedup-group-report-limit: file moves them to a temporary file, stream lists them unsorted or groups without subject' -x -a 'file stream'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply' -o snippet -d 'If set, e.g. to 120, the first characters of the text of the messages in groups of duplicates are printed after the listing, fetching at most 2048 bytes of each' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o sort -d 'Print the listing of messages after the scan sorted by uid, subject, date, sender, size or group-size instead of in fetch order' -x -a 'date group-size sender size subject uid'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o sort-order -d 'Order of -sort, asc or desc' -x -a 'asc desc'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean cross-server' -o ignore-message-id -d 'If present, MessageId is ignored, a hash for each message is instead calculated'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o ignore-from -d 'If present, from addresses are left out of the calculated hash'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o ignore-sender -d 'If present, sender addresses are left out of the calculated hash'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o ignore-reply-to -d 'If present, reply-to addresses are left out of the calculated hash'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o ignore-to -d 'If present, to addresses are left out of the calculated hash'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o ignore-cc -d 'If present, cc addresses are left out of the calculated hash'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o ignore-bcc -d 'If present, bcc addresses are left out of the calculated hash'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o normalize-subject -d 'If present, case, whitespace and Re:/Fwd: markers of the subject are ignored in the calculated hash'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o date-window -d 'If set, dates within the same window (e.g. 24h) are treated as equal in the calculated hash' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o list-id -d 'If present, the List-Id header is included in the calculated hash'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o dedup-attachment-name-only -d 'If present, the file names and sizes of the attachments are included in every key, read from the BODYSTRUCTURE without fetching attachments'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o key-include-size -d 'If present, the RFC822.SIZE of each message is included in every key, keeping apart copies of a different size without fetching bodies'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o scope-by-sender -d 'If present, messages without a Message-ID are only duplicates if their first From address is the same, even with -ignore-from, -key-template or -dedup-hash-header-raw'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean cross-server' -o dedup-hash-header-raw -d 'If present, the whole header without -volatile-headers is hashed instead of Message-ID and envelope, without fetching bodies'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean cross-server' -o volatile-headers -d 'Comma-separated headers left out by -dedup-hash-header-raw, a trailing * matches any rest' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean cross-server' -o dedup-ignore-resent-headers -d 'If present, the Resent-* headers are left out by -dedup-hash-header-raw too, so that redistributed messages are copies of the original'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean cross-server' -o key-template -d 'Go template evaluated on each message giving its key, e.g. \'{{.Subject}}|{{index .From 0}}\'; replaces Message-ID and envelope hash' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o preset -d 'Defaults for a use case: exact, aggressive or newsletters, individual flags still override them' -x -a 'aggressive exact newsletters'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o scope -d 'Where copies are looked for: mailbox, or conversation for copies within a thread linked by Message-ID, In-Reply-To and References only' -x -a 'mailbox conversation'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats' -o min-group-size -d 'Only groups with at least this many copies have their duplicates removed' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o report-threshold-bytes -d 'Only groups whose duplicates take at least this many bytes together are reported and removed, 0 handles all' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o dedup-preserve-largest -d 'If present, the largest copy of each group is kept instead of the first, e.g. the one with attachments'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o dedup-preserve-smallest -d 'If present, the smallest copy of each group is kept instead of the first'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o compare-strategies -d 'If present, the duplicates found by keying with message-id, envelope-hash, body-hash and tiered are counted and compared in a table instead, fetching the bodies once; nothing is removed'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o strategy -d 'How duplicates are detected: envelope compares Message-IDs or envelope hashes, tiered additionally confirms them by comparing bodies' -x -a 'envelope tiered'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o dedup-key -d 'What -strategy tiered compares: body for whole bodies or body-first-n-bytes for the first -body-bytes bytes and the message size' -x -a 'body body-first-n-bytes'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o body-bytes -d 'Number of body bytes compared with -dedup-key body-first-n-bytes' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o fetch-buffer -d 'Number of fetched messages buffered ahead of the key calculation' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o hash-workers -d 'Number of goroutines calculating message keys' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o fetch-chunk -d 'Number of messages fetched per command, 0 fetches the whole mailbox at once' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o max-dups -d 'Stop scanning between chunks once this many duplicates were found, 0 scans the whole mailbox' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o preserve-newest-per-sender -d 'Keep at most this many messages of each sender, removing the older ones after duplicates, 0 keeps all' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean apply stats cross-server' -o op-retries -d 'Number of times an IMAP command failing transiently, e.g. with an internal server error or a lost connection, is retried' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o uid-from -d 'Lowest UID scanned, * leaves the range open' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o uid-to -d 'Highest UID scanned, * leaves the range open' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean stats cross-server' -o limit -d 'Scan only the first this many messages of each mailbox in UID order, e.g. to try settings on a slice, 0 scans all' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o noop-keepalive -d 'Send a NOOP between fetch chunks once this long passed since the last one, 0 disables it' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o stats -d 'If present, the mailbox status including its flags and permanent flags is printed'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean list-mailboxes stats' -o format -d 'Format of the mailbox status report and -always-report, text or json' -x -a 'text json'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o count-only -d 'If present, only the number of duplicates is printed and nothing is removed'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o fail-on-duplicates -d 'If present, the exit code is 4 if any duplicates were found'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o dedup-sent-reconcile -d 'If present, messages in both -mbox and -sent-mbox with the same Message-ID and From are reconciled instead, keeping the copy of -prefer'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o sent-mbox -d 'Mailbox of sent messages for -dedup-sent-reconcile' -x -a '(imap-clean-dup list-mailboxes 2>/dev/null)'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o prefer -d 'Copy kept by -dedup-sent-reconcile: inbox (the -mbox copy) or sent' -x -a 'inbox sent'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o keep-role -d 'Special-use role of the mailbox whose copies are kept, e.g. inbox or archive; copies of its messages in -mbox or every mailbox are removed' -x -a 'all archive drafts flagged important inbox junk sent trash'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from scan clean' -o drafts-mode -d 'Handling of the drafts mailbox, whose versions of a draft share a Message-ID: skip it with -all-mailboxes, safe (only identical bodies, keeping the newest) or normal' -x -a 'skip safe normal'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean apply' -o dry-run -d 'If present, no removal will be performed'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean apply cross-server' -o backup-dir -d 'Save removed duplicates as .eml files below this directory first, together with a restore.sh' -x -a '(__fish_complete_directories)'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean apply' -o merge-flags -d 'If present, the flags of removed duplicates, such as \\Seen, \\Flagged and keywords, are added to the copy kept'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean apply cross-server' -o per-message-delay -d 'Wait this long between removing two messages, e.g. 500ms, for servers failing under quick successions of STORE and EXPUNGE' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean apply cross-server' -o allow-full-expunge -d 'If present, on servers without UIDPLUS duplicates are also removed from mailboxes where other messages are flagged \\Deleted, which EXPUNGE then removes too'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean' -o verify-before-delete -d 'If present, the Message-ID and subject of every kept copy and duplicate are fetched again before removal, duplicates of a message which changed since the scan are not removed'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean' -o verify-after -d 'If present, each mailbox duplicates were removed from is scanned again to check that all kept copies exist and no duplicates are left'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean' -o watch -d 'If present, after the first pass the connection is kept open and duplicates of messages arriving in -mbox are handled as they arrive, using IDLE if the server has it, until interrupted'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean' -o interval -d 'If set, e.g. 1h, the run repeats this long after each cycle until interrupted, only fetching the messages arrived since after the first pass' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean' -o max-consecutive-failures -d 'Number of failed -interval cycles in a row after which the run exits with 1, 0 never exits' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from clean apply restore cross-server' -o force-lock -d 'If present, the lock of a mailbox held by a run which no longer exists is taken over'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from list-mailboxes stats' -o overview -d 'If present, list-mailboxes and stats print the number of messages, unseen messages and the next UID of each mailbox, asked with STATUS without selecting it'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from restore' -o append-flags -d 'Flags set on messages uploaded by -append, e.g. \'\\Seen,\\Flagged\'' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from stats' -o analyze -d 'If present, stats scans each mailbox read-only and reports its size, date range, duplicates by strategy, top senders and a size histogram'
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from cross-server' -o new-server-url -d 'IMAP URL of the mailbox a migration copied -mbox to, e.g. imaps://user@new.example.org/INBOX, compared by cross-server' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from cross-server' -o new-password -d 'Password of the user of -new-server-url' -x
+complete -c imap-clean-dup -n '__fish_seen_subcommand_from cross-server' -o delete-migrated -d 'If present, cross-server removes the messages found on both servers from the old one, never touching the new one'
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// errNoTerminal is returned by runReview if stdin or stdout is not a
+// terminal.
+var errNoTerminal = errors.New("-tui needs a terminal; without one, check the plan written by scan -plan and remove its duplicates with apply")
+
+// copyInfo is what the review shows of a message besides its mailbox
+// and UID.
+type copyInfo struct {
+	Date    time.Time
+	Size    uint32
+	Flags   []string
+	Subject string
+}
+
+// copyDetails fetches the copyInfo of the messages of groups, by
+// mailbox and UID, examining each mailbox read-only. Messages gone
+// since are left out.
+func copyDetails(c dedup.Client, groups []PlanGroup) (map[string]map[uint32]copyInfo, error) {
+	uids := make(map[string][]uint32)
+	for _, g := range groups {
+		keeperMbox := g.Mailbox
+		if g.KeeperMailbox != "" {
+			keeperMbox = g.KeeperMailbox
+		}
+		uids[keeperMbox] = append(uids[keeperMbox], g.Keeper)
+		if len(g.Duplicates) > 0 {
+			uids[g.Mailbox] = append(uids[g.Mailbox], g.Duplicates...)
+		}
+	}
+	var names []string
+	for mbox := range uids {
+		names = append(names, mbox)
+	}
+	sort.Strings(names)
+
+	details := make(map[string]map[uint32]copyInfo)
+	for _, mbox := range names {
+		if _, err := c.Select(mbox, true); err != nil {
+			return nil, &dedup.Error{Op: "select", Mailbox: mbox, Err: err}
+		}
+		seqset := &imap.SeqSet{}
+		seqset.AddNum(uids[mbox]...)
+		items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchEnvelope}
+		msgChan := make(chan *imap.Message, 16)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- c.UidFetch(seqset, items, msgChan)
+		}()
+		details[mbox] = make(map[uint32]copyInfo)
+		for msg := range msgChan {
+			info := copyInfo{Date: msg.InternalDate, Size: msg.Size, Flags: msg.Flags}
+			if msg.Envelope != nil {
+				info.Subject = msg.Envelope.Subject
+			}
+			details[mbox][msg.Uid] = info
+		}
+		if err := <-errChan; err != nil {
+			return nil, &dedup.Error{Op: "fetch", Mailbox: mbox, Set: seqset, Err: err}
+		}
+	}
+	return details, nil
+}
+
+// reviewAction is how a review ended.
+type reviewAction int
+
+const (
+	// reviewAbandon leaves the plan as it was.
+	reviewAbandon reviewAction = iota
+	// reviewSave keeps the confirmed groups in the plan.
+	reviewSave
+	// reviewRemove keeps the confirmed groups in the plan and removes
+	// their duplicates.
+	reviewRemove
+)
+
+// reviewCopy is a message of a group under review.
+type reviewCopy struct {
+	mbox   string
+	uid    uint32
+	info   copyInfo
+	known  bool
+	remove bool
+}
+
+// reviewGroup is a group under review, its keeper first among copies.
+type reviewGroup struct {
+	group     PlanGroup
+	copies    []reviewCopy
+	expanded  bool
+	confirmed bool
+}
+
+// review is the state of the terminal review of the groups of a plan:
+// a list of groups, largest first, each expandable to its copies, whose
+// keep or remove decisions can be toggled. Only confirmed groups end up
+// in the plan.
+type review struct {
+	groups []*reviewGroup
+	// removable allows ending the review with reviewRemove.
+	removable bool
+	// cursor is the row selected, top the first one shown.
+	cursor, top int
+	// height is the number of lines of the terminal.
+	height int
+	status string
+}
+
+// newReview returns the review of groups with the details of their
+// copies, which may be incomplete.
+func newReview(groups []PlanGroup, details map[string]map[uint32]copyInfo, height int, removable bool) *review {
+	r := &review{height: height, removable: removable}
+	for _, g := range groups {
+		rg := &reviewGroup{group: g}
+		keeperMbox := g.Mailbox
+		if g.KeeperMailbox != "" {
+			keeperMbox = g.KeeperMailbox
+		}
+		info, known := details[keeperMbox][g.Keeper]
+		rg.copies = append(rg.copies, reviewCopy{mbox: keeperMbox, uid: g.Keeper, info: info, known: known})
+		for _, uid := range g.Duplicates {
+			info, known := details[g.Mailbox][uid]
+			rg.copies = append(rg.copies, reviewCopy{mbox: g.Mailbox, uid: uid, info: info, known: known, remove: true})
+		}
+		r.groups = append(r.groups, rg)
+	}
+	// the groups with the most copies, then wasting the most, first
+	sort.SliceStable(r.groups, func(i, j int) bool {
+		a, b := r.groups[i], r.groups[j]
+		if len(a.copies) != len(b.copies) {
+			return len(a.copies) > len(b.copies)
+		}
+		return a.wasted() > b.wasted()
+	})
+	return r
+}
+
+// wasted returns the size of the copies of g to be removed.
+func (g *reviewGroup) wasted() int64 {
+	var n int64
+	for _, c := range g.copies {
+		if c.remove {
+			n += int64(c.info.Size)
+		}
+	}
+	return n
+}
+
+// removals returns the number of copies of g to be removed.
+func (g *reviewGroup) removals() int {
+	n := 0
+	for _, c := range g.copies {
+		if c.remove {
+			n++
+		}
+	}
+	return n
+}
+
+// planGroup returns g with the decisions of the review: the keeper is
+// kept if it still is, the first copy kept otherwise, and the copies
+// to be removed are its duplicates. Other copies kept are left out.
+func (g *reviewGroup) planGroup() PlanGroup {
+	pg := g.group
+	pg.Duplicates = nil
+	if g.copies[0].remove {
+		for _, c := range g.copies[1:] {
+			if !c.remove {
+				pg.Keeper = c.uid
+				break
+			}
+		}
+	}
+	for _, c := range g.copies {
+		if c.remove {
+			pg.Duplicates = append(pg.Duplicates, c.uid)
+		}
+	}
+	return pg
+}
+
+// row is a line of the list, a group or one of its copies.
+type row struct {
+	group *reviewGroup
+	// copy is the index of the copy, -1 for the group itself.
+	copy int
+}
+
+// rows returns the lines of the list, the copies of expanded groups
+// below them.
+func (r *review) rows() []row {
+	var rows []row
+	for _, g := range r.groups {
+		rows = append(rows, row{g, -1})
+		if g.expanded {
+			for i := range g.copies {
+				rows = append(rows, row{g, i})
+			}
+		}
+	}
+	return rows
+}
+
+// Keys of the review besides the arrows.
+const (
+	keyCtrlC = 0x03
+	keyEnter = '\r'
+)
+
+// Keys decoded from escape sequences.
+const (
+	keyUp = 0x100 + iota
+	keyDown
+	keyRight
+	keyLeft
+)
+
+// readKey returns the next key of in, decoding the arrow keys.
+func readKey(in *bufio.Reader) (int, error) {
+	b, err := in.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0x1b || in.Buffered() < 2 {
+		return int(b), nil
+	}
+	if next, _ := in.Peek(2); next[0] == '[' {
+		in.Discard(2)
+		switch next[1] {
+		case 'A':
+			return keyUp, nil
+		case 'B':
+			return keyDown, nil
+		case 'C':
+			return keyRight, nil
+		case 'D':
+			return keyLeft, nil
+		}
+	}
+	return int(b), nil
+}
+
+// handle applies key to the review and reports whether it ended, and
+// how.
+func (r *review) handle(key int) (bool, reviewAction) {
+	rows := r.rows()
+	r.status = ""
+	if len(rows) == 0 {
+		switch key {
+		case 'q':
+			return true, reviewSave
+		case keyCtrlC:
+			return true, reviewAbandon
+		}
+		return false, 0
+	}
+	cur := rows[r.cursor]
+	switch key {
+	case 'j', keyDown:
+		if r.cursor < len(rows)-1 {
+			r.cursor++
+		}
+	case 'k', keyUp:
+		if r.cursor > 0 {
+			r.cursor--
+		}
+	case keyEnter, 'l', keyRight, 'h', keyLeft:
+		expand := key == keyEnter && !cur.group.expanded || key == 'l' || key == keyRight
+		if cur.group.expanded != expand {
+			cur.group.expanded = expand
+			// the cursor stays on the group
+			for i, rw := range r.rows() {
+				if rw.group == cur.group && rw.copy == -1 {
+					r.cursor = i
+				}
+			}
+		}
+	case ' ':
+		if cur.copy < 0 {
+			r.status = "expand the group to choose the copies to keep"
+			break
+		}
+		c := &cur.group.copies[cur.copy]
+		switch {
+		case cur.copy == 0 && cur.group.group.KeeperMailbox != "":
+			r.status = "the kept copy is in " + c.mbox + ", it cannot be removed here"
+		case !c.remove && cur.group.removals() == len(cur.group.copies)-1:
+			r.status = "a group keeps at least one copy"
+		default:
+			c.remove = !c.remove
+		}
+	case 'c':
+		cur.group.confirmed = !cur.group.confirmed
+	case 'A':
+		for _, g := range r.groups {
+			g.confirmed = true
+		}
+	case 'q':
+		return true, reviewSave
+	case 'x':
+		if !r.removable {
+			r.status = "x only removes with apply, q writes the plan"
+			break
+		}
+		return true, reviewRemove
+	case keyCtrlC:
+		return true, reviewAbandon
+	}
+	return false, 0
+}
+
+// result returns the groups of the plan after the review: the
+// confirmed ones still removing copies, largest first.
+func (r *review) result() []PlanGroup {
+	groups := []PlanGroup{}
+	for _, g := range r.groups {
+		if g.confirmed && g.removals() > 0 {
+			groups = append(groups, g.planGroup())
+		}
+	}
+	return groups
+}
+
+// render writes the screen of the review to w, with CRLF line endings
+// as the terminal is in raw mode.
+func (r *review) render(w io.Writer) {
+	rows := r.rows()
+	confirmed, removals := 0, 0
+	for _, g := range r.groups {
+		if g.confirmed {
+			confirmed++
+			removals += g.removals()
+		}
+	}
+	lines := []string{fmt.Sprintf("review: %d groups, %d confirmed removing %d messages", len(r.groups), confirmed, removals)}
+
+	// the rows fit between the header and the two lines of help and
+	// status, scrolled to keep the cursor in view
+	visible := r.height - 3
+	if visible < 1 {
+		visible = 1
+	}
+	if r.cursor < r.top {
+		r.top = r.cursor
+	} else if r.cursor >= r.top+visible {
+		r.top = r.cursor - visible + 1
+	}
+	for i := r.top; i < len(rows) && i < r.top+visible; i++ {
+		line := r.line(rows[i])
+		if i == r.cursor {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) < visible+1 {
+		lines = append(lines, "")
+	}
+
+	help := "j/k move  enter expand  space keep/remove  c confirm  A confirm all  q write plan"
+	if r.removable {
+		help += "  x write and remove"
+	}
+	lines = append(lines, help+"  ctrl-c abandon", r.status)
+	fmt.Fprint(w, "\x1b[H\x1b[2J"+strings.Join(lines, "\x1b[K\r\n"))
+}
+
+// line returns the text of rw.
+func (r *review) line(rw row) string {
+	g := rw.group
+	if rw.copy < 0 {
+		mark := "[ ]"
+		if g.confirmed {
+			mark = "[x]"
+		}
+		subject := g.copies[0].info.Subject
+		if env, ok := g.group.Envelopes[g.group.Keeper]; ok && subject == "" {
+			subject = env.Subject
+		}
+		return fmt.Sprintf("%s %d copies in %s, %d to remove (%s): %q", mark, len(g.copies), g.group.Mailbox, g.removals(), byteSize(g.wasted()), subject)
+	}
+	c := g.copies[rw.copy]
+	decision := "keep  "
+	if c.remove {
+		decision = "remove"
+	}
+	if !c.known {
+		return fmt.Sprintf("      %s %s %d (gone)", decision, c.mbox, c.uid)
+	}
+	return fmt.Sprintf("      %s %s %d  %s  %s  %s", decision, c.mbox, c.uid, c.info.Date.Format("2006-01-02 15:04"), byteSize(int64(c.info.Size)), strings.Join(c.info.Flags, " "))
+}
+
+// reviewGroups runs the review of groups on in and out until it ends,
+// returning the groups to be kept in the plan and how it ended. EOF
+// of in abandons the review.
+func reviewGroups(in io.Reader, out io.Writer, height int, groups []PlanGroup, details map[string]map[uint32]copyInfo, removable bool) ([]PlanGroup, reviewAction, error) {
+	r := newReview(groups, details, height, removable)
+	keys := bufio.NewReader(in)
+	for {
+		r.render(out)
+		key, err := readKey(keys)
+		if err == io.EOF {
+			return nil, reviewAbandon, nil
+		}
+		if err != nil {
+			return nil, reviewAbandon, err
+		}
+		if done, action := r.handle(key); done {
+			if action == reviewAbandon {
+				return nil, action, nil
+			}
+			return r.result(), action, nil
+		}
+	}
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// stty runs stty with args on the terminal of stdin.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// rawTerminal holds the settings of the terminal while the review has
+// it in raw mode.
+var rawTerminal struct {
+	mu    sync.Mutex
+	saved string
+}
+
+// restoreTerminal leaves the alternate screen and restores the settings
+// of the terminal if the review has it in raw mode, also when the run
+// exits on a second interrupt during the review.
+func restoreTerminal() {
+	rawTerminal.mu.Lock()
+	defer rawTerminal.mu.Unlock()
+	if rawTerminal.saved == "" {
+		return
+	}
+	fmt.Print("\x1b[?25h\x1b[?1049l")
+	stty(rawTerminal.saved)
+	rawTerminal.saved = ""
+}
+
+// runReview reviews groups on the terminal, in raw mode and on the
+// alternate screen, which are both restored afterwards. It returns
+// errNoTerminal if stdin or stdout is not a terminal.
+func runReview(groups []PlanGroup, details map[string]map[uint32]copyInfo, removable bool) ([]PlanGroup, reviewAction, error) {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return nil, reviewAbandon, errNoTerminal
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, reviewAbandon, fmt.Errorf("%w (stty: %v)", errNoTerminal, err)
+	}
+	height := 24
+	if size, err := stty("size"); err == nil {
+		fmt.Sscan(size, &height)
+	}
+	rawTerminal.mu.Lock()
+	if _, err := stty("raw", "-echo"); err != nil {
+		rawTerminal.mu.Unlock()
+		return nil, reviewAbandon, fmt.Errorf("%w (stty: %v)", errNoTerminal, err)
+	}
+	rawTerminal.saved = saved
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	rawTerminal.mu.Unlock()
+	defer restoreTerminal()
+	return reviewGroups(os.Stdin, os.Stdout, height, groups, details, removable)
+}
+
+// review reviews groups on the terminal with the details of their
+// copies fetched on the scan connection.
+func (cl *cleaner) review(ctx context.Context, groups []PlanGroup, removable bool) ([]PlanGroup, reviewAction, error) {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return nil, reviewAbandon, errNoTerminal
+	}
+	details, err := copyDetails(cl.retrying(ctx, cl.scan), groups)
+	if err != nil {
+		return nil, reviewAbandon, err
+	}
+	return runReview(groups, details, removable)
+}
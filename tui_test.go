@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+// reviewed are the groups reviewed by TestReviewGroups, listed by the
+// review in the order g2, g1, g3.
+var reviewed = []PlanGroup{
+	{Mailbox: "INBOX", Keeper: 1, Duplicates: []uint32{3}},
+	{Mailbox: "INBOX", Keeper: 2, Duplicates: []uint32{4, 5}},
+	{Mailbox: "Archive", KeeperMailbox: "INBOX", Keeper: 6, Duplicates: []uint32{2}},
+}
+
+func TestReviewGroups(t *testing.T) {
+	g1, g2, g3 := reviewed[0], reviewed[1], reviewed[2]
+	details := map[string]map[uint32]copyInfo{
+		"INBOX":   {1: {Size: 100}, 2: {Size: 10}, 3: {Size: 100}, 4: {Size: 10}, 5: {Size: 10}, 6: {Size: 50}},
+		"Archive": {2: {Size: 50}},
+	}
+	for _, test := range []struct {
+		name      string
+		keys      string
+		removable bool
+		groups    []PlanGroup
+		action    reviewAction
+		// status is part of the screen, if not empty.
+		status string
+	}{
+		{"nothing confirmed", "q", false, []PlanGroup{}, reviewSave, ""},
+		{"all confirmed", "Aq", false, []PlanGroup{g2, g1, g3}, reviewSave, ""},
+		{"confirmed twice", "ccq", false, []PlanGroup{}, reviewSave, ""},
+		{"abandoned", "A\x03", false, nil, reviewAbandon, ""},
+		{"end of input", "A", false, nil, reviewAbandon, ""},
+		{"remove", "Ax", true, []PlanGroup{g2, g1, g3}, reviewRemove, ""},
+		{"remove without apply", "Ax", false, nil, reviewAbandon, "x only removes with apply"},
+		{"arrow down", "\x1b[Bcq", false, []PlanGroup{g1}, reviewSave, ""},
+		{"arrow up", "jjk\x1b[Acq", false, []PlanGroup{g2}, reviewSave, ""},
+		{"past the end", "jjjjcq", false, []PlanGroup{g3}, reviewSave, ""},
+		{"keep a duplicate", "\rjj cq", false, []PlanGroup{{Mailbox: "INBOX", Keeper: 2, Duplicates: []uint32{5}}}, reviewSave, ""},
+		{"remove the keeper", "\rjj k cq", false, []PlanGroup{{Mailbox: "INBOX", Keeper: 4, Duplicates: []uint32{2, 5}}}, reviewSave, ""},
+		{"keep all", "\rjj j cq", false, []PlanGroup{}, reviewSave, ""},
+		{"remove all", "\rj q", false, []PlanGroup{}, reviewSave, "a group keeps at least one copy"},
+		{"keeper elsewhere", "jj\x1b[Cj cq", false, []PlanGroup{g3}, reviewSave, "it cannot be removed here"},
+		{"toggle a group", " q", false, []PlanGroup{}, reviewSave, "expand the group"},
+		{"collapse", "\rjjhcq", false, []PlanGroup{g2}, reviewSave, ""},
+		{"collapse with enter", "\rjj\rjcq", false, []PlanGroup{g1}, reviewSave, ""},
+		{"expand with l", "ljjj\x1b[Dcq", false, []PlanGroup{g2}, reviewSave, ""},
+	} {
+		var screen bytes.Buffer
+		groups, action, err := reviewGroups(strings.NewReader(test.keys), &screen, 24, reviewed, details, test.removable)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if action != test.action || !reflect.DeepEqual(groups, test.groups) {
+			t.Errorf("%s: got %v, action %d", test.name, groups, action)
+		}
+		if test.status != "" && !strings.Contains(screen.String(), test.status) {
+			t.Errorf("%s: got screen without %q", test.name, test.status)
+		}
+	}
+}
+
+func TestReviewRender(t *testing.T) {
+	details := map[string]map[uint32]copyInfo{"INBOX": {2: {Size: 2048, Flags: []string{`\Seen`}}}}
+	var screen bytes.Buffer
+	if _, _, err := reviewGroups(strings.NewReader("\rc"), &screen, 24, reviewed, details, true); err != nil {
+		t.Fatal(err)
+	}
+	// the last screen after expanding and confirming the largest group
+	got := screen.String()
+	got = got[strings.LastIndex(got, "\x1b[H"):]
+	for _, want := range []string{
+		"review: 3 groups, 1 confirmed removing 2 messages",
+		`[x] 3 copies in INBOX, 2 to remove (0 B)`,
+		`keep   INBOX 2  0001-01-01 00:00  2.0 KiB  \Seen`,
+		"remove INBOX 4 (gone)",
+		"x write and remove",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got screen without %q:\n%q", want, got)
+		}
+	}
+
+	// the list scrolls to keep the cursor in view
+	screen.Reset()
+	if _, _, err := reviewGroups(strings.NewReader("jj"), &screen, 4, reviewed, details, true); err != nil {
+		t.Fatal(err)
+	}
+	got = screen.String()
+	got = got[strings.LastIndex(got, "\x1b[H"):]
+	if !strings.Contains(got, "in Archive") || strings.Contains(got, "3 copies") {
+		t.Errorf("got screen:\n%q", got)
+	}
+}
+
+func TestCopyDetails(t *testing.T) {
+	s := dupServer(t)
+	c := s.Dial(t)
+	s.SetFlags(t, "INBOX", 3, `\Seen`)
+	groups := []PlanGroup{
+		{Mailbox: "INBOX", Keeper: 1, Duplicates: []uint32{3, 99}},
+		{Mailbox: "Archive", KeeperMailbox: "INBOX", Keeper: 2, Duplicates: nil},
+	}
+	s.Create(t, "Archive")
+	details, err := copyDetails(c, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := details["INBOX"]
+	if len(inbox) != 3 || len(details["Archive"]) != 0 {
+		t.Fatalf("got details %v", details)
+	}
+	if inbox[1].Subject != "A" || inbox[2].Subject != "B" || inbox[3].Size == 0 || inbox[3].Date.IsZero() {
+		t.Errorf("got details %v", inbox)
+	}
+	if !reflect.DeepEqual(inbox[3].Flags, []string{`\Seen`}) {
+		t.Errorf("got flags %v", inbox[3].Flags)
+	}
+
+	// a mailbox gone since is named in the error
+	_, err = copyDetails(c, []PlanGroup{{Mailbox: "Gone", Keeper: 1, Duplicates: []uint32{2}}})
+	var derr *dedup.Error
+	if !errors.As(err, &derr) || derr.Op != "select" || derr.Mailbox != "Gone" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+// TestRunReviewedPlan applies a plan as the review writes it, with
+// another copy kept, and checks that -tui refuses to run without a
+// terminal.
+func TestRunReviewedPlan(t *testing.T) {
+	s := dupServer(t)
+	path := t.TempDir() + "/plan.json"
+	if code, _, stderr := runMain(t, nil, args(s, "scan", "-plan", path)...); code != 0 {
+		t.Fatalf("scan: exit code %d, stderr:\n%s", code, stderr)
+	}
+	plan, err := readPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the group of C is listed first, keeping its last copy instead of
+	// the first
+	plan.Groups, _, err = reviewGroups(strings.NewReader("\rjjj kk Aq"), &bytes.Buffer{}, 24, plan.Groups, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.write(path); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, stderr := runMain(t, nil, args(s, "apply", path)...); code != 0 {
+		t.Fatalf("apply: exit code %d, stderr:\n%s", code, stderr)
+	}
+	if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, []uint32{1, 2, 6}) {
+		t.Errorf("got UIDs %v left", uids)
+	}
+
+	for _, cmd := range [][]string{{"scan", "-tui", "-plan", path}, {"apply", "-tui", path}, {"scan", "-tui"}} {
+		code, _, stderr := runMain(t, nil, args(s, cmd[0], cmd[1:]...)...)
+		if code != exitUsage || !strings.Contains(stderr, "-tui needs") {
+			t.Errorf("%v: got exit code %d, stderr:\n%s", cmd, code, stderr)
+		}
+	}
+}
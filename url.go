@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ServerURL holds the connection parameters of an IMAP URL such as
+// imaps://user@host:993/INBOX, loosely following RFC 5092.
+type ServerURL struct {
+	Username string
+	Server   string
+	Port     int
+	// TLS is set for imaps URLs, imap URLs use STARTTLS.
+	TLS  bool
+	Mbox string
+}
+
+// ParseServerURL parses an imap or imaps URL. Passwords are rejected,
+// they must come from a separate source.
+func ParseServerURL(s string) (*ServerURL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	su := &ServerURL{Server: u.Hostname()}
+	switch u.Scheme {
+	case "imaps":
+		su.TLS = true
+	case "imap":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected imap or imaps", u.Scheme)
+	}
+	if su.Server == "" {
+		return nil, fmt.Errorf("missing host in %q", s)
+	}
+	if p := u.Port(); p != "" {
+		if su.Port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return nil, fmt.Errorf("the URL must not contain a password")
+		}
+		// drop the authentication mechanism, as in user;AUTH=*
+		su.Username = strings.SplitN(u.User.Username(), ";", 2)[0]
+	}
+	// drop the UIDVALIDITY and other parameters, as in INBOX;UIDVALIDITY=1
+	su.Mbox = strings.SplitN(strings.TrimPrefix(u.Path, "/"), ";", 2)[0]
+	return su, nil
+}
+
+// mergeURLValue sets *value from the URL unless it was given
+// separately with a different value.
+func mergeURLValue(name string, value *string, fromURL string) error {
+	if fromURL == "" {
+		return nil
+	}
+	if *value != "" && *value != fromURL {
+		return fmt.Errorf("-%s %q conflicts with -server-url", name, *value)
+	}
+	*value = fromURL
+	return nil
+}
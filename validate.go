@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// problems collects what is wrong with the flags of a run, so that all
+// of it is reported at once before connecting.
+type problems []string
+
+// check records the problem described by format and args unless ok.
+func (p *problems) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		*p = append(*p, fmt.Sprintf(format, args...))
+	}
+}
+
+// oneOf records a problem unless value is one of values.
+func (p *problems) oneOf(name, value string, values ...string) {
+	p.check(contains(values, value), "-%s must be %s, not %q", name, alternatives(values), value)
+}
+
+// print writes the problems to w on one line, followed by where to find
+// the usage of command.
+func (p problems) print(w io.Writer, command string) {
+	fmt.Fprintln(w, strings.Join(p, "; "))
+	if command != "" {
+		fmt.Fprintf(w, "run '%s %s -h' for usage\n", os.Args[0], command)
+	} else {
+		fmt.Fprintf(w, "run '%s -h' for usage\n", os.Args[0])
+	}
+}
+
+// alternatives returns values as "a, b or c".
+func alternatives(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return strings.Join(values[:len(values)-1], ", ") + " or " + values[len(values)-1]
+}
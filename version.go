@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build information, set with e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Unset values are taken from the build information of the binary
+// where available, as for go install builds.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// buildVersion describes the running binary.
+type buildVersion struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	// IMAP is the version of the go-imap dependency.
+	IMAP string
+}
+
+// currentVersion returns the version of the running binary, filling in
+// what was not set by the linker from the embedded build information.
+func currentVersion() buildVersion {
+	v := buildVersion{Version: version, Commit: commit, BuildDate: buildDate}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v.Version == "" {
+			v.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && v.Commit == "":
+				v.Commit = s.Value
+			case s.Key == "vcs.time" && v.BuildDate == "":
+				v.BuildDate = s.Value
+			}
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/emersion/go-imap" {
+				v.IMAP = dep.Version
+				if dep.Replace != nil {
+					v.IMAP = dep.Replace.Version
+				}
+			}
+		}
+	}
+	if v.Version == "" || v.Version == "(devel)" {
+		v.Version = "devel"
+	}
+	for _, s := range []*string{&v.Commit, &v.BuildDate, &v.IMAP} {
+		if *s == "" {
+			*s = "unknown"
+		}
+	}
+	return v
+}
+
+// String returns the version in a single line.
+func (v buildVersion) String() string {
+	return fmt.Sprintf("imap-clean-dup %s (commit %s, built %s, go-imap %s)", v.Version, v.Commit, v.BuildDate, v.IMAP)
+}
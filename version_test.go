@@ -0,0 +1,36 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// TestVersion checks that -version prints something sane in a test
+// binary, built without -ldflags, and that values set by the linker
+// take precedence.
+func TestVersion(t *testing.T) {
+	code, stdout, stderr := runMain(t, nil, "-version")
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	line := regexp.MustCompile(`^imap-clean-dup (\S+) \(commit \S+, built \S+, go-imap (\S+)\)\n$`)
+	m := line.FindStringSubmatch(stdout)
+	if m == nil {
+		t.Fatalf("got stdout %q", stdout)
+	}
+	if m[1] != "devel" || m[2] != "v1.0.5" {
+		t.Errorf("got version %s, go-imap %s", m[1], m[2])
+	}
+
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.2.0", "0123abc", "2024-05-01T10:00:00Z"
+	_, stdout, _ = runMain(t, nil, "-version")
+	if want := "imap-clean-dup 1.2.0 (commit 0123abc, built 2024-05-01T10:00:00Z, go-imap v1.0.5)\n"; stdout != want {
+		t.Errorf("got stdout %q, want %q", stdout, want)
+	}
+	if v := NewMailboxReport(&imap.MailboxStatus{Name: "INBOX"}).Version; v != "1.2.0" {
+		t.Errorf("report of version %q", v)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/tomasvitek/imap-clean-dup/dedup"
+)
+
+const (
+	// idleRestart is how long an IDLE lasts before it is restarted,
+	// below the 30 minutes after which servers may log out idle
+	// clients (RFC 2177).
+	idleRestart = 25 * time.Minute
+	// reconnectMax is the longest wait between two attempts to
+	// reconnect while watching or between -interval cycles.
+	reconnectMax = 5 * time.Minute
+	// logoutTimeout is how long the LOGOUT of a replaced connection is
+	// waited for before it is closed.
+	logoutTimeout = 10 * time.Second
+)
+
+// watchPoll is how often a mailbox is checked for new messages on
+// servers without IDLE, shortened by the tests.
+var watchPoll = time.Minute
+
+// idleCommand is the IDLE command (RFC 2177).
+type idleCommand struct{}
+
+func (idleCommand) Command() *imap.Command {
+	return &imap.Command{Name: "IDLE"}
+}
+
+// idleHandler ends an IDLE with DONE once stop is closed.
+type idleHandler struct {
+	stop    <-chan struct{}
+	replies chan []byte
+}
+
+func (h *idleHandler) Handle(resp imap.Resp) error {
+	if _, ok := resp.(*imap.ContinuationReq); !ok {
+		return responses.ErrUnhandled
+	}
+	go func() {
+		<-h.stop
+		h.replies <- []byte("DONE\r\n")
+	}()
+	return nil
+}
+
+func (h *idleHandler) Replies() <-chan []byte {
+	return h.replies
+}
+
+// idle issues IDLE on c until ctx is done, arrived receives or timeout
+// passes.
+func idle(ctx context.Context, c *client.Client, arrived <-chan struct{}, timeout time.Duration) error {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-arrived:
+		case <-time.After(timeout):
+		case <-done:
+		}
+		close(stop)
+	}()
+	status, err := c.Execute(idleCommand{}, &idleHandler{stop: stop, replies: make(chan []byte, 1)})
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// notifyArrivals sets the updates of c to signal arrived whenever the
+// number of messages of the selected mailbox changes.
+func notifyArrivals(c *client.Client, arrived chan struct{}) {
+	updates := make(chan client.Update, 64)
+	c.Updates = updates
+	go func() {
+		for u := range updates {
+			if _, ok := u.(*client.MailboxUpdate); ok {
+				select {
+				case arrived <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+}
+
+// watch keeps removing the duplicates of messages arriving in mbox
+// after the first pass, whose result is res, until ctx is done. New
+// messages are waited for with IDLE if the server has it and polled for
+// otherwise; their keys are checked against those of the messages
+// already in the mailbox, which are fetched once, or the mailbox is
+// scanned again if the configuration needs that (see dedup.Index). A
+// lost connection is
+// reopened with reopen, waiting longer after each failed attempt. The
+// duplicates found and removed while watching are added to res.
+func (cl *cleaner) watch(ctx context.Context, mbox string, res MailboxResult, reopen func() (*client.Client, error)) MailboxResult {
+	release, err := cl.locks.hold(mbox)
+	if err != nil {
+		cl.logger.Error("cannot lock mailbox", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "cannot watch: %s\n", err)
+		res.Err = err
+		return res
+	}
+	defer release()
+
+	arrived := make(chan struct{}, 1)
+	notifyArrivals(cl.scan, arrived)
+	var index *dedup.Index
+	found, removed, start := 0, 0, time.Now()
+	for ctx.Err() == nil {
+		if index == nil {
+			index, err = dedup.NewIndex(ctx, cl.retrying(ctx, cl.scan), mbox, cl.config(mbox))
+			if err == nil {
+				cl.logger.Info("watching", "mailbox", mbox, "uid_next", index.UIDNext, "idle", cl.caps[cl.scan].Has("IDLE"))
+				fmt.Printf("%s: watching for new messages, interrupt to stop\n", mbox)
+			}
+		} else if cl.caps[cl.scan].Has("IDLE") {
+			err = idle(ctx, cl.scan, arrived, idleRestart)
+		} else {
+			select {
+			case <-ctx.Done():
+			case <-arrived:
+			case <-time.After(watchPoll):
+			}
+		}
+		if err == nil && ctx.Err() == nil {
+			var groups []dedup.Group
+			if groups, err = index.Update(ctx, cl.retrying(ctx, cl.scan)); err == nil && len(groups) > 0 {
+				if cl.sorted != nil {
+					cl.sorted.flush(os.Stdout)
+				}
+				r := cl.apply(ctx, mbox, groups)
+				found, removed = found+r.Found, removed+r.Removed
+				res.Found, res.Removed, res.Expunged = res.Found+r.Found, res.Removed+r.Removed, res.Expunged+r.Expunged
+				err = r.Err
+			}
+		}
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+
+		cl.logger.Warn("watching failed, reconnecting", "mailbox", mbox, "err", err)
+		fmt.Fprintf(os.Stderr, "warning: watching %s failed, reconnecting: %s\n", mbox, err)
+		if cl.reconnect(ctx, reopen) {
+			notifyArrivals(cl.c, arrived)
+		}
+	}
+	cl.logger.Info("stopped watching", "mailbox", mbox, "found", found, "removed", removed)
+	fmt.Printf("%s: watched for %s, found %d and removed %d duplicates of new messages\n", mbox, time.Since(start).Round(time.Second), found, removed)
+	return res
+}
+
+// reconnect replaces the connection of cl, used both to scan and
+// remove, by one opened with reopen, waiting longer after each failed
+// attempt, and logs the old one out. It reports false if ctx was done
+// first.
+func (cl *cleaner) reconnect(ctx context.Context, reopen func() (*client.Client, error)) bool {
+	for wait := time.Second; ; wait *= 2 {
+		if wait > reconnectMax {
+			wait = reconnectMax
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+		c, err := reopen()
+		if err != nil {
+			cl.logger.Warn("cannot reconnect", "err", err)
+			continue
+		}
+		old := cl.c
+		cl.c, cl.scan = c, c
+		logout(old)
+		return true
+	}
+}
+
+// logout logs c out, closing its connection instead if the server does
+// not answer within logoutTimeout, as when the connection was lost.
+func logout(c *client.Client) {
+	done := make(chan error, 1)
+	go func() { done <- c.Logout() }()
+	select {
+	case <-done:
+	case <-time.After(logoutTimeout):
+		c.Terminate()
+	}
+}
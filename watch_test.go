@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomasvitek/imap-clean-dup/internal/imaptest"
+)
+
+// arrive appends msgs to mbox of s after the first pass of a run
+// started meanwhile, which is assumed to take less than after.
+func arrive(t *testing.T, s *imaptest.Server, mbox string, after time.Duration, msgs ...imaptest.Message) {
+	go func() {
+		time.Sleep(after)
+		s.AppendMessages(t, mbox, msgs...)
+	}()
+}
+
+func TestRunWatch(t *testing.T) {
+	defer func(poll time.Duration) { watchPoll = poll }(watchPoll)
+	watchPoll = 10 * time.Millisecond
+	a := imaptest.Message{MessageID: "<a@example.org>", Subject: "A"}
+	b := imaptest.Message{MessageID: "<b@example.org>", Subject: "B"}
+	c := imaptest.Message{MessageID: "<c@example.org>", Subject: "C"}
+	// the memory backend reuses the UIDs of the last messages expunged,
+	// the unique d stays last
+	d := imaptest.Message{MessageID: "<d@example.org>", Subject: "D"}
+	for _, test := range []struct {
+		flags []string
+		left  []uint32
+		// found is the number of duplicates of new messages.
+		found int
+	}{
+		{nil, []uint32{1, 2, 4, 7}, 3},
+		// a third copy arriving makes a group of the first two
+		{[]string{"-min-group-size", "3"}, []uint32{1, 2, 4, 6, 7, 8}, 2},
+	} {
+		s := imaptest.NewServer(t)
+		s.AppendMessages(t, "INBOX", a, b, a, d)
+		arrive(t, s, "INBOX", 300*time.Millisecond, a, b, c, c)
+		flags := append([]string{"-mbox", "INBOX", "-watch", "-max-duration", "1s"}, test.flags...)
+		_, stdout, stderr := runMain(t, nil, args(s, "clean", flags...)...)
+		if uids := s.UIDs(t, "INBOX"); !reflect.DeepEqual(uids, test.left) {
+			t.Errorf("%q: got UIDs %v left, want %v; stderr:\n%s", test.flags, uids, test.left, stderr)
+		}
+		if want := "INBOX: watching for new messages"; !strings.Contains(stdout, want) {
+			t.Errorf("%q: got stdout:\n%s", test.flags, stdout)
+		}
+		if want := " found " + strconv.Itoa(test.found) + " and removed "; !strings.Contains(stdout, want) {
+			t.Errorf("%q: got stdout:\n%s", test.flags, stdout)
+		}
+	}
+}
+
+// TestRunWatchDrafts checks that -watch and -interval scan a drafts
+// mailbox as -drafts-mode says when new versions of a draft arrive.
+func TestRunWatchDrafts(t *testing.T) {
+	defer func(poll time.Duration) { watchPoll = poll }(watchPoll)
+	watchPoll = 10 * time.Millisecond
+	draft := imaptest.Message{MessageID: "<draft@example.org>", Subject: "Draft", Body: "first version"}
+	saved := imaptest.Message{MessageID: "<draft@example.org>", Subject: "Draft", Body: "second version"}
+	for _, test := range []struct {
+		flags []string
+		left  []uint32
+	}{
+		// only the identical copies of the second version are
+		// duplicates, the newest is kept
+		{[]string{"-watch"}, []uint32{1, 2, 4}},
+		{[]string{"-interval", "50ms"}, []uint32{1, 2, 4}},
+		{[]string{"-watch", "-drafts-mode", "normal"}, []uint32{1, 2}},
+		{[]string{"-interval", "50ms", "-drafts-mode", "normal"}, []uint32{1, 2}},
+	} {
+		s := imaptest.NewServer(t)
+		s.AppendMessages(t, "Drafts", draft, imaptest.Message{Subject: "Other"})
+		arrive(t, s, "Drafts", 300*time.Millisecond, saved, saved)
+		flags := append([]string{"-mbox", "Drafts", "-max-duration", "1s"}, test.flags...)
+		_, _, stderr := runMain(t, nil, args(s, "clean", flags...)...)
+		if uids := s.UIDs(t, "Drafts"); !reflect.DeepEqual(uids, test.left) {
+			t.Errorf("%q: got UIDs %v left, want %v; stderr:\n%s", test.flags, uids, test.left, stderr)
+		}
+	}
+}